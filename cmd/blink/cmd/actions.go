@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/TFMV/blink/pkg/blink"
+	"github.com/spf13/viper"
+)
+
+// actionSpec is an entry of the "actions" list in the configuration file
+type actionSpec struct {
+	Name        string            `mapstructure:"name"`
+	Command     any               `mapstructure:"command"`
+	Dir         string            `mapstructure:"dir"`
+	Env         map[string]string `mapstructure:"env"`
+	Roots       []string          `mapstructure:"roots"`
+	Include     []string          `mapstructure:"include"`
+	Exclude     []string          `mapstructure:"exclude"`
+	Events      []string          `mapstructure:"events"`
+	Ignore      []string          `mapstructure:"ignore"`
+	Filter      string            `mapstructure:"filter"`
+	Debounce    time.Duration     `mapstructure:"debounce"`
+	Mode        string            `mapstructure:"mode"`
+	StopTimeout time.Duration     `mapstructure:"stop_timeout"`
+}
+
+// loadActions returns the actions declared in the configuration file, or
+// nil if there are none. A command given as a string is run by the shell,
+// a command given as a list is run directly.
+func loadActions() ([]blink.ActionConfig, error) {
+	var specs []actionSpec
+	if err := viper.UnmarshalKey("actions", &specs); err != nil {
+		return nil, fmt.Errorf("invalid actions: %w", err)
+	}
+
+	actions := make([]blink.ActionConfig, 0, len(specs))
+	for i, spec := range specs {
+		action := blink.ActionConfig{
+			Name:            spec.Name,
+			Dir:             spec.Dir,
+			Roots:           spec.Roots,
+			IncludePatterns: spec.Include,
+			ExcludePatterns: spec.Exclude,
+			IncludeEvents:   spec.Events,
+			IgnoreEvents:    spec.Ignore,
+			Filter:          spec.Filter,
+			Debounce:        spec.Debounce,
+			Mode:            blink.ExecMode(spec.Mode),
+			StopTimeout:     spec.StopTimeout,
+			Stdout:          os.Stdout,
+			Stderr:          os.Stderr,
+		}
+
+		switch command := spec.Command.(type) {
+		case string:
+			action.Command = []string{command}
+			action.Shell = true
+		case []any:
+			for _, arg := range command {
+				action.Command = append(action.Command, fmt.Sprint(arg))
+			}
+		}
+		if len(action.Command) == 0 {
+			return nil, fmt.Errorf("action %d has no command", i+1)
+		}
+
+		// Sort the variables so the environment does not change between runs
+		names := make([]string, 0, len(spec.Env))
+		for name := range spec.Env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			action.Env = append(action.Env, name+"="+spec.Env[name])
+		}
+
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
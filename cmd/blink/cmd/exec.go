@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"os"
+	"time"
+
+	"github.com/TFMV/blink/pkg/blink"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	// Exec flags, they apply to the action of the command line only
+	execPath        string
+	execName        string
+	execShell       bool
+	execInclude     string
+	execExclude     string
+	execEvents      string
+	execIgnore      string
+	execFilter      string
+	execDebounce    time.Duration
+	execMode        string
+	execStopTimeout time.Duration
+
+	// execCmd represents the exec command
+	execCmd = &cobra.Command{
+		Use:   "exec [flags] -- command [args...]",
+		Short: "Run a command when files change",
+		Long: `Watch a directory and run a command whenever files change, e.g.
+
+  blink exec --include '*.go' -- go test ./...
+  blink exec --mode restart -- go run ./cmd/server
+  blink exec --shell -- 'gofmt -l {paths}'
+
+The placeholders {path}, {paths}, {rel_path}, {rel_paths}, {op} and {root}
+are replaced with the changed files. The output and exit status of the
+command are also streamed as "exec" events, like the actions of the
+configuration file.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if cmd.Flags().Changed("path") {
+				viper.Set("path", execPath)
+			}
+			mode, err := blink.ParseExecMode(execMode)
+			if err != nil {
+				return err
+			}
+			action := blink.ActionConfig{
+				Name:            execName,
+				Command:         args,
+				Shell:           execShell,
+				IncludePatterns: blink.SplitPatterns(execInclude),
+				ExcludePatterns: blink.SplitPatterns(execExclude),
+				IncludeEvents:   blink.SplitPatterns(execEvents),
+				IgnoreEvents:    blink.SplitPatterns(execIgnore),
+				Filter:          execFilter,
+				Debounce:        execDebounce,
+				Mode:            mode,
+				StopTimeout:     execStopTimeout,
+				Stdout:          os.Stdout,
+				Stderr:          os.Stderr,
+			}
+			return runWatcher(cmd.Context(), blink.WithActions(action))
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(execCmd)
+
+	execCmd.Flags().StringVar(&execPath, "path", ".", "Directory path to watch for changes")
+	execCmd.Flags().StringVar(&execName, "name", "", "Name of the action in events and logs (default is the command)")
+	execCmd.Flags().BoolVar(&execShell, "shell", false, "Run the command with the shell, quoting the placeholders")
+	execCmd.Flags().StringVar(&execInclude, "include", "", "Include patterns for the files that trigger the command (e.g., \"*.go,go.mod\")")
+	execCmd.Flags().StringVar(&execExclude, "exclude", "", "Exclude patterns for the files that trigger the command")
+	execCmd.Flags().StringVar(&execEvents, "events", "", "Event types that trigger the command (e.g., \"write,create\")")
+	execCmd.Flags().StringVar(&execIgnore, "ignore", "", "Event types that do not trigger the command (e.g., \"chmod\")")
+	execCmd.Flags().StringVar(&execFilter, "filter", "", "Filter expression for the events that trigger the command")
+	execCmd.Flags().DurationVar(&execDebounce, "debounce", 100*time.Millisecond, "Time to wait for changes to settle before running the command")
+	execCmd.Flags().StringVar(&execMode, "mode", "queue", "What to do with a run still in progress (queue, cancel, restart)")
+	execCmd.Flags().DurationVar(&execStopTimeout, "stop-timeout", 5*time.Second, "Time a stopped command gets to exit before it is killed")
+}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"runtime"
@@ -30,16 +31,41 @@ var (
 	excludePatterns string
 	includeEvents   string
 	ignoreEvents    string
+	filterExpr      string
 	filterDev       bool
+	gitignore       bool
+	// Watcher flags
+	backend      string
+	pollInterval time.Duration
+	adminToken   string
 	// Webhook flags
 	webhookURL              string
 	webhookMethod           string
 	webhookHeaders          string
 	webhookTimeout          time.Duration
 	webhookDebounceDuration time.Duration
+	webhookDebounceMode     string
+	webhookDebounceMaxWait  time.Duration
 	webhookMaxRetries       int
+	webhookQueueDir         string
+	webhookQueueSync        time.Duration
+	webhookRetryBackoff     time.Duration
+	webhookMaxBackoff       time.Duration
+	webhookSecret           string
+	webhookBatchMaxEvents   int
+	webhookBatchMaxBytes    int
+	webhookBatchMaxWait     time.Duration
+	webhookBatchCoalesce    string
+	webhookBreakerFailures  int
+	webhookBreakerOpen      time.Duration
+	webhookBreakerSuccesses int
+	webhookTemplateFile     string
+	webhookContentType      string
 	// Streaming flags
-	streamMethod string
+	streamMethod       string
+	replayBufferSize   int
+	clientBufferSize   int
+	slowConsumerPolicy string
 	// Logging flags
 	logLevel  string
 	logPretty bool
@@ -57,15 +83,16 @@ when files change.`,
 		// Uncomment the following line if your bare application
 		// has an action associated with it:
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runWatcher()
+			return runWatcher(cmd.Context())
 		},
 	}
 )
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
-func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+// Cancelling ctx shuts the watcher down gracefully.
+func Execute(ctx context.Context) {
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
@@ -93,14 +120,38 @@ func init() {
 	rootCmd.Flags().StringVar(&excludePatterns, "exclude", "", "Exclude patterns for files (e.g., \"node_modules,*.tmp\")")
 	rootCmd.Flags().StringVar(&includeEvents, "events", "", "Include event types (e.g., \"write,create\")")
 	rootCmd.Flags().StringVar(&ignoreEvents, "ignore", "", "Ignore event types (e.g., \"chmod\")")
+	rootCmd.Flags().StringVar(&filterExpr, "filter", "", "Filter expression for events (e.g., 'op in [write,create] && ext == \".go\" && size < 1MB')")
 	rootCmd.Flags().BoolVar(&filterDev, "filter-dev", false, "Filter out development-related noise")
+	rootCmd.Flags().BoolVar(&gitignore, "gitignore", false, "Honour .gitignore, .dockerignore and .blinkignore files instead of the default excludes")
+	rootCmd.Flags().StringVar(&backend, "backend", "inotify", "Watcher backend (inotify, poll, fanotify, auto)")
+	rootCmd.Flags().DurationVar(&pollInterval, "poll-interval", 4*time.Second, "Interval for discovering new directories, and for detecting changes with the poll backend")
+	rootCmd.Flags().StringVar(&adminToken, "admin-token", "", "Bearer token for the /api/watches and /api/webhooks admin APIs, which are disabled without one (prefer BLINK_ADMIN_TOKEN)")
 	rootCmd.Flags().StringVar(&webhookURL, "webhook-url", "", "URL for the webhook")
 	rootCmd.Flags().StringVar(&webhookMethod, "webhook-method", "POST", "HTTP method for the webhook")
 	rootCmd.Flags().StringVar(&webhookHeaders, "webhook-headers", "", "Headers for the webhook")
 	rootCmd.Flags().DurationVar(&webhookTimeout, "webhook-timeout", 5*time.Second, "Timeout for the webhook")
 	rootCmd.Flags().DurationVar(&webhookDebounceDuration, "webhook-debounce-duration", 0*time.Second, "Debounce duration for the webhook")
+	rootCmd.Flags().StringVar(&webhookDebounceMode, "webhook-debounce-mode", "leading", "When the webhook is sent for the events of a path within the debounce duration (leading, trailing, both)")
+	rootCmd.Flags().DurationVar(&webhookDebounceMaxWait, "webhook-debounce-max-wait", 0, "Longest time trailing webhook events are held back while a path keeps changing (0 for no limit)")
 	rootCmd.Flags().IntVar(&webhookMaxRetries, "webhook-max-retries", 3, "Maximum number of retries for the webhook")
+	rootCmd.Flags().StringVar(&webhookQueueDir, "webhook-queue-dir", blink.DefaultWebhookQueueDir(), "Directory of the webhook delivery queue and dead-letter store, one per running blink")
+	rootCmd.Flags().DurationVar(&webhookQueueSync, "webhook-queue-sync-interval", 100*time.Millisecond, "How often the webhook queue is synced to disk (negative to sync every delivery)")
+	rootCmd.Flags().DurationVar(&webhookRetryBackoff, "webhook-retry-backoff", time.Second, "Delay before the first webhook retry, doubled for every further retry")
+	rootCmd.Flags().DurationVar(&webhookMaxBackoff, "webhook-max-backoff", 5*time.Minute, "Maximum delay between webhook retries")
+	rootCmd.Flags().StringVar(&webhookSecret, "webhook-secret", "", "Comma-separated secrets for signing webhook requests, all of them sign while rotating (prefer BLINK_WEBHOOK_SECRET)")
+	rootCmd.Flags().IntVar(&webhookBatchMaxEvents, "webhook-batch-max-events", 0, "Send webhooks in batches of at most this many events")
+	rootCmd.Flags().IntVar(&webhookBatchMaxBytes, "webhook-batch-max-bytes", 0, "Send webhooks in batches of at most this many bytes of events")
+	rootCmd.Flags().DurationVar(&webhookBatchMaxWait, "webhook-batch-max-wait", 0, "Send webhooks in batches collected for at most this long")
+	rootCmd.Flags().StringVar(&webhookBatchCoalesce, "webhook-batch-coalesce", "none", "How a batch combines the events of a path (none, last, merge)")
+	rootCmd.Flags().IntVar(&webhookBreakerFailures, "webhook-breaker-failures", 5, "Failed webhook attempts in a row that pause deliveries (-1 to never pause)")
+	rootCmd.Flags().DurationVar(&webhookBreakerOpen, "webhook-breaker-open-duration", 30*time.Second, "How long webhook deliveries are paused before a trial delivery")
+	rootCmd.Flags().IntVar(&webhookBreakerSuccesses, "webhook-breaker-successes", 1, "Successful trial deliveries that resume webhook deliveries")
+	rootCmd.Flags().StringVar(&webhookTemplateFile, "webhook-template-file", "", "File with a Go text/template for the webhook request body")
+	rootCmd.Flags().StringVar(&webhookContentType, "webhook-content-type", "", "Content type of the webhook requests (default is application/json)")
 	rootCmd.Flags().StringVar(&streamMethod, "stream-method", "sse", "Method for streaming events (sse, websocket, both)")
+	rootCmd.Flags().IntVar(&replayBufferSize, "replay-buffer", 1024, "Number of recent events kept for SSE replay (Last-Event-ID)")
+	rootCmd.Flags().IntVar(&clientBufferSize, "client-buffer", 256, "Number of messages buffered per streaming client")
+	rootCmd.Flags().StringVar(&slowConsumerPolicy, "slow-consumer", "drop-newest", "Policy for clients whose buffer is full (drop-oldest, drop-newest, disconnect)")
 	// Add logging flags
 	rootCmd.Flags().StringVar(&logLevel, "log-level", "info", "Log level (debug, info, warn, error, fatal)")
 	rootCmd.Flags().BoolVar(&logPretty, "log-pretty", true, "Enable pretty logging")
@@ -119,14 +170,38 @@ func init() {
 	viper.BindPFlag("exclude", rootCmd.Flags().Lookup("exclude"))
 	viper.BindPFlag("events", rootCmd.Flags().Lookup("events"))
 	viper.BindPFlag("ignore", rootCmd.Flags().Lookup("ignore"))
+	viper.BindPFlag("filter", rootCmd.Flags().Lookup("filter"))
 	viper.BindPFlag("filter-dev", rootCmd.Flags().Lookup("filter-dev"))
+	viper.BindPFlag("gitignore", rootCmd.Flags().Lookup("gitignore"))
+	viper.BindPFlag("backend", rootCmd.Flags().Lookup("backend"))
+	viper.BindPFlag("poll-interval", rootCmd.Flags().Lookup("poll-interval"))
+	viper.BindPFlag("admin-token", rootCmd.Flags().Lookup("admin-token"))
 	viper.BindPFlag("webhook-url", rootCmd.Flags().Lookup("webhook-url"))
 	viper.BindPFlag("webhook-method", rootCmd.Flags().Lookup("webhook-method"))
 	viper.BindPFlag("webhook-headers", rootCmd.Flags().Lookup("webhook-headers"))
 	viper.BindPFlag("webhook-timeout", rootCmd.Flags().Lookup("webhook-timeout"))
 	viper.BindPFlag("webhook-debounce-duration", rootCmd.Flags().Lookup("webhook-debounce-duration"))
+	viper.BindPFlag("webhook-debounce-mode", rootCmd.Flags().Lookup("webhook-debounce-mode"))
+	viper.BindPFlag("webhook-debounce-max-wait", rootCmd.Flags().Lookup("webhook-debounce-max-wait"))
 	viper.BindPFlag("webhook-max-retries", rootCmd.Flags().Lookup("webhook-max-retries"))
+	viper.BindPFlag("webhook-queue-dir", rootCmd.Flags().Lookup("webhook-queue-dir"))
+	viper.BindPFlag("webhook-queue-sync-interval", rootCmd.Flags().Lookup("webhook-queue-sync-interval"))
+	viper.BindPFlag("webhook-retry-backoff", rootCmd.Flags().Lookup("webhook-retry-backoff"))
+	viper.BindPFlag("webhook-max-backoff", rootCmd.Flags().Lookup("webhook-max-backoff"))
+	viper.BindPFlag("webhook-secret", rootCmd.Flags().Lookup("webhook-secret"))
+	viper.BindPFlag("webhook-batch-max-events", rootCmd.Flags().Lookup("webhook-batch-max-events"))
+	viper.BindPFlag("webhook-batch-max-bytes", rootCmd.Flags().Lookup("webhook-batch-max-bytes"))
+	viper.BindPFlag("webhook-batch-max-wait", rootCmd.Flags().Lookup("webhook-batch-max-wait"))
+	viper.BindPFlag("webhook-batch-coalesce", rootCmd.Flags().Lookup("webhook-batch-coalesce"))
+	viper.BindPFlag("webhook-breaker-failures", rootCmd.Flags().Lookup("webhook-breaker-failures"))
+	viper.BindPFlag("webhook-breaker-open-duration", rootCmd.Flags().Lookup("webhook-breaker-open-duration"))
+	viper.BindPFlag("webhook-breaker-successes", rootCmd.Flags().Lookup("webhook-breaker-successes"))
+	viper.BindPFlag("webhook-template-file", rootCmd.Flags().Lookup("webhook-template-file"))
+	viper.BindPFlag("webhook-content-type", rootCmd.Flags().Lookup("webhook-content-type"))
 	viper.BindPFlag("stream-method", rootCmd.Flags().Lookup("stream-method"))
+	viper.BindPFlag("replay-buffer", rootCmd.Flags().Lookup("replay-buffer"))
+	viper.BindPFlag("client-buffer", rootCmd.Flags().Lookup("client-buffer"))
+	viper.BindPFlag("slow-consumer", rootCmd.Flags().Lookup("slow-consumer"))
 	viper.BindPFlag("log-level", rootCmd.Flags().Lookup("log-level"))
 	viper.BindPFlag("log-pretty", rootCmd.Flags().Lookup("log-pretty"))
 	viper.BindPFlag("log-colors", rootCmd.Flags().Lookup("log-colors"))
@@ -144,14 +219,39 @@ func init() {
 	viper.SetDefault("exclude", "")
 	viper.SetDefault("events", "")
 	viper.SetDefault("ignore", "")
+	viper.SetDefault("filter", "")
 	viper.SetDefault("filter-dev", false)
+	viper.SetDefault("gitignore", false)
+	viper.SetDefault("backend", "inotify")
+	viper.SetDefault("poll-interval", 4*time.Second)
+	viper.SetDefault("admin-token", "")
 	viper.SetDefault("webhook-url", "")
 	viper.SetDefault("webhook-method", "POST")
 	viper.SetDefault("webhook-headers", "")
 	viper.SetDefault("webhook-timeout", 5*time.Second)
 	viper.SetDefault("webhook-debounce-duration", 0*time.Second)
+	viper.SetDefault("webhook-debounce-mode", "leading")
+	viper.SetDefault("webhook-debounce-max-wait", 0*time.Second)
 	viper.SetDefault("webhook-max-retries", 3)
+	viper.SetDefault("webhook-queue-dir", blink.DefaultWebhookQueueDir())
+	viper.SetDefault("webhook-queue-sync-interval", 100*time.Millisecond)
+	viper.SetDefault("webhook-retry-backoff", time.Second)
+	viper.SetDefault("webhook-max-backoff", 5*time.Minute)
+	viper.SetDefault("webhook-secret", "")
+	viper.SetDefault("webhook-batch-max-events", 0)
+	viper.SetDefault("webhook-batch-max-bytes", 0)
+	viper.SetDefault("webhook-batch-max-wait", 0*time.Second)
+	viper.SetDefault("webhook-batch-coalesce", "none")
+	viper.SetDefault("webhook-breaker-failures", 5)
+	viper.SetDefault("webhook-breaker-open-duration", 30*time.Second)
+	viper.SetDefault("webhook-breaker-successes", 1)
+	viper.SetDefault("webhook-template-file", "")
+	viper.SetDefault("webhook-content-type", "")
 	viper.SetDefault("stream-method", "sse")
+	viper.SetDefault("replay-buffer", 1024)
+	viper.SetDefault("client-buffer", 256)
+	viper.SetDefault("slow-consumer", "drop-newest")
+	viper.SetDefault("shutdown-timeout", 5*time.Second)
 	viper.SetDefault("log-level", "info")
 	viper.SetDefault("log-pretty", true)
 	viper.SetDefault("log-colors", true)
@@ -225,8 +325,9 @@ func initLogger() {
 	blink.SetVerbose(viper.GetBool("verbose"))
 }
 
-// runWatcher starts the file watcher and event server
-func runWatcher() error {
+// runWatcher starts the file watcher and event server, with the given
+// options on top of the configured ones, and blocks until ctx is cancelled
+func runWatcher(ctx context.Context, extra ...blink.Option) error {
 	// Set the maximum number of CPUs to use
 	runtime.GOMAXPROCS(viper.GetInt("max-procs"))
 
@@ -264,7 +365,7 @@ func runWatcher() error {
 	// Create filter if any filter options are specified
 	if viper.GetString("include") != "" || viper.GetString("exclude") != "" ||
 		viper.GetString("events") != "" || viper.GetString("ignore") != "" ||
-		viper.GetBool("filter-dev") {
+		viper.GetString("filter") != "" || viper.GetBool("filter-dev") {
 
 		filter := blink.NewEventFilter()
 
@@ -288,6 +389,11 @@ func runWatcher() error {
 			filter.SetIgnoreEvents(ignoreEvents)
 		}
 
+		// Add the filter expression if specified
+		if err := filter.SetExpression(viper.GetString("filter")); err != nil {
+			return fmt.Errorf("invalid --filter: %w", err)
+		}
+
 		// Apply development filtering if enabled
 		if viper.GetBool("filter-dev") {
 			blink.ApplyDevFilter(filter, watchPath)
@@ -297,18 +403,54 @@ func runWatcher() error {
 		options = append(options, blink.WithFilter(filter))
 	}
 
-	// Add webhook options if specified
-	if webhookURL := viper.GetString("webhook-url"); webhookURL != "" {
-		options = append(options, blink.WithWebhook(
-			webhookURL,
-			viper.GetString("webhook-method"),
-			parseHeaders(viper.GetString("webhook-headers")),
-			viper.GetDuration("webhook-timeout"),
-			viper.GetDuration("webhook-debounce-duration"),
-			viper.GetInt("webhook-max-retries"),
-		))
+	// Add the watch roots of the configuration file, which replace the path
+	roots, err := loadWatches()
+	if err != nil {
+		return err
+	}
+	if len(roots) > 0 {
+		options = append(options, blink.WithRoots(roots...))
+	}
+
+	// Add the actions of the configuration file
+	actions, err := loadActions()
+	if err != nil {
+		return err
+	}
+	if len(actions) > 0 {
+		options = append(options, blink.WithActions(actions...))
+	}
+
+	// Add watcher backend option
+	options = append(options, blink.WithBackend(viper.GetString("backend"), viper.GetDuration("poll-interval")))
+
+	// Honour ignore files if requested
+	if viper.GetBool("gitignore") {
+		options = append(options, blink.WithIgnoreFiles())
 	}
 
+	// Add the admin API if a token is set
+	if token := viper.GetString("admin-token"); token != "" {
+		options = append(options, blink.WithAdminToken(token))
+	}
+
+	// Add the webhook of the flags and those of the configuration file
+	var targets []blink.WebhookConfig
+	if webhook, ok, err := flagWebhook(); err != nil {
+		return err
+	} else if ok {
+		targets = append(targets, webhook)
+	}
+	webhooks, err := loadWebhooks()
+	if err != nil {
+		return err
+	}
+	targets = append(targets, webhooks...)
+	if len(targets) > 0 {
+		options = append(options, blink.WithWebhookTargets(targets...))
+	}
+	options = append(options, blink.WithWebhookQueueDir(viper.GetString("webhook-queue-dir")))
+
 	// Add stream method option
 	streamMethodStr := viper.GetString("stream-method")
 	var streamMethod blink.StreamMethod
@@ -324,17 +466,46 @@ func runWatcher() error {
 	}
 	options = append(options, blink.WithStreamMethod(streamMethod))
 
+	// Add SSE replay buffer option
+	options = append(options, blink.WithReplayBufferSize(viper.GetInt("replay-buffer")))
+
+	// Add slow consumer options
+	slowConsumer, err := blink.ParseSlowConsumerPolicy(viper.GetString("slow-consumer"))
+	if err != nil {
+		return err
+	}
+	options = append(options, blink.WithSlowConsumer(viper.GetInt("client-buffer"), slowConsumer))
+
 	// Add show events option
 	options = append(options, blink.WithShowEvents(viper.GetBool("show-events")))
 
+	// Add shutdown timeout option
+	options = append(options, blink.WithShutdownTimeout(viper.GetDuration("shutdown-timeout")))
+
+	// Add the options of subcommands such as exec
+	options = append(options, extra...)
+
 	// Print information about the watcher
-	fmt.Printf("Watching %s\n", watchPath)
+	if len(roots) > 0 {
+		for _, root := range roots {
+			fmt.Printf("Watching %s\n", root.Path)
+		}
+	} else {
+		fmt.Printf("Watching %s\n", watchPath)
+	}
+	fmt.Printf("Backend: %s\n", viper.GetString("backend"))
 	fmt.Printf("Event server address: %s\n", viper.GetString("event-addr"))
 	fmt.Printf("Event path: %s\n", viper.GetString("event-path"))
 	fmt.Printf("Stream method: %s\n", streamMethodStr)
 	fmt.Printf("Refresh duration: %v\n", viper.GetDuration("refresh"))
 	fmt.Printf("Allowed origin: %s\n", viper.GetString("allowed-origin"))
 	fmt.Printf("Show events: %v\n", viper.GetBool("show-events"))
+	if viper.GetString("admin-token") != "" {
+		fmt.Printf("Admin API: %s\n", blink.WatchesPath)
+	}
+	for _, action := range actions {
+		fmt.Printf("Action: %s\n", strings.Join(action.Command, " "))
+	}
 
 	// Print filter information if specified
 	if viper.GetString("include") != "" {
@@ -349,9 +520,15 @@ func runWatcher() error {
 	if viper.GetString("ignore") != "" {
 		fmt.Printf("Ignore events: %s\n", viper.GetString("ignore"))
 	}
+	if viper.GetString("filter") != "" {
+		fmt.Printf("Filter: %s\n", viper.GetString("filter"))
+	}
 	if viper.GetBool("filter-dev") {
 		fmt.Printf("Development filtering: enabled\n")
 	}
+	if viper.GetBool("gitignore") {
+		fmt.Printf("Ignore files: %s\n", strings.Join(blink.DefaultIgnoreFiles, ", "))
+	}
 
 	// Print webhook information if specified
 	if viper.GetString("webhook-url") != "" {
@@ -363,14 +540,30 @@ func runWatcher() error {
 		fmt.Printf("Webhook timeout: %v\n", viper.GetDuration("webhook-timeout"))
 		if viper.GetDuration("webhook-debounce-duration") > 0 {
 			fmt.Printf("Webhook debounce duration: %v\n", viper.GetDuration("webhook-debounce-duration"))
+			fmt.Printf("Webhook debounce mode: %s\n", viper.GetString("webhook-debounce-mode"))
 		}
 		fmt.Printf("Webhook max retries: %d\n", viper.GetInt("webhook-max-retries"))
+		if secrets := webhookSecrets(); len(secrets) > 0 {
+			fmt.Printf("Webhook signing: %d secrets\n", len(secrets))
+		}
+		if viper.GetInt("webhook-batch-max-events") > 0 || viper.GetInt("webhook-batch-max-bytes") > 0 || viper.GetDuration("webhook-batch-max-wait") > 0 {
+			fmt.Printf("Webhook batching: coalesce %s\n", viper.GetString("webhook-batch-coalesce"))
+		}
+		if file := viper.GetString("webhook-template-file"); file != "" {
+			fmt.Printf("Webhook template: %s\n", file)
+		}
+	}
+	for _, webhook := range webhooks {
+		fmt.Printf("Webhook %s: %s\n", webhook.Name, webhook.URL)
+	}
+	if dir := viper.GetString("webhook-queue-dir"); dir != "" && (viper.GetString("webhook-url") != "" || len(webhooks) > 0) {
+		fmt.Printf("Webhook queue: %s\n", dir)
 	}
 
 	fmt.Printf("Press Ctrl+C to exit\n\n")
 
-	// Start the event server
-	blink.EventServer(
+	// Create the event server
+	server, err := blink.NewServer(
 		watchPath,
 		viper.GetString("allowed-origin"),
 		viper.GetString("event-addr"),
@@ -378,9 +571,26 @@ func runWatcher() error {
 		viper.GetDuration("refresh"),
 		options...,
 	)
+	if err != nil {
+		return err
+	}
+
+	// Run until interrupted, then drain and shut down
+	return server.Run(ctx)
+}
 
-	// Block forever (the event server runs in a goroutine)
-	select {}
+// webhookSecrets returns the webhook signing secrets, given as a list in the
+// configuration file or comma-separated
+func webhookSecrets() []string {
+	var secrets []string
+	for _, value := range viper.GetStringSlice("webhook-secret") {
+		for _, secret := range strings.Split(value, ",") {
+			if secret = strings.TrimSpace(secret); secret != "" {
+				secrets = append(secrets, secret)
+			}
+		}
+	}
+	return secrets
 }
 
 // parseHeaders parses a string of headers in the format "key1:value1,key2:value2"
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/TFMV/blink/pkg/blink"
+	"github.com/spf13/viper"
+)
+
+// watchSpec is an entry of the "watches" list in the configuration file
+type watchSpec struct {
+	Name      string        `mapstructure:"name"`
+	Path      string        `mapstructure:"path"`
+	Include   []string      `mapstructure:"include"`
+	Exclude   []string      `mapstructure:"exclude"`
+	Events    []string      `mapstructure:"events"`
+	Ignore    []string      `mapstructure:"ignore"`
+	Recursive *bool         `mapstructure:"recursive"`
+	Debounce  time.Duration `mapstructure:"debounce"`
+	Filter    string        `mapstructure:"filter"`
+}
+
+// loadWatches returns the watch roots declared in the configuration file,
+// or nil if there are none
+func loadWatches() ([]blink.RootConfig, error) {
+	var specs []watchSpec
+	if err := viper.UnmarshalKey("watches", &specs); err != nil {
+		return nil, fmt.Errorf("invalid watches: %w", err)
+	}
+
+	roots := make([]blink.RootConfig, 0, len(specs))
+	for i, spec := range specs {
+		if spec.Path == "" {
+			return nil, fmt.Errorf("watch %d has no path", i+1)
+		}
+		info, err := os.Stat(spec.Path)
+		if err != nil {
+			return nil, fmt.Errorf("error accessing path %s: %w", spec.Path, err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("path is not a directory: %s", spec.Path)
+		}
+
+		// Watches are recursive unless stated otherwise
+		recursive := spec.Recursive == nil || *spec.Recursive
+		roots = append(roots, blink.RootConfig{
+			Name:            spec.Name,
+			Path:            spec.Path,
+			IncludePatterns: spec.Include,
+			ExcludePatterns: spec.Exclude,
+			IncludeEvents:   spec.Events,
+			IgnoreEvents:    spec.Ignore,
+			Recursive:       recursive,
+			HandlerDelay:    spec.Debounce,
+			Filter:          spec.Filter,
+		})
+	}
+	return roots, nil
+}
@@ -0,0 +1,319 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/TFMV/blink/pkg/blink"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	// Dead-letter flags
+	dlqQueueDir string
+	dlqTarget   string
+	dlqAll      bool
+
+	// Webhook test flags
+	testTarget       string
+	testURL          string
+	testTemplateFile string
+	testContentType  string
+	testFile         string
+	testOp           string
+
+	// webhookCmd groups the webhook commands
+	webhookCmd = &cobra.Command{
+		Use:   "webhook",
+		Short: "Manage webhook deliveries",
+	}
+
+	// dlqCmd groups the dead-letter store commands
+	dlqCmd = &cobra.Command{
+		Use:   "dlq",
+		Short: "Inspect and re-drive failed webhook deliveries",
+		Long: `Webhook deliveries that the receiver rejected, or that failed after all
+retries, are kept in the dead-letter store of their webhook, in a
+subdirectory of the webhook queue directory named after the webhook.
+They can be listed, replayed or purged, also while blink is running: a
+running blink picks up replayed deliveries within a second, otherwise they
+are sent on its next start.`,
+	}
+
+	webhookTestCmd = &cobra.Command{
+		Use:   "test",
+		Short: "Print the request a webhook sends for a sample event",
+		Long: `Render the request of a webhook for a sample event without sending it,
+to check its URL, headers and body templates. The webhook is the one of
+the --webhook-* flags, or the one named with --webhook in the configuration
+file; --url, --template-file and --content-type override its settings.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			webhook, err := testWebhook()
+			if err != nil {
+				return err
+			}
+			if testURL != "" {
+				webhook.URL = testURL
+			}
+			if testTemplateFile != "" {
+				template, err := os.ReadFile(testTemplateFile)
+				if err != nil {
+					return fmt.Errorf("error reading the webhook template: %w", err)
+				}
+				webhook.Template = string(template)
+			}
+			if testContentType != "" {
+				webhook.ContentType = testContentType
+			}
+			if webhook.URL == "" {
+				return errors.New("no webhook url, use --url")
+			}
+
+			op, err := blink.ParseOp(testOp)
+			if err != nil {
+				return err
+			}
+			root, err := filepath.Abs(viper.GetString("path"))
+			if err != nil {
+				return err
+			}
+			file := testFile
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(root, file)
+			}
+			event := blink.NewEvent(fsnotify.Event{Name: file, Op: op}, root)
+
+			req, err := blink.PreviewWebhook(webhook, event)
+			if err != nil {
+				return err
+			}
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s %s\n", req.Method, req.URL)
+			if err := req.Header.Write(os.Stdout); err != nil {
+				return err
+			}
+			fmt.Printf("\n%s\n", body)
+			return nil
+		},
+	}
+
+	dlqListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List failed webhook deliveries",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stores, err := openDeadLetters()
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "WEBHOOK\tID\tFAILED\tATTEMPTS\tOP\tPATH\tERROR")
+			found := false
+			for _, store := range stores {
+				letters, err := store.List()
+				if err != nil {
+					return fmt.Errorf("webhook %s: %w", store.name, err)
+				}
+				for _, letter := range letters {
+					found = true
+					op, path := letter.Event.OpString(), letter.Event.Name
+					if letter.Batch != nil {
+						op, path = "batch", fmt.Sprintf("%d events", len(letter.Batch))
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+						store.name,
+						letter.ID,
+						letter.FailedAt.Local().Format(time.DateTime),
+						letter.Attempts,
+						op,
+						path,
+						letter.LastError,
+					)
+				}
+			}
+			if !found {
+				fmt.Println("No failed deliveries")
+				return nil
+			}
+			return w.Flush()
+		},
+	}
+
+	dlqReplayCmd = &cobra.Command{
+		Use:   "replay [id...]",
+		Short: "Queue failed webhook deliveries again",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkDeadLetterArgs(args); err != nil {
+				return err
+			}
+			n, err := eachDeadLetterStore(args, (*blink.DeadLetterStore).Replay)
+			fmt.Printf("Replayed %d deliveries\n", n)
+			return err
+		},
+	}
+
+	dlqPurgeCmd = &cobra.Command{
+		Use:   "purge [id...]",
+		Short: "Delete failed webhook deliveries",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkDeadLetterArgs(args); err != nil {
+				return err
+			}
+			n, err := eachDeadLetterStore(args, (*blink.DeadLetterStore).Purge)
+			fmt.Printf("Purged %d deliveries\n", n)
+			return err
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(webhookCmd)
+	webhookCmd.AddCommand(dlqCmd, webhookTestCmd)
+	dlqCmd.AddCommand(dlqListCmd, dlqReplayCmd, dlqPurgeCmd)
+
+	dlqCmd.PersistentFlags().StringVar(&dlqTarget, "webhook", "", "Only the deliveries of the webhook with this name (default is all webhooks)")
+	dlqCmd.PersistentFlags().StringVar(&dlqQueueDir, "queue-dir", "", "Webhook queue directory (default is the webhook-queue-dir setting)")
+	dlqReplayCmd.Flags().BoolVar(&dlqAll, "all", false, "Replay all failed deliveries")
+	dlqPurgeCmd.Flags().BoolVar(&dlqAll, "all", false, "Purge all failed deliveries")
+
+	webhookTestCmd.Flags().StringVar(&testTarget, "webhook", "", "Name of the webhook in the configuration file (default is the webhook of the --webhook-* flags)")
+	webhookTestCmd.Flags().StringVar(&testURL, "url", "", "URL template of the webhook")
+	webhookTestCmd.Flags().StringVar(&testTemplateFile, "template-file", "", "File with the body template of the webhook")
+	webhookTestCmd.Flags().StringVar(&testContentType, "content-type", "", "Content type of the webhook request")
+	webhookTestCmd.Flags().StringVar(&testFile, "file", "example.txt", "Path of the sample event, relative to the watch path")
+	webhookTestCmd.Flags().StringVar(&testOp, "op", "write", "Operation of the sample event")
+}
+
+// testWebhook returns the webhook to render with webhook test
+func testWebhook() (blink.WebhookConfig, error) {
+	if testTarget == "" {
+		webhook, _, err := flagWebhook()
+		return webhook, err
+	}
+
+	webhooks, err := loadWebhooks()
+	if err != nil {
+		return blink.WebhookConfig{}, err
+	}
+	for _, webhook := range webhooks {
+		if webhook.Name == testTarget {
+			return webhook, nil
+		}
+	}
+	return blink.WebhookConfig{}, fmt.Errorf("no webhook named %s in the configuration", testTarget)
+}
+
+// namedDeadLetters is the dead-letter store of a webhook
+type namedDeadLetters struct {
+	name string
+	*blink.DeadLetterStore
+}
+
+// openDeadLetters opens the dead-letter stores of the webhooks in the
+// configured queue directory, or of the webhook given with --webhook
+func openDeadLetters() ([]namedDeadLetters, error) {
+	dir := dlqQueueDir
+	if dir == "" {
+		dir = viper.GetString("webhook-queue-dir")
+	}
+	if dir == "" {
+		return nil, errors.New("no webhook queue directory, use --queue-dir")
+	}
+
+	var names []string
+	if dlqTarget != "" {
+		names = []string{dlqTarget}
+	} else {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("error accessing webhook queue directory: %w", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				names = append(names, entry.Name())
+			}
+		}
+	}
+
+	stores := make([]namedDeadLetters, 0, len(names))
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return nil, fmt.Errorf("no queue for webhook %s: %w", name, err)
+		}
+		store, err := blink.OpenDeadLetterStore(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, namedDeadLetters{name: name, DeadLetterStore: store})
+	}
+	return stores, nil
+}
+
+// eachDeadLetterStore applies a replay or purge function to the dead letters
+// with the given ids, or to all of them, and returns how many it affected
+func eachDeadLetterStore(ids []string, fn func(*blink.DeadLetterStore, ...string) (int, error)) (int, error) {
+	stores, err := openDeadLetters()
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	remaining := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		remaining[id] = true
+	}
+	for _, store := range stores {
+		var selected []string
+		if len(ids) > 0 {
+			letters, err := store.List()
+			if err != nil {
+				return total, fmt.Errorf("webhook %s: %w", store.name, err)
+			}
+			for _, letter := range letters {
+				if remaining[letter.ID] {
+					selected = append(selected, letter.ID)
+					delete(remaining, letter.ID)
+				}
+			}
+			if len(selected) == 0 {
+				continue
+			}
+		}
+		n, err := fn(store.DeadLetterStore, selected...)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("webhook %s: %w", store.name, err)
+		}
+	}
+
+	for _, id := range ids {
+		if remaining[id] {
+			return total, fmt.Errorf("no dead letter with id %s", id)
+		}
+	}
+	return total, nil
+}
+
+// checkDeadLetterArgs requires either ids or --all, so that a bare command
+// does not affect every delivery
+func checkDeadLetterArgs(args []string) error {
+	switch {
+	case len(args) == 0 && !dlqAll:
+		return errors.New("give the ids of the deliveries, or --all")
+	case len(args) > 0 && dlqAll:
+		return errors.New("give either ids or --all, not both")
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/TFMV/blink/pkg/blink"
+	"github.com/spf13/viper"
+)
+
+// webhookSpec is an entry of the "webhooks" list in the configuration file
+type webhookSpec struct {
+	Name         string            `mapstructure:"name"`
+	URL          string            `mapstructure:"url"`
+	Method       string            `mapstructure:"method"`
+	Headers      map[string]string `mapstructure:"headers"`
+	Include      []string          `mapstructure:"include"`
+	Exclude      []string          `mapstructure:"exclude"`
+	Events       []string          `mapstructure:"events"`
+	Ignore       []string          `mapstructure:"ignore"`
+	Filter       string            `mapstructure:"filter"`
+	Debounce     time.Duration     `mapstructure:"debounce"`
+	DebounceMode string            `mapstructure:"debounce_mode"`
+	MaxWait      time.Duration     `mapstructure:"debounce_max_wait"`
+	Timeout      time.Duration     `mapstructure:"timeout"`
+	MaxRetries   int               `mapstructure:"max_retries"`
+	RetryBackoff time.Duration     `mapstructure:"retry_backoff"`
+	MaxBackoff   time.Duration     `mapstructure:"max_backoff"`
+	QueueSync    time.Duration     `mapstructure:"queue_sync_interval"`
+	Format       string            `mapstructure:"format"`
+	Template     string            `mapstructure:"template"`
+	TemplateFile string            `mapstructure:"template_file"`
+	ContentType  string            `mapstructure:"content_type"`
+	Secret       any               `mapstructure:"secret"`
+	Batch        struct {
+		MaxEvents int           `mapstructure:"max_events"`
+		MaxBytes  int           `mapstructure:"max_bytes"`
+		MaxWait   time.Duration `mapstructure:"max_wait"`
+		Coalesce  string        `mapstructure:"coalesce"`
+	} `mapstructure:"batch"`
+	Breaker struct {
+		Failures     int           `mapstructure:"failures"`
+		OpenDuration time.Duration `mapstructure:"open_duration"`
+		Successes    int           `mapstructure:"successes"`
+	} `mapstructure:"breaker"`
+}
+
+// loadWebhooks returns the webhook targets declared in the configuration
+// file, or nil if there are none. A secret is given as a string, or as a
+// list while rotating secrets.
+func loadWebhooks() ([]blink.WebhookConfig, error) {
+	var specs []webhookSpec
+	if err := viper.UnmarshalKey("webhooks", &specs); err != nil {
+		return nil, fmt.Errorf("invalid webhooks: %w", err)
+	}
+
+	webhooks := make([]blink.WebhookConfig, 0, len(specs))
+	for i, spec := range specs {
+		// The name keys the queue of the webhook, it must not change
+		if spec.Name == "" {
+			return nil, fmt.Errorf("webhook %d has no name", i+1)
+		}
+		if spec.URL == "" {
+			return nil, fmt.Errorf("webhook %q has no url", spec.Name)
+		}
+
+		webhook := blink.WebhookConfig{
+			Name:              spec.Name,
+			URL:               spec.URL,
+			Method:            spec.Method,
+			Headers:           spec.Headers,
+			Timeout:           spec.Timeout,
+			DebounceDuration:  spec.Debounce,
+			DebounceMode:      blink.DebounceMode(spec.DebounceMode),
+			DebounceMaxWait:   spec.MaxWait,
+			MaxRetries:        spec.MaxRetries,
+			RetryBackoff:      spec.RetryBackoff,
+			MaxRetryBackoff:   spec.MaxBackoff,
+			QueueSyncInterval: spec.QueueSync,
+			Format:            blink.WebhookFormat(spec.Format),
+			Template:          spec.Template,
+			ContentType:       spec.ContentType,
+			IncludePatterns:   spec.Include,
+			ExcludePatterns:   spec.Exclude,
+			IncludeEvents:     spec.Events,
+			IgnoreEvents:      spec.Ignore,
+			Filter:            spec.Filter,
+			Batch: blink.WebhookBatchConfig{
+				MaxEvents: spec.Batch.MaxEvents,
+				MaxBytes:  spec.Batch.MaxBytes,
+				MaxWait:   spec.Batch.MaxWait,
+				Coalesce:  blink.CoalesceMode(spec.Batch.Coalesce),
+			},
+			Breaker: blink.WebhookBreakerConfig{
+				FailureThreshold: spec.Breaker.Failures,
+				OpenDuration:     spec.Breaker.OpenDuration,
+				SuccessThreshold: spec.Breaker.Successes,
+			},
+		}
+
+		if spec.TemplateFile != "" {
+			if spec.Template != "" {
+				return nil, fmt.Errorf("webhook %q has both a template and a template_file", spec.Name)
+			}
+			template, err := os.ReadFile(spec.TemplateFile)
+			if err != nil {
+				return nil, fmt.Errorf("error reading the template of webhook %q: %w", spec.Name, err)
+			}
+			webhook.Template = string(template)
+		}
+
+		switch secret := spec.Secret.(type) {
+		case string:
+			webhook.Secrets = []string{secret}
+		case []any:
+			for _, value := range secret {
+				webhook.Secrets = append(webhook.Secrets, fmt.Sprint(value))
+			}
+		}
+
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, nil
+}
+
+// flagWebhook returns the webhook configured with the --webhook-* flags, if
+// --webhook-url is set
+func flagWebhook() (blink.WebhookConfig, bool, error) {
+	url := viper.GetString("webhook-url")
+	if url == "" {
+		return blink.WebhookConfig{}, false, nil
+	}
+
+	coalesce, err := blink.ParseCoalesceMode(viper.GetString("webhook-batch-coalesce"))
+	if err != nil {
+		return blink.WebhookConfig{}, false, err
+	}
+	debounceMode, err := blink.ParseDebounceMode(viper.GetString("webhook-debounce-mode"))
+	if err != nil {
+		return blink.WebhookConfig{}, false, err
+	}
+	webhook := blink.WebhookConfig{
+		URL:               url,
+		Method:            viper.GetString("webhook-method"),
+		Headers:           parseHeaders(viper.GetString("webhook-headers")),
+		Timeout:           viper.GetDuration("webhook-timeout"),
+		DebounceDuration:  viper.GetDuration("webhook-debounce-duration"),
+		DebounceMode:      debounceMode,
+		DebounceMaxWait:   viper.GetDuration("webhook-debounce-max-wait"),
+		MaxRetries:        viper.GetInt("webhook-max-retries"),
+		RetryBackoff:      viper.GetDuration("webhook-retry-backoff"),
+		MaxRetryBackoff:   viper.GetDuration("webhook-max-backoff"),
+		QueueSyncInterval: viper.GetDuration("webhook-queue-sync-interval"),
+		Secrets:           webhookSecrets(),
+		ContentType:       viper.GetString("webhook-content-type"),
+		Batch: blink.WebhookBatchConfig{
+			MaxEvents: viper.GetInt("webhook-batch-max-events"),
+			MaxBytes:  viper.GetInt("webhook-batch-max-bytes"),
+			MaxWait:   viper.GetDuration("webhook-batch-max-wait"),
+			Coalesce:  coalesce,
+		},
+		Breaker: blink.WebhookBreakerConfig{
+			FailureThreshold: viper.GetInt("webhook-breaker-failures"),
+			OpenDuration:     viper.GetDuration("webhook-breaker-open-duration"),
+			SuccessThreshold: viper.GetInt("webhook-breaker-successes"),
+		},
+	}
+	if file := viper.GetString("webhook-template-file"); file != "" {
+		template, err := os.ReadFile(file)
+		if err != nil {
+			return blink.WebhookConfig{}, false, fmt.Errorf("error reading the webhook template: %w", err)
+		}
+		webhook.Template = string(template)
+	}
+	return webhook, true, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"syscall"
@@ -9,18 +10,9 @@ import (
 )
 
 func main() {
-	// Set up signal handling for graceful shutdown
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	// Cancel the context on SIGINT/SIGTERM for a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Run the command in a goroutine
-	go func() {
-		cmd.Execute()
-	}()
-
-	// Wait for a signal
-	<-sigs
-
-	// Perform any cleanup here if needed
-	os.Exit(0)
+	cmd.Execute(ctx)
 }
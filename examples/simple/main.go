@@ -54,7 +54,7 @@ func main() {
 		for {
 			select {
 			case ev := <-watcher.Events:
-				event := blink.Event(ev)
+				event := blink.NewEvent(ev, path)
 				events <- event
 				fmt.Printf("Event: %s %s\n", event.Op.String(), event.Name)
 			case err := <-watcher.Errors:
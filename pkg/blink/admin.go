@@ -0,0 +1,202 @@
+package blink
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/TFMV/blink/pkg/logger"
+)
+
+// WatchesPath is the admin endpoint for adding and removing watch roots
+const WatchesPath = "/api/watches"
+
+// WebhooksPath is the status endpoint of the webhooks
+const WebhooksPath = "/api/webhooks"
+
+// Maximum size of an admin request body
+const maxAdminBodySize = 1 << 20
+
+// watchJSON is the wire format of a watch root, with the same fields as
+// the entries of "watches" in the configuration file
+type watchJSON struct {
+	Name      string   `json:"name,omitempty"`
+	Path      string   `json:"path"`
+	Include   []string `json:"include,omitempty"`
+	Exclude   []string `json:"exclude,omitempty"`
+	Events    []string `json:"events,omitempty"`
+	Ignore    []string `json:"ignore,omitempty"`
+	Recursive *bool    `json:"recursive,omitempty"`
+	Debounce  string   `json:"debounce,omitempty"`
+	Filter    string   `json:"filter,omitempty"`
+}
+
+// newWatchJSON converts a root configuration to its wire format
+func newWatchJSON(config RootConfig) watchJSON {
+	recursive := config.Recursive
+	return watchJSON{
+		Name:      config.Name,
+		Path:      config.Path,
+		Include:   config.IncludePatterns,
+		Exclude:   config.ExcludePatterns,
+		Events:    config.IncludeEvents,
+		Ignore:    config.IgnoreEvents,
+		Recursive: &recursive,
+		Debounce:  config.HandlerDelay.String(),
+		Filter:    config.Filter,
+	}
+}
+
+// rootConfig converts the wire format to a root configuration. Roots are
+// recursive unless stated otherwise.
+func (j watchJSON) rootConfig() (RootConfig, error) {
+	config := RootConfig{
+		Name:            j.Name,
+		Path:            j.Path,
+		IncludePatterns: j.Include,
+		ExcludePatterns: j.Exclude,
+		IncludeEvents:   j.Events,
+		IgnoreEvents:    j.Ignore,
+		Recursive:       j.Recursive == nil || *j.Recursive,
+		Filter:          j.Filter,
+	}
+	if j.Debounce != "" {
+		delay, err := time.ParseDuration(j.Debounce)
+		if err != nil {
+			return RootConfig{}, fmt.Errorf("invalid debounce: %w", err)
+		}
+		config.HandlerDelay = delay
+	}
+	return config, nil
+}
+
+// watchesHandler serves the admin API for the watch roots of a watcher:
+//
+//	GET    /api/watches              lists the roots
+//	POST   /api/watches              adds the root in the JSON body
+//	DELETE /api/watches?path=<path>  removes a root, or ?name=<name>
+//
+// Streaming clients stay connected while roots come and go.
+func watchesHandler(watcher *Watcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			roots := watcher.Roots()
+			watches := make([]watchJSON, len(roots))
+			for i, root := range roots {
+				watches[i] = newWatchJSON(root)
+			}
+			writeJSON(w, http.StatusOK, watches)
+
+		case http.MethodPost:
+			var watch watchJSON
+			decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBodySize))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&watch); err != nil {
+				http.Error(w, fmt.Sprintf("invalid watch: %v", err), http.StatusBadRequest)
+				return
+			}
+			if watch.Path == "" {
+				http.Error(w, "invalid watch: no path", http.StatusBadRequest)
+				return
+			}
+			config, err := watch.rootConfig()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := watcher.AddRoot(config.Path, config); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			// Answer with the root as the watcher completed it
+			path, _ := filepath.Abs(config.Path)
+			for _, root := range watcher.Roots() {
+				if root.Path == path {
+					logger.Infof("Watching %s (%s)", root.Path, root.Name)
+					writeJSON(w, http.StatusCreated, newWatchJSON(root))
+					return
+				}
+			}
+			w.WriteHeader(http.StatusCreated)
+
+		case http.MethodDelete:
+			path := r.URL.Query().Get("path")
+			if name := r.URL.Query().Get("name"); name != "" {
+				for _, root := range watcher.Roots() {
+					if root.Name == name {
+						path = root.Path
+					}
+				}
+				if path == "" {
+					http.Error(w, fmt.Sprintf("%v: %s", ErrRootNotFound, name), http.StatusNotFound)
+					return
+				}
+			}
+			if path == "" {
+				http.Error(w, "missing path or name parameter", http.StatusBadRequest)
+				return
+			}
+			if err := watcher.RemoveRoot(path); err != nil {
+				status := http.StatusBadRequest
+				if errors.Is(err, ErrRootNotFound) {
+					status = http.StatusNotFound
+				}
+				http.Error(w, err.Error(), status)
+				return
+			}
+			logger.Infof("Stopped watching %s", path)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// webhooksHandler serves the delivery status of the webhooks:
+//
+//	GET /api/webhooks  lists the status of each webhook
+func webhooksHandler(webhooks []*WebhookManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		statuses := make([]WebhookStatus, len(webhooks))
+		for i, webhook := range webhooks {
+			statuses[i] = webhook.Status()
+		}
+		writeJSON(w, http.StatusOK, statuses)
+	})
+}
+
+// requireToken only passes on requests that carry the bearer token
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="blink"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON writes a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logger.Error(fmt.Errorf("error writing response: %w", err))
+	}
+}
@@ -0,0 +1,80 @@
+package blink
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestWatchesHandler tests adding, listing and removing roots through the admin API
+func TestWatchesHandler(t *testing.T) {
+	watcher, err := NewWatcher(context.Background(), WatcherConfig{RootPath: t.TempDir(), Recursive: true})
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	watcher.Start()
+	defer watcher.Close()
+
+	server := httptest.NewServer(requireToken("secret", watchesHandler(watcher)))
+	defer server.Close()
+
+	do := func(method, url, token, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+url, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if resp := do(http.MethodGet, WatchesPath, token, ""); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected 401 with token %q, got %d", token, resp.StatusCode)
+		}
+	}
+
+	dir := t.TempDir()
+	body, _ := json.Marshal(map[string]interface{}{"name": "extra", "path": dir, "include": []string{"*.go"}, "debounce": "50ms"})
+	resp := do(http.MethodPost, WatchesPath, "secret", string(body))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d", resp.StatusCode)
+	}
+	var created watchJSON
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if created.Name != "extra" || created.Path != dir || created.Debounce != "50ms" || created.Recursive == nil || !*created.Recursive {
+		t.Errorf("Unexpected watch: %+v", created)
+	}
+
+	// Adding the same tree twice fails
+	if resp := do(http.MethodPost, WatchesPath, "secret", string(body)); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a duplicate watch, got %d", resp.StatusCode)
+	}
+
+	var listed []watchJSON
+	if err := json.NewDecoder(do(http.MethodGet, WatchesPath, "secret", "").Body).Decode(&listed); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(listed) != 2 {
+		t.Errorf("Expected 2 watches, got %+v", listed)
+	}
+
+	if resp := do(http.MethodDelete, WatchesPath+"?name=extra", "secret", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodDelete, WatchesPath+"?name=extra", "secret", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", resp.StatusCode)
+	}
+	if len(watcher.Roots()) != 1 {
+		t.Errorf("Expected 1 watch left, got %+v", watcher.Roots())
+	}
+}
@@ -0,0 +1,145 @@
+package blink
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/TFMV/blink/pkg/logger"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Backend names, see WatcherConfig.Backend
+const (
+	BackendInotify  = "inotify"
+	BackendPoll     = "poll"
+	BackendFanotify = "fanotify"
+	BackendAuto     = "auto"
+)
+
+// How long the auto backend waits for the event of its test write
+const probeTimeout = time.Second
+
+// Backend is a source of raw file system events for the directories added
+// to it. Like inotify, watching a directory reports changes to its direct
+// entries; the Watcher adds every directory of a recursive tree itself,
+// unless the backend is a rootBackend.
+type Backend interface {
+	// Name returns the name of the backend, e.g. "inotify"
+	Name() string
+	// Add starts watching a directory
+	Add(path string) error
+	// Remove stops watching a directory
+	Remove(path string) error
+	// WatchList returns the watched directories
+	WatchList() []string
+	// Events returns the channel of file system events
+	Events() <-chan fsnotify.Event
+	// Errors returns the channel of errors. fsnotify.ErrEventOverflow
+	// tells the Watcher that events were lost.
+	Errors() <-chan error
+	// Close stops the backend and closes its channels
+	Close() error
+}
+
+// rootBackend is implemented by backends that watch whole directory trees
+// given when they are created, so that Watcher.AddRoot and
+// Watcher.RemoveRoot can change them. They report events anywhere below a
+// root; the Watcher only adds the roots to them, and drops the events of
+// excluded directories itself.
+type rootBackend interface {
+	// AddRoot starts watching the tree at path, before its directories are added
+	AddRoot(path string) error
+	// RemoveRoot stops watching the tree at path, after its directories were removed
+	RemoveRoot(path string)
+}
+
+// NewBackend creates the backend with the given name for watching the
+// directory trees at roots. The poll backend checks for changes every
+// pollInterval. The auto backend uses inotify, unless a test write under a
+// root produces no inotify event, as on NFS, FUSE or some Docker bind
+// mounts, and polls then. The fanotify backend needs Linux and
+// CAP_SYS_ADMIN, and falls back to inotify without.
+func NewBackend(name string, roots []string, pollInterval time.Duration) (Backend, error) {
+	switch name {
+	case "", BackendInotify:
+		return newInotifyBackend()
+	case BackendPoll:
+		return newPollBackend(pollInterval), nil
+	case BackendFanotify:
+		backend, err := newFanotifyBackend(roots)
+		if err != nil {
+			logger.Warnf("fanotify is not available, falling back to inotify: %v", err)
+			return newInotifyBackend()
+		}
+		return backend, nil
+	case BackendAuto:
+		for _, root := range roots {
+			if !probeInotify(root, probeTimeout) {
+				return newPollBackend(pollInterval), nil
+			}
+		}
+		return newInotifyBackend()
+	default:
+		return nil, fmt.Errorf("unknown backend: %q", name)
+	}
+}
+
+// inotifyBackend is the Backend of fsnotify, which uses inotify on Linux
+type inotifyBackend struct {
+	watcher *fsnotify.Watcher
+}
+
+func newInotifyBackend() (*inotifyBackend, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create fsnotify watcher: %w", err)
+	}
+	return &inotifyBackend{watcher: watcher}, nil
+}
+
+func (b *inotifyBackend) Name() string                  { return BackendInotify }
+func (b *inotifyBackend) Add(path string) error         { return b.watcher.Add(path) }
+func (b *inotifyBackend) Remove(path string) error      { return b.watcher.Remove(path) }
+func (b *inotifyBackend) WatchList() []string           { return b.watcher.WatchList() }
+func (b *inotifyBackend) Events() <-chan fsnotify.Event { return b.watcher.Events }
+func (b *inotifyBackend) Errors() <-chan error          { return b.watcher.Errors }
+func (b *inotifyBackend) Close() error                  { return b.watcher.Close() }
+
+// probeInotify reports whether inotify events arrive for a test file written
+// in dir. If the file cannot be written there is nothing to tell, and inotify
+// is assumed to work.
+func probeInotify(dir string, timeout time.Duration) bool {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return false
+	}
+	defer watcher.Close()
+	if err := watcher.Add(dir); err != nil {
+		return false
+	}
+
+	file, err := os.CreateTemp(dir, ".blink-probe-*")
+	if err != nil {
+		return true
+	}
+	name := file.Name()
+	file.Close()
+	defer os.Remove(name)
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return false
+			}
+			if filepath.Clean(event.Name) == filepath.Clean(name) {
+				return true
+			}
+		case <-deadline:
+			return false
+		}
+	}
+}
@@ -0,0 +1,356 @@
+//go:build linux
+
+package blink
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/sys/unix"
+)
+
+// Events the fanotify backend asks for, see fanotify_mark(2)
+const fanotifyMask = unix.FAN_CREATE | unix.FAN_DELETE | unix.FAN_MOVED_FROM | unix.FAN_MOVED_TO |
+	unix.FAN_MODIFY | unix.FAN_ATTRIB | unix.FAN_ONDIR
+
+// Size of struct fanotify_event_metadata
+const sizeofFanotifyEventMetadata = int(unsafe.Sizeof(unix.FanotifyEventMetadata{}))
+
+// fanotifyBackend is a Backend that marks the whole filesystem of every
+// watch root with a single fanotify mark, instead of one inotify watch per
+// directory. Events carry the handle of their directory and the name of the
+// entry (FAN_REPORT_DFID_NAME). They are resolved to paths and passed on
+// for entries anywhere under the roots, including in directories created
+// a moment ago, so no directory needs to be added. Directories on other
+// filesystems mounted below a root are not reported.
+type fanotifyBackend struct {
+	file *os.File // fanotify group
+
+	events chan fsnotify.Event
+	errors chan error
+
+	// Roots, a file on every marked filesystem to open handles, and
+	// directories added for WatchList, protected by mu
+	roots  []string
+	mounts map[unix.Fsid]*os.File
+	dirs   map[string]bool
+	mu     sync.Mutex
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// newFanotifyBackend marks the filesystems of roots. It fails without
+// CAP_SYS_ADMIN, or on kernels older than 5.9.
+func newFanotifyBackend(roots []string) (Backend, error) {
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC|unix.FAN_NONBLOCK|unix.FAN_REPORT_DFID_NAME, unix.O_RDONLY|unix.O_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("fanotify_init: %w", err)
+	}
+	// Non-blocking, so reads go through the runtime poller and Close unblocks them
+	file := os.NewFile(uintptr(fd), "fanotify")
+
+	b := &fanotifyBackend{
+		file:   file,
+		mounts: make(map[unix.Fsid]*os.File),
+		events: make(chan fsnotify.Event, defaultChannelBufferSize),
+		errors: make(chan error, defaultChannelBufferSize),
+		dirs:   make(map[string]bool),
+		done:   make(chan struct{}),
+	}
+	for _, root := range roots {
+		if err := b.AddRoot(root); err != nil {
+			for _, mount := range b.mounts {
+				mount.Close()
+			}
+			file.Close()
+			return nil, err
+		}
+	}
+	b.wg.Add(1)
+	go b.run()
+	return b, nil
+}
+
+func (b *fanotifyBackend) Name() string                  { return BackendFanotify }
+func (b *fanotifyBackend) Events() <-chan fsnotify.Event { return b.events }
+func (b *fanotifyBackend) Errors() <-chan error          { return b.errors }
+
+// AddRoot marks the filesystem of a root, unless it already is
+func (b *fanotifyBackend) AddRoot(root string) error {
+	root = filepath.Clean(root)
+	if err := unix.FanotifyMark(int(b.file.Fd()), unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, fanotifyMask, unix.AT_FDCWD, root); err != nil {
+		return fmt.Errorf("fanotify_mark %s: %w", root, err)
+	}
+	var stat unix.Statfs_t
+	if err := unix.Statfs(root, &stat); err != nil {
+		return fmt.Errorf("statfs %s: %w", root, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roots = append(b.roots, root)
+	if _, ok := b.mounts[stat.Fsid]; ok {
+		return nil
+	}
+	mount, err := os.Open(root)
+	if err != nil {
+		return err
+	}
+	b.mounts[stat.Fsid] = mount
+	return nil
+}
+
+// RemoveRoot stops passing on the events of a root. The filesystem stays
+// marked, other roots may be on it.
+func (b *fanotifyBackend) RemoveRoot(root string) {
+	root = filepath.Clean(root)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, candidate := range b.roots {
+		if candidate == root {
+			b.roots = append(b.roots[:i:i], b.roots[i+1:]...)
+			return
+		}
+	}
+}
+
+// Add records a directory for WatchList. Its events are passed on anyway
+// if it is under a root, the filesystem is already marked.
+func (b *fanotifyBackend) Add(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dirs[filepath.Clean(path)] = true
+	return nil
+}
+
+// Remove forgets a directory added with Add
+func (b *fanotifyBackend) Remove(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	path = filepath.Clean(path)
+	if !b.dirs[path] {
+		return fsnotify.ErrNonExistentWatch
+	}
+	delete(b.dirs, path)
+	return nil
+}
+
+// WatchList returns the watched directories
+func (b *fanotifyBackend) WatchList() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := make([]string, 0, len(b.dirs))
+	for dir := range b.dirs {
+		list = append(list, dir)
+	}
+	return list
+}
+
+// Close removes the mark and closes the channels
+func (b *fanotifyBackend) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		close(b.done)
+		err = b.file.Close()
+		b.wg.Wait()
+		for _, mount := range b.mounts {
+			mount.Close()
+		}
+		close(b.events)
+		close(b.errors)
+	})
+	return err
+}
+
+func (b *fanotifyBackend) run() {
+	defer b.wg.Done()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := b.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				select {
+				case b.errors <- err:
+				case <-b.done:
+				}
+			}
+			return
+		}
+		for _, event := range b.parse(buf[:n]) {
+			select {
+			case b.events <- event:
+			case <-b.done:
+				return
+			}
+		}
+		if b.overflowed(buf[:n]) {
+			select {
+			case b.errors <- fsnotify.ErrEventOverflow:
+			case <-b.done:
+				return
+			}
+		}
+	}
+}
+
+// overflowed reports whether the kernel dropped events before this read
+func (b *fanotifyBackend) overflowed(buf []byte) bool {
+	for len(buf) >= sizeofFanotifyEventMetadata {
+		meta := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[0]))
+		if int(meta.Event_len) < sizeofFanotifyEventMetadata || int(meta.Event_len) > len(buf) {
+			return false
+		}
+		if meta.Mask&unix.FAN_Q_OVERFLOW != 0 {
+			return true
+		}
+		buf = buf[meta.Event_len:]
+	}
+	return false
+}
+
+// parse turns the events in buf into fsnotify events, dropping those
+// outside the roots
+func (b *fanotifyBackend) parse(buf []byte) []fsnotify.Event {
+	var events []fsnotify.Event
+	for len(buf) >= sizeofFanotifyEventMetadata {
+		meta := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[0]))
+		if int(meta.Event_len) < sizeofFanotifyEventMetadata || int(meta.Event_len) > len(buf) || meta.Vers != unix.FANOTIFY_METADATA_VERSION || meta.Metadata_len > uint16(meta.Event_len) {
+			break
+		}
+		record := buf[meta.Metadata_len:meta.Event_len]
+		buf = buf[meta.Event_len:]
+
+		ops := fanotifyOps(meta.Mask)
+		if len(ops) == 0 {
+			continue
+		}
+		dir, name, ok := b.resolve(record)
+		if !ok || name == "." {
+			continue
+		}
+		if !b.accept(dir) {
+			continue
+		}
+		for _, op := range ops {
+			events = append(events, fsnotify.Event{Name: filepath.Join(dir, name), Op: op})
+		}
+	}
+	return events
+}
+
+// accept reports whether events in dir are passed on: dir must be under
+// a root
+func (b *fanotifyBackend) accept(dir string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, root := range b.roots {
+		if dir == root || strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the directory and entry name of an event's
+// FAN_EVENT_INFO_TYPE_DFID_NAME record
+func (b *fanotifyBackend) resolve(info []byte) (string, string, bool) {
+	// struct fanotify_event_info_header { u8 info_type; u8 pad; u16 len; }
+	for len(info) >= 4 {
+		infoType, length := info[0], int(binary.NativeEndian.Uint16(info[2:4]))
+		if length < 4 || length > len(info) {
+			return "", "", false
+		}
+		record := info[:length]
+		info = info[length:]
+		if infoType != unix.FAN_EVENT_INFO_TYPE_DFID_NAME {
+			continue
+		}
+
+		// Header, __kernel_fsid_t, then struct file_handle
+		// { u32 handle_bytes; i32 handle_type; u8 f_handle[]; } and the name
+		const handleStart = 4 + 8
+		if len(record) < handleStart+8 {
+			return "", "", false
+		}
+		size := int(binary.NativeEndian.Uint32(record[handleStart:]))
+		handleType := int32(binary.NativeEndian.Uint32(record[handleStart+4:]))
+		nameStart := handleStart + 8 + size
+		if nameStart > len(record) {
+			return "", "", false
+		}
+		name := record[nameStart:]
+		if i := strings.IndexByte(string(name), 0); i >= 0 {
+			name = name[:i]
+		}
+
+		fsid := unix.Fsid{Val: [2]int32{
+			int32(binary.NativeEndian.Uint32(record[4:])),
+			int32(binary.NativeEndian.Uint32(record[8:])),
+		}}
+		dir, err := b.handlePath(fsid, unix.NewFileHandle(handleType, record[handleStart+8:nameStart]))
+		if err != nil {
+			return "", "", false
+		}
+		return dir, string(name), true
+	}
+	return "", "", false
+}
+
+// handlePath returns the current path of the directory behind a handle
+// on the filesystem fsid
+func (b *fanotifyBackend) handlePath(fsid unix.Fsid, handle unix.FileHandle) (string, error) {
+	b.mu.Lock()
+	mount, ok := b.mounts[fsid]
+	b.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("unknown filesystem %v", fsid.Val)
+	}
+	fd, err := unix.OpenByHandleAt(int(mount.Fd()), handle, unix.O_PATH|unix.O_CLOEXEC)
+	if err != nil {
+		return "", err
+	}
+	defer unix.Close(fd)
+	return os.Readlink("/proc/self/fd/" + strconv.Itoa(fd))
+}
+
+// fanotifyOps converts a fanotify event mask to fsnotify operations. The
+// kernel merges events for the same entry that are still queued, so one
+// mask can stand for several events; they are returned in the order they
+// most likely happened.
+func fanotifyOps(mask uint64) []fsnotify.Op {
+	var ops []fsnotify.Op
+	if mask&(unix.FAN_CREATE|unix.FAN_MOVED_TO) != 0 {
+		ops = append(ops, fsnotify.Create)
+	}
+	if mask&unix.FAN_MODIFY != 0 {
+		ops = append(ops, fsnotify.Write)
+	}
+	if mask&unix.FAN_ATTRIB != 0 {
+		ops = append(ops, fsnotify.Chmod)
+	}
+	if mask&unix.FAN_MOVED_FROM != 0 {
+		ops = append(ops, fsnotify.Rename)
+	}
+	if mask&unix.FAN_DELETE != 0 {
+		ops = append(ops, fsnotify.Remove)
+	}
+	return ops
+}
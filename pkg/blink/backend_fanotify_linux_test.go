@@ -0,0 +1,76 @@
+//go:build linux
+
+package blink
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// TestFanotifyBackend tests that the fanotify backend reports entries
+// anywhere under its roots, added or not, and nothing outside. It is
+// skipped without CAP_SYS_ADMIN.
+func TestFanotifyBackend(t *testing.T) {
+	root := t.TempDir()
+	b, err := newFanotifyBackend([]string{root})
+	if err != nil {
+		t.Skipf("fanotify is not available: %v", err)
+	}
+	defer b.Close()
+
+	if err := b.Add(root); err != nil {
+		t.Fatalf("Failed to add directory: %v", err)
+	}
+	unwatched := filepath.Join(root, "unwatched")
+	if err := os.Mkdir(unwatched, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	// Not outside the root, but in a directory that was never added
+	if err := os.WriteFile(filepath.Join(t.TempDir(), "outside.txt"), []byte("a"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	nested := filepath.Join(unwatched, "nested.txt")
+	if err := os.WriteFile(nested, []byte("a"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	path := filepath.Join(root, "file.txt")
+	renamed := filepath.Join(root, "renamed.txt")
+	if err := os.WriteFile(path, []byte("a"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.Rename(path, renamed); err != nil {
+		t.Fatalf("Failed to rename file: %v", err)
+	}
+	if err := os.Remove(renamed); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+
+	var got []fsnotify.Event
+	timeout := time.After(2 * time.Second)
+	for len(got) == 0 || got[len(got)-1].Op&fsnotify.Remove == 0 {
+		select {
+		case event := <-b.Events():
+			got = append(got, event)
+		case <-timeout:
+			t.Fatalf("Timed out waiting for events, got %v", got)
+		}
+	}
+
+	for _, event := range got {
+		if event.Name != unwatched && event.Name != nested && event.Name != path && event.Name != renamed {
+			t.Errorf("Unexpected event: %s", event)
+		}
+	}
+	if got[0].Name != unwatched || got[0].Op != fsnotify.Create {
+		t.Errorf("Expected the directory to be created first, got %s", got[0])
+	}
+	if len(got) < 2 || got[1].Name != nested || got[1].Op != fsnotify.Create {
+		t.Errorf("Expected the file in the directory to be created next, got %v", got)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package blink
+
+import "errors"
+
+// newFanotifyBackend fails, fanotify only exists on Linux
+func newFanotifyBackend(roots []string) (Backend, error) {
+	return nil, errors.New("fanotify is only supported on Linux")
+}
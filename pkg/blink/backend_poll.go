@@ -0,0 +1,246 @@
+package blink
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// pollEntry is what the poll backend last saw of a directory entry
+type pollEntry struct {
+	fileState
+	mode os.FileMode
+}
+
+// pollDir is the snapshot of a watched directory. Add creates a new one, so
+// a poll can tell whether the directory was removed and watched again while
+// it scanned.
+type pollDir struct {
+	entries map[string]pollEntry
+}
+
+// pollBackend is a Backend that detects changes by comparing stat snapshots
+// of the watched directories, for file systems where inotify events never
+// arrive. A file that disappears from one path and appears under another
+// within the same poll is reported as a rename followed by a create.
+type pollBackend struct {
+	interval time.Duration
+	events   chan fsnotify.Event
+	errors   chan error
+
+	// Snapshots of the watched directories, protected by mu. Polls scan
+	// without holding it, so that a slow file system does not stall Add,
+	// Remove and WatchList.
+	dirs map[string]*pollDir
+	mu   sync.Mutex
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+func newPollBackend(interval time.Duration) *pollBackend {
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	b := &pollBackend{
+		interval: interval,
+		events:   make(chan fsnotify.Event, defaultChannelBufferSize),
+		errors:   make(chan error, defaultChannelBufferSize),
+		dirs:     make(map[string]*pollDir),
+		done:     make(chan struct{}),
+	}
+	b.wg.Add(1)
+	go b.run()
+	return b
+}
+
+func (b *pollBackend) Name() string                  { return BackendPoll }
+func (b *pollBackend) Events() <-chan fsnotify.Event { return b.events }
+func (b *pollBackend) Errors() <-chan error          { return b.errors }
+
+// Add starts watching a directory, changes are reported from now on
+func (b *pollBackend) Add(path string) error {
+	entries, err := scanPollDir(path)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.dirs[path]; !ok {
+		b.dirs[path] = &pollDir{entries: entries}
+	}
+	return nil
+}
+
+// Remove stops watching a directory
+func (b *pollBackend) Remove(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.dirs[path]; !ok {
+		return fsnotify.ErrNonExistentWatch
+	}
+	delete(b.dirs, path)
+	return nil
+}
+
+// WatchList returns the watched directories
+func (b *pollBackend) WatchList() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := make([]string, 0, len(b.dirs))
+	for dir := range b.dirs {
+		list = append(list, dir)
+	}
+	return list
+}
+
+// Close stops polling and closes the channels
+func (b *pollBackend) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.done)
+		b.wg.Wait()
+		close(b.events)
+		close(b.errors)
+	})
+	return nil
+}
+
+func (b *pollBackend) run() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			for _, event := range b.poll() {
+				select {
+				case b.events <- event:
+				case <-b.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+// poll rescans the watched directories and returns the events for what
+// changed since the last poll: removes and renames first, then creates,
+// then writes and chmods.
+func (b *pollBackend) poll() []fsnotify.Event {
+	b.mu.Lock()
+	dirs := make(map[string]*pollDir, len(b.dirs))
+	for dir, snapshot := range b.dirs {
+		dirs[dir] = snapshot
+	}
+	b.mu.Unlock()
+
+	// Scan without the lock, a scan can take long on network file systems
+	type scan struct {
+		entries map[string]pollEntry
+		err     error
+	}
+	scans := make(map[string]scan, len(dirs))
+	for dir := range dirs {
+		entries, err := scanPollDir(dir)
+		scans[dir] = scan{entries, err}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var removed, created, changed []fsnotify.Event
+	var removedKeys []fileKey
+	createdKeys := make(map[fileKey]bool)
+	for dir, snapshot := range dirs {
+		if b.dirs[dir] != snapshot {
+			// Removed or added again while scanning
+			continue
+		}
+		old, current, err := snapshot.entries, scans[dir].entries, scans[dir].err
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// Its parent reports it, unless it is not watched
+				delete(b.dirs, dir)
+				if _, ok := b.dirs[filepath.Dir(dir)]; !ok {
+					removed = append(removed, fsnotify.Event{Name: dir, Op: fsnotify.Remove})
+					removedKeys = append(removedKeys, fileKey{})
+				}
+			}
+			continue
+		}
+
+		for name, entry := range current {
+			path := filepath.Join(dir, name)
+			previous, ok := old[name]
+			switch {
+			case !ok || previous.key != entry.key:
+				// New, or replaced by another file
+				created = append(created, fsnotify.Event{Name: path, Op: fsnotify.Create})
+				createdKeys[entry.key] = true
+			case entry.mode.IsDir():
+				// A directory's size and mtime change with its entries,
+				// which are reported by its own watch
+				if previous.mode != entry.mode {
+					changed = append(changed, fsnotify.Event{Name: path, Op: fsnotify.Chmod})
+				}
+			case previous.fileState != entry.fileState:
+				changed = append(changed, fsnotify.Event{Name: path, Op: fsnotify.Write})
+			case previous.mode != entry.mode:
+				changed = append(changed, fsnotify.Event{Name: path, Op: fsnotify.Chmod})
+			}
+		}
+		for name, entry := range old {
+			if next, ok := current[name]; !ok || next.key != entry.key {
+				removed = append(removed, fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Remove})
+				removedKeys = append(removedKeys, entry.key)
+			}
+		}
+		snapshot.entries = current
+	}
+
+	// A file that went away and turned up elsewhere was renamed
+	for i, key := range removedKeys {
+		if key.inode != 0 && createdKeys[key] {
+			removed[i].Op = fsnotify.Rename
+		}
+	}
+
+	events := make([]fsnotify.Event, 0, len(removed)+len(created)+len(changed))
+	for _, list := range [][]fsnotify.Event{removed, created, changed} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+		events = append(events, list...)
+	}
+	return events
+}
+
+// scanPollDir returns the entries of a directory by name
+func scanPollDir(dir string) (map[string]pollEntry, error) {
+	names, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]pollEntry, len(names))
+	for _, name := range names {
+		info, err := name.Info()
+		if err != nil {
+			// Removed since it was listed
+			continue
+		}
+		inode, device := fileID(info)
+		entries[name.Name()] = pollEntry{
+			fileState: fileState{key: fileKey{inode: inode, device: device}, size: info.Size(), modTime: info.ModTime()},
+			mode:      info.Mode(),
+		}
+	}
+	return entries, nil
+}
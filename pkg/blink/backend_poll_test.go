@@ -0,0 +1,109 @@
+package blink
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// nextPollEvent returns the next event of the backend, failing the test on timeout
+func nextPollEvent(t *testing.T, b Backend) fsnotify.Event {
+	t.Helper()
+	select {
+	case event := <-b.Events():
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for an event")
+		return fsnotify.Event{}
+	}
+}
+
+// TestPollBackend tests that the poll backend detects changes from stat snapshots
+func TestPollBackend(t *testing.T) {
+	dir := t.TempDir()
+	b := newPollBackend(10 * time.Millisecond)
+	defer b.Close()
+
+	if err := b.Add(dir); err != nil {
+		t.Fatalf("Failed to add directory: %v", err)
+	}
+	if list := b.WatchList(); len(list) != 1 || list[0] != dir {
+		t.Errorf("Unexpected watch list: %v", list)
+	}
+
+	path := filepath.Join(dir, "file.txt")
+	expect := func(op fsnotify.Op, name string) {
+		t.Helper()
+		if event := nextPollEvent(t, b); event.Op != op || event.Name != name {
+			t.Errorf("Got %s, want %s %q", event, op, name)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("a"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	expect(fsnotify.Create, path)
+
+	if err := os.WriteFile(path, []byte("changed"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	expect(fsnotify.Write, path)
+
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatalf("Failed to chmod file: %v", err)
+	}
+	expect(fsnotify.Chmod, path)
+
+	renamed := filepath.Join(dir, "renamed.txt")
+	if err := os.Rename(path, renamed); err != nil {
+		t.Fatalf("Failed to rename file: %v", err)
+	}
+	expect(fsnotify.Rename, path)
+	expect(fsnotify.Create, renamed)
+
+	if err := os.Remove(renamed); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	expect(fsnotify.Remove, renamed)
+
+	// Removed directories are no longer polled
+	if err := b.Remove(dir); err != nil {
+		t.Fatalf("Failed to remove watch: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("a"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	select {
+	case event := <-b.Events():
+		t.Errorf("Unexpected event after removing the watch: %s", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// TestNewBackend tests selecting a backend by name
+func TestNewBackend(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"", BackendInotify, BackendPoll, BackendFanotify, BackendAuto} {
+		b, err := NewBackend(name, []string{dir}, time.Second)
+		if err != nil {
+			t.Errorf("NewBackend(%q) failed: %v", name, err)
+			continue
+		}
+		b.Close()
+	}
+
+	if _, err := NewBackend("kqueue", []string{dir}, time.Second); err == nil {
+		t.Error("Expected an error for an unknown backend")
+	}
+
+	// inotify works in a temporary directory, and the probe cleans up after itself
+	if !probeInotify(dir, probeTimeout) {
+		t.Error("Expected inotify events to arrive")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Probe left files behind: %v", entries)
+	}
+}
@@ -145,7 +145,7 @@ func (w *Watcher) addFolderToWatch(folder string) error {
 	}
 
 	// Add the folder to the watcher
-	if err := w.watcher.Add(folder); err != nil {
+	if err := w.backend.Add(folder); err != nil {
 		logger.Error(err)
 		return err
 	}
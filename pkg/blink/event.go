@@ -1,11 +1,257 @@
 package blink
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
 	"github.com/fsnotify/fsnotify"
 )
 
-type Event fsnotify.Event
+// Event is a file system event together with the file metadata observed
+// when it happened. All transports (SSE, WebSockets and webhooks) send the
+// same JSON encoding of it, see MarshalJSON.
+type Event struct {
+	// ID is the server-wide sequence number, 0 until the event is sequenced
+	ID uint64
+	// Name is the absolute path of the file
+	Name string
+	// Op is the operation that happened
+	Op fsnotify.Op
+	// Timestamp is when the event was read from the kernel
+	Timestamp time.Time
+
+	// Root is the watch root the event belongs to
+	Root string
+	// RootName is the name of the watch root, see RootConfig.Name
+	RootName string
+	// RelPath is the path of the file relative to Root
+	RelPath string
+	// OldName is the previous absolute path of a renamed file, if known
+	OldName string
+
+	// File metadata, zero when the file no longer exists
+	IsDir   bool
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+	Inode   uint64
+	Device  uint64
+
+	// Exec describes the command of an action, for OpExec events only
+	Exec *ExecInfo
+}
+
+// eventJSON is the canonical wire format of an Event
+type eventJSON struct {
+	ID        uint64    `json:"id,omitempty"`
+	Op        string    `json:"op"`
+	Path      string    `json:"path"`
+	RelPath   string    `json:"rel_path,omitempty"`
+	OldPath   string    `json:"old_path,omitempty"`
+	From      string    `json:"from,omitempty"`
+	To        string    `json:"to,omitempty"`
+	Root      string    `json:"root,omitempty"`
+	RootName  string    `json:"root_name,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	IsDir     bool      `json:"is_dir"`
+	Size      int64     `json:"size"`
+	Mode      string    `json:"mode,omitempty"`
+	ModTime   time.Time `json:"mtime,omitzero"`
+	Inode     uint64    `json:"inode,omitempty"`
+	Device    uint64    `json:"device,omitempty"`
+	Exec      *execJSON `json:"exec,omitempty"`
+}
+
+// execJSON is the wire format of an ExecInfo
+type execJSON struct {
+	Action     string `json:"action"`
+	Run        uint64 `json:"run"`
+	Status     string `json:"status"`
+	Stream     string `json:"stream,omitempty"`
+	Line       string `json:"line,omitempty"`
+	ExitCode   *int   `json:"exit_code,omitempty"`
+	DurationMS int64  `json:"duration_ms,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// NewEvent creates an Event for an fsnotify event read just now, and stats
+// the file for its metadata. root is the watch root the file belongs to.
+func NewEvent(fsEvent fsnotify.Event, root string) Event {
+	info, err := os.Lstat(fsEvent.Name)
+	if err != nil {
+		info = nil
+	}
+	return newEvent(fsEvent, root, info, time.Now())
+}
+
+// newEvent creates an Event from an fsnotify event and the file info
+// already looked up by the caller. info may be nil.
+func newEvent(fsEvent fsnotify.Event, root string, info os.FileInfo, observed time.Time) Event {
+	event := Event{
+		Name:      fsEvent.Name,
+		Op:        fsEvent.Op,
+		Timestamp: observed,
+		Root:      root,
+		RelPath:   relativePath(root, fsEvent.Name),
+	}
+	if info != nil {
+		event.IsDir = info.IsDir()
+		event.Size = info.Size()
+		event.Mode = info.Mode()
+		event.ModTime = info.ModTime()
+		event.Inode, event.Device = fileID(info)
+	}
+	return event
+}
+
+// relativePath returns path relative to root, or path itself if that is not possible
+func relativePath(root, path string) string {
+	if root == "" {
+		return path
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
 
+// String returns the event in the same format as fsnotify.Event
 func (e Event) String() string {
-	return fsnotify.Event(e).String()
+	switch {
+	case e.Op&OpOverflow != 0:
+		return fmt.Sprintf("%-13s %q", "OVERFLOW", e.Name)
+	case e.Op&OpMove != 0:
+		return fmt.Sprintf("%-13s %q ← %q", "MOVE", e.Name, e.OldName)
+	case e.Op&OpExec != 0 && e.Exec != nil:
+		return fmt.Sprintf("%-13s %q %s", "EXEC", e.Exec.Action, e.Exec.Status)
+	}
+	return fsnotify.Event{Name: e.Name, Op: e.Op}.String()
+}
+
+// OpString returns the name of the event's operation, e.g. "write"
+func (e Event) OpString() string {
+	return eventTypeToString(e.Op)
+}
+
+// MarshalJSON encodes the event in the canonical format shared by all transports
+func (e Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.wire())
+}
+
+// wire returns the event in its wire format
+func (e Event) wire() eventJSON {
+	wire := eventJSON{
+		ID:        e.ID,
+		Op:        e.OpString(),
+		Path:      e.Name,
+		RelPath:   e.RelPath,
+		OldPath:   e.OldName,
+		Root:      e.Root,
+		RootName:  e.RootName,
+		Timestamp: e.Timestamp,
+		IsDir:     e.IsDir,
+		Size:      e.Size,
+		ModTime:   e.ModTime,
+		Inode:     e.Inode,
+		Device:    e.Device,
+	}
+	if e.Mode != 0 {
+		wire.Mode = e.Mode.String()
+	}
+	if e.Op&OpMove != 0 {
+		wire.From, wire.To = e.OldName, e.Name
+	}
+	if e.Exec != nil {
+		wire.Exec = &execJSON{
+			Action: e.Exec.Action,
+			Run:    e.Exec.Run,
+			Status: e.Exec.Status,
+			Stream: e.Exec.Stream,
+			Line:   e.Exec.Line,
+			Error:  e.Exec.Error,
+		}
+		if e.Exec.Status == ExecExited {
+			wire.Exec.ExitCode = &e.Exec.ExitCode
+			wire.Exec.DurationMS = e.Exec.Duration.Milliseconds()
+		}
+	}
+	return wire
+}
+
+// UnmarshalJSON decodes an event from the canonical format
+func (e *Event) UnmarshalJSON(data []byte) error {
+	var wire eventJSON
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return err
+	}
+
+	var op fsnotify.Op
+	if wire.Op != "" && wire.Op != "unknown" {
+		var err error
+		if op, err = compileEventTypes([]string{wire.Op}); err != nil {
+			return fmt.Errorf("invalid event: %w", err)
+		}
+	}
+
+	*e = Event{
+		ID:        wire.ID,
+		Name:      wire.Path,
+		Op:        op,
+		Timestamp: wire.Timestamp,
+		Root:      wire.Root,
+		RootName:  wire.RootName,
+		RelPath:   wire.RelPath,
+		OldName:   wire.OldPath,
+		IsDir:     wire.IsDir,
+		Size:      wire.Size,
+		Mode:      parseFileMode(wire.Mode),
+		ModTime:   wire.ModTime,
+		Inode:     wire.Inode,
+		Device:    wire.Device,
+	}
+	if wire.Exec != nil {
+		e.Exec = &ExecInfo{
+			Action:   wire.Exec.Action,
+			Run:      wire.Exec.Run,
+			Status:   wire.Exec.Status,
+			Stream:   wire.Exec.Stream,
+			Line:     wire.Exec.Line,
+			Duration: time.Duration(wire.Exec.DurationMS) * time.Millisecond,
+			Error:    wire.Exec.Error,
+		}
+		if wire.Exec.ExitCode != nil {
+			e.Exec.ExitCode = *wire.Exec.ExitCode
+		}
+	}
+	return nil
+}
+
+// parseFileMode parses the output of os.FileMode.String, e.g. "drwxr-xr-x".
+// Unknown type letters are ignored.
+func parseFileMode(s string) os.FileMode {
+	if len(s) < 9 {
+		return 0
+	}
+
+	var mode os.FileMode
+	perm, kinds := s[len(s)-9:], s[:len(s)-9]
+	for i, c := range perm {
+		if c != '-' {
+			mode |= 1 << uint(8-i)
+		}
+	}
+
+	// Same letters, in the same order, as os.FileMode.String
+	const letters = "dalTLDpSugct?"
+	for _, c := range kinds {
+		if i := strings.IndexRune(letters, c); i >= 0 {
+			mode |= 1 << uint(31-i)
+		}
+	}
+	return mode
 }
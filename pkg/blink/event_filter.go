@@ -1,7 +1,6 @@
 package blink
 
 import (
-	"os"
 	"path/filepath"
 	"strings"
 
@@ -15,13 +14,16 @@ type CustomFilterFunc func(path string, isDir bool) bool
 // EventFilter provides filtering capabilities for file system events
 type EventFilter struct {
 	// Include/exclude patterns
-	includePatterns []string
-	excludePatterns []string
+	includePatterns PatternSet
+	excludePatterns PatternSet
 
 	// Event types to include/ignore
 	includeEvents map[fsnotify.Op]bool
 	ignoreEvents  map[fsnotify.Op]bool
 
+	// Filter expression, nil if not set
+	expr *Expr
+
 	// Custom filter functions
 	customFilters []CustomFilterFunc
 }
@@ -29,11 +31,9 @@ type EventFilter struct {
 // NewEventFilter creates a new event filter
 func NewEventFilter() *EventFilter {
 	return &EventFilter{
-		includePatterns: []string{},
-		excludePatterns: []string{},
-		includeEvents:   make(map[fsnotify.Op]bool),
-		ignoreEvents:    make(map[fsnotify.Op]bool),
-		customFilters:   []CustomFilterFunc{},
+		includeEvents: make(map[fsnotify.Op]bool),
+		ignoreEvents:  make(map[fsnotify.Op]bool),
+		customFilters: []CustomFilterFunc{},
 	}
 }
 
@@ -62,181 +62,77 @@ func (f *EventFilter) SetIgnoreEvents(events string) {
 	f.ignoreEvents = parseEvents(events)
 }
 
-// GetExcludePatterns returns the current exclude patterns as a comma-separated string
-func (f *EventFilter) GetExcludePatterns() string {
-	return strings.Join(f.excludePatterns, ",")
+// SetExpression sets the filter expression that events must satisfy, see
+// Expr. An empty expression removes it.
+func (f *EventFilter) SetExpression(expr string) error {
+	if strings.TrimSpace(expr) == "" {
+		f.expr = nil
+		return nil
+	}
+	compiled, err := CompileExpr(expr)
+	if err != nil {
+		return err
+	}
+	f.expr = compiled
+	return nil
 }
 
-// ShouldIncludePath checks if a path should be included based on patterns
-func (f *EventFilter) ShouldIncludePath(path string) bool {
-	// Normalize path for consistent matching
-	normalizedPath := filepath.ToSlash(path)
-	baseName := filepath.Base(normalizedPath)
-
-	// If no include patterns are specified, include everything
-	includeAll := len(f.includePatterns) == 0
-
-	// Check exclude patterns first
-	for _, pattern := range f.excludePatterns {
-		// Try to match against the base name first (simple case)
-		matched, err := filepath.Match(pattern, baseName)
-		if err == nil && matched {
-			logger.Debugf("Path excluded by base name pattern: %s (pattern: %s)", path, pattern)
-			return false
-		}
+// Expression returns the current filter expression, or "" if there is none
+func (f *EventFilter) Expression() string {
+	if f.expr == nil {
+		return ""
+	}
+	return f.expr.String()
+}
 
-		// Handle ** pattern (recursive matching)
-		if strings.Contains(pattern, "**") {
-			// Convert ** to a more specific check
-			parts := strings.Split(pattern, "**")
-			allPartsMatch := true
-
-			// Check if all parts of the pattern exist in the path in the correct order
-			lastIndex := 0
-			for _, part := range parts {
-				if part == "" {
-					continue
-				}
-
-				index := strings.Index(normalizedPath[lastIndex:], part)
-				if index == -1 {
-					allPartsMatch = false
-					break
-				}
-				lastIndex += index + len(part)
-			}
+// GetExcludePatterns returns the current exclude patterns as a comma-separated string
+func (f *EventFilter) GetExcludePatterns() string {
+	return strings.Join(f.excludePatterns.Strings(), ",")
+}
 
-			if allPartsMatch {
-				logger.Debugf("Path excluded by ** pattern: %s (pattern: %s)", path, pattern)
-				return false
-			}
-		}
+// IncludePatterns returns the current include patterns
+func (f *EventFilter) IncludePatterns() []string {
+	return f.includePatterns.Strings()
+}
 
-		// Handle * pattern (single directory matching)
-		if strings.Contains(pattern, "*") {
-			// Try matching against the full path
-			// This is a simplified approach - for complex cases, consider using a library like doublestar
-			if matched, _ := filepath.Match(pattern, normalizedPath); matched {
-				logger.Debugf("Path excluded by full path pattern: %s (pattern: %s)", path, pattern)
-				return false
-			}
+// ExcludePatterns returns the current exclude patterns
+func (f *EventFilter) ExcludePatterns() []string {
+	return f.excludePatterns.Strings()
+}
 
-			// Try matching against path segments
-			pathParts := strings.Split(normalizedPath, "/")
-			for _, part := range pathParts {
-				if matched, _ := filepath.Match(pattern, part); matched {
-					logger.Debugf("Path excluded by path segment pattern: %s (pattern: %s, segment: %s)", path, pattern, part)
-					return false
-				}
-			}
-		}
+// ShouldIncludePath checks if a path should be included based on patterns.
+// The path is matched as given, so anchored patterns should be written
+// relative to what the caller passes in; ShouldProcessEvent uses the path
+// relative to the event's watch root. A path is excluded if it or one of
+// its parent directories matches the exclude patterns.
+func (f *EventFilter) ShouldIncludePath(path string) bool {
+	return f.shouldIncludePath(filepath.ToSlash(path), false)
+}
 
-		// Direct substring match for non-glob patterns
-		if !strings.Contains(pattern, "*") && strings.Contains(normalizedPath, pattern) {
-			logger.Debugf("Path excluded by substring match: %s (pattern: %s)", path, pattern)
-			return false
-		}
+// shouldIncludePath checks a slash-separated path against the patterns
+func (f *EventFilter) shouldIncludePath(path string, isDir bool) bool {
+	if f.excludePatterns.MatchOrParent(path, isDir) {
+		logger.Debugf("Path excluded by pattern: %s", path)
+		return false
 	}
-
-	// If we're including all and nothing was excluded, include the path
-	if includeAll {
+	if f.includePatterns.Len() == 0 {
 		return true
 	}
-
-	// Check include patterns
-	for _, pattern := range f.includePatterns {
-		// Try to match against the base name first (simple case)
-		matched, err := filepath.Match(pattern, baseName)
-		if err == nil && matched {
-			logger.Debugf("Path included by base name pattern: %s (pattern: %s)", path, pattern)
-			return true
-		}
-
-		// Handle ** pattern (recursive matching)
-		if strings.Contains(pattern, "**") {
-			// Convert ** to a more specific check
-			parts := strings.Split(pattern, "**")
-			allPartsMatch := true
-
-			// Check if all parts of the pattern exist in the path in the correct order
-			lastIndex := 0
-			for _, part := range parts {
-				if part == "" {
-					continue
-				}
-
-				index := strings.Index(normalizedPath[lastIndex:], part)
-				if index == -1 {
-					allPartsMatch = false
-					break
-				}
-				lastIndex += index + len(part)
-			}
-
-			if allPartsMatch {
-				logger.Debugf("Path included by ** pattern: %s (pattern: %s)", path, pattern)
-				return true
-			}
-		}
-
-		// Handle * pattern (single directory matching)
-		if strings.Contains(pattern, "*") {
-			// Try matching against the full path
-			if matched, _ := filepath.Match(pattern, normalizedPath); matched {
-				logger.Debugf("Path included by full path pattern: %s (pattern: %s)", path, pattern)
-				return true
-			}
-
-			// Try matching against path segments
-			pathParts := strings.Split(normalizedPath, "/")
-			for _, part := range pathParts {
-				if matched, _ := filepath.Match(pattern, part); matched {
-					logger.Debugf("Path included by path segment pattern: %s (pattern: %s, segment: %s)", path, pattern, part)
-					return true
-				}
-			}
-		}
-
-		// Direct substring match for non-glob patterns
-		if !strings.Contains(pattern, "*") && strings.Contains(normalizedPath, pattern) {
-			logger.Debugf("Path included by substring match: %s (pattern: %s)", path, pattern)
-			return true
-		}
-	}
-
-	return false
+	return f.includePatterns.Match(path, isDir)
 }
 
 // ShouldProcessEvent checks if an event should be processed based on event type and path
-func (f *EventFilter) ShouldProcessEvent(event fsnotify.Event) bool {
+func (f *EventFilter) ShouldProcessEvent(event Event) bool {
 	// Debug the event being processed
 	logger.Debugf("Processing event: %s, path: %s", event.Op, event.Name)
 
-	// Check custom filters first - these have highest priority
-	for i, filter := range f.customFilters {
-		if filter != nil {
-			// Get file info to determine if it's a directory
-			isDir := false
-			fileInfo, err := os.Stat(event.Name)
-			if err == nil {
-				isDir = fileInfo.IsDir()
-			} else {
-				logger.Debugf("Error getting file info for %s: %v", event.Name, err)
-			}
-
-			// Apply the custom filter
-			result := filter(event.Name, isDir)
-			logger.Debugf("Custom filter %d result for %s: %v", i, event.Name, result)
-			if !result {
-				logger.Debugf("Event excluded by custom filter %d: %s", i, event.Name)
-				return false
-			}
-		}
+	// Clients must always learn that events were lost, whatever they filter on
+	if event.Op&OpOverflow != 0 {
+		return true
 	}
 
-	// Check if the path should be included based on patterns
-	if !f.ShouldIncludePath(event.Name) {
-		logger.Debugf("Event excluded by pattern: %s", event.Name)
+	// The events of action commands have no file to match, only a type
+	if event.Op&OpExec == 0 && !f.matchesFile(event) {
 		return false
 	}
 
@@ -268,46 +164,129 @@ func (f *EventFilter) ShouldProcessEvent(event fsnotify.Event) bool {
 	return true
 }
 
-// parsePatterns converts a comma-separated string of patterns to a slice of strings
-func parsePatterns(patterns string) []string {
-	if patterns == "" {
-		return []string{}
+// matchesFile checks the custom filters, the patterns and the filter
+// expression against the file of an event
+func (f *EventFilter) matchesFile(event Event) bool {
+	// Check custom filters first - these have highest priority
+	for i, filter := range f.customFilters {
+		if filter != nil {
+			// Apply the custom filter, using the metadata observed with the event
+			result := filter(event.Name, event.IsDir)
+			logger.Debugf("Custom filter %d result for %s: %v", i, event.Name, result)
+			if !result {
+				logger.Debugf("Event excluded by custom filter %d: %s", i, event.Name)
+				return false
+			}
+		}
 	}
 
-	patternList := strings.Split(patterns, ",")
-	result := make([]string, 0, len(patternList))
+	// Check if the path should be included based on patterns, relative to
+	// the watch root if known
+	path := event.RelPath
+	if path == "" {
+		path = event.Name
+	}
+	if !f.shouldIncludePath(filepath.ToSlash(path), event.IsDir) {
+		logger.Debugf("Event excluded by pattern: %s", event.Name)
+		return false
+	}
 
-	for _, p := range patternList {
-		p = strings.TrimSpace(p)
-		if p != "" {
-			// Normalize pattern to use forward slashes
-			p = filepath.ToSlash(p)
-
-			// Handle special case for **/ prefix (match any directory)
-			if strings.HasPrefix(p, "**/") && !strings.HasPrefix(p, "**/*") {
-				// Add both the original pattern and a version without the **/ prefix
-				// This helps match both absolute and relative paths
-				result = append(result, p)
-				result = append(result, p[3:])
-				continue
-			}
+	// Check the filter expression
+	if f.expr != nil && !f.expr.Match(&event) {
+		logger.Debugf("Event excluded by filter expression: %s", event.Name)
+		return false
+	}
+	return true
+}
 
-			// Handle special case for /** suffix (match any subdirectory)
-			if strings.HasSuffix(p, "/**") && !strings.HasSuffix(p, "/**/*") {
-				// Add both the original pattern and a version with /** replaced by /**/*
-				// This helps match files in subdirectories
-				result = append(result, p)
-				result = append(result, p+"/*")
-				continue
-			}
+// compileEventFilter creates a filter from lists of patterns and event
+// types and a filter expression, or returns nil if all are empty. Unlike
+// the EventFilter setters, it rejects malformed patterns and event types,
+// since they come from someone who can be told.
+func compileEventFilter(include, exclude, events, ignore []string, expr string) (*EventFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 && len(events) == 0 && len(ignore) == 0 && expr == "" {
+		return nil, nil
+	}
+	for _, patterns := range [][]string{include, exclude} {
+		if _, err := CompilePatterns(patterns); err != nil {
+			return nil, err
+		}
+	}
+	for _, types := range [][]string{events, ignore} {
+		if _, err := compileEventTypes(types); err != nil {
+			return nil, err
+		}
+	}
 
-			result = append(result, p)
+	filter := NewEventFilter()
+	filter.SetIncludePatterns(strings.Join(include, ","))
+	filter.SetExcludePatterns(strings.Join(exclude, ","))
+	filter.SetIncludeEvents(strings.Join(events, ","))
+	filter.SetIgnoreEvents(strings.Join(ignore, ","))
+	if err := filter.SetExpression(expr); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// parsePatterns compiles a comma-separated list of patterns, see Pattern.
+// Commas inside braces belong to the pattern, e.g. "*.{js,ts},*.css".
+// Malformed patterns are logged and skipped.
+func parsePatterns(patterns string) PatternSet {
+	var set PatternSet
+	for _, p := range splitPatterns(patterns) {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		pattern, err := CompilePattern(filepath.ToSlash(p))
+		if err != nil {
+			logger.Warnf("Ignoring pattern: %v", err)
+			continue
 		}
+		set.patterns = append(set.patterns, pattern)
 	}
+	return set
+}
 
+// SplitPatterns splits a comma-separated list of patterns, e.g.
+// "*.{js,ts}, *.css", on the commas outside braces, trims the patterns and
+// drops the empty ones
+func SplitPatterns(patterns string) []string {
+	var result []string
+	for _, p := range splitPatterns(patterns) {
+		if p = strings.TrimSpace(p); p != "" {
+			result = append(result, p)
+		}
+	}
 	return result
 }
 
+// splitPatterns splits a comma-separated list of patterns on the commas
+// outside braces
+func splitPatterns(patterns string) []string {
+	var result []string
+	depth, start := 0, 0
+	for i := 0; i < len(patterns); i++ {
+		switch patterns[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+		case ',':
+			if depth == 0 {
+				result = append(result, patterns[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(result, patterns[start:])
+}
+
 // parseEvents converts a comma-separated string of event types to a map
 func parseEvents(events string) map[fsnotify.Op]bool {
 	result := make(map[fsnotify.Op]bool)
@@ -331,6 +310,12 @@ func parseEvents(events string) map[fsnotify.Op]bool {
 			result[fsnotify.Rename] = true
 		case "chmod":
 			result[fsnotify.Chmod] = true
+		case "move":
+			result[OpMove] = true
+		case "overflow":
+			result[OpOverflow] = true
+		case "exec":
+			result[OpExec] = true
 		}
 	}
 
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package blink
+
+import "os"
+
+// fileID returns zero, inode and device numbers are not available on this platform
+func fileID(info os.FileInfo) (inode, device uint64) {
+	return 0, 0
+}
@@ -0,0 +1,125 @@
+package blink
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// TestNewEventMetadata tests that NewEvent fills in paths and file metadata
+func TestNewEventMetadata(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "sub", "file.txt")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	event := NewEvent(fsnotify.Event{Name: path, Op: fsnotify.Write}, root)
+
+	if event.Name != path || event.Root != root || event.RelPath != "sub/file.txt" {
+		t.Errorf("Unexpected paths: name=%s root=%s rel=%s", event.Name, event.Root, event.RelPath)
+	}
+	if event.IsDir || event.Size != 5 || event.Mode.Perm() != 0644 {
+		t.Errorf("Unexpected metadata: isDir=%v size=%d mode=%s", event.IsDir, event.Size, event.Mode)
+	}
+	if event.ModTime.IsZero() || event.Timestamp.IsZero() {
+		t.Errorf("Expected mtime and timestamp to be set")
+	}
+
+	// Removed files keep their paths but have no metadata
+	removed := NewEvent(fsnotify.Event{Name: filepath.Join(root, "gone.txt"), Op: fsnotify.Remove}, root)
+	if removed.RelPath != "gone.txt" || removed.Size != 0 || removed.Mode != 0 || removed.Inode != 0 {
+		t.Errorf("Unexpected event for removed file: %+v", removed)
+	}
+}
+
+// TestEventJSON tests the canonical JSON encoding and that it round-trips
+func TestEventJSON(t *testing.T) {
+	timestamp := time.Date(2025, 3, 1, 12, 0, 0, 123456789, time.UTC)
+	event := Event{
+		ID:        42,
+		Name:      "/src/new.go",
+		Op:        fsnotify.Rename,
+		Timestamp: timestamp,
+		Root:      "/src",
+		RootName:  "src",
+		RelPath:   "new.go",
+		OldName:   "/src/old.go",
+		Size:      128,
+		Mode:      0644,
+		ModTime:   timestamp.Add(-time.Second),
+		Inode:     7,
+		Device:    3,
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("Failed to marshal event: %v", err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("Failed to decode JSON: %v", err)
+	}
+	expected := map[string]interface{}{
+		"id":        float64(42),
+		"op":        "rename",
+		"path":      "/src/new.go",
+		"rel_path":  "new.go",
+		"old_path":  "/src/old.go",
+		"root":      "/src",
+		"root_name": "src",
+		"timestamp": "2025-03-01T12:00:00.123456789Z",
+		"is_dir":    false,
+		"size":      float64(128),
+		"mode":      "-rw-r--r--",
+		"inode":     float64(7),
+		"device":    float64(3),
+	}
+	for key, want := range expected {
+		if fields[key] != want {
+			t.Errorf("Field %s = %v, want %v", key, fields[key], want)
+		}
+	}
+
+	var decoded Event
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to unmarshal event: %v", err)
+	}
+	if !decoded.Timestamp.Equal(event.Timestamp) || !decoded.ModTime.Equal(event.ModTime) {
+		t.Errorf("Timestamps did not round-trip: %+v", decoded)
+	}
+	decoded.Timestamp, decoded.ModTime = event.Timestamp, event.ModTime
+	if decoded != event {
+		t.Errorf("Event did not round-trip:\n got %+v\nwant %+v", decoded, event)
+	}
+}
+
+// TestParseFileMode tests that file modes survive the string encoding
+func TestParseFileMode(t *testing.T) {
+	modes := []os.FileMode{0644, 0755 | os.ModeDir, 0777 | os.ModeSymlink, 0600 | os.ModeSetuid}
+	for _, mode := range modes {
+		if got := parseFileMode(mode.String()); got != mode {
+			t.Errorf("parseFileMode(%q) = %v, want %v", mode.String(), got, mode)
+		}
+	}
+}
+
+// BenchmarkEventMarshal benchmarks encoding an event to JSON
+func BenchmarkEventMarshal(b *testing.B) {
+	event := Event{ID: 1, Name: "/test/file.txt", Op: fsnotify.Write, Timestamp: time.Now(), Root: "/test", RelPath: "file.txt", Size: 10, Mode: 0644}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(event); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package blink
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID returns the inode and device numbers of a file
+func fileID(info os.FileInfo) (inode, device uint64) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino), uint64(stat.Dev)
+	}
+	return 0, 0
+}
@@ -0,0 +1,558 @@
+package blink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TFMV/blink/pkg/logger"
+	"github.com/TFMV/blink/pkg/metrics"
+	"github.com/fsnotify/fsnotify"
+)
+
+// OpExec is the operation of the events that report on the commands of
+// actions: a run starting, a line of its output, and its exit. Their Name is
+// the working directory of the command and Exec holds the details. Like
+// OpMove, it uses a bit fsnotify leaves free.
+const OpExec fsnotify.Op = 1 << 18
+
+// ExecMode decides what happens when files change while the command of an
+// action is still running
+type ExecMode string
+
+const (
+	// ExecQueue runs the command again once the current run has finished,
+	// for all the changes in the meantime
+	ExecQueue ExecMode = "queue"
+	// ExecCancel kills the current run and starts a new one
+	ExecCancel ExecMode = "cancel"
+	// ExecRestart is ExecCancel for long-running commands such as servers,
+	// which are also started as soon as the action is
+	ExecRestart ExecMode = "restart"
+)
+
+// ParseExecMode converts a string to an ExecMode. "cancel-previous" is
+// accepted for ExecCancel.
+func ParseExecMode(mode string) (ExecMode, error) {
+	switch ExecMode(strings.ToLower(strings.TrimSpace(mode))) {
+	case "", ExecQueue:
+		return ExecQueue, nil
+	case ExecCancel, "cancel-previous":
+		return ExecCancel, nil
+	case ExecRestart:
+		return ExecRestart, nil
+	default:
+		return "", fmt.Errorf("unknown exec mode: %q", mode)
+	}
+}
+
+// Statuses of the runs of an action, see ExecInfo
+const (
+	ExecStarted = "started"
+	ExecOutput  = "output"
+	ExecExited  = "exited"
+)
+
+// ExecInfo describes what happened to the command of an action, see OpExec
+type ExecInfo struct {
+	// Action is the name of the action
+	Action string
+	// Run numbers the runs of the action, from 1
+	Run uint64
+	// Status is ExecStarted, ExecOutput or ExecExited
+	Status string
+	// Stream is "stdout" or "stderr" for output
+	Stream string
+	// Line is a line of output, without its line ending
+	Line string
+	// ExitCode is the exit status of an exited command, -1 if it was killed
+	// by a signal or could not be started
+	ExitCode int
+	// Duration is how long an exited command ran
+	Duration time.Duration
+	// Error explains why a command could not be started or did not exit
+	// normally
+	Error string
+}
+
+// Defaults of ActionConfig
+const (
+	defaultExecDebounce    = 100 * time.Millisecond
+	defaultExecStopTimeout = 5 * time.Second
+)
+
+// Longest line of output sent in a single event, longer lines are split
+const maxExecLine = 4096
+
+// ActionConfig defines a command run when files change
+type ActionConfig struct {
+	// Name identifies the action in events and logs, defaults to the command
+	Name string
+	// Command is the program and its arguments or, with Shell, a command
+	// line. Placeholders are replaced with the changed files, see expandArgs.
+	Command []string
+	// Shell runs Command, joined with spaces, with /bin/sh -c (cmd /C on
+	// Windows), quoting the replaced placeholders
+	Shell bool
+	// Dir is the working directory of the command, the current one if empty
+	Dir string
+	// Env holds "KEY=value" entries added to the environment of blink
+	Env []string
+	// Roots restricts the action to the events of some watch roots, by name
+	Roots []string
+	// Patterns and event types of the events that trigger the action, with
+	// the syntax of those of RootConfig
+	IncludePatterns []string
+	ExcludePatterns []string
+	IncludeEvents   []string
+	IgnoreEvents    []string
+	// Filter is a filter expression for the events, see Expr
+	Filter string
+	// Debounce is how long the action waits for the changes to settle
+	// before running its command
+	Debounce time.Duration
+	// Mode decides what happens to a run still in progress, ExecQueue by
+	// default
+	Mode ExecMode
+	// StopTimeout is how long a command asked to exit with SIGTERM gets
+	// before its process group is killed
+	StopTimeout time.Duration
+	// Stdout and Stderr receive a copy of the command's output, if set.
+	// Every line is also published as an event.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// ExecRunner runs the commands of actions when the events they accept
+// arrive, and publishes their output and exit status as OpExec events
+type ExecRunner struct {
+	actions []*execAction
+
+	// Lifetime of the actions, canceled by Close
+	ctx    context.Context
+	cancel context.CancelFunc
+	loops  sync.WaitGroup
+}
+
+// execAction is an action and the events waiting for its next run
+type execAction struct {
+	ActionConfig
+	publish func(Event)
+	roots   map[string]bool // nil for all roots
+	filter  *EventFilter    // nil for all events
+	runs    uint64          // only used by loop
+
+	// Changed files by path, in the order they first changed, protected by mu
+	pending []Event
+	seen    map[string]int
+	mu      sync.Mutex
+
+	// Signals loop that pending has grown
+	wake chan struct{}
+}
+
+// execRun is a run of the command of an action
+type execRun struct {
+	cmd      *exec.Cmd
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewExecRunner validates the actions and creates a runner that publishes
+// the events of their commands with publish, which must be safe for
+// concurrent use. Nothing runs until Start is called.
+func NewExecRunner(configs []ActionConfig, publish func(Event)) (*ExecRunner, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &ExecRunner{ctx: ctx, cancel: cancel}
+
+	for i, config := range configs {
+		if len(config.Command) == 0 || config.Command[0] == "" {
+			cancel()
+			return nil, fmt.Errorf("action %d has no command", i+1)
+		}
+		if config.Name == "" {
+			config.Name = strings.Join(config.Command, " ")
+		}
+		mode, err := ParseExecMode(string(config.Mode))
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("invalid mode for action %q: %w", config.Name, err)
+		}
+		config.Mode = mode
+		filter, err := compileEventFilter(config.IncludePatterns, config.ExcludePatterns,
+			config.IncludeEvents, config.IgnoreEvents, config.Filter)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("invalid filter for action %q: %w", config.Name, err)
+		}
+		if config.Dir == "" {
+			if config.Dir, err = os.Getwd(); err != nil {
+				cancel()
+				return nil, fmt.Errorf("error getting current working directory: %w", err)
+			}
+		}
+		if config.Debounce == 0 {
+			config.Debounce = defaultExecDebounce
+		}
+		if config.StopTimeout == 0 {
+			config.StopTimeout = defaultExecStopTimeout
+		}
+
+		action := &execAction{
+			ActionConfig: config,
+			publish:      publish,
+			filter:       filter,
+			seen:         make(map[string]int),
+			wake:         make(chan struct{}, 1),
+		}
+		if len(config.Roots) > 0 {
+			action.roots = make(map[string]bool, len(config.Roots))
+			for _, root := range config.Roots {
+				action.roots[root] = true
+			}
+		}
+		r.actions = append(r.actions, action)
+	}
+	return r, nil
+}
+
+// Start starts the actions, and the commands of those in ExecRestart mode
+func (r *ExecRunner) Start() {
+	for _, action := range r.actions {
+		r.loops.Add(1)
+		go func() {
+			defer r.loops.Done()
+			action.loop(r.ctx)
+		}()
+	}
+}
+
+// HandleEvent hands an event to the actions that accept it. It never
+// blocks; the events of an action are coalesced by path until it runs.
+func (r *ExecRunner) HandleEvent(event Event) {
+	// Actions never trigger on the output of commands
+	if event.Op&OpExec != 0 {
+		return
+	}
+	for _, action := range r.actions {
+		action.handle(event)
+	}
+}
+
+// Close stops the actions, terminating the commands still running, and
+// waits for them to exit. If ctx expires first, ctx.Err() is returned.
+func (r *ExecRunner) Close(ctx context.Context) error {
+	r.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		r.loops.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handle queues an event for the next run if the action accepts it
+func (a *execAction) handle(event Event) {
+	if a.roots != nil && !a.roots[event.RootName] {
+		return
+	}
+	if a.filter != nil && !a.filter.ShouldProcessEvent(event) {
+		return
+	}
+
+	a.mu.Lock()
+	if i, ok := a.seen[event.Name]; ok {
+		a.pending[i] = event
+	} else {
+		a.seen[event.Name] = len(a.pending)
+		a.pending = append(a.pending, event)
+	}
+	a.mu.Unlock()
+
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// takePending returns the events waiting for the next run and forgets them
+func (a *execAction) takePending() []Event {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	events := a.pending
+	a.pending = nil
+	clear(a.seen)
+	return events
+}
+
+// loop runs the command once the changes have settled for the debounce
+// duration, according to the mode, until ctx is canceled
+func (a *execAction) loop(ctx context.Context) {
+	var current *execRun
+	// A run is due as soon as the current one has exited
+	due := false
+
+	timer := time.NewTimer(a.Debounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	if a.Mode == ExecRestart {
+		current = a.start(nil)
+	}
+
+	for {
+		var exited chan struct{}
+		if current != nil {
+			exited = current.done
+		}
+
+		select {
+		case <-a.wake:
+			timer.Reset(a.Debounce)
+		case <-timer.C:
+			switch {
+			case current == nil:
+				current = a.start(a.takePending())
+			case a.Mode == ExecQueue:
+				due = true
+			default:
+				due = true
+				current.stop(a.StopTimeout)
+			}
+		case <-exited:
+			current = nil
+			if due {
+				due = false
+				current = a.start(a.takePending())
+			}
+		case <-ctx.Done():
+			if current != nil {
+				current.stop(a.StopTimeout)
+				<-current.done
+			}
+			return
+		}
+	}
+}
+
+// start starts the command for the changed files and publishes its events
+// until it exits
+func (a *execAction) start(events []Event) *execRun {
+	a.runs++
+	info := ExecInfo{Action: a.Name, Run: a.runs}
+
+	args := expandArgs(a.Command, events, a.Shell)
+	var cmd *exec.Cmd
+	if a.Shell {
+		cmd = shellCommand(strings.Join(args, " "))
+	} else {
+		cmd = exec.Command(args[0], args[1:]...)
+	}
+	cmd.Dir = a.Dir
+	if len(a.Env) > 0 {
+		cmd.Env = append(os.Environ(), a.Env...)
+	}
+	setProcessGroup(cmd)
+	// Children that inherited the output must not keep Wait from returning
+	cmd.WaitDelay = a.StopTimeout
+
+	stdout := a.outputWriter(info, "stdout")
+	stderr := a.outputWriter(info, "stderr")
+	cmd.Stdout = teeWriter(a.Stdout, stdout)
+	cmd.Stderr = teeWriter(a.Stderr, stderr)
+
+	run := &execRun{cmd: cmd, done: make(chan struct{})}
+	started := time.Now()
+	if err := cmd.Start(); err != nil {
+		logger.Errorf("Action %s failed to start: %v", a.Name, err)
+		metrics.ExecRuns.WithLabelValues(a.Name, "failure").Inc()
+		info.Status, info.ExitCode, info.Error = ExecExited, -1, err.Error()
+		a.emit(info)
+		close(run.done)
+		return run
+	}
+	logger.Infof("Action %s started (run %d)", a.Name, info.Run)
+	info.Status = ExecStarted
+	a.emit(info)
+
+	go func() {
+		defer close(run.done)
+		err := cmd.Wait()
+		stdout.flush()
+		stderr.flush()
+
+		info.Status = ExecExited
+		info.Duration = time.Since(started)
+		info.ExitCode = cmd.ProcessState.ExitCode()
+		var exitErr *exec.ExitError
+		if err != nil && (!errors.As(err, &exitErr) || info.ExitCode < 0) {
+			info.Error = err.Error()
+		}
+
+		if err != nil {
+			logger.Warnf("Action %s failed after %v: %v", a.Name, info.Duration.Round(time.Millisecond), err)
+			metrics.ExecRuns.WithLabelValues(a.Name, "failure").Inc()
+		} else {
+			logger.Infof("Action %s succeeded after %v", a.Name, info.Duration.Round(time.Millisecond))
+			metrics.ExecRuns.WithLabelValues(a.Name, "success").Inc()
+		}
+		a.emit(info)
+	}()
+	return run
+}
+
+// stop asks the command to exit, and kills its process group if it is
+// still running after timeout
+func (r *execRun) stop(timeout time.Duration) {
+	r.stopOnce.Do(func() {
+		if r.cmd.Process == nil {
+			return
+		}
+		terminateProcessGroup(r.cmd)
+		go func() {
+			select {
+			case <-r.done:
+			case <-time.After(timeout):
+				killProcessGroup(r.cmd)
+			}
+		}()
+	})
+}
+
+// outputWriter returns a writer that publishes every line written to it as
+// output of the given stream
+func (a *execAction) outputWriter(info ExecInfo, stream string) *lineWriter {
+	info.Status, info.Stream = ExecOutput, stream
+	return &lineWriter{emit: func(line string) {
+		info.Line = line
+		a.emit(info)
+	}}
+}
+
+// emit publishes an event about the command
+func (a *execAction) emit(info ExecInfo) {
+	a.publish(Event{
+		Name:      a.Dir,
+		Op:        OpExec,
+		Timestamp: time.Now(),
+		Exec:      &info,
+	})
+}
+
+// teeWriter returns a writer that writes to both writers, or to the second
+// if the first is nil
+func teeWriter(copy io.Writer, w io.Writer) io.Writer {
+	if copy == nil {
+		return w
+	}
+	return io.MultiWriter(copy, w)
+}
+
+// lineWriter calls emit for every line written to it. It is not safe for
+// concurrent use, exec.Cmd copies each stream from a single goroutine.
+type lineWriter struct {
+	emit func(line string)
+	buf  []byte
+}
+
+// Write emits the complete lines of p, and buffers the rest
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	rest := w.buf
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(string(bytes.TrimSuffix(rest[:i], []byte("\r"))))
+		rest = rest[i+1:]
+	}
+	for len(rest) >= maxExecLine {
+		w.emit(string(rest[:maxExecLine]))
+		rest = rest[maxExecLine:]
+	}
+	w.buf = w.buf[:copy(w.buf, rest)]
+	return len(p), nil
+}
+
+// flush emits the last line if it did not end with a newline
+func (w *lineWriter) flush() {
+	if len(w.buf) > 0 {
+		w.emit(string(w.buf))
+		w.buf = w.buf[:0]
+	}
+}
+
+// expandArgs replaces the placeholders in the arguments of a command with
+// the changed files, the last of which is the most recent:
+//
+//	{path}       absolute path of the last changed file
+//	{rel_path}   its path relative to its watch root
+//	{paths}      absolute paths of all changed files
+//	{rel_paths}  their paths relative to their watch roots
+//	{op}         operation of the last change, e.g. "write"
+//	{root}       name of the watch root of the last change
+//
+// An argument that is just {paths} or {rel_paths} becomes one argument per
+// file, elsewhere the paths are separated by spaces. For shell commands
+// every replaced value is quoted. Placeholders expand to nothing when the
+// command runs without changes, e.g. when a restarted command first starts.
+func expandArgs(args []string, events []Event, shell bool) []string {
+	var paths, relPaths []string
+	var last Event
+	for _, event := range events {
+		paths = append(paths, event.Name)
+		relPaths = append(relPaths, event.RelPath)
+		last = event
+	}
+
+	quote := func(words ...string) string {
+		if !shell {
+			return strings.Join(words, " ")
+		}
+		quoted := make([]string, len(words))
+		for i, word := range words {
+			quoted[i] = shellQuote(word)
+		}
+		return strings.Join(quoted, " ")
+	}
+	var op string
+	if len(events) > 0 {
+		op = last.OpString()
+	}
+	replacer := strings.NewReplacer(
+		"{path}", quote(last.Name),
+		"{rel_path}", quote(last.RelPath),
+		"{paths}", quote(paths...),
+		"{rel_paths}", quote(relPaths...),
+		"{op}", quote(op),
+		"{root}", quote(last.RootName),
+	)
+
+	expanded := make([]string, 0, len(args))
+	for _, arg := range args {
+		switch {
+		case arg == "{paths}" && !shell:
+			expanded = append(expanded, paths...)
+		case arg == "{rel_paths}" && !shell:
+			expanded = append(expanded, relPaths...)
+		default:
+			expanded = append(expanded, replacer.Replace(arg))
+		}
+	}
+	return expanded
+}
@@ -0,0 +1,32 @@
+//go:build !unix
+
+package blink
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// shellCommand returns a command that runs a line with cmd.exe
+func shellCommand(line string) *exec.Cmd {
+	return exec.Command("cmd", "/C", line)
+}
+
+// shellQuote quotes a word for cmd.exe
+func shellQuote(word string) string {
+	return `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+}
+
+// setProcessGroup does nothing, process groups are only used on Unix
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// terminateProcessGroup kills the command, there is no gentler way on this
+// platform
+func terminateProcessGroup(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
+
+// killProcessGroup kills the command, its children are left running
+func killProcessGroup(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
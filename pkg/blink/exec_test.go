@@ -0,0 +1,230 @@
+package blink
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// TestExpandArgs tests placeholder substitution in commands
+func TestExpandArgs(t *testing.T) {
+	events := []Event{
+		{Name: "/src/a.go", RelPath: "a.go", Op: fsnotify.Write, RootName: "api"},
+		{Name: "/src/it's.go", RelPath: "it's.go", Op: fsnotify.Create, RootName: "api"},
+	}
+
+	tests := []struct {
+		args   []string
+		events []Event
+		shell  bool
+		want   []string
+	}{
+		{[]string{"gofmt", "-l", "{paths}"}, events, false, []string{"gofmt", "-l", "/src/a.go", "/src/it's.go"}},
+		{[]string{"lint", "{rel_paths}", "--"}, events, false, []string{"lint", "a.go", "it's.go", "--"}},
+		{[]string{"echo", "{op}:{root}:{rel_path}"}, events, false, []string{"echo", "create:api:it's.go"}},
+		{[]string{"echo", "files={rel_paths}"}, events, false, []string{"echo", "files=a.go it's.go"}},
+		{[]string{"echo", "{paths}", "{path}"}, nil, false, []string{"echo", ""}},
+		{[]string{"echo {rel_paths}"}, events, true, []string{`echo 'a.go' 'it'\''s.go'`}},
+		{[]string{"echo", "{path}"}, nil, true, []string{"echo", "''"}},
+	}
+
+	for _, tt := range tests {
+		got := expandArgs(tt.args, tt.events, tt.shell)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expandArgs(%q, shell %v) = %q, want %q", tt.args, tt.shell, got, tt.want)
+		}
+	}
+}
+
+// TestLineWriter tests splitting command output into lines
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	w := &lineWriter{emit: func(line string) { lines = append(lines, line) }}
+
+	w.Write([]byte("one\r\ntw"))
+	w.Write([]byte("o\n\nthree"))
+	w.Write([]byte(strings.Repeat("x", maxExecLine+1)))
+	w.flush()
+
+	want := []string{"one", "two", "", "three" + strings.Repeat("x", maxExecLine-5), "xxxxxx"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("Unexpected lines: %q", lines)
+	}
+}
+
+// TestExecEventJSON tests that exec events survive the wire format
+func TestExecEventJSON(t *testing.T) {
+	event := Event{ID: 7, Name: "/src", Op: OpExec, Exec: &ExecInfo{
+		Action: "test", Run: 2, Status: ExecExited, ExitCode: 0, Duration: 1500 * time.Millisecond,
+	}}
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if !strings.Contains(string(data), `"op":"exec"`) || !strings.Contains(string(data), `"exit_code":0`) {
+		t.Errorf("Unexpected encoding: %s", data)
+	}
+
+	var decoded Event
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if decoded.Op != OpExec || decoded.Exec == nil || *decoded.Exec != *event.Exec {
+		t.Errorf("Round trip changed the event: %+v", decoded.Exec)
+	}
+}
+
+// execRecorder collects the events published by an ExecRunner
+type execRecorder chan ExecInfo
+
+func (r execRecorder) publish(event Event) {
+	r <- *event.Exec
+}
+
+// next returns the next event with the given status, skipping the others
+func (r execRecorder) next(t *testing.T, status string) ExecInfo {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case info := <-r:
+			if info.Status == status {
+				return info
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for a %s event", status)
+		}
+	}
+}
+
+// newTestRunner starts a runner with a single shell action
+func newTestRunner(t *testing.T, config ActionConfig) (*ExecRunner, execRecorder) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("Shell commands are written for /bin/sh")
+	}
+	config.Shell = true
+	if config.Debounce == 0 {
+		config.Debounce = 20 * time.Millisecond
+	}
+	recorder := make(execRecorder, 100)
+	runner, err := NewExecRunner([]ActionConfig{config}, recorder.publish)
+	if err != nil {
+		t.Fatalf("NewExecRunner failed: %v", err)
+	}
+	runner.Start()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := runner.Close(ctx); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+	})
+	return runner, recorder
+}
+
+// TestExecRunnerQueue tests that changes are debounced, filtered, and
+// queued while a run is in progress
+func TestExecRunnerQueue(t *testing.T) {
+	runner, recorder := newTestRunner(t, ActionConfig{
+		Name:            "lint",
+		Command:         []string{"sleep 0.2; echo {rel_paths}; exit 3"},
+		IncludePatterns: []string{"*.go"},
+	})
+
+	runner.HandleEvent(Event{Name: "/src/a.go", RelPath: "a.go", Op: fsnotify.Write})
+	runner.HandleEvent(Event{Name: "/src/a.go", RelPath: "a.go", Op: fsnotify.Write})
+	runner.HandleEvent(Event{Name: "/src/a.txt", RelPath: "a.txt", Op: fsnotify.Write})
+	if info := recorder.next(t, ExecStarted); info.Run != 1 || info.Action != "lint" {
+		t.Fatalf("Unexpected start: %+v", info)
+	}
+
+	// Changes during the run are coalesced into the next one
+	runner.HandleEvent(Event{Name: "/src/b.go", RelPath: "b.go", Op: fsnotify.Write})
+	runner.HandleEvent(Event{Name: "/src/c.go", RelPath: "c.go", Op: fsnotify.Create})
+
+	if info := recorder.next(t, ExecOutput); info.Line != "a.go" || info.Stream != "stdout" {
+		t.Errorf("Unexpected output of run 1: %+v", info)
+	}
+	if info := recorder.next(t, ExecExited); info.Run != 1 || info.ExitCode != 3 || info.Error != "" {
+		t.Errorf("Unexpected exit of run 1: %+v", info)
+	}
+	recorder.next(t, ExecStarted)
+	if info := recorder.next(t, ExecOutput); info.Run != 2 || info.Line != "b.go c.go" {
+		t.Errorf("Unexpected output of run 2: %+v", info)
+	}
+}
+
+// TestExecRunnerRestart tests that restarted commands start at once, and
+// that their whole process group is stopped on changes and on Close
+func TestExecRunnerRestart(t *testing.T) {
+	runner, recorder := newTestRunner(t, ActionConfig{
+		Command:     []string{"echo up >&2; sleep 30 & wait"},
+		Mode:        ExecRestart,
+		StopTimeout: time.Second,
+	})
+
+	recorder.next(t, ExecStarted)
+	if info := recorder.next(t, ExecOutput); info.Line != "up" || info.Stream != "stderr" {
+		t.Errorf("Unexpected output: %+v", info)
+	}
+
+	runner.HandleEvent(Event{Name: "/src/main.go", RelPath: "main.go", Op: fsnotify.Write})
+	info := recorder.next(t, ExecExited)
+	if info.Run != 1 || info.ExitCode != -1 || info.Error == "" {
+		t.Errorf("Unexpected exit of the first run: %+v", info)
+	}
+	// Had the orphaned sleep kept the output open, Wait would have waited
+	// for the stop timeout
+	if info.Duration > 900*time.Millisecond {
+		t.Errorf("The first run took %v to stop", info.Duration)
+	}
+	if info := recorder.next(t, ExecStarted); info.Run != 2 {
+		t.Errorf("Unexpected restart: %+v", info)
+	}
+}
+
+// TestNewExecRunnerErrors tests that invalid actions are rejected
+func TestNewExecRunnerErrors(t *testing.T) {
+	bad := []ActionConfig{
+		{},
+		{Command: []string{"true"}, Mode: "sometimes"},
+		{Command: []string{"true"}, IncludePatterns: []string{"[bad"}},
+		{Command: []string{"true"}, IncludeEvents: []string{"explode"}},
+		{Command: []string{"true"}, Filter: "size <"},
+	}
+	for _, config := range bad {
+		if _, err := NewExecRunner([]ActionConfig{config}, func(Event) {}); err == nil {
+			t.Errorf("NewExecRunner accepted %+v", config)
+		}
+	}
+}
+
+// TestEventFilterExecEvents tests that exec events are filtered by type only
+func TestEventFilterExecEvents(t *testing.T) {
+	event := Event{Name: "/src", Op: OpExec, Exec: &ExecInfo{Action: "test", Status: ExecStarted}}
+
+	filter := NewEventFilter()
+	filter.SetIncludePatterns("*.go")
+	if err := filter.SetExpression(`size > 1MB`); err != nil {
+		t.Fatalf("SetExpression failed: %v", err)
+	}
+	if !filter.ShouldProcessEvent(event) {
+		t.Error("Expected patterns and expressions not to apply to exec events")
+	}
+
+	filter.SetIncludeEvents("write")
+	if filter.ShouldProcessEvent(event) {
+		t.Error("Expected exec events to be filtered by type")
+	}
+	filter.SetIncludeEvents("write,exec")
+	if !filter.ShouldProcessEvent(event) {
+		t.Error("Expected exec events to be included by type")
+	}
+}
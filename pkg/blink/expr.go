@@ -0,0 +1,686 @@
+package blink
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ErrBadExpression is returned for malformed filter expressions
+var ErrBadExpression = errors.New("invalid filter expression")
+
+// Expr is a compiled filter expression, which selects events by their
+// path, operation and metadata, e.g.
+//
+//	op in [write,create] && ext == ".go" && size < 1MB && !path.matches("**/testdata/**")
+//
+// Expressions combine comparisons with &&, || and !, and parentheses.
+// The fields are:
+//
+//	path     the path relative to the watch root, e.g. "src/main.go"
+//	name     the base name, e.g. "main.go"
+//	ext      the extension including the dot, e.g. ".go"
+//	root     the name of the watch root
+//	op       the operation: create, write, remove, rename, chmod, move or overflow
+//	size     the file size, compared with sizes such as 512, 10KB or 1MiB
+//	age      the time since the file was modified, compared with durations such as 5m or 2d
+//	isDir    whether the file is a directory
+//
+// Strings compare with ==, != and in [...], match regular expressions with
+// =~ and !~, and have the methods matches (a glob, see Pattern), contains,
+// startsWith and endsWith. op compares with ==, != and in, and matches if
+// the event has any of the operations. Sizes and ages compare with ==, !=,
+// <, <=, > and >=; KB, MB and GB are powers of 1000, KiB, MiB and GiB
+// powers of 1024.
+//
+// An Expr is compiled once and safe for concurrent use; Match does not
+// allocate.
+type Expr struct {
+	text string
+	root *exprNode
+}
+
+// Kinds of expression nodes
+type exprKind int
+
+const (
+	exprAnd exprKind = iota
+	exprOr
+	exprNot
+	exprConst
+	exprIsDir
+	exprEqual
+	exprIn
+	exprContains
+	exprPrefix
+	exprSuffix
+	exprGlob
+	exprRegex
+	exprOp
+	exprSize
+	exprAge
+)
+
+// Fields of an event that expressions can refer to
+type exprField int
+
+const (
+	fieldPath exprField = iota
+	fieldName
+	fieldExt
+	fieldRoot
+	fieldOp
+	fieldSize
+	fieldAge
+	fieldIsDir
+)
+
+var exprFields = map[string]exprField{
+	"path":   fieldPath,
+	"name":   fieldName,
+	"ext":    fieldExt,
+	"root":   fieldRoot,
+	"op":     fieldOp,
+	"size":   fieldSize,
+	"age":    fieldAge,
+	"isDir":  fieldIsDir,
+	"is_dir": fieldIsDir,
+}
+
+// exprNode is a node of a compiled expression. All kinds share one struct,
+// so that evaluating needs neither interfaces nor allocations.
+type exprNode struct {
+	kind        exprKind
+	left, right *exprNode
+
+	field   exprField
+	cmp     string // Comparison operator of exprSize and exprAge
+	value   bool   // exprConst
+	str     string
+	strs    []string
+	num     int64
+	op      fsnotify.Op
+	pattern *Pattern
+	re      *regexp.Regexp
+}
+
+// CompileExpr compiles a filter expression, see Expr for the syntax
+func CompileExpr(text string) (*Expr, error) {
+	p := &exprParser{text: text}
+	p.next()
+	root, err := p.parseOr()
+	if err == nil {
+		err = p.err
+	}
+	if err == nil && p.tok.kind != tokEOF {
+		err = p.errorf("unexpected %s", p.tok)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadExpression, err)
+	}
+	return &Expr{text: text, root: root}, nil
+}
+
+// MustCompileExpr is like CompileExpr but panics on malformed expressions
+func MustCompileExpr(text string) *Expr {
+	x, err := CompileExpr(text)
+	if err != nil {
+		panic(err)
+	}
+	return x
+}
+
+// String returns the expression as it was given
+func (x *Expr) String() string {
+	return x.text
+}
+
+// Match reports whether an event satisfies the expression
+func (x *Expr) Match(event *Event) bool {
+	return x.root.eval(event)
+}
+
+// eval evaluates the node for an event
+func (n *exprNode) eval(e *Event) bool {
+	switch n.kind {
+	case exprAnd:
+		return n.left.eval(e) && n.right.eval(e)
+	case exprOr:
+		return n.left.eval(e) || n.right.eval(e)
+	case exprNot:
+		return !n.left.eval(e)
+	case exprConst:
+		return n.value
+	case exprIsDir:
+		return e.IsDir
+	case exprEqual:
+		return n.field.stringOf(e) == n.str
+	case exprIn:
+		s := n.field.stringOf(e)
+		for _, candidate := range n.strs {
+			if s == candidate {
+				return true
+			}
+		}
+		return false
+	case exprContains:
+		return strings.Contains(n.field.stringOf(e), n.str)
+	case exprPrefix:
+		return strings.HasPrefix(n.field.stringOf(e), n.str)
+	case exprSuffix:
+		return strings.HasSuffix(n.field.stringOf(e), n.str)
+	case exprGlob:
+		return n.pattern.Match(n.field.stringOf(e), e.IsDir)
+	case exprRegex:
+		return n.re.MatchString(n.field.stringOf(e))
+	case exprOp:
+		return e.Op&n.op != 0
+	case exprSize:
+		return compareInt(e.Size, n.cmp, n.num)
+	case exprAge:
+		age := int64(math.MaxInt64)
+		if !e.ModTime.IsZero() {
+			age = int64(time.Since(e.ModTime))
+		}
+		return compareInt(age, n.cmp, n.num)
+	}
+	return false
+}
+
+// stringOf returns the value of a string field of an event
+func (f exprField) stringOf(e *Event) string {
+	path := e.RelPath
+	if path == "" {
+		path = e.Name
+	}
+	switch f {
+	case fieldPath:
+		return path
+	case fieldName:
+		return path[strings.LastIndexByte(path, '/')+1:]
+	case fieldExt:
+		name := path[strings.LastIndexByte(path, '/')+1:]
+		if i := strings.LastIndexByte(name, '.'); i >= 0 {
+			return name[i:]
+		}
+		return ""
+	case fieldRoot:
+		return e.RootName
+	}
+	return ""
+}
+
+// compareInt compares two numbers with a comparison operator
+func compareInt(a int64, cmp string, b int64) bool {
+	switch cmp {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
+
+// Kinds of tokens
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokPunct
+)
+
+type exprToken struct {
+	kind tokenKind
+	text string // Unquoted for strings
+	pos  int
+}
+
+func (t exprToken) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// exprParser is a recursive descent parser that compiles an expression
+// while it parses it
+type exprParser struct {
+	text string
+	pos  int
+	tok  exprToken
+	err  error // Error of the lexer
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s at offset %d", fmt.Sprintf(format, args...), p.tok.pos)
+}
+
+// Punctuation, longest first
+var exprPuncts = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "(", ")", "[", "]", ",", ".", "!", "<", ">"}
+
+// next reads the next token
+func (p *exprParser) next() {
+	for p.pos < len(p.text) && unicode.IsSpace(rune(p.text[p.pos])) {
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.text) {
+		p.tok = exprToken{kind: tokEOF, pos: start}
+		return
+	}
+
+	c := p.text[p.pos]
+	switch {
+	case c == '"' || c == '\'':
+		// A backslash only escapes the quote and itself, so that regular
+		// expressions and globs such as "\.go$" need no double escaping
+		var b strings.Builder
+		for p.pos++; p.pos < len(p.text) && p.text[p.pos] != c; p.pos++ {
+			if p.text[p.pos] == '\\' && p.pos+1 < len(p.text) && (p.text[p.pos+1] == c || p.text[p.pos+1] == '\\') {
+				p.pos++
+			}
+			b.WriteByte(p.text[p.pos])
+		}
+		if p.pos >= len(p.text) {
+			p.tok = exprToken{kind: tokEOF, pos: start}
+			p.err = fmt.Errorf("unterminated string at offset %d", start)
+			return
+		}
+		p.pos++
+		p.tok = exprToken{kind: tokString, text: b.String(), pos: start}
+	case isIdentByte(c) && !('0' <= c && c <= '9'):
+		for p.pos < len(p.text) && isIdentByte(p.text[p.pos]) {
+			p.pos++
+		}
+		p.tok = exprToken{kind: tokIdent, text: p.text[start:p.pos], pos: start}
+	case '0' <= c && c <= '9':
+		// Numbers run on into their unit, e.g. 10KB or 1h30m
+		for p.pos < len(p.text) && (isIdentByte(p.text[p.pos]) || p.text[p.pos] == '.') {
+			p.pos++
+		}
+		p.tok = exprToken{kind: tokNumber, text: p.text[start:p.pos], pos: start}
+	default:
+		for _, punct := range exprPuncts {
+			if strings.HasPrefix(p.text[p.pos:], punct) {
+				p.pos += len(punct)
+				p.tok = exprToken{kind: tokPunct, text: punct, pos: start}
+				return
+			}
+		}
+		p.tok = exprToken{kind: tokPunct, text: string(c), pos: start}
+		p.err = fmt.Errorf("unexpected %q at offset %d", c, start)
+		p.pos = len(p.text)
+	}
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// is reports whether the current token is the given punctuation or keyword
+func (p *exprParser) is(text string) bool {
+	return (p.tok.kind == tokPunct || p.tok.kind == tokIdent) && p.tok.text == text
+}
+
+// expect consumes the given punctuation
+func (p *exprParser) expect(text string) error {
+	if p.err != nil {
+		return p.err
+	}
+	if !p.is(text) {
+		return p.errorf("expected %q, got %s", text, p.tok)
+	}
+	p.next()
+	return nil
+}
+
+func (p *exprParser) parseOr() (*exprNode, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.is("||") {
+		p.next()
+		var right *exprNode
+		if right, err = p.parseAnd(); err == nil {
+			left = &exprNode{kind: exprOr, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseAnd() (*exprNode, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.is("&&") {
+		p.next()
+		var right *exprNode
+		if right, err = p.parseUnary(); err == nil {
+			left = &exprNode{kind: exprAnd, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *exprParser) parseUnary() (*exprNode, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.is("!") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return not(operand), nil
+	}
+	if p.is("(") {
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	}
+	return p.parseComparison()
+}
+
+// parseComparison parses a comparison, method call or boolean
+func (p *exprParser) parseComparison() (*exprNode, error) {
+	if p.tok.kind != tokIdent {
+		return nil, p.errorf("expected a field, got %s", p.tok)
+	}
+	switch p.tok.text {
+	case "true", "false":
+		value := p.tok.text == "true"
+		p.next()
+		return &exprNode{kind: exprConst, value: value}, nil
+	}
+	field, ok := exprFields[p.tok.text]
+	if !ok {
+		return nil, p.errorf("unknown field %s", p.tok)
+	}
+	fieldTok := p.tok
+	p.next()
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	switch field {
+	case fieldIsDir:
+		return p.parseBool()
+	case fieldOp:
+		return p.parseOp()
+	case fieldSize, fieldAge:
+		return p.parseNumber(field)
+	}
+
+	// String fields
+	if p.is(".") {
+		p.next()
+		return p.parseMethod(field)
+	}
+	switch {
+	case p.is("==") || p.is("!="):
+		negate := p.tok.text == "!="
+		p.next()
+		s, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		return negated(&exprNode{kind: exprEqual, field: field, str: s}, negate), nil
+	case p.is("in"):
+		p.next()
+		strs, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNode{kind: exprIn, field: field, strs: strs}, nil
+	case p.is("=~") || p.is("!~"):
+		negate := p.tok.text == "!~"
+		p.next()
+		s, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %v", s, err)
+		}
+		return negated(&exprNode{kind: exprRegex, field: field, re: re}, negate), nil
+	}
+	return nil, fmt.Errorf("expected a comparison after %s at offset %d, got %s", fieldTok, p.tok.pos, p.tok)
+}
+
+// parseMethod parses a method call on a string field
+func (p *exprParser) parseMethod(field exprField) (*exprNode, error) {
+	if p.tok.kind != tokIdent {
+		return nil, p.errorf("expected a method, got %s", p.tok)
+	}
+	method := p.tok
+	p.next()
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	arg, err := p.parseString()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	node := &exprNode{field: field, str: arg}
+	switch method.text {
+	case "matches":
+		if node.pattern, err = CompilePattern(arg); err != nil {
+			return nil, err
+		}
+		node.kind = exprGlob
+	case "contains":
+		node.kind = exprContains
+	case "startsWith":
+		node.kind = exprPrefix
+	case "endsWith":
+		node.kind = exprSuffix
+	default:
+		return nil, fmt.Errorf("unknown method %s at offset %d", method, method.pos)
+	}
+	return node, nil
+}
+
+// parseBool parses what follows isDir: nothing, or a comparison with a boolean
+func (p *exprParser) parseBool() (*exprNode, error) {
+	node := &exprNode{kind: exprIsDir}
+	if !p.is("==") && !p.is("!=") {
+		return node, nil
+	}
+	negate := p.tok.text == "!="
+	p.next()
+	if !p.is("true") && !p.is("false") {
+		return nil, p.errorf("expected true or false, got %s", p.tok)
+	}
+	negate = negate != (p.tok.text == "false")
+	p.next()
+	return negated(node, negate), nil
+}
+
+// parseOp parses a comparison of op
+func (p *exprParser) parseOp() (*exprNode, error) {
+	var names []string
+	negate := false
+	switch {
+	case p.is("==") || p.is("!="):
+		negate = p.tok.text == "!="
+		p.next()
+		if p.tok.kind != tokIdent && p.tok.kind != tokString {
+			return nil, p.errorf("expected an operation, got %s", p.tok)
+		}
+		names = []string{p.tok.text}
+		p.next()
+	case p.is("in"):
+		p.next()
+		var err error
+		if names, err = p.parseList(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, p.errorf("expected ==, != or in after op, got %s", p.tok)
+	}
+	op, err := compileEventTypes(names)
+	if err != nil {
+		return nil, err
+	}
+	return negated(&exprNode{kind: exprOp, op: op}, negate), nil
+}
+
+// parseNumber parses a comparison of size or age
+func (p *exprParser) parseNumber(field exprField) (*exprNode, error) {
+	cmp := p.tok.text
+	switch {
+	case p.tok.kind != tokPunct:
+		return nil, p.errorf("expected a comparison, got %s", p.tok)
+	case cmp != "==" && cmp != "!=" && cmp != "<" && cmp != "<=" && cmp != ">" && cmp != ">=":
+		return nil, p.errorf("expected a comparison, got %s", p.tok)
+	}
+	p.next()
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.tok.kind != tokNumber {
+		return nil, p.errorf("expected a number, got %s", p.tok)
+	}
+
+	node := &exprNode{kind: exprSize, cmp: cmp}
+	var err error
+	if field == fieldAge {
+		node.kind = exprAge
+		var d time.Duration
+		d, err = parseAge(p.tok.text)
+		node.num = int64(d)
+	} else {
+		node.num, err = parseSize(p.tok.text)
+	}
+	if err != nil {
+		return nil, p.errorf("%v", err)
+	}
+	p.next()
+	return node, nil
+}
+
+// parseString parses a string literal
+func (p *exprParser) parseString() (string, error) {
+	if p.err != nil {
+		return "", p.err
+	}
+	if p.tok.kind != tokString {
+		return "", p.errorf("expected a string, got %s", p.tok)
+	}
+	s := p.tok.text
+	p.next()
+	return s, nil
+}
+
+// parseList parses a list of strings or bare words, e.g. [write, "create"]
+func (p *exprParser) parseList() ([]string, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	var items []string
+	for !p.is("]") {
+		if p.err != nil {
+			return nil, p.err
+		}
+		if p.tok.kind != tokIdent && p.tok.kind != tokString {
+			return nil, p.errorf("expected a list item, got %s", p.tok)
+		}
+		items = append(items, p.tok.text)
+		p.next()
+		if !p.is(",") {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, p.errorf("empty list")
+	}
+	return items, nil
+}
+
+func not(n *exprNode) *exprNode {
+	return &exprNode{kind: exprNot, left: n}
+}
+
+func negated(n *exprNode, negate bool) *exprNode {
+	if negate {
+		return not(n)
+	}
+	return n
+}
+
+// Units of sizes
+var sizeUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"KB":  1000,
+	"MB":  1000 * 1000,
+	"GB":  1000 * 1000 * 1000,
+	"TB":  1000 * 1000 * 1000 * 1000,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+	"TiB": 1 << 40,
+}
+
+// parseSize parses a size such as 512, 10KB or 1.5MiB
+func parseSize(s string) (int64, error) {
+	i := strings.IndexFunc(s, func(r rune) bool { return r != '.' && !unicode.IsDigit(r) })
+	if i < 0 {
+		i = len(s)
+	}
+	unit, ok := sizeUnits[s[i:]]
+	if !ok {
+		return 0, fmt.Errorf("unknown size unit %q", s[i:])
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || n*float64(unit) > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// parseAge parses a duration such as 30s or 1h30m, or a number of days such as 2d
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
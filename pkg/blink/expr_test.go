@@ -0,0 +1,127 @@
+package blink
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// TestExprMatch tests expressions against a set of events
+func TestExprMatch(t *testing.T) {
+	now := time.Now()
+	goFile := Event{Name: "/src/api/main.go", Op: fsnotify.Write, RootName: "api", RelPath: "api/main.go", Size: 2048, ModTime: now.Add(-time.Minute)}
+	fixture := Event{Name: "/src/api/testdata/big.go", Op: fsnotify.Create, RootName: "api", RelPath: "api/testdata/big.go", Size: 5 << 20, ModTime: now.Add(-48 * time.Hour)}
+	dir := Event{Name: "/src/docs", Op: fsnotify.Remove, RootName: "docs", RelPath: "docs", IsDir: true}
+
+	tests := []struct {
+		expr  string
+		event Event
+		want  bool
+	}{
+		{`op in [write,create] && ext == ".go" && size < 1MB && !path.matches("**/testdata/**")`, goFile, true},
+		{`op in [write,create] && ext == ".go" && size < 1MB && !path.matches("**/testdata/**")`, fixture, false},
+		{`op == write`, goFile, true},
+		{`op == "create"`, goFile, false},
+		{`op != remove`, dir, false},
+		{`name == "main.go"`, goFile, true},
+		{`name != 'main.go'`, goFile, false},
+		{`ext in [".go", ".mod"]`, goFile, true},
+		{`ext == ""`, dir, true},
+		{`root == "api"`, goFile, true},
+		{`root in [docs]`, goFile, false},
+		{`path =~ "^api/.*\.go$"`, goFile, true},
+		{`path !~ "test"`, fixture, false},
+		{`path.startsWith("api/") && name.endsWith(".go")`, goFile, true},
+		{`path.contains("testdata")`, fixture, true},
+		{`path.matches("api/*.go")`, fixture, false},
+		{`path.matches("docs/")`, dir, true},
+		{`size >= 5MiB`, fixture, true},
+		{`size > 5MiB`, fixture, false},
+		{`size == 2KiB`, goFile, true},
+		{`size <= 2KB`, goFile, false},
+		{`age < 5m`, goFile, true},
+		{`age > 1d`, fixture, true},
+		{`age < 1h30m`, fixture, false},
+		{`age < 1d`, dir, false},
+		{`isDir`, dir, true},
+		{`!isDir`, dir, false},
+		{`is_dir == false`, goFile, true},
+		{`isDir != true`, dir, false},
+		{`true && (false || isDir)`, dir, true},
+		{`!(op == write || op == create) || size == 0`, dir, true},
+		{`name == "a" || name == "main.go" && size < 1`, goFile, false},
+		{`name == "main.go" || name == "a" && size < 1`, goFile, true},
+	}
+
+	for _, tt := range tests {
+		expr, err := CompileExpr(tt.expr)
+		if err != nil {
+			t.Errorf("CompileExpr(%q) failed: %v", tt.expr, err)
+			continue
+		}
+		if got := expr.Match(&tt.event); got != tt.want {
+			t.Errorf("%s on %s = %v, want %v", tt.expr, tt.event.RelPath, got, tt.want)
+		}
+	}
+}
+
+// TestCompileExprErrors tests that malformed expressions are rejected
+func TestCompileExprErrors(t *testing.T) {
+	bad := []string{
+		``,
+		`op`,
+		`op == bogus`,
+		`op < write`,
+		`size < "big"`,
+		`size < 1XB`,
+		`age > soon`,
+		`age > 5`,
+		`name == main.go`,
+		`name < "a"`,
+		`name.matches("{a")`,
+		`name.explode("x")`,
+		`path =~ "("`,
+		`colour == "red"`,
+		`name == "unterminated`,
+		`ext in []`,
+		`(isDir`,
+		`isDir)`,
+		`isDir && `,
+		`isDir & isDir`,
+		`isDir == maybe`,
+		`name == "a" name == "b"`,
+	}
+	for _, expr := range bad {
+		if _, err := CompileExpr(expr); !errors.Is(err, ErrBadExpression) {
+			t.Errorf("CompileExpr(%q) = %v, want ErrBadExpression", expr, err)
+		}
+	}
+}
+
+// TestExprNoAllocs tests that matching does not allocate
+func TestExprNoAllocs(t *testing.T) {
+	expr := MustCompileExpr(`op in [write,create] && ext == ".go" && size < 1MB && !path.matches("**/testdata/**") && age < 1h && name =~ "^m"`)
+	event := Event{Name: "/src/api/main.go", Op: fsnotify.Write, RelPath: "api/main.go", Size: 10, ModTime: time.Now()}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		if !expr.Match(&event) {
+			t.Fatal("Expected the event to match")
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("Match allocated %v times, want 0", allocs)
+	}
+}
+
+// BenchmarkExprMatch benchmarks matching the example expression
+func BenchmarkExprMatch(b *testing.B) {
+	expr := MustCompileExpr(`op in [write,create] && ext == ".go" && size < 1MB && !path.matches("**/testdata/**")`)
+	event := Event{Name: "/src/api/main.go", Op: fsnotify.Write, RelPath: "api/main.go", Size: 10}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		expr.Match(&event)
+	}
+}
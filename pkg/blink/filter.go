@@ -49,8 +49,8 @@ var defaultDevExcludePatterns = []string{
 	// Rust
 	"target/", "Cargo.lock", "**/*.rs.bk",
 
-	// Go
-	"go.sum", "vendor/", "bin/", "pkg/",
+	// Go. pkg/ holds sources in most Go projects, so it is not excluded.
+	"go.sum", "vendor/", "bin/",
 
 	// .NET / C#
 	"bin/", "obj/", "*.suo", "*.user", "*.userosscache", "*.dbmdl",
@@ -92,8 +92,9 @@ var defaultDevExcludePatterns = []string{
 	// Jupyter Notebooks
 	".ipynb_checkpoints",
 
-	// Dependency directories for various languages
-	"lib/", "libs/", "lib64/", "vendor/", "third_party/",
+	// Dependency directories for various languages. lib/ is left out, as
+	// many projects keep their sources there.
+	"vendor/", "third_party/",
 
 	// Build artifacts
 	"dist/", "build/", "out/", "bin/", "obj/", "target/",
@@ -175,3 +175,46 @@ func TestDisableDefaultExcludes(t *testing.T) {
 		t.Fatal("Timed out waiting for events")
 	}
 }
+
+// TestEventFilterPatterns verifies that the event filter matches patterns
+// against the path relative to the event's root
+func TestEventFilterPatterns(t *testing.T) {
+	filter := blink.NewEventFilter()
+	filter.SetIncludePatterns("src/**/*.{go,mod}, *.md")
+	filter.SetExcludePatterns("testdata,[bad")
+
+	assert.Equal(t, []string{"src/**/*.{go,mod}", "*.md"}, filter.IncludePatterns())
+	assert.Equal(t, []string{"testdata"}, filter.ExcludePatterns())
+
+	tests := []struct {
+		relPath  string
+		expected bool
+	}{
+		{"src/main.go", true},
+		{"src/a/b/go.mod", true},
+		{"lib/src/main.go", false},
+		{"docs/README.md", true},
+		{"src/testdata/x.go", false},
+		{"src/main.c", false},
+	}
+	for _, tt := range tests {
+		event := blink.Event{Name: "/repo/" + tt.relPath, Root: "/repo", RelPath: tt.relPath, Op: fsnotify.Write}
+		assert.Equal(t, tt.expected, filter.ShouldProcessEvent(event), tt.relPath)
+	}
+}
+
+// TestEventFilterExpression verifies that events must satisfy the filter expression
+func TestEventFilterExpression(t *testing.T) {
+	filter := blink.NewEventFilter()
+	require.Error(t, filter.SetExpression("size <"))
+	require.NoError(t, filter.SetExpression(`op == write && size < 1KB`))
+	assert.Equal(t, `op == write && size < 1KB`, filter.Expression())
+
+	assert.True(t, filter.ShouldProcessEvent(blink.Event{Name: "/a/small.txt", Op: fsnotify.Write, Size: 10}))
+	assert.False(t, filter.ShouldProcessEvent(blink.Event{Name: "/a/big.txt", Op: fsnotify.Write, Size: 1 << 20}))
+	assert.False(t, filter.ShouldProcessEvent(blink.Event{Name: "/a/small.txt", Op: fsnotify.Create}))
+	assert.True(t, filter.ShouldProcessEvent(blink.Event{Name: "/a", Op: blink.OpOverflow}))
+
+	require.NoError(t, filter.SetExpression(""))
+	assert.True(t, filter.ShouldProcessEvent(blink.Event{Name: "/a/small.txt", Op: fsnotify.Create}))
+}
@@ -0,0 +1,376 @@
+package blink
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ErrBadPattern is returned for malformed glob patterns
+var ErrBadPattern = errors.New("syntax error in pattern")
+
+// Maximum number of alternatives a pattern may expand to, so that nested
+// braces cannot blow up
+const maxPatternAlternatives = 1024
+
+// Pattern is a compiled glob pattern, matched against slash-separated paths
+// relative to a watch root. The syntax is:
+//
+//	a*b     "*" matches any sequence of characters except "/"
+//	a?b     "?" matches any single character except "/"
+//	[a-z]   a character class, negated with [!a-z] or [^a-z]
+//	{a,b}   either alternative; alternatives may nest and contain any syntax
+//	**      as a whole path element, zero or more directories
+//	\c      the character c, e.g. \* or \{
+//
+// A pattern with a slash at the start or in the middle is anchored: it must
+// match the whole path, e.g. "src/*.go" matches "src/main.go" but not
+// "lib/src/main.go". Any other pattern only has to match the base name, so
+// "*.go" matches Go files at any depth. A trailing slash restricts a
+// pattern to directories, and a leading "!" negates it, see PatternSet.
+type Pattern struct {
+	text         string
+	alternatives []patternAlternative
+	negate       bool
+	dirOnly      bool
+}
+
+// patternAlternative is one expansion of the braces of a pattern
+type patternAlternative struct {
+	segments []patternSegment
+	anchored bool
+}
+
+// patternSegment matches a single path element, or any number of them
+type patternSegment struct {
+	literal  string // Matched as is, if glob is empty and globstar unset
+	glob     string // path.Match pattern
+	globstar bool   // "**"
+}
+
+// CompilePattern compiles a glob pattern, see Pattern for the syntax.
+func CompilePattern(pattern string) (*Pattern, error) {
+	return compilePattern(pattern, true)
+}
+
+// compilePattern compiles a glob pattern, with braces as alternatives or,
+// as in gitignore(5), as literal characters
+func compilePattern(pattern string, braces bool) (*Pattern, error) {
+	p := &Pattern{text: pattern}
+	if strings.HasPrefix(pattern, "!") {
+		p.negate = true
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		p.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return nil, fmt.Errorf("%w: %q is empty", ErrBadPattern, p.text)
+	}
+
+	expanded := []string{pattern}
+	if braces {
+		var err error
+		if expanded, err = expandBraces(pattern); err != nil {
+			return nil, fmt.Errorf("%w: %q: %v", ErrBadPattern, p.text, err)
+		}
+	}
+	for _, alternative := range expanded {
+		compiled, err := compileAlternative(alternative)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrBadPattern, p.text)
+		}
+		p.alternatives = append(p.alternatives, compiled)
+	}
+	return p, nil
+}
+
+// MustCompilePattern is like CompilePattern but panics on malformed patterns
+func MustCompilePattern(pattern string) *Pattern {
+	p, err := CompilePattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// String returns the pattern as it was given
+func (p *Pattern) String() string {
+	return p.text
+}
+
+// Negated reports whether the pattern starts with "!"
+func (p *Pattern) Negated() bool {
+	return p.negate
+}
+
+// Match reports whether the pattern, ignoring a leading "!", matches a
+// slash-separated path relative to the watch root. isDir tells whether
+// the path is a directory.
+func (p *Pattern) Match(name string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	name = strings.TrimPrefix(name, "/")
+	base := name[strings.LastIndexByte(name, '/')+1:]
+	for _, alternative := range p.alternatives {
+		if alternative.anchored {
+			if matchSegments(alternative.segments, name) {
+				return true
+			}
+		} else if matchSegments(alternative.segments, base) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileAlternative splits a pattern without braces into its segments
+func compileAlternative(pattern string) (patternAlternative, error) {
+	var alternative patternAlternative
+	if strings.Contains(pattern, "/") {
+		alternative.anchored = true
+		pattern = strings.TrimPrefix(pattern, "/")
+	}
+
+	for _, element := range strings.Split(pattern, "/") {
+		switch {
+		case element == "**":
+			// Consecutive globstars match the same as one
+			if n := len(alternative.segments); n > 0 && alternative.segments[n-1].globstar {
+				continue
+			}
+			alternative.segments = append(alternative.segments, patternSegment{globstar: true})
+		case strings.ContainsAny(element, `*?[\`):
+			glob := negateClasses(element)
+			if _, err := path.Match(glob, ""); err != nil {
+				return patternAlternative{}, err
+			}
+			alternative.segments = append(alternative.segments, patternSegment{glob: glob})
+		default:
+			alternative.segments = append(alternative.segments, patternSegment{literal: element})
+		}
+	}
+	return alternative, nil
+}
+
+// negateClasses rewrites "[!" to the "[^" understood by path.Match
+func negateClasses(glob string) string {
+	if !strings.Contains(glob, "[!") {
+		return glob
+	}
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		b.WriteByte(c)
+		switch {
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteByte(glob[i])
+		case c == '[' && i+1 < len(glob) && glob[i+1] == '!':
+			i++
+			b.WriteByte('^')
+		}
+	}
+	return b.String()
+}
+
+// expandBraces returns every alternative of a pattern, expanding its
+// braces from left to right
+func expandBraces(pattern string) ([]string, error) {
+	open, close, commas := -1, -1, []int(nil)
+	depth := 0
+scan:
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '{':
+			if depth == 0 {
+				open = i
+			}
+			depth++
+		case ',':
+			if depth == 1 {
+				commas = append(commas, i)
+			}
+		case '}':
+			if depth == 0 {
+				return nil, errors.New("unmatched '}'")
+			}
+			depth--
+			if depth == 0 {
+				close = i
+				break scan
+			}
+		}
+	}
+	if depth > 0 {
+		return nil, errors.New("unclosed '{'")
+	}
+	if open < 0 {
+		return []string{pattern}, nil
+	}
+
+	// Split the braces into their alternatives
+	prefix, suffix := pattern[:open], pattern[close+1:]
+	var options []string
+	start := open + 1
+	for _, comma := range commas {
+		options = append(options, pattern[start:comma])
+		start = comma + 1
+	}
+	options = append(options, pattern[start:close])
+
+	rests, err := expandBraces(suffix)
+	if err != nil {
+		return nil, err
+	}
+	var expanded []string
+	for _, option := range options {
+		heads, err := expandBraces(prefix + option)
+		if err != nil {
+			return nil, err
+		}
+		for _, head := range heads {
+			for _, rest := range rests {
+				expanded = append(expanded, head+rest)
+				if len(expanded) > maxPatternAlternatives {
+					return nil, fmt.Errorf("more than %d alternatives", maxPatternAlternatives)
+				}
+			}
+		}
+	}
+	return expanded, nil
+}
+
+// matchSegments reports whether the segments match the whole of a
+// slash-separated path
+func matchSegments(segments []patternSegment, name string) bool {
+	return matchSegmentsFrom(segments, name) == segmentsMatch
+}
+
+// Results of matchSegmentsFrom
+const (
+	segmentsMatch = iota
+	segmentsNoMatch
+	// No globstar before can make the segments match either, since giving
+	// it more of the path only leaves less for the rest
+	segmentsAbort
+)
+
+// matchSegmentsFrom matches segments against a path, like wildmatch in git:
+// once the rest of a pattern after a globstar fails at every depth, the
+// whole match fails, which keeps matching linear in the number of
+// globstars rather than exponential
+func matchSegmentsFrom(segments []patternSegment, name string) int {
+	for i, segment := range segments {
+		if segment.globstar {
+			rest := segments[i+1:]
+			if len(rest) == 0 {
+				return segmentsMatch
+			}
+			// Try the rest of the pattern at every directory depth
+			for {
+				if result := matchSegmentsFrom(rest, name); result != segmentsNoMatch {
+					return result
+				}
+				slash := strings.IndexByte(name, '/')
+				if slash < 0 {
+					return segmentsAbort
+				}
+				name = name[slash+1:]
+			}
+		}
+
+		element, remainder, more := strings.Cut(name, "/")
+		if !segment.match(element) {
+			return segmentsNoMatch
+		}
+		if !more {
+			if i == len(segments)-1 {
+				return segmentsMatch
+			}
+			return segmentsNoMatch
+		}
+		name = remainder
+	}
+	return segmentsNoMatch
+}
+
+// match reports whether the segment matches a single path element
+func (s patternSegment) match(element string) bool {
+	if s.glob == "" {
+		return element == s.literal
+	}
+	matched, _ := path.Match(s.glob, element)
+	return matched
+}
+
+// PatternSet is an ordered list of patterns in which the last pattern that
+// matches a path decides: a path matches the set if that pattern is not
+// negated. "!" patterns thereby carve exceptions out of earlier ones, e.g.
+// "*.go", "!*_test.go".
+type PatternSet struct {
+	patterns []*Pattern
+}
+
+// CompilePatterns compiles a list of patterns into a set
+func CompilePatterns(patterns []string) (PatternSet, error) {
+	set := PatternSet{patterns: make([]*Pattern, 0, len(patterns))}
+	for _, pattern := range patterns {
+		compiled, err := CompilePattern(pattern)
+		if err != nil {
+			return PatternSet{}, err
+		}
+		set.patterns = append(set.patterns, compiled)
+	}
+	return set, nil
+}
+
+// Len returns the number of patterns in the set
+func (s PatternSet) Len() int {
+	return len(s.patterns)
+}
+
+// Strings returns the patterns as they were given
+func (s PatternSet) Strings() []string {
+	patterns := make([]string, len(s.patterns))
+	for i, pattern := range s.patterns {
+		patterns[i] = pattern.String()
+	}
+	return patterns
+}
+
+// Match reports whether a slash-separated path relative to the watch root
+// matches the set
+func (s PatternSet) Match(name string, isDir bool) bool {
+	matched, _ := s.decide(name, isDir)
+	return matched
+}
+
+// decide returns whether a path matches the set, and false for ok if no
+// pattern of the set matches it at all
+func (s PatternSet) decide(name string, isDir bool) (matched, ok bool) {
+	for i := len(s.patterns) - 1; i >= 0; i-- {
+		if s.patterns[i].Match(name, isDir) {
+			return !s.patterns[i].negate, true
+		}
+	}
+	return false, false
+}
+
+// MatchOrParent reports whether a path or one of its parent directories
+// matches the set, which is how exclude patterns apply: excluding a
+// directory excludes everything inside it.
+func (s PatternSet) MatchOrParent(name string, isDir bool) bool {
+	name = strings.TrimPrefix(name, "/")
+	for i := 0; i < len(name); i++ {
+		if name[i] == '/' && s.Match(name[:i], true) {
+			return true
+		}
+	}
+	return s.Match(name, isDir)
+}
@@ -0,0 +1,202 @@
+package blink
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"testing"
+)
+
+// TestPatternMatch tests single patterns against paths relative to a root
+func TestPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		// Basename patterns match at any depth
+		{"*.go", "main.go", false, true},
+		{"*.go", "cmd/blink/main.go", false, true},
+		{"*.go", "main.go.orig", false, false},
+		{"*.go", "src.go/readme", false, false},
+		{"main.go", "cmd/main.go", false, true},
+		{"?.txt", "a.txt", false, true},
+		{"?.txt", "ab.txt", false, false},
+
+		// Anchored patterns match the whole path
+		{"src/*.go", "src/main.go", false, true},
+		{"src/*.go", "lib/src/main.go", false, false},
+		{"src/*.go", "src/sub/main.go", false, false},
+		{"/main.go", "main.go", false, true},
+		{"/main.go", "cmd/main.go", false, false},
+		{"/main.go", "/main.go", false, true},
+
+		// Globstar
+		{"**/*.go", "main.go", false, true},
+		{"**/*.go", "a/b/c/main.go", false, true},
+		{"src/**/*.go", "src/main.go", false, true},
+		{"src/**/*.go", "src/a/b/main.go", false, true},
+		{"src/**/*.go", "lib/src/main.go", false, false},
+		{"**/testdata/**", "pkg/testdata/file", false, true},
+		{"**/testdata/**", "testdata/a/b", false, true},
+		{"**/testdata/**", "testdata", true, false},
+		{"a/**/**/b", "a/x/b", false, true},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/bb", false, false},
+		{strings.Repeat("**/a/", 12) + "b", strings.Repeat("a/", 40) + "c", false, false},
+		{"a**b", "axxb", false, true},
+		{"a**b", "ax/xb", false, false},
+
+		// Braces
+		{"*.{go,mod}", "go.mod", false, true},
+		{"*.{go,mod}", "main.go", false, true},
+		{"*.{go,mod}", "go.sum", false, false},
+		{"{src,lib}/**/*.js", "lib/a/b.js", false, true},
+		{"{src,lib}/**/*.js", "test/a/b.js", false, false},
+		{"{a,b{c,d}}.txt", "bd.txt", false, true},
+		{"{a,b{c,d}}.txt", "b.txt", false, false},
+		{"{*.go,docs/**}", "docs/a/b.md", false, true},
+		{"{*.go,docs/**}", "x/docs/a.md", false, false},
+		{"x{,.bak}", "x", false, true},
+		{"x{,.bak}", "x.bak", false, true},
+
+		// Character classes
+		{"file[0-9].txt", "file7.txt", false, true},
+		{"file[0-9].txt", "filex.txt", false, false},
+		{"file[!0-9].txt", "filex.txt", false, true},
+		{"file[!0-9].txt", "file7.txt", false, false},
+		{"file[^0-9].txt", "filex.txt", false, true},
+		{"[a-c]*/*.go", "b/x.go", false, true},
+
+		// Escapes
+		{`\*.go`, "*.go", false, true},
+		{`\*.go`, "main.go", false, false},
+		{`\{a,b\}`, "{a,b}", false, true},
+		{`a\[1\]`, "a[1]", false, true},
+
+		// Directory-only patterns
+		{"build/", "build", true, true},
+		{"build/", "build", false, false},
+		{"build/", "sub/build", true, true},
+		{"src/build/", "src/build", true, true},
+
+		// Negation is ignored by Match itself
+		{"!*.go", "main.go", false, true},
+	}
+
+	for _, tt := range tests {
+		pattern, err := CompilePattern(tt.pattern)
+		if err != nil {
+			t.Errorf("CompilePattern(%q) failed: %v", tt.pattern, err)
+			continue
+		}
+		if got := pattern.Match(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("Pattern %q on %q (dir %v) = %v, want %v", tt.pattern, tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+// TestCompilePatternErrors tests that malformed patterns are rejected
+func TestCompilePatternErrors(t *testing.T) {
+	bad := []string{
+		"",
+		"!",
+		"/",
+		"[unclosed",
+		"a/[b/c",
+		"{a,b",
+		"a,b}",
+		"{a,{b}",
+		`trailing\`,
+		strings.Repeat("{a,b}", 11),
+	}
+	for _, pattern := range bad {
+		if _, err := CompilePattern(pattern); !errors.Is(err, ErrBadPattern) {
+			t.Errorf("CompilePattern(%q) = %v, want ErrBadPattern", pattern, err)
+		}
+	}
+
+	if _, err := CompilePatterns([]string{"*.go", "[bad"}); !errors.Is(err, ErrBadPattern) {
+		t.Errorf("CompilePatterns accepted a malformed pattern: %v", err)
+	}
+}
+
+// TestPatternSet tests negation and parent directory matching
+func TestPatternSet(t *testing.T) {
+	set, err := CompilePatterns([]string{"*.go", "!*_test.go", "testdata/", "!keep/"})
+	if err != nil {
+		t.Fatalf("CompilePatterns failed: %v", err)
+	}
+	if set.Len() != 4 || strings.Join(set.Strings(), ",") != "*.go,!*_test.go,testdata/,!keep/" {
+		t.Errorf("Unexpected patterns: %v", set.Strings())
+	}
+
+	tests := []struct {
+		path     string
+		isDir    bool
+		match    bool
+		orParent bool
+	}{
+		{"main.go", false, true, true},
+		{"pkg/main_test.go", false, false, false},
+		{"README.md", false, false, false},
+		{"testdata", true, true, true},
+		{"testdata/input.txt", false, false, true},
+		{"a/testdata/b/input.txt", false, false, true},
+		{"keep", true, false, false},
+		{"keep/main_test.go", false, false, false},
+	}
+	for _, tt := range tests {
+		if got := set.Match(tt.path, tt.isDir); got != tt.match {
+			t.Errorf("Match(%q) = %v, want %v", tt.path, got, tt.match)
+		}
+		if got := set.MatchOrParent(tt.path, tt.isDir); got != tt.orParent {
+			t.Errorf("MatchOrParent(%q) = %v, want %v", tt.path, got, tt.orParent)
+		}
+	}
+
+	// Later patterns override earlier ones
+	set, _ = CompilePatterns([]string{"!*.go", "*.go"})
+	if !set.Match("main.go", false) {
+		t.Errorf("Expected the last pattern to win")
+	}
+	if (PatternSet{}).Match("main.go", false) {
+		t.Errorf("Expected an empty set to match nothing")
+	}
+}
+
+// BenchmarkPatternMatch benchmarks matching a globstar pattern
+func BenchmarkPatternMatch(b *testing.B) {
+	pattern := MustCompilePattern("src/**/{*.go,*.mod}")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pattern.Match("src/pkg/blink/internal/watcher.go", false)
+	}
+}
+
+// FuzzCompilePattern checks that no pattern makes compiling or matching
+// panic, and that patterns of a single element without braces or globstars
+// match like path.Match
+func FuzzCompilePattern(f *testing.F) {
+	for _, seed := range []string{"*.go", "src/**/*.go", "{a,b}/c", "[!a-z]?", `\*`, "a/", "!x"} {
+		f.Add(seed, "src/main.go")
+	}
+
+	f.Fuzz(func(t *testing.T, pattern, name string) {
+		compiled, err := CompilePattern(pattern)
+		if err != nil {
+			return
+		}
+		got := compiled.Match(name, false)
+		compiled.Match(name, true)
+
+		simple := !strings.ContainsAny(pattern, "/{}!") && !strings.Contains(pattern, "**")
+		if simple && !strings.Contains(name, "/") {
+			want, err := path.Match(pattern, name)
+			if err == nil && got != want {
+				t.Errorf("Pattern %q on %q = %v, path.Match says %v", pattern, name, got, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,120 @@
+package blink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/TFMV/blink/pkg/health"
+	"github.com/TFMV/blink/pkg/logger"
+	"github.com/TFMV/blink/pkg/metrics"
+)
+
+// Default paths served by the HTTPServer next to the event stream
+const (
+	DefaultWebSocketPath = "/ws"
+	HealthPath           = "/health"
+	ReadyPath            = "/ready"
+	MetricsPath          = "/metrics"
+)
+
+// HTTPServer owns the single listener shared by the event streamers,
+// the health and readiness probes and the Prometheus metrics endpoint
+type HTTPServer struct {
+	address  string
+	mux      *http.ServeMux
+	server   *http.Server
+	listener net.Listener
+	mu       sync.Mutex
+}
+
+// NewHTTPServer creates a new HTTP server for the given address ([host][:port]).
+// The health, readiness and metrics endpoints are mounted right away.
+func NewHTTPServer(address string) *HTTPServer {
+	if address == "" {
+		address = ":12345"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(HealthPath, health.HealthHandler)
+	mux.HandleFunc(ReadyPath, health.ReadyHandler)
+	mux.Handle(MetricsPath, metrics.Handler())
+
+	return &HTTPServer{
+		address: address,
+		mux:     mux,
+	}
+}
+
+// Handle mounts a handler on the given path
+func (h *HTTPServer) Handle(path string, handler http.Handler) {
+	h.mux.Handle(path, handler)
+}
+
+// Handler returns the root handler of the server
+func (h *HTTPServer) Handler() http.Handler {
+	return h.mux
+}
+
+// Start binds the listener and starts serving in the background.
+// Binding happens synchronously so that errors such as a port already
+// in use are returned to the caller.
+func (h *HTTPServer) Start() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.server != nil {
+		return errors.New("http server already started")
+	}
+
+	listener, err := net.Listen("tcp", h.address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", h.address, err)
+	}
+
+	h.listener = listener
+	h.server = &http.Server{
+		Handler: h.mux,
+	}
+
+	go func() {
+		if err := h.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error(fmt.Errorf("HTTP server error: %w", err))
+		}
+	}()
+
+	logger.Infof("HTTP server started on %s", listener.Addr())
+	return nil
+}
+
+// Addr returns the address the server is listening on, or the configured
+// address if the server has not been started yet
+func (h *HTTPServer) Addr() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.listener != nil {
+		return h.listener.Addr().String()
+	}
+	return h.address
+}
+
+// Shutdown gracefully shuts down the server. If ctx expires before all
+// connections are idle, the remaining connections are closed forcibly.
+func (h *HTTPServer) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	server := h.server
+	h.mu.Unlock()
+
+	if server == nil {
+		return nil
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		server.Close()
+		return err
+	}
+	return nil
+}
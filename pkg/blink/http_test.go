@@ -0,0 +1,130 @@
+package blink
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TFMV/blink/pkg/health"
+	"github.com/gorilla/websocket"
+)
+
+func TestHTTPServerSharedListener(t *testing.T) {
+	sseStreamer := NewSSEStreamer(StreamerOptions{})
+	wsStreamer := NewWebSocketStreamer(StreamerOptions{})
+
+	server := NewHTTPServer("127.0.0.1:0")
+	server.Handle("/events", sseStreamer.Handler())
+	server.Handle(DefaultWebSocketPath, wsStreamer.Handler())
+
+	if err := server.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.Shutdown(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sseStreamer.Start(ctx)
+	wsStreamer.Start(ctx)
+
+	baseURL := "http://" + server.Addr()
+
+	t.Run("health", func(t *testing.T) {
+		resp, err := http.Get(baseURL + HealthPath)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", HealthPath, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("ready", func(t *testing.T) {
+		health.SetReady(false)
+		resp, err := http.Get(baseURL + ReadyPath)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", ReadyPath, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Expected status 503 before ready, got %d", resp.StatusCode)
+		}
+
+		health.SetReady(true)
+		defer health.SetReady(false)
+		resp, err = http.Get(baseURL + ReadyPath)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", ReadyPath, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200 when ready, got %d", resp.StatusCode)
+		}
+
+		health.SetCheck("test", func() error { return errors.New("circuit open") })
+		defer health.SetCheck("test", nil)
+		resp, err = http.Get(baseURL + ReadyPath)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", ReadyPath, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(body), "test: circuit open") {
+			t.Errorf("Expected status 503 with the failed check, got %d: %s", resp.StatusCode, body)
+		}
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		resp, err := http.Get(baseURL + MetricsPath)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", MetricsPath, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if !strings.Contains(string(body), "blink_events_processed_total") {
+			t.Errorf("Expected blink metrics in response, got: %s", body)
+		}
+	})
+
+	t.Run("sse", func(t *testing.T) {
+		client := &http.Client{Timeout: time.Second}
+		req, _ := http.NewRequest(http.MethodGet, baseURL+"/events", nil)
+		reqCtx, reqCancel := context.WithCancel(context.Background())
+		defer reqCancel()
+		resp, err := client.Do(req.WithContext(reqCtx))
+		if err != nil {
+			t.Fatalf("Failed to connect to SSE stream: %v", err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+			t.Errorf("Expected event stream content type, got %q", ct)
+		}
+	})
+
+	t.Run("websocket", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial("ws://"+server.Addr()+DefaultWebSocketPath, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect to WebSocket: %v", err)
+		}
+		conn.Close()
+	})
+}
+
+func TestHTTPServerAddressInUse(t *testing.T) {
+	first := NewHTTPServer("127.0.0.1:0")
+	if err := first.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer first.Shutdown(context.Background())
+
+	second := NewHTTPServer(first.Addr())
+	if err := second.Start(); err == nil {
+		second.Shutdown(context.Background())
+		t.Fatal("Expected an error when binding an address that is already in use")
+	}
+}
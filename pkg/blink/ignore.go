@@ -0,0 +1,170 @@
+package blink
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/TFMV/blink/pkg/logger"
+)
+
+// DefaultIgnoreFiles are the ignore files honoured by WithIgnoreFiles when
+// no names are given
+var DefaultIgnoreFiles = []string{".gitignore", ".dockerignore", ".blinkignore"}
+
+// parseIgnoreLine parses a line of an ignore file, and returns a nil
+// pattern for blank lines and comments. The patterns of ignore files have
+// the syntax of Pattern without braces, which are literal characters as in
+// gitignore(5).
+func parseIgnoreLine(line string) (*Pattern, error) {
+	line = strings.TrimSuffix(line, "\r")
+	// Trailing spaces are ignored unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+	return compilePattern(line, false)
+}
+
+// ignoreMatcher decides which paths of a watch root are ignored by the
+// ignore files found in the tree, following gitignore semantics: every
+// directory may have its own files, whose patterns are relative to it and
+// take precedence over those of its parents, the last matching pattern
+// wins, and nothing inside an ignored directory can be re-included. The
+// rules of a directory are read the first time they are needed, and again
+// after Reload. Like git, the matcher always ignores .git directories.
+type ignoreMatcher struct {
+	root  string
+	names []string
+
+	// Rules by directory, protected by mu
+	rules map[string]PatternSet
+	mu    sync.Mutex
+}
+
+// Rules that apply whatever the ignore files say
+var builtinIgnoreRules = PatternSet{patterns: []*Pattern{MustCompilePattern(".git/")}}
+
+// newIgnoreMatcher creates a matcher for the tree at root that reads the
+// ignore files with the given names
+func newIgnoreMatcher(root string, names []string) *ignoreMatcher {
+	return &ignoreMatcher{
+		root:  root,
+		names: names,
+		rules: make(map[string]PatternSet),
+	}
+}
+
+// isIgnoreFile reports whether path is one of the matcher's ignore files
+func (m *ignoreMatcher) isIgnoreFile(path string) bool {
+	name := filepath.Base(path)
+	for _, candidate := range m.names {
+		if name == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload forgets the rules of a directory, so its ignore files are read
+// again the next time they are needed
+func (m *ignoreMatcher) Reload(dir string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.rules, dir)
+}
+
+// Ignored reports whether path, which belongs to the matcher's tree, is
+// ignored
+func (m *ignoreMatcher) Ignored(path string, isDir bool) bool {
+	rel, ok := rootRelative(m.root, path)
+	if !ok || rel == "" {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// A path inside an ignored directory is ignored, whatever its own rules say
+	for i := 0; i < len(rel); i++ {
+		if rel[i] == '/' && m.ignored(rel[:i], true) {
+			return true
+		}
+	}
+	return m.ignored(rel, isDir)
+}
+
+// ignored applies the rules of the directories from the parent of the
+// path up to the root, the first one with a matching pattern decides, after
+// the built-in rules. The caller must hold mu.
+func (m *ignoreMatcher) ignored(rel string, isDir bool) bool {
+	if builtinIgnoreRules.Match(rel, isDir) {
+		return true
+	}
+	for i := len(rel) - 1; i >= -1; i-- {
+		if i >= 0 && rel[i] != '/' {
+			continue
+		}
+		dir := m.root
+		if i > 0 {
+			dir = filepath.Join(m.root, filepath.FromSlash(rel[:i]))
+		}
+		if matched, ok := m.rulesOf(dir).decide(rel[i+1:], isDir); ok {
+			return matched
+		}
+	}
+	return false
+}
+
+// rulesOf returns the rules of the ignore files in dir, in the order of
+// the matcher's names. The caller must hold mu.
+func (m *ignoreMatcher) rulesOf(dir string) PatternSet {
+	if rules, ok := m.rules[dir]; ok {
+		return rules
+	}
+
+	var rules PatternSet
+	for _, name := range m.names {
+		file, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for line := 1; scanner.Scan(); line++ {
+			pattern, err := parseIgnoreLine(scanner.Text())
+			if err != nil {
+				logger.Warnf("Skipping line %d of %s: %v", line, file.Name(), err)
+				continue
+			}
+			if pattern != nil {
+				rules.patterns = append(rules.patterns, pattern)
+			}
+		}
+		file.Close()
+	}
+	m.rules[dir] = rules
+	return rules
+}
+
+// reloadIgnores reads the ignore files of dir again, stops watching the
+// directories below it that are now ignored and watches those that no
+// longer are
+func (w *Watcher) reloadIgnores(root *watchRoot, dir string) {
+	root.ignores.Reload(dir)
+
+	w.dirLock.Lock()
+	defer w.dirLock.Unlock()
+
+	prefix := dir + string(filepath.Separator)
+	for watched := range w.watches {
+		if strings.HasPrefix(watched, prefix) && root.ignores.Ignored(watched, true) {
+			_ = w.backend.Remove(watched)
+			delete(w.watches, watched)
+		}
+	}
+	w.walkTree(root, dir, func(string, os.FileInfo) {})
+}
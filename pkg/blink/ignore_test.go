@@ -0,0 +1,121 @@
+package blink
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestIgnoreRules tests single gitignore patterns
+func TestIgnoreRules(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		{"*.log", "debug.log", false, true},
+		{"*.log", "sub/dir/debug.log", false, true},
+		{"*.log", "debug.txt", false, false},
+		{"build/", "build", true, true},
+		{"build/", "build", false, false},
+		{"build/", "sub/build", true, true},
+		{"/build", "build", false, true},
+		{"/build", "sub/build", false, false},
+		{"doc/*.txt", "doc/notes.txt", false, true},
+		{"doc/*.txt", "doc/sub/notes.txt", false, false},
+		{"doc/*.txt", "other/doc/notes.txt", false, false},
+		{"**/foo", "foo", false, true},
+		{"**/foo", "a/b/foo", false, true},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/x/y/b", false, true},
+		{"a/**", "a/x/y", false, true},
+		{"a/**", "a", true, false},
+		{"file[0-9].txt", "file7.txt", false, true},
+		{`\#hash`, "#hash", false, true},
+		{`\!bang`, "!bang", false, true},
+		{"trailing   ", "trailing", false, true},
+		{"{a,b}.txt", "{a,b}.txt", false, true},
+		{"{a,b}.txt", "a.txt", false, false},
+		{"*{x}", "file{x}", false, true},
+	}
+
+	for _, tt := range tests {
+		pattern, err := parseIgnoreLine(tt.pattern)
+		if err != nil || pattern == nil {
+			t.Errorf("Pattern %q did not parse: %v", tt.pattern, err)
+			continue
+		}
+		if got := pattern.Match(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("Pattern %q on %q (dir %v) = %v, want %v", tt.pattern, tt.path, tt.isDir, got, tt.want)
+		}
+	}
+
+	for _, line := range []string{"", "   ", "# comment"} {
+		if pattern, err := parseIgnoreLine(line); pattern != nil || err != nil {
+			t.Errorf("Expected %q to be skipped, got %v, %v", line, pattern, err)
+		}
+	}
+	for _, line := range []string{"/", "[unclosed"} {
+		if _, err := parseIgnoreLine(line); err == nil {
+			t.Errorf("Expected %q to be malformed", line)
+		}
+	}
+}
+
+// writeFile writes a file below root, creating its directory
+func writeFile(t *testing.T, root, name, content string) {
+	t.Helper()
+	path := filepath.Join(root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+}
+
+// TestIgnoreMatcher tests nested ignore files, negation and reloading
+func TestIgnoreMatcher(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, ".gitignore", "*.log\nbuild/\n/secret.txt\nvendor/\n")
+	writeFile(t, root, ".blinkignore", "*.tmp\n")
+	writeFile(t, root, "app/.gitignore", "!keep.log\n")
+	writeFile(t, root, "vendor/.gitignore", "!*\n")
+
+	m := newIgnoreMatcher(root, DefaultIgnoreFiles)
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"main.go", false, false},
+		{"debug.log", false, true},
+		{"app/debug.log", false, true},
+		{"app/keep.log", false, false}, // Re-included by the nested file
+		{"keep.log", false, true},      // The nested file only applies below it
+		{"build", true, true},
+		{"app/build/out.go", false, true},
+		{"secret.txt", false, true},
+		{"app/secret.txt", false, false},
+		{"scratch.tmp", false, true},
+		{"vendor/lib.go", false, true}, // Nothing inside an ignored directory is re-included
+		{".git", true, true},
+		{".git/config", false, true},
+	}
+	for _, tt := range tests {
+		if got := m.Ignored(filepath.Join(root, filepath.FromSlash(tt.path)), tt.isDir); got != tt.want {
+			t.Errorf("Ignored(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	// Rules are cached until reloaded
+	writeFile(t, root, ".gitignore", "*.go\n")
+	if m.Ignored(filepath.Join(root, "main.go"), false) {
+		t.Errorf("Expected the old rules until reload")
+	}
+	m.Reload(root)
+	if !m.Ignored(filepath.Join(root, "main.go"), false) || m.Ignored(filepath.Join(root, "debug.log"), false) {
+		t.Errorf("Expected the new rules after reload")
+	}
+}
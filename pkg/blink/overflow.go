@@ -0,0 +1,168 @@
+package blink
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/TFMV/blink/pkg/metrics"
+	"github.com/fsnotify/fsnotify"
+)
+
+// OpOverflow is the operation of the event sent when the kernel event queue
+// overflowed and events were lost. Its Name is the watch root. Clients
+// should resync their view of the tree; the watcher follows it with
+// synthetic create, write and remove events for the changes it found by
+// rescanning. Like OpMove, it uses a bit fsnotify leaves free.
+const OpOverflow fsnotify.Op = 1 << 17
+
+// fileState is what the watcher last saw of a file, used to find the
+// changes that were lost when the event queue overflowed
+type fileState struct {
+	key     fileKey
+	size    int64
+	modTime time.Time
+}
+
+// stateOf returns the state of the file behind an event, and false if the
+// event carries no metadata because the file no longer exists
+func stateOf(event Event) (fileState, bool) {
+	if event.ModTime.IsZero() {
+		return fileState{}, false
+	}
+	key, _ := event.key()
+	return fileState{key: key, size: event.Size, modTime: event.ModTime}, true
+}
+
+// handleOverflow queues an overflow event for every root, rescans the
+// watched directories and queues a synthetic event for every file and
+// directory that was created, written or removed since it was last seen.
+func (w *Watcher) handleOverflow() {
+	metrics.WatcherOverflows.Inc()
+	w.rootsLock.RLock()
+	defer w.rootsLock.RUnlock()
+	for _, root := range w.roots {
+		w.rescan(root)
+	}
+}
+
+// rescan queues the overflow event and the synthetic events of one root.
+// Removes come first, deepest first, then creates and writes, parents first.
+func (w *Watcher) rescan(root *watchRoot) {
+	now := time.Now()
+
+	current := make(map[string]Event)
+	w.dirLock.Lock()
+	watched := make(map[string]bool, len(w.watches))
+	for dir := range w.watches {
+		watched[dir] = true
+	}
+	w.walkTree(root, root.Path, func(path string, info os.FileInfo) {
+		event := root.newEvent(fsnotify.Event{Name: path, Op: fsnotify.Create}, info, now)
+		event.IsDir = info.IsDir()
+		current[path] = event
+	})
+	var vanished []string
+	for dir := range w.watches {
+		if dir != root.Path && root.contains(dir) {
+			if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+				vanished = append(vanished, dir)
+			}
+		}
+	}
+	w.dirLock.Unlock()
+
+	// Directories that vanished are pruned with everything known inside
+	removed := make(map[string]Event)
+	sort.Strings(vanished)
+	for _, dir := range vanished {
+		if !w.isWatched(dir) {
+			// Pruned with its parent
+			continue
+		}
+		for _, event := range w.removeTree(root, dir, now) {
+			removed[event.Name] = event
+		}
+		if root.included(dir, true) {
+			event := root.newEvent(fsnotify.Event{Name: dir, Op: fsnotify.Remove}, nil, now)
+			event.IsDir = true
+			removed[dir] = event
+		}
+	}
+
+	w.eventLock.Lock()
+	var changes []Event
+	for path, event := range current {
+		if event.IsDir {
+			// Directories watched before the walk were already known
+			if !watched[path] {
+				changes = append(changes, event)
+			}
+			continue
+		}
+		cached, known := w.files[path]
+		state, _ := stateOf(event)
+		switch {
+		case !known:
+			changes = append(changes, event)
+		case cached != state:
+			event.Op = fsnotify.Write
+			changes = append(changes, event)
+		}
+	}
+	for path := range w.files {
+		if _, exists := current[path]; !exists && root.contains(path) {
+			if _, ok := removed[path]; !ok {
+				removed[path] = root.newEvent(fsnotify.Event{Name: path, Op: fsnotify.Remove}, nil, now)
+			}
+		}
+	}
+	w.eventLock.Unlock()
+
+	removes := make([]Event, 0, len(removed))
+	for _, event := range removed {
+		removes = append(removes, event)
+	}
+	sort.Slice(removes, func(i, j int) bool {
+		return removes[i].Name > removes[j].Name
+	})
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+
+	w.queueEvent(root, root.newEvent(fsnotify.Event{Name: root.Path, Op: OpOverflow}, nil, now))
+	for _, event := range append(removes, changes...) {
+		w.queueEvent(root, event)
+	}
+	w.updateWatchedDirectories(len(w.backend.WatchList()))
+}
+
+// walkTree walks the tree below dir, which belongs to root, adding watches
+// for directories that are not watched yet, and calls fn for every included
+// file and directory. Directories are descended into unless excluded, so
+// that include patterns such as "src/**/*.go" find their files. The caller
+// must hold dirLock.
+func (w *Watcher) walkTree(root *watchRoot, dir string, fn func(path string, info os.FileInfo)) {
+	_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return nil
+		}
+		if root.excluded(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if !root.Recursive {
+				return filepath.SkipDir
+			}
+			w.watch(path)
+		}
+		if root.included(path, info.IsDir()) {
+			fn(path, info)
+		}
+		return nil
+	})
+}
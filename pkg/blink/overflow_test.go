@@ -0,0 +1,88 @@
+package blink
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// TestHandleOverflow tests that a rescan after an overflow reports what changed
+func TestHandleOverflow(t *testing.T) {
+	root := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	write("removed.txt", "a")
+	write("unchanged.txt", "b")
+	write("written.txt", "c")
+	write("gone/old.txt", "f")
+
+	w, err := NewWatcher(context.Background(), WatcherConfig{RootPath: root, Recursive: true})
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.backend.Close()
+	w.initialScan()
+
+	// Changes whose events were lost
+	if err := os.Remove(filepath.Join(root, "removed.txt")); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	if err := os.RemoveAll(filepath.Join(root, "gone")); err != nil {
+		t.Fatalf("Failed to remove directory: %v", err)
+	}
+	write("written.txt", "changed")
+	write("created.txt", "d")
+	write("sub/nested.txt", "e")
+
+	w.handleOverflow()
+	events := w.roots[0].events
+
+	expected := []struct {
+		op   fsnotify.Op
+		path string
+	}{
+		{OpOverflow, "."},
+		{fsnotify.Remove, "removed.txt"},
+		{fsnotify.Remove, "gone/old.txt"},
+		{fsnotify.Remove, "gone"},
+		{fsnotify.Create, "created.txt"},
+		{fsnotify.Create, "sub"},
+		{fsnotify.Create, "sub/nested.txt"},
+		{fsnotify.Write, "written.txt"},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Got %d events, want %d: %v", len(events), len(expected), events)
+	}
+	for i, want := range expected {
+		if got := events[i]; got.Op != want.op || got.RelPath != want.path {
+			t.Errorf("Event %d = %s %s, want %s %s", i, got.OpString(), got.RelPath, eventTypeToString(want.op), want.path)
+		}
+	}
+
+	// The new directory is watched, so later changes in it are not lost
+	if !w.watches[filepath.Join(root, "sub")] {
+		t.Error("Expected the new directory to be watched")
+	}
+	// The removed one is not
+	if w.watches[filepath.Join(root, "gone")] {
+		t.Error("Expected the removed directory not to be watched")
+	}
+
+	// A second rescan finds nothing new
+	w.roots[0].events = nil
+	w.handleOverflow()
+	if events := w.roots[0].events; len(events) != 1 || events[0].Op != OpOverflow {
+		t.Errorf("Expected only the overflow event, got %v", events)
+	}
+}
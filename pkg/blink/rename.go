@@ -0,0 +1,103 @@
+package blink
+
+import (
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// OpMove is the operation of a rename whose source and destination were both
+// seen inside the watch. Event.OldName holds the source and Event.Name the
+// destination. It is not an fsnotify operation, so it uses a bit fsnotify
+// leaves free. Moves also carry fsnotify.Create, so that filters on create
+// keep seeing files that appear under a new name.
+const OpMove fsnotify.Op = 1 << 16
+
+// Default time a rename waits for its matching create before it is
+// reported as a remove
+const defaultRenameWindow = 50 * time.Millisecond
+
+// fileKey identifies a file independently of its path
+type fileKey struct {
+	inode  uint64
+	device uint64
+}
+
+// key returns the identity of the file behind an event, and false if unknown
+func (e Event) key() (fileKey, bool) {
+	if e.Inode == 0 {
+		return fileKey{}, false
+	}
+	return fileKey{inode: e.Inode, device: e.Device}, true
+}
+
+// pairRenames turns a rename of a file followed by a create of the same file
+// (same inode and device) into a single move event at the position of the
+// create. Renames without a match are held back while they are younger than
+// window, since the create may still arrive, and reported as removes
+// afterwards, keeping the rename bit: the file was moved out of the watch.
+// Creates without a match stay creates, the file was moved in from outside.
+func pairRenames(events []Event, now time.Time, window time.Duration) (ready, held []Event) {
+	// Index the renames by file identity, oldest first
+	var renames map[fileKey][]int
+	for i, event := range events {
+		if event.Op&fsnotify.Rename == 0 {
+			continue
+		}
+		if key, ok := event.key(); ok {
+			if renames == nil {
+				renames = make(map[fileKey][]int)
+			}
+			renames[key] = append(renames[key], i)
+		}
+	}
+
+	// Match every create with the oldest earlier rename of the same file
+	movedFrom := make(map[int]int)
+	paired := make(map[int]bool)
+	for i, event := range events {
+		if event.Op&fsnotify.Create == 0 {
+			continue
+		}
+		if key, ok := event.key(); ok {
+			if from, found := takeRename(renames, key, i); found {
+				movedFrom[i] = from
+				paired[from] = true
+			}
+		}
+	}
+
+	ready = make([]Event, 0, len(events))
+	for i, event := range events {
+		switch {
+		case paired[i]:
+			// Reported as part of the move
+			continue
+		case event.Op&fsnotify.Rename != 0:
+			if now.Sub(event.Timestamp) < window {
+				held = append(held, event)
+				continue
+			}
+			event.Op = fsnotify.Rename | fsnotify.Remove
+		default:
+			if from, ok := movedFrom[i]; ok {
+				event.Op = OpMove | fsnotify.Create
+				event.OldName = events[from].Name
+			}
+		}
+		ready = append(ready, event)
+	}
+
+	return ready, held
+}
+
+// takeRename removes and returns the index of the oldest rename of the given
+// file that happened before index before
+func takeRename(renames map[fileKey][]int, key fileKey, before int) (int, bool) {
+	candidates := renames[key]
+	if len(candidates) == 0 || candidates[0] > before {
+		return 0, false
+	}
+	renames[key] = candidates[1:]
+	return candidates[0], true
+}
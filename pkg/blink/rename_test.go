@@ -0,0 +1,141 @@
+package blink
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// TestPairRenames tests pairing renames and creates of the same file into moves
+func TestPairRenames(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-time.Second)
+
+	rename := func(name string, inode uint64, at time.Time) Event {
+		return Event{Name: name, Op: fsnotify.Rename, Inode: inode, Device: 1, Timestamp: at}
+	}
+	create := func(name string, inode uint64) Event {
+		return Event{Name: name, Op: fsnotify.Create, Inode: inode, Device: 1, Timestamp: now}
+	}
+
+	tests := []struct {
+		name     string
+		events   []Event
+		want     []string // "op path" or "move from to"
+		wantHeld int
+	}{
+		{
+			name:   "Move within the watch",
+			events: []Event{rename("/w/a", 1, old), create("/w/b", 1)},
+			want:   []string{"move /w/a /w/b"},
+		},
+		{
+			name:   "Moved out of the watch",
+			events: []Event{rename("/w/a", 1, old)},
+			want:   []string{"remove /w/a"},
+		},
+		{
+			name:   "Moved into the watch",
+			events: []Event{create("/w/b", 2)},
+			want:   []string{"create /w/b"},
+		},
+		{
+			name:     "Create may still arrive",
+			events:   []Event{rename("/w/a", 1, now)},
+			want:     nil,
+			wantHeld: 1,
+		},
+		{
+			name:   "Different file",
+			events: []Event{rename("/w/a", 1, old), create("/w/b", 2)},
+			want:   []string{"remove /w/a", "create /w/b"},
+		},
+		{
+			name:   "Unknown identity",
+			events: []Event{rename("/w/a", 0, old), create("/w/b", 0)},
+			want:   []string{"remove /w/a", "create /w/b"},
+		},
+		{
+			name:   "Create before rename",
+			events: []Event{create("/w/b", 1), rename("/w/a", 1, old)},
+			want:   []string{"create /w/b", "remove /w/a"},
+		},
+		{
+			name: "Chained moves keep order",
+			events: []Event{
+				rename("/w/a", 1, old), create("/w/b", 1),
+				{Name: "/w/c", Op: fsnotify.Write, Timestamp: now},
+				rename("/w/b", 1, old), create("/w/d", 1),
+			},
+			want: []string{"move /w/a /w/b", "write /w/c", "move /w/b /w/d"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ready, held := pairRenames(tt.events, now, defaultRenameWindow)
+
+			var got []string
+			for _, event := range ready {
+				if event.Op&OpMove != 0 {
+					got = append(got, "move "+event.OldName+" "+event.Name)
+				} else {
+					got = append(got, event.OpString()+" "+event.Name)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("Event %d = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+			if len(held) != tt.wantHeld {
+				t.Errorf("Held %d events, want %d", len(held), tt.wantHeld)
+			}
+		})
+	}
+}
+
+// TestPairRenamesFilters tests that filters on the fsnotify operations still
+// match moves and renames out of the watch
+func TestPairRenamesFilters(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-time.Second)
+	events := []Event{
+		{Name: "/w/a", Op: fsnotify.Rename, Inode: 1, Device: 1, Timestamp: old},
+		{Name: "/w/b", Op: fsnotify.Create, Inode: 1, Device: 1, Timestamp: now},
+		{Name: "/w/c", Op: fsnotify.Rename, Inode: 2, Device: 1, Timestamp: old},
+	}
+	ready, _ := pairRenames(events, now, defaultRenameWindow)
+	if len(ready) != 2 {
+		t.Fatalf("Got %d events, want 2", len(ready))
+	}
+	moved, movedOut := ready[0], ready[1]
+
+	tests := []struct {
+		events string
+		event  Event
+	}{
+		{"move", moved},
+		{"create", moved},
+		{"remove", movedOut},
+		{"rename", movedOut},
+	}
+	for _, tt := range tests {
+		filter := NewEventFilter()
+		filter.SetIncludeEvents(tt.events)
+		if !filter.ShouldProcessEvent(tt.event) {
+			t.Errorf("Filter on %s dropped %s", tt.events, tt.event)
+		}
+		op, err := compileEventTypes([]string{tt.events})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.event.Op&op == 0 {
+			t.Errorf("Watch filter on %s dropped %s", tt.events, tt.event)
+		}
+	}
+}
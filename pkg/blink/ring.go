@@ -0,0 +1,101 @@
+package blink
+
+import (
+	"sort"
+	"sync"
+)
+
+// Default number of events kept for SSE replay
+const defaultReplayBufferSize = 1024
+
+// EventRing is a bounded ring buffer of sequenced events.
+// Events that were not sequenced yet (ID 0) get the next value of a
+// monotonically increasing sequence, starting at 1, so clients can resume
+// from the last id they saw. Events sequenced upstream keep their id.
+// Once the buffer is full the oldest events are overwritten.
+type EventRing struct {
+	mu      sync.RWMutex
+	entries []Event
+	start   int    // Index of the oldest entry
+	count   int    // Number of valid entries
+	lastID  uint64 // Sequence number of the newest entry
+}
+
+// NewEventRing creates a new ring buffer holding at most capacity events
+func NewEventRing(capacity int) *EventRing {
+	if capacity <= 0 {
+		capacity = defaultReplayBufferSize
+	}
+	return &EventRing{
+		entries: make([]Event, capacity),
+	}
+}
+
+// Append adds an event to the ring and returns it with its sequence number set.
+// Ids that do not follow the sequence are replaced by the next one.
+func (r *EventRing) Append(event Event) Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if event.ID <= r.lastID {
+		event.ID = r.lastID + 1
+	}
+	r.lastID = event.ID
+
+	if r.count < len(r.entries) {
+		r.entries[(r.start+r.count)%len(r.entries)] = event
+		r.count++
+	} else {
+		// Buffer is full, overwrite the oldest entry
+		r.entries[r.start] = event
+		r.start = (r.start + 1) % len(r.entries)
+	}
+
+	return event
+}
+
+// LastID returns the sequence number of the newest event, or 0 if none were added
+func (r *EventRing) LastID() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.lastID
+}
+
+// Since returns all buffered events with an id greater than id, oldest first.
+// gap is true when events after id have already been evicted from the buffer,
+// or when id is ahead of the sequence (e.g. the client saw a previous server
+// instance), meaning the caller cannot deliver a complete history.
+func (r *EventRing) Since(id uint64) (events []Event, gap bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if id > r.lastID {
+		return r.copyFrom(0), true
+	}
+	if r.count == 0 || id >= r.lastID {
+		return nil, false
+	}
+
+	oldest := r.entries[r.start].ID
+	if id+1 < oldest {
+		return r.copyFrom(0), true
+	}
+
+	offset := sort.Search(r.count, func(i int) bool {
+		return r.entries[(r.start+i)%len(r.entries)].ID > id
+	})
+	return r.copyFrom(offset), false
+}
+
+// copyFrom copies entries starting at the given offset from the oldest entry.
+// Needs to be called with the lock held.
+func (r *EventRing) copyFrom(offset int) []Event {
+	if offset >= r.count {
+		return nil
+	}
+	result := make([]Event, 0, r.count-offset)
+	for i := offset; i < r.count; i++ {
+		result = append(result, r.entries[(r.start+i)%len(r.entries)])
+	}
+	return result
+}
@@ -0,0 +1,100 @@
+package blink
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// TestEventRingSequence tests that ids are assigned monotonically starting at 1
+func TestEventRingSequence(t *testing.T) {
+	ring := NewEventRing(4)
+
+	if ring.LastID() != 0 {
+		t.Fatalf("Expected empty ring to have last id 0, got %d", ring.LastID())
+	}
+
+	for i := 1; i <= 3; i++ {
+		event := ring.Append(Event{Name: fmt.Sprintf("file%d", i), Op: fsnotify.Write})
+		if event.ID != uint64(i) {
+			t.Errorf("Expected id %d, got %d", i, event.ID)
+		}
+	}
+
+	if ring.LastID() != 3 {
+		t.Errorf("Expected last id 3, got %d", ring.LastID())
+	}
+
+	// Events sequenced upstream keep their id, stale ids are replaced
+	if event := ring.Append(Event{ID: 10, Name: "file10"}); event.ID != 10 {
+		t.Errorf("Expected upstream id 10 to be kept, got %d", event.ID)
+	}
+	if event := ring.Append(Event{ID: 5, Name: "stale"}); event.ID != 11 {
+		t.Errorf("Expected stale id to be replaced by 11, got %d", event.ID)
+	}
+}
+
+// TestEventRingSince tests replaying events after a given id
+func TestEventRingSince(t *testing.T) {
+	ring := NewEventRing(4)
+	for i := 1; i <= 6; i++ {
+		ring.Append(Event{Name: fmt.Sprintf("file%d", i), Op: fsnotify.Write})
+	}
+
+	// The ring holds ids 3..6 now
+	tests := []struct {
+		name    string
+		since   uint64
+		wantIDs []uint64
+		wantGap bool
+	}{
+		{"Up to date", 6, nil, false},
+		{"One behind", 5, []uint64{6}, false},
+		{"Oldest boundary", 2, []uint64{3, 4, 5, 6}, false},
+		{"Evicted", 1, []uint64{3, 4, 5, 6}, true},
+		{"From the start", 0, []uint64{3, 4, 5, 6}, true},
+		{"Ahead of sequence", 42, []uint64{3, 4, 5, 6}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, gap := ring.Since(tt.since)
+			if gap != tt.wantGap {
+				t.Errorf("Since(%d) gap = %v, want %v", tt.since, gap, tt.wantGap)
+			}
+			if len(entries) != len(tt.wantIDs) {
+				t.Fatalf("Since(%d) returned %d entries, want %d", tt.since, len(entries), len(tt.wantIDs))
+			}
+			for i, entry := range entries {
+				if entry.ID != tt.wantIDs[i] {
+					t.Errorf("Since(%d)[%d].ID = %d, want %d", tt.since, i, entry.ID, tt.wantIDs[i])
+				}
+				if entry.Name != fmt.Sprintf("file%d", tt.wantIDs[i]) {
+					t.Errorf("Since(%d)[%d].Name = %s, want file%d", tt.since, i, entry.Name, tt.wantIDs[i])
+				}
+			}
+		})
+	}
+}
+
+// TestEventRingEmpty tests that an empty ring reports no gap for new clients
+func TestEventRingEmpty(t *testing.T) {
+	ring := NewEventRing(4)
+
+	entries, gap := ring.Since(0)
+	if gap || len(entries) != 0 {
+		t.Errorf("Expected no entries and no gap, got %d entries and gap=%v", len(entries), gap)
+	}
+}
+
+// BenchmarkEventRingAppend benchmarks appending to a full ring
+func BenchmarkEventRingAppend(b *testing.B) {
+	ring := NewEventRing(defaultReplayBufferSize)
+	event := Event{Name: "/test/file.txt", Op: fsnotify.Write}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ring.Append(event)
+	}
+}
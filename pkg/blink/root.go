@@ -0,0 +1,232 @@
+package blink
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ErrRootNotFound is returned by Watcher.RemoveRoot for a path that is not a
+// watch root
+var ErrRootNotFound = errors.New("watch root not found")
+
+// RootConfig configures one directory tree watched by a Watcher. Unset
+// fields fall back to the WatcherConfig: include patterns and event types
+// are replaced, exclude patterns and ignored event types are added to.
+type RootConfig struct {
+	Name            string        // Carried by every event of the root, defaults to the base name of Path
+	Path            string        // Directory to watch
+	IncludePatterns []string      // e.g., ["*.go"]
+	ExcludePatterns []string      // e.g., ["vendor"]
+	IncludeEvents   []string      // e.g., ["create", "write"]
+	IgnoreEvents    []string      // e.g., ["chmod"]
+	Recursive       bool          // Watch subdirectories too
+	HandlerDelay    time.Duration // Debounce delay of the root's batches
+	IgnoreFiles     []string      // e.g., [".gitignore", ".blinkignore"]
+	Filter          string        // Filter expression, e.g. `size < 1MB`, see Expr
+}
+
+// watchRoot is a watched directory tree together with its pending events
+type watchRoot struct {
+	RootConfig
+
+	// Pre-compiled filters
+	includes      PatternSet
+	excludes      PatternSet
+	includeEvents fsnotify.Op
+	ignoreEvents  fsnotify.Op
+	filter        *Expr // nil without Filter
+	// Rules of the root's ignore files, nil without IgnoreFiles
+	ignores *ignoreMatcher
+
+	// Events waiting for the root's debounce delay, protected by the
+	// Watcher's eventLock
+	events []Event
+	// When the pending events are due, zero if there are none. Only run()
+	// uses it.
+	flushAt time.Time
+}
+
+// rootConfigs returns the configurations of the watch roots, with the
+// defaults of the WatcherConfig applied. Without Roots, RootPath is the
+// only root.
+func (c WatcherConfig) rootConfigs() ([]RootConfig, error) {
+	roots := c.Roots
+	if len(roots) == 0 {
+		if c.RootPath == "" {
+			return nil, nil
+		}
+		roots = []RootConfig{{Path: c.RootPath, Recursive: c.Recursive}}
+	}
+
+	configs := make([]RootConfig, 0, len(roots))
+	for _, root := range roots {
+		config, err := c.rootConfig(root, configs)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// rootConfig applies the defaults of the WatcherConfig to a root, and
+// checks it against the existing roots: names must be unique, and every
+// directory belongs to a single root.
+func (c WatcherConfig) rootConfig(root RootConfig, existing []RootConfig) (RootConfig, error) {
+	if root.Path == "" {
+		return RootConfig{}, fmt.Errorf("watch %q has no path", root.Name)
+	}
+	if abs, err := filepath.Abs(root.Path); err == nil {
+		root.Path = abs
+	}
+	if root.Name == "" {
+		root.Name = filepath.Base(root.Path)
+	}
+	for _, other := range existing {
+		if other.Name == root.Name {
+			return RootConfig{}, fmt.Errorf("duplicate watch name %q", root.Name)
+		}
+		if other.contains(root.Path) || root.contains(other.Path) {
+			return RootConfig{}, fmt.Errorf("watches %q and %q overlap", other.Name, root.Name)
+		}
+	}
+
+	if len(root.IncludePatterns) == 0 {
+		root.IncludePatterns = c.IncludePatterns
+	}
+	root.ExcludePatterns = append(append([]string(nil), root.ExcludePatterns...), c.ExcludePatterns...)
+	if len(root.IncludeEvents) == 0 {
+		root.IncludeEvents = c.IncludeEvents
+	}
+	root.IgnoreEvents = append(append([]string(nil), root.IgnoreEvents...), c.IgnoreEvents...)
+	if root.HandlerDelay == 0 {
+		root.HandlerDelay = c.HandlerDelay
+	}
+	if len(root.IgnoreFiles) == 0 {
+		root.IgnoreFiles = c.IgnoreFiles
+	}
+	return root, nil
+}
+
+// newWatchRoot compiles the patterns and event type filters of a root
+func newWatchRoot(config RootConfig) (*watchRoot, error) {
+	includes, err := CompilePatterns(config.IncludePatterns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include pattern for watch %q: %w", config.Name, err)
+	}
+	excludes, err := CompilePatterns(config.ExcludePatterns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exclude pattern for watch %q: %w", config.Name, err)
+	}
+	includeEvents, err := compileEventTypes(config.IncludeEvents)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include event type for watch %q: %w", config.Name, err)
+	}
+	ignoreEvents, err := compileEventTypes(config.IgnoreEvents)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ignore event type for watch %q: %w", config.Name, err)
+	}
+	root := &watchRoot{
+		RootConfig:    config,
+		includes:      includes,
+		excludes:      excludes,
+		includeEvents: includeEvents,
+		ignoreEvents:  ignoreEvents,
+	}
+	if config.Filter != "" {
+		if root.filter, err = CompileExpr(config.Filter); err != nil {
+			return nil, fmt.Errorf("invalid filter for watch %q: %w", config.Name, err)
+		}
+	}
+	if len(config.IgnoreFiles) > 0 {
+		root.ignores = newIgnoreMatcher(config.Path, config.IgnoreFiles)
+	}
+	return root, nil
+}
+
+// contains reports whether path is the root or below it
+func (c RootConfig) contains(path string) bool {
+	return path == c.Path || strings.HasPrefix(path, c.Path+string(filepath.Separator))
+}
+
+// newEvent creates an event of the root, see newEvent
+func (r *watchRoot) newEvent(fsEvent fsnotify.Event, info os.FileInfo, observed time.Time) Event {
+	event := newEvent(fsEvent, r.Path, info, observed)
+	event.RootName = r.Name
+	return event
+}
+
+// excluded reports whether a path is left out by the exclude patterns or
+// the ignore files of the root. Only the path itself is checked: nothing
+// inside an excluded directory is watched in the first place.
+func (r *watchRoot) excluded(path string, isDir bool) bool {
+	if r.ignores != nil && r.ignores.Ignored(path, isDir) {
+		return true
+	}
+	rel, ok := rootRelative(r.Path, path)
+	return ok && r.excludes.Match(rel, isDir)
+}
+
+// shouldIncludePath checks if a path should be reported, based on patterns
+// and ignore files. Directories that are not excluded are watched even if
+// the include patterns leave them out, since their content may match.
+func (r *watchRoot) shouldIncludePath(path string, isDir bool) bool {
+	return !r.excluded(path, isDir) && r.included(path, isDir)
+}
+
+// included reports whether a path matches the include patterns of the root
+func (r *watchRoot) included(path string, isDir bool) bool {
+	if r.includes.Len() == 0 {
+		return true
+	}
+	rel, ok := rootRelative(r.Path, path)
+	return ok && r.includes.Match(rel, isDir)
+}
+
+// rootRelative returns path relative to root with forward slashes, "" for
+// root itself, and false if path is not inside root
+func rootRelative(root, path string) (string, bool) {
+	if path == root {
+		return "", true
+	}
+	prefix := len(root)
+	if !strings.HasSuffix(root, string(filepath.Separator)) {
+		prefix++
+	}
+	if len(path) <= prefix || !strings.HasPrefix(path, root) || path[prefix-1] != filepath.Separator {
+		return "", false
+	}
+	return filepath.ToSlash(path[prefix:]), true
+}
+
+// shouldProcessEvent checks if an event passes the event types and the
+// filter expression of the root
+func (r *watchRoot) shouldProcessEvent(event *Event) bool {
+	if !r.shouldProcessEventType(event.Op) {
+		return false
+	}
+	return r.filter == nil || event.Op&OpOverflow != 0 || r.filter.Match(event)
+}
+
+func (r *watchRoot) shouldProcessEventType(op fsnotify.Op) bool {
+	// Clients must always learn that events were lost
+	if op&OpOverflow != 0 {
+		return true
+	}
+
+	if r.ignoreEvents&op != 0 {
+		return false
+	}
+
+	if r.includeEvents != 0 {
+		return r.includeEvents&op != 0
+	}
+
+	return true
+}
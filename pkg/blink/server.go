@@ -9,13 +9,14 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/TFMV/blink/pkg/health"
 	"github.com/TFMV/blink/pkg/logger"
+	"github.com/TFMV/blink/pkg/metrics"
 	"github.com/fsnotify/fsnotify"
 )
 
@@ -83,12 +84,10 @@ func CollectFileChangeEvents(ctx context.Context, watcher *Watcher, mut *sync.Mu
 			select {
 			case eventBatch := <-watcher.Events():
 				// Process each event in the batch
-				for _, fsEvent := range eventBatch {
-					// Convert to our Event type
-					event := Event(fsEvent)
-
+				for _, event := range eventBatch {
 					// Apply filter if provided
-					if filter != nil && !filter.ShouldProcessEvent(fsEvent) {
+					if filter != nil && !filter.ShouldProcessEvent(event) {
+						metrics.EventsFiltered.Inc()
 						if LogInfo != nil {
 							LogInfo(fmt.Sprintf("Filtered event: %s", event))
 						}
@@ -110,7 +109,7 @@ func CollectFileChangeEvents(ctx context.Context, watcher *Watcher, mut *sync.Mu
 
 					// Send webhook if configured
 					if webhookManager != nil {
-						webhookManager.HandleEvent(fsnotify.Event(event))
+						webhookManager.HandleEvent(event)
 					}
 				}
 
@@ -172,10 +171,19 @@ func GenFileChangeEvents(events TimeEventMap, mut *sync.Mutex, maxAge time.Durat
 // WriteEvent writes SSE events to the given ResponseWriter.
 // id can be nil.
 func WriteEvent(w http.ResponseWriter, id *uint64, message string, flush bool) {
+	WriteNamedEvent(w, id, "", message, flush)
+}
+
+// WriteNamedEvent writes an SSE event with the given event type to the given ResponseWriter.
+// id can be nil, and an empty eventType results in a default "message" event.
+func WriteNamedEvent(w http.ResponseWriter, id *uint64, eventType, message string, flush bool) {
 	var buf bytes.Buffer
 	if id != nil {
 		buf.WriteString(fmt.Sprintf("id: %v\n", *id))
 	}
+	if eventType != "" {
+		buf.WriteString(fmt.Sprintf("event: %s\n", eventType))
+	}
 	for _, msg := range strings.Split(message, "\n") {
 		buf.WriteString(fmt.Sprintf("data: %s\n", msg))
 	}
@@ -199,22 +207,74 @@ func Flush(w http.ResponseWriter) bool {
 	return ok
 }
 
-// EventServer starts a server that serves events over SSE and/or WebSockets
-func EventServer(path, allowed, eventAddr, eventPath string, refreshDuration time.Duration, options ...Option) {
+// Default time allowed for a graceful shutdown
+const defaultShutdownTimeout = 5 * time.Second
+
+// Server watches a directory and serves its events over SSE and/or WebSockets,
+// delivers them to webhooks and actions, and exposes health, readiness and
+// metrics endpoints
+type Server struct {
+	path      string
+	eventPath string
+	opts      *Options
+
+	watcher    *Watcher
+	webhooks   []*WebhookManager
+	execRunner *ExecRunner
+	streamer   EventStreamer
+	httpServer *HTTPServer
+
+	// Lifetime of the streamers, canceled at the end of Shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Closed once every batch from the watcher has been processed
+	pipelineDone chan struct{}
+
+	// Closed when Shutdown starts, so Run can return
+	shutdownStarted chan struct{}
+
+	// Sequence number of the last delivered event, protected by sendMu so
+	// that the events of the watcher and of actions are sent in id order
+	sequence uint64
+	sendMu   sync.Mutex
+
+	// running is set by Run, started once the events are being processed
+	running      bool
+	started      bool
+	shutdownOnce sync.Once
+	shutdownErr  error
+	mu           sync.Mutex
+}
+
+// NewServer creates a new event server for the given path, or for the
+// roots given with WithRoots. Nothing is started until Run is called.
+func NewServer(path, allowed, eventAddr, eventPath string, refreshDuration time.Duration, options ...Option) (*Server, error) {
 	// Check if the path exists
 	if !Exists(path) {
-		FatalExit(errors.New("path does not exist: " + path))
+		return nil, errors.New("path does not exist: " + path)
 	}
 
-	// Create a new context for the server
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
 	// Parse options
 	opts := &Options{}
 	for _, option := range options {
 		option(opts)
 	}
+	if opts.ShutdownTimeout == 0 {
+		opts.ShutdownTimeout = defaultShutdownTimeout
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &Server{
+		path:            path,
+		eventPath:       eventPath,
+		opts:            opts,
+		ctx:             ctx,
+		cancel:          cancel,
+		pipelineDone:    make(chan struct{}),
+		shutdownStarted: make(chan struct{}),
+	}
 
 	// Create a new watcher
 	config := WatcherConfig{
@@ -226,26 +286,19 @@ func EventServer(path, allowed, eventAddr, eventPath string, refreshDuration tim
 		ExcludePatterns: nil,
 		IncludeEvents:   nil,
 		IgnoreEvents:    nil,
+		Roots:           opts.Roots,
+		Backend:         opts.Backend,
+		IgnoreFiles:     opts.IgnoreFiles,
+	}
+	if opts.PollInterval > 0 {
+		config.PollInterval = opts.PollInterval
 	}
 
 	// Apply filter options if provided
 	if opts.Filter != nil {
-		// Convert filter patterns to string arrays
-		if len(opts.Filter.includePatterns) > 0 {
-			config.IncludePatterns = make([]string, len(opts.Filter.includePatterns))
-			for i, pattern := range opts.Filter.includePatterns {
-				// Use pattern as string directly since glob.Glob doesn't have String() method
-				config.IncludePatterns[i] = fmt.Sprintf("%v", pattern)
-			}
-		}
-
-		if len(opts.Filter.excludePatterns) > 0 {
-			config.ExcludePatterns = make([]string, len(opts.Filter.excludePatterns))
-			for i, pattern := range opts.Filter.excludePatterns {
-				// Use pattern as string directly since glob.Glob doesn't have String() method
-				config.ExcludePatterns[i] = fmt.Sprintf("%v", pattern)
-			}
-		}
+		// The watcher compiles the same patterns
+		config.IncludePatterns = opts.Filter.IncludePatterns()
+		config.ExcludePatterns = opts.Filter.ExcludePatterns()
 
 		// Convert event types to string arrays
 		if len(opts.Filter.includeEvents) > 0 {
@@ -267,134 +320,346 @@ func EventServer(path, allowed, eventAddr, eventPath string, refreshDuration tim
 
 	watcher, err := NewWatcher(ctx, config)
 	if err != nil {
-		FatalExit(err)
+		cancel()
+		return nil, err
 	}
-	defer watcher.Close()
+	s.watcher = watcher
+	logger.Infof("Using the %s backend", watcher.Backend())
 
-	// Create a webhook manager if configured
-	var webhookManager *WebhookManager
+	// Create a webhook manager per target, each with its own queue so that
+	// a failing target does not hold up the others
+	targets := opts.WebhookTargets
 	if opts.WebhookURL != "" {
-		webhookManager = NewWebhookManager(WebhookConfig{
+		targets = append([]WebhookConfig{{
 			URL:              opts.WebhookURL,
 			Method:           opts.WebhookMethod,
 			Headers:          opts.WebhookHeaders,
 			Timeout:          opts.WebhookTimeout,
 			DebounceDuration: opts.WebhookDebounceDuration,
+			DebounceMode:     opts.WebhookDebounceMode,
+			DebounceMaxWait:  opts.WebhookDebounceMaxWait,
 			MaxRetries:       opts.WebhookMaxRetries,
-		})
+			RetryBackoff:     opts.WebhookRetryBackoff,
+			MaxRetryBackoff:  opts.WebhookMaxRetryBackoff,
+			Secrets:          opts.WebhookSecrets,
+			Batch:            opts.WebhookBatch,
+			Breaker:          opts.WebhookBreaker,
+			Template:         opts.WebhookTemplate,
+			ContentType:      opts.WebhookContentType,
+		}}, targets...)
+	}
+	if s.webhooks, err = newWebhooks(targets, opts.WebhookQueueDir); err != nil {
+		cancel()
+		return nil, err
 	}
 
-	// Create the appropriate streamer based on the stream method
-	var streamer EventStreamer
+	// Create the actions if configured, their events go to the streamer
+	if len(opts.Actions) > 0 {
+		if s.execRunner, err = NewExecRunner(opts.Actions, s.publishExec); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
 
+	// Create the appropriate streamer based on the stream method.
+	// Events are filtered before they are sent, so the streamers get no filter.
 	streamerOpts := StreamerOptions{
-		Address:         eventAddr,
-		Path:            eventPath,
-		AllowedOrigin:   allowed,
-		RefreshDuration: refreshDuration,
-		Filter:          opts.Filter,
+		Address:            eventAddr,
+		Path:               eventPath,
+		AllowedOrigin:      allowed,
+		RefreshDuration:    refreshDuration,
+		ReplayBufferSize:   opts.ReplayBufferSize,
+		ClientBufferSize:   opts.ClientBufferSize,
+		SlowConsumerPolicy: opts.SlowConsumerPolicy,
+	}
+
+	// A single HTTP server owns the listener for all endpoints
+	s.httpServer = NewHTTPServer(eventAddr)
+	if opts.AdminToken != "" {
+		s.httpServer.Handle(WatchesPath, requireToken(opts.AdminToken, watchesHandler(watcher)))
+		logger.Infof("Admin API enabled on %s", WatchesPath)
+		if len(s.webhooks) > 0 {
+			s.httpServer.Handle(WebhooksPath, requireToken(opts.AdminToken, webhooksHandler(s.webhooks)))
+		}
 	}
 
 	switch opts.StreamMethod {
-	case StreamMethodSSE:
-		streamer = NewSSEStreamer(streamerOpts)
 	case StreamMethodWebSocket:
-		streamer = NewWebSocketStreamer(streamerOpts)
+		wsOpts := streamerOpts
+		wsOpts.Path = DefaultWebSocketPath
+		wsStreamer := NewWebSocketStreamer(wsOpts)
+		s.httpServer.Handle(DefaultWebSocketPath, wsStreamer.Handler())
+		// Keep serving WebSockets on the event path for existing clients
+		if eventPath != DefaultWebSocketPath {
+			s.httpServer.Handle(eventPath, wsStreamer.Handler())
+		}
+		s.streamer = wsStreamer
 	case StreamMethodBoth:
-		// For WebSocket, use a different path by appending "/ws" to the eventPath
+		if eventPath == DefaultWebSocketPath {
+			cancel()
+			return nil, fmt.Errorf("event path %s is reserved for WebSockets when streaming both", eventPath)
+		}
 		wsOpts := streamerOpts
-		wsOpts.Path = eventPath + "/ws"
+		wsOpts.Path = DefaultWebSocketPath
 
 		sseStreamer := NewSSEStreamer(streamerOpts)
 		wsStreamer := NewWebSocketStreamer(wsOpts)
 
-		streamer = NewMultiStreamer(sseStreamer, wsStreamer)
+		s.httpServer.Handle(eventPath, sseStreamer.Handler())
+		s.httpServer.Handle(DefaultWebSocketPath, wsStreamer.Handler())
+		// Keep serving WebSockets on the legacy "<event-path>/ws" path
+		s.httpServer.Handle(eventPath+DefaultWebSocketPath, wsStreamer.Handler())
+
+		s.streamer = NewMultiStreamer(sseStreamer, wsStreamer)
 	default:
 		// Default to SSE for backward compatibility
-		streamer = NewSSEStreamer(streamerOpts)
+		sseStreamer := NewSSEStreamer(streamerOpts)
+		s.httpServer.Handle(eventPath, sseStreamer.Handler())
+		s.streamer = sseStreamer
+	}
+
+	return s, nil
+}
+
+// Addr returns the address the HTTP server is listening on
+func (s *Server) Addr() string {
+	return s.httpServer.Addr()
+}
+
+// Run starts watching and serving, and blocks until ctx is canceled or
+// Shutdown is called. When ctx is canceled, Run shuts the server down
+// gracefully within the configured shutdown timeout.
+func (s *Server) Run(ctx context.Context) error {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return errors.New("server already started")
 	}
+	s.running = true
+	s.mu.Unlock()
 
 	// Start the streamer
-	if err := streamer.Start(ctx); err != nil {
-		FatalExit(err)
+	if err := s.streamer.Start(s.ctx); err != nil {
+		s.abort()
+		return err
+	}
+
+	// Start serving
+	if err := s.httpServer.Start(); err != nil {
+		s.abort()
+		return err
 	}
 
 	// Collect events from the watcher and send them to the streamer
-	go func() {
-		for {
-			select {
-			case events := <-watcher.Events():
-				for _, event := range events {
-					// Check if the event should be filtered
-					shouldProcess := true
-					if opts.Filter != nil {
-						shouldProcess = opts.Filter.ShouldProcessEvent(event)
-						if !shouldProcess {
-							logger.Debugf("Filtered event: %s %s", event.Op, event.Name)
-						}
-					}
+	go s.processEvents()
+	go s.processErrors()
+	s.mu.Lock()
+	s.started = true
+	s.mu.Unlock()
+
+	// Start the actions, restarted commands start right away
+	if s.execRunner != nil {
+		s.execRunner.Start()
+	}
 
-					// Only process the event if it passes the filter
-					if shouldProcess {
-						// Print the event to the console
-						if opts.ShowEvents {
-							// Format the event for display
-							var eventType string
-							switch event.Op {
-							case fsnotify.Create:
-								eventType = "CREATE"
-							case fsnotify.Write:
-								eventType = "WRITE"
-							case fsnotify.Remove:
-								eventType = "REMOVE"
-							case fsnotify.Rename:
-								eventType = "RENAME"
-							case fsnotify.Chmod:
-								eventType = "CHMOD"
-							default:
-								eventType = "UNKNOWN"
-							}
-
-							// Get relative path if possible
-							relPath := event.Name
-							if absPath, err := filepath.Abs(path); err == nil {
-								if rel, err := filepath.Rel(absPath, event.Name); err == nil {
-									relPath = rel
-								}
-							}
-
-							// Log the event with colors using zerolog
-							logger.Event(eventType, relPath)
-						}
+	// Start the watcher
+	s.watcher.Start()
+	if len(s.webhooks) > 0 {
+		health.SetCheck(webhooksCheck, s.checkWebhooks)
+	}
+	health.SetReady(true)
+
+	select {
+	case <-ctx.Done():
+		logger.Info("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.opts.ShutdownTimeout)
+		defer cancel()
+		return s.Shutdown(shutdownCtx)
+	case <-s.shutdownStarted:
+		// Shutdown was called directly; wait for it to finish
+		<-s.ctx.Done()
+		return nil
+	}
+}
 
-						// Send the event to the streamer
-						if err := streamer.Send(event); err != nil && LogError != nil {
-							LogError(err)
-						}
+// abort closes the watcher, the actions and the webhooks when Run fails to
+// start, so that a later Shutdown has nothing left to wait for
+func (s *Server) abort() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.ShutdownTimeout)
+	defer cancel()
+	s.Shutdown(ctx)
+}
 
-						// Send webhook if configured
-						if webhookManager != nil {
-							webhookManager.HandleEvent(event)
-						}
-					}
-				}
+// Shutdown gracefully stops the server. The watcher's pending batch is
+// flushed and processed, in-flight webhook deliveries finish, WebSocket
+// clients receive a close frame and the HTTP server stops accepting
+// connections. If ctx expires first, the remaining steps are cut short
+// and the context error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		close(s.shutdownStarted)
+		s.shutdownErr = s.shutdown(ctx)
+	})
+	return s.shutdownErr
+}
 
-			case err := <-watcher.Errors():
-				if err != nil && LogError != nil {
-					LogError(err)
-				}
+// shutdown performs the shutdown steps in order
+func (s *Server) shutdown(ctx context.Context) error {
+	defer s.cancel()
+	health.SetReady(false)
+	health.SetCheck(webhooksCheck, nil)
 
-			case <-ctx.Done():
-				return
-			}
+	var errs []error
+
+	// Stop the watcher; it flushes its pending batch before closing its channels
+	if err := s.watcher.Close(); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Wait for every flushed event to reach the streamers and webhooks
+	s.mu.Lock()
+	started := s.started
+	s.mu.Unlock()
+	if started {
+		select {
+		case <-s.pipelineDone:
+		case <-ctx.Done():
+			errs = append(errs, fmt.Errorf("waiting for pending events: %w", ctx.Err()))
+		}
+	}
+
+	// Stop the actions, their last events still reach the streamers
+	if s.execRunner != nil {
+		if err := s.execRunner.Close(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("stopping actions: %w", err))
 		}
+	}
+
+	// Finish in-flight webhook deliveries
+	if err := closeWebhooks(ctx, s.webhooks); err != nil {
+		errs = append(errs, fmt.Errorf("closing webhooks: %w", err))
+	}
+
+	// Disconnect streaming clients, sending WebSocket close frames
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.streamer.Stop()
 	}()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			errs = append(errs, err)
+		}
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("stopping streamers: %w", ctx.Err()))
+	}
 
-	// Start the watcher
-	watcher.Start()
+	// Stop the HTTP server
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("shutting down http server: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// processEvents sends the watcher's batches to the streamer and webhooks
+// until the watcher closes its channel
+func (s *Server) processEvents() {
+	defer close(s.pipelineDone)
+
+	for events := range s.watcher.Events() {
+		for _, event := range events {
+			s.processEvent(event)
+		}
+	}
+}
+
+// processErrors logs the watcher's errors until the watcher closes its channel
+func (s *Server) processErrors() {
+	for err := range s.watcher.Errors() {
+		if err != nil && LogError != nil {
+			LogError(err)
+		}
+	}
+}
+
+// processEvent filters, sequences, logs and delivers a single event
+func (s *Server) processEvent(event Event) {
+	// Check if the event should be filtered
+	// Only the global filter counts, not those of subscriptions, webhooks
+	// and actions, which see the same events again
+	if s.opts.Filter != nil && !s.opts.Filter.ShouldProcessEvent(event) {
+		metrics.EventsFiltered.Inc()
+		logger.Debugf("Filtered event: %s %s", event.Op, event.Name)
+		return
+	}
+
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	// Every transport sees the same id for the same event
+	s.sequence++
+	event.ID = s.sequence
+
+	// Print the event to the console
+	if s.opts.ShowEvents {
+		// Format the event for display; moves and removes carry several bits
+		eventType := strings.ToUpper(event.OpString())
+
+		// Log the event with colors using zerolog
+		relPath := event.RelPath
+		if event.OldName != "" {
+			relPath = relativePath(event.Root, event.OldName) + " -> " + relPath
+		}
+		if s.watcher.rootCount() > 1 {
+			relPath = event.RootName + ":" + relPath
+		}
+		logger.Event(eventType, relPath)
+	}
+
+	// Send the event to the streamer
+	if err := s.streamer.Send(event); err != nil && LogError != nil {
+		LogError(err)
+	}
+
+	// Send the webhooks that accept the event
+	for _, webhook := range s.webhooks {
+		webhook.HandleEvent(event)
+	}
 
-	// Block until context is canceled
-	<-ctx.Done()
+	// Run the actions that accept the event
+	if s.execRunner != nil {
+		s.execRunner.HandleEvent(event)
+	}
+}
+
+// publishExec sequences an event of an action and sends it to the
+// streamer. Such events are about commands rather than files, so the
+// server's filter does not apply to them.
+func (s *Server) publishExec(event Event) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	s.sequence++
+	event.ID = s.sequence
+	if err := s.streamer.Send(event); err != nil && LogError != nil {
+		LogError(err)
+	}
+}
+
+// EventServer starts a server that serves events over SSE and/or WebSockets.
+// It blocks forever and calls FatalExit on errors; use NewServer and
+// Server.Run for graceful shutdown and error handling.
+func EventServer(path, allowed, eventAddr, eventPath string, refreshDuration time.Duration, options ...Option) {
+	server, err := NewServer(path, allowed, eventAddr, eventPath, refreshDuration, options...)
+	if err != nil {
+		FatalExit(err)
+		return
+	}
+
+	if err := server.Run(context.Background()); err != nil {
+		FatalExit(err)
+	}
 }
 
 // eventOpToString converts an fsnotify.Op to a string
@@ -410,6 +675,12 @@ func eventOpToString(op fsnotify.Op) string {
 		return "rename"
 	case fsnotify.Chmod:
 		return "chmod"
+	case OpMove:
+		return "move"
+	case OpOverflow:
+		return "overflow"
+	case OpExec:
+		return "exec"
 	default:
 		return ""
 	}
@@ -429,12 +700,54 @@ type Options struct {
 	WebhookTimeout time.Duration
 	// Debounce duration for webhooks
 	WebhookDebounceDuration time.Duration
+	// Debounce mode for webhooks, and the limit of trailing debounce
+	WebhookDebounceMode    DebounceMode
+	WebhookDebounceMaxWait time.Duration
 	// Maximum number of retries for webhook requests
 	WebhookMaxRetries int
+	// Directory of the webhook delivery queues and dead-letter stores, with
+	// a subdirectory per webhook, DefaultWebhookQueueDir if empty
+	WebhookQueueDir string
+	// Delay before the first webhook retry, doubled for every further retry
+	WebhookRetryBackoff time.Duration
+	// Maximum delay between webhook retries
+	WebhookMaxRetryBackoff time.Duration
+	// Secrets for signing webhook requests
+	WebhookSecrets []string
+	// Batching of webhook deliveries
+	WebhookBatch WebhookBatchConfig
+	// Circuit breaker of webhook receivers
+	WebhookBreaker WebhookBreakerConfig
+	// Template for webhook request bodies
+	WebhookTemplate string
+	// Content type of webhook requests
+	WebhookContentType string
+	// Webhook targets besides WebhookURL, each with its own settings
+	WebhookTargets []WebhookConfig
 	// Stream method to use
 	StreamMethod StreamMethod
 	// Show events in the console
 	ShowEvents bool
+	// Number of recent events kept for SSE replay
+	ReplayBufferSize int
+	// Number of messages buffered per streaming client
+	ClientBufferSize int
+	// Maximum time allowed for a graceful shutdown
+	ShutdownTimeout time.Duration
+	// What to do when a streaming client's buffer is full
+	SlowConsumerPolicy SlowConsumerPolicy
+	// Directory trees to watch instead of the server's path
+	Roots []RootConfig
+	// Watcher backend: inotify, poll, fanotify or auto
+	Backend string
+	// Interval for discovering new directories and for the poll backend
+	PollInterval time.Duration
+	// Bearer token of the admin API, which is disabled without one
+	AdminToken string
+	// Ignore files honoured instead of the default excludes, e.g. ".gitignore"
+	IgnoreFiles []string
+	// Commands run when files change
+	Actions []ActionConfig
 }
 
 // Option is a function that configures Options
@@ -480,6 +793,15 @@ func WithWebhookDebounce(duration time.Duration) Option {
 	}
 }
 
+// WithWebhookDebounceMode creates an Option that sets the webhook debounce
+// mode, and how long trailing events can be held back
+func WithWebhookDebounceMode(mode DebounceMode, maxWait time.Duration) Option {
+	return func(o *Options) {
+		o.WebhookDebounceMode = mode
+		o.WebhookDebounceMaxWait = maxWait
+	}
+}
+
 // WithWebhookRetries creates an Option that sets the webhook max retries
 func WithWebhookRetries(retries int) Option {
 	return func(o *Options) {
@@ -487,6 +809,63 @@ func WithWebhookRetries(retries int) Option {
 	}
 }
 
+// WithWebhookQueueDir creates an Option that sets the directory of the
+// webhook delivery queue, which keeps undelivered webhooks across restarts
+func WithWebhookQueueDir(dir string) Option {
+	return func(o *Options) {
+		o.WebhookQueueDir = dir
+	}
+}
+
+// WithWebhookBackoff creates an Option that sets the delay before the first
+// webhook retry and the maximum delay between retries
+func WithWebhookBackoff(initial, max time.Duration) Option {
+	return func(o *Options) {
+		o.WebhookRetryBackoff = initial
+		o.WebhookMaxRetryBackoff = max
+	}
+}
+
+// WithWebhookSecrets creates an Option that signs webhook requests with the
+// given secrets, see package verify
+func WithWebhookSecrets(secrets ...string) Option {
+	return func(o *Options) {
+		o.WebhookSecrets = secrets
+	}
+}
+
+// WithWebhookBatch creates an Option that sends webhooks in batches
+func WithWebhookBatch(batch WebhookBatchConfig) Option {
+	return func(o *Options) {
+		o.WebhookBatch = batch
+	}
+}
+
+// WithWebhookBreaker creates an Option that configures the circuit breaker
+// that pauses webhooks while the receiver is down
+func WithWebhookBreaker(breaker WebhookBreakerConfig) Option {
+	return func(o *Options) {
+		o.WebhookBreaker = breaker
+	}
+}
+
+// WithWebhookTemplate creates an Option that renders webhook request bodies
+// with a text/template, see WebhookConfig.Template
+func WithWebhookTemplate(template, contentType string) Option {
+	return func(o *Options) {
+		o.WebhookTemplate = template
+		o.WebhookContentType = contentType
+	}
+}
+
+// WithWebhookTargets creates an Option that adds webhook targets, each with
+// its own URL, filter and delivery settings
+func WithWebhookTargets(targets ...WebhookConfig) Option {
+	return func(o *Options) {
+		o.WebhookTargets = append(o.WebhookTargets, targets...)
+	}
+}
+
 // WithStreamMethod creates an Option that sets the stream method
 func WithStreamMethod(method StreamMethod) Option {
 	return func(o *Options) {
@@ -501,6 +880,73 @@ func WithShowEvents(show bool) Option {
 	}
 }
 
+// WithReplayBufferSize creates an Option that sets the number of events kept for SSE replay
+func WithReplayBufferSize(size int) Option {
+	return func(o *Options) {
+		o.ReplayBufferSize = size
+	}
+}
+
+// WithSlowConsumer creates an Option that sets the per-client buffer size and slow-consumer policy
+func WithSlowConsumer(bufferSize int, policy SlowConsumerPolicy) Option {
+	return func(o *Options) {
+		o.ClientBufferSize = bufferSize
+		o.SlowConsumerPolicy = policy
+	}
+}
+
+// WithRoots creates an Option that watches several directory trees, each
+// with its own configuration, instead of the server's path
+func WithRoots(roots ...RootConfig) Option {
+	return func(o *Options) {
+		o.Roots = roots
+	}
+}
+
+// WithBackend creates an Option that sets the watcher backend and its poll interval
+func WithBackend(backend string, pollInterval time.Duration) Option {
+	return func(o *Options) {
+		o.Backend = backend
+		o.PollInterval = pollInterval
+	}
+}
+
+// WithIgnoreFiles creates an Option that makes the watcher honour the given
+// ignore files, or DefaultIgnoreFiles if none are given, at every level of
+// the tree instead of the default excludes
+func WithIgnoreFiles(names ...string) Option {
+	return func(o *Options) {
+		if len(names) == 0 {
+			names = DefaultIgnoreFiles
+		}
+		o.IgnoreFiles = names
+	}
+}
+
+// WithAdminToken creates an Option that serves the admin API for adding and
+// removing watch roots at runtime, and the status of the webhooks, for
+// requests with the given bearer token
+func WithAdminToken(token string) Option {
+	return func(o *Options) {
+		o.AdminToken = token
+	}
+}
+
+// WithActions creates an Option that runs commands when files change, and
+// streams their output and exit status as OpExec events
+func WithActions(actions ...ActionConfig) Option {
+	return func(o *Options) {
+		o.Actions = append(o.Actions, actions...)
+	}
+}
+
+// WithShutdownTimeout creates an Option that sets the maximum time allowed for a graceful shutdown
+func WithShutdownTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.ShutdownTimeout = timeout
+	}
+}
+
 // FilterOption is a function that configures an EventFilter
 type FilterOption func(*EventFilter)
 
@@ -531,3 +977,21 @@ func WithIgnoreEvents(events string) FilterOption {
 		f.SetIgnoreEvents(events)
 	}
 }
+
+// webhooksCheck is the name of the readiness check of the webhooks
+const webhooksCheck = "webhooks"
+
+// checkWebhooks fails while the circuit of a webhook is open, so that the
+// readiness probe shows that deliveries are degraded
+func (s *Server) checkWebhooks() error {
+	var open []string
+	for _, webhook := range s.webhooks {
+		if webhook.breaker.isOpen() {
+			open = append(open, webhook.Config.Name)
+		}
+	}
+	if len(open) > 0 {
+		return fmt.Errorf("circuit open for %s", strings.Join(open, ", "))
+	}
+	return nil
+}
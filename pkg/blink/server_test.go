@@ -1,8 +1,12 @@
 package blink
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
@@ -130,3 +134,163 @@ func TestEventServer(t *testing.T) {
 	// event stream and verify that we receive the expected events
 	// However, that requires more complex HTTP client setup for SSE
 }
+
+// TestServerGracefulShutdown checks that cancelling the Run context drains
+// pending events to connected clients and stops the server cleanly
+func TestServerGracefulShutdown(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	tempDir := t.TempDir()
+
+	server, err := NewServer(tempDir, "*", "127.0.0.1:0", "/events", 100*time.Millisecond,
+		WithShowEvents(false),
+		WithShutdownTimeout(2*time.Second),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- server.Run(ctx)
+	}()
+
+	// Avoid idle connections the transport may dial ahead, which would
+	// keep the HTTP server from shutting down
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	// Wait for the server to become ready
+	var baseURL string
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if addr := server.Addr(); addr != "127.0.0.1:0" {
+			baseURL = "http://" + addr
+			if resp, err := client.Get(baseURL + ReadyPath); err == nil {
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusOK {
+					break
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Server did not become ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err := client.Get(baseURL + "/events")
+	if err != nil {
+		t.Fatalf("Failed to connect to event stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Write a file and shut down right away; the pending batch must still be delivered
+	testFile := filepath.Join(tempDir, "test.txt")
+	if err := os.WriteFile(testFile, []byte("test"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-runErr:
+		if err != nil {
+			t.Fatalf("Run returned an error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+
+	// The stream ends after the drained events were written
+	body, err := io.ReadAll(bufio.NewReader(resp.Body))
+	if err != nil {
+		t.Fatalf("Failed to read event stream: %v", err)
+	}
+	if !strings.Contains(string(body), testFile) {
+		t.Errorf("Expected event for %s before the stream closed, got %q", testFile, body)
+	}
+
+	// The server no longer accepts connections
+	if _, err := client.Get(baseURL + HealthPath); err == nil {
+		t.Error("Expected the HTTP server to be stopped")
+	}
+}
+
+// TestServerRunFailure checks that a Run that fails to start releases the
+// server, so that a later Shutdown does not wait for events that never come
+func TestServerRunFailure(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer busy.Close()
+
+	server, err := NewServer(t.TempDir(), "*", busy.Addr().String(), "/events", 100*time.Millisecond,
+		WithShowEvents(false),
+		WithShutdownTimeout(2*time.Second),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	if err := server.Run(context.Background()); err == nil {
+		t.Fatal("Expected Run to fail on a busy address")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Expected a clean shutdown, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Shutdown took %v", elapsed)
+	}
+}
+
+// TestServerWebhooksEndpoint tests that the webhook status is only served
+// with the admin token
+func TestServerWebhooksEndpoint(t *testing.T) {
+	for _, token := range []string{"", "secret"} {
+		server, err := NewServer(t.TempDir(), "*", "127.0.0.1:0", "/events", 100*time.Millisecond,
+			WithShowEvents(false),
+			WithAdminToken(token),
+			WithWebhookTargets(WebhookConfig{Name: "ci", URL: "http://127.0.0.1:1/hook", QueueDir: t.TempDir()}),
+		)
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+		get := func(auth string) int {
+			req := httptest.NewRequest(http.MethodGet, WebhooksPath, nil)
+			if auth != "" {
+				req.Header.Set("Authorization", "Bearer "+auth)
+			}
+			rec := httptest.NewRecorder()
+			server.httpServer.Handler().ServeHTTP(rec, req)
+			return rec.Code
+		}
+
+		if token == "" {
+			if code := get(""); code != http.StatusNotFound {
+				t.Errorf("Without a token: got status %d, want %d", code, http.StatusNotFound)
+			}
+		} else {
+			if code := get(""); code != http.StatusUnauthorized {
+				t.Errorf("Without credentials: got status %d, want %d", code, http.StatusUnauthorized)
+			}
+			if code := get(token); code != http.StatusOK {
+				t.Errorf("With the token: got status %d, want %d", code, http.StatusOK)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if err := server.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown failed: %v", err)
+		}
+		cancel()
+	}
+}
@@ -5,12 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/TFMV/blink/pkg/logger"
-	"github.com/fsnotify/fsnotify"
+	"github.com/TFMV/blink/pkg/metrics"
 	"github.com/gorilla/websocket"
 )
 
@@ -35,7 +37,69 @@ type EventStreamer interface {
 	Stop() error
 
 	// Send delivers an event to all connected clients
-	Send(event fsnotify.Event) error
+	Send(event Event) error
+}
+
+// SlowConsumerPolicy defines what happens when a client's send buffer is full
+type SlowConsumerPolicy string
+
+const (
+	// SlowConsumerDropOldest discards the oldest queued message to make room for the new one
+	SlowConsumerDropOldest SlowConsumerPolicy = "drop-oldest"
+	// SlowConsumerDropNewest discards the new message and keeps the queue as is
+	SlowConsumerDropNewest SlowConsumerPolicy = "drop-newest"
+	// SlowConsumerDisconnect closes the connection of the slow client
+	SlowConsumerDisconnect SlowConsumerPolicy = "disconnect"
+)
+
+// Default number of messages buffered per client
+const defaultClientBufferSize = 256
+
+// Interval between SSE keep-alive comments
+const sseKeepAliveInterval = 30 * time.Second
+
+// ParseSlowConsumerPolicy converts a string to a SlowConsumerPolicy
+func ParseSlowConsumerPolicy(policy string) (SlowConsumerPolicy, error) {
+	switch SlowConsumerPolicy(strings.ToLower(strings.TrimSpace(policy))) {
+	case SlowConsumerDropOldest:
+		return SlowConsumerDropOldest, nil
+	case SlowConsumerDropNewest:
+		return SlowConsumerDropNewest, nil
+	case SlowConsumerDisconnect:
+		return SlowConsumerDisconnect, nil
+	default:
+		return "", fmt.Errorf("unknown slow consumer policy: %q", policy)
+	}
+}
+
+// offer delivers a message to a client channel without blocking, applying the
+// slow-consumer policy if the channel is full.
+// Returns false if the client should be disconnected.
+func offer[T any](ch chan T, message T, policy SlowConsumerPolicy) (delivered, keep bool) {
+	select {
+	case ch <- message:
+		return true, true
+	default:
+	}
+
+	switch policy {
+	case SlowConsumerDisconnect:
+		return false, false
+	case SlowConsumerDropOldest:
+		// Make room by discarding the oldest message, then retry once
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- message:
+			return true, true
+		default:
+			return false, true
+		}
+	default:
+		return false, true
+	}
 }
 
 // StreamerOptions contains configuration for event streamers
@@ -54,16 +118,49 @@ type StreamerOptions struct {
 
 	// Filter for events
 	Filter *EventFilter
+
+	// ReplayBufferSize is the number of recent events kept for SSE replay
+	ReplayBufferSize int
+
+	// ClientBufferSize is the number of messages buffered per client
+	ClientBufferSize int
+
+	// SlowConsumerPolicy is the default policy for clients whose buffer is full.
+	// SSE clients can override it with the "slow_consumer" query parameter.
+	SlowConsumerPolicy SlowConsumerPolicy
 }
 
 // SSEStreamer implements EventStreamer using Server-Sent Events
 type SSEStreamer struct {
 	opts      StreamerOptions
-	server    *http.Server
-	events    TimeEventMap
-	mutex     sync.Mutex
-	clients   map[string]chan fsnotify.Event
-	clientsMu sync.Mutex
+	ring      *EventRing
+	clients   map[string]*sseClient
+	clientsMu sync.RWMutex
+	stopped   bool // Protected by clientsMu
+}
+
+// sseClient represents a connected SSE client
+type sseClient struct {
+	id        string
+	events    chan Event
+	policy    SlowConsumerPolicy
+	sub       *subscription
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// close signals the client's handler to return
+func (c *sseClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// sseGap is the payload of the "gap" event sent to clients whose
+// Last-Event-ID is no longer covered by the replay buffer
+type sseGap struct {
+	LastEventID uint64 `json:"last_event_id"`
+	OldestID    uint64 `json:"oldest_id"`
 }
 
 // NewSSEStreamer creates a new SSE streamer
@@ -80,31 +177,32 @@ func NewSSEStreamer(opts StreamerOptions) *SSEStreamer {
 	if opts.RefreshDuration == 0 {
 		opts.RefreshDuration = 100 * time.Millisecond
 	}
+	if opts.ReplayBufferSize == 0 {
+		opts.ReplayBufferSize = defaultReplayBufferSize
+	}
+	if opts.ClientBufferSize == 0 {
+		opts.ClientBufferSize = defaultClientBufferSize
+	}
+	if opts.SlowConsumerPolicy == "" {
+		opts.SlowConsumerPolicy = SlowConsumerDropNewest
+	}
 
 	return &SSEStreamer{
 		opts:    opts,
-		events:  make(TimeEventMap),
-		clients: make(map[string]chan fsnotify.Event),
+		ring:    NewEventRing(opts.ReplayBufferSize),
+		clients: make(map[string]*sseClient),
 	}
 }
 
+// Handler returns the http.Handler serving the SSE stream.
+// It is mounted on the shared HTTPServer.
+func (s *SSEStreamer) Handler() http.Handler {
+	return http.HandlerFunc(s.handleSSE)
+}
+
 // Start initializes and starts the SSE streamer
 func (s *SSEStreamer) Start(ctx context.Context) error {
-	mux := http.NewServeMux()
-	mux.HandleFunc(s.opts.Path, s.handleSSE)
-
-	s.server = &http.Server{
-		Addr:    s.opts.Address,
-		Handler: mux,
-	}
-
-	go func() {
-		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logger.Error(err)
-		}
-	}()
-
-	logger.Infof("SSE server started on %s%s", s.opts.Address, s.opts.Path)
+	logger.Infof("SSE streaming enabled on %s", s.opts.Path)
 
 	// Listen for context cancellation
 	go func() {
@@ -117,115 +215,280 @@ func (s *SSEStreamer) Start(ctx context.Context) error {
 	return nil
 }
 
-// Stop gracefully shuts down the SSE streamer
+// Stop gracefully shuts down the SSE streamer.
+// All streaming handlers write their queued events and return, so the
+// HTTP server can shut down. New connections are refused afterwards.
 func (s *SSEStreamer) Stop() error {
-	if s.server == nil {
-		return nil
-	}
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
 
-	// Create a shutdown context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	s.stopped = true
+	for _, client := range s.clients {
+		client.close()
+	}
 
-	// Shutdown the server
-	err := s.server.Shutdown(ctx)
-	return err
+	return nil
 }
 
 // Send delivers an event to all connected clients
-func (s *SSEStreamer) Send(event fsnotify.Event) error {
-	// Add the event to the map
-	now := time.Now()
+func (s *SSEStreamer) Send(event Event) error {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	// Sequence the event and keep it for replay
+	entry := s.ring.Append(event)
 
-	s.mutex.Lock()
-	s.events[now] = Event(event)
-	// Remove old events
-	RemoveOldEvents(&s.events, s.opts.RefreshDuration*10)
-	s.mutex.Unlock()
+	// Fan out to all clients
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+
+	for _, client := range s.clients {
+		if !client.sub.match(entry) {
+			continue
+		}
+		delivered, keep := offer(client.events, entry, client.policy)
+		if !delivered {
+			metrics.MessagesDropped.WithLabelValues(metrics.StreamSSE).Inc()
+		}
+		if !keep {
+			logger.Warnf("SSE client %s is too slow, disconnecting", client.id)
+			client.close()
+		} else if !delivered {
+			logger.Error(fmt.Errorf("SSE client %s send buffer full, dropping message", client.id))
+		}
+	}
 
 	return nil
 }
 
-// handleSSE handles SSE connections
+// handleSSE handles SSE connections.
+// Clients can subscribe to some of the events with query parameters, e.g.
+// ?root=api,web&include=*.go&events=write, see parseSubscription. Clients
+// that reconnect with a Last-Event-ID header (or a "since" query
+// parameter) receive exactly the buffered events after that id. If that id
+// has already fallen out of the replay buffer, a "gap" event is sent first.
 func (s *SSEStreamer) handleSSE(w http.ResponseWriter, r *http.Request) {
+	sub, err := parseSubscription(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	policy := s.opts.SlowConsumerPolicy
+	if value := r.URL.Query().Get("slow_consumer"); value != "" {
+		parsed, err := ParseSlowConsumerPolicy(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		policy = parsed
+	}
+
+	// Register the client before replaying, so no event falls between the
+	// replay and the live stream. Duplicates are skipped by id below.
+	client := &sseClient{
+		id:     fmt.Sprintf("%s-%d", r.RemoteAddr, time.Now().UnixNano()),
+		events: make(chan Event, s.opts.ClientBufferSize),
+		policy: policy,
+		sub:    sub,
+		done:   make(chan struct{}),
+	}
+	s.clientsMu.Lock()
+	if s.stopped {
+		s.clientsMu.Unlock()
+		http.Error(w, "event stream is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	s.clients[client.id] = client
+	s.clientsMu.Unlock()
+	metrics.ConnectedClients.WithLabelValues(metrics.StreamSSE).Inc()
+
+	defer func() {
+		s.clientsMu.Lock()
+		delete(s.clients, client.id)
+		s.clientsMu.Unlock()
+		client.close()
+		metrics.ConnectedClients.WithLabelValues(metrics.StreamSSE).Dec()
+	}()
+
 	w.Header().Set("Content-Type", "text/event-stream;charset=utf-8")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Access-Control-Allow-Origin", s.opts.AllowedOrigin)
+	w.WriteHeader(http.StatusOK)
+	Flush(w)
+
+	// New clients start at the live edge of the stream
+	lastID, resume := parseLastEventID(r)
+	if resume {
+		entries, gap := s.ring.Since(lastID)
+		if gap {
+			s.writeGap(w, lastID, entries)
+		}
+		for _, entry := range entries {
+			lastID = entry.ID
+			if client.sub.match(entry) {
+				s.writeEntry(w, entry)
+			}
+		}
+	} else {
+		lastID = s.ring.LastID()
+	}
 
-	var id uint64
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
 
 	for {
-		func() { // Use an anonymous function for defer
-			s.mutex.Lock()
-			defer s.mutex.Unlock()
-
-			if len(s.events) > 0 {
-				// Remove old keys
-				RemoveOldEvents(&s.events, s.opts.RefreshDuration*10)
-
-				// Sort the events by the registered time
-				var keys timeKeys
-				for k := range s.events {
-					keys = append(keys, k)
-				}
-				sort.Sort(keys)
-
-				prevname := ""
-				for _, k := range keys {
-					ev := s.events[k]
-
-					// Apply filter if one exists
-					if s.opts.Filter != nil && !s.opts.Filter.ShouldProcessEvent(fsnotify.Event(ev)) {
-						continue
-					}
-
-					// Log the event
-					logger.Infof("EVENT %s", ev.String())
-
-					// Avoid sending several events for the same filename
-					if ev.Name != prevname {
-						// Send an event to the client
-						WriteEvent(w, &id, ev.Name, true)
-						id++
-						prevname = ev.Name
-					}
-				}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-client.done:
+			s.drain(w, client, lastID)
+			return
+		case entry := <-client.events:
+			if entry.ID <= lastID {
+				continue
+			}
+			lastID = entry.ID
+			s.writeEntry(w, entry)
+		case <-keepAlive.C:
+			// Comment lines are ignored by EventSource but keep proxies from timing out
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return
 			}
-		}()
+			Flush(w)
+		}
+	}
+}
 
-		// Wait for old events to be gone, and new to appear
-		time.Sleep(s.opts.RefreshDuration)
+// drain writes the events still queued for a client when the streamer is
+// stopping, so a graceful shutdown does not lose them. Slow consumers that
+// were disconnected get nothing more.
+func (s *SSEStreamer) drain(w http.ResponseWriter, client *sseClient, lastID uint64) {
+	s.clientsMu.RLock()
+	stopped := s.stopped
+	s.clientsMu.RUnlock()
+	if !stopped {
+		return
+	}
+
+	for {
+		select {
+		case entry := <-client.events:
+			if entry.ID > lastID {
+				lastID = entry.ID
+				s.writeEntry(w, entry)
+			}
+		default:
+			return
+		}
 	}
 }
 
+// writeEntry sends a single sequenced event to the client if it passes the filter
+func (s *SSEStreamer) writeEntry(w http.ResponseWriter, entry Event) {
+	// Apply filter if one exists
+	if s.opts.Filter != nil && !s.opts.Filter.ShouldProcessEvent(entry) {
+		return
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		logger.Error(fmt.Errorf("failed to marshal event: %w", err))
+		return
+	}
+
+	// Log the event
+	logger.Infof("EVENT %s", entry.String())
+
+	// Send an event to the client
+	id := entry.ID
+	WriteEvent(w, &id, string(data), true)
+
+	metrics.MessagesSent.WithLabelValues(metrics.StreamSSE).Inc()
+	metrics.DeliveryLatency.WithLabelValues(metrics.StreamSSE).Observe(time.Since(entry.Timestamp).Seconds())
+}
+
+// writeGap tells the client that events after lastID are no longer available
+func (s *SSEStreamer) writeGap(w http.ResponseWriter, lastID uint64, entries []Event) {
+	payload := sseGap{LastEventID: lastID}
+	if len(entries) > 0 {
+		payload.OldestID = entries[0].ID
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		logger.Error(fmt.Errorf("failed to marshal gap event: %w", err))
+		return
+	}
+
+	WriteNamedEvent(w, nil, "gap", string(data), true)
+}
+
+// parseLastEventID returns the event id a client wants to resume from.
+// The Last-Event-ID header, sent by browsers on reconnect, takes precedence
+// over the "since" query parameter.
+func parseLastEventID(r *http.Request) (uint64, bool) {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("since")
+	}
+	if value == "" {
+		return 0, false
+	}
+
+	id, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		logger.Debugf("Ignoring invalid last event id: %q", value)
+		return 0, false
+	}
+	return id, true
+}
+
 // WebSocketClient represents a connected WebSocket client
 type WebSocketClient struct {
 	ID         string
 	Connection *websocket.Conn
-	SendChan   chan []byte
+	SendChan   chan WebSocketMessage
+	// What the client receives, replaced by its control messages
+	sub atomic.Pointer[subscription]
+}
+
+// WebSocketMessage is a message queued for a WebSocket client
+type WebSocketMessage struct {
+	// Data is the encoded message
+	Data []byte
+	// Observed is when the event behind the message was read from the
+	// kernel, zero for replies to control messages
+	Observed time.Time
 }
 
 // WebSocketStreamer implements EventStreamer using WebSockets
 type WebSocketStreamer struct {
-	server    *http.Server
-	upgrader  websocket.Upgrader
-	clients   map[string]*WebSocketClient
-	mutex     sync.RWMutex
-	opts      StreamerOptions
-	started   bool
-	filter    *EventFilter
-	clientsMu sync.Mutex
+	upgrader websocket.Upgrader
+	clients  map[string]*WebSocketClient
+	mutex    sync.RWMutex
+	opts     StreamerOptions
+	started  bool
+	stopped  bool // Refuses new connections once Stop was called
+	filter   *EventFilter
+	writers  sync.WaitGroup // Running writeLoops, waited for by Stop
 }
 
 // NewWebSocketStreamer creates a new WebSocket streamer
 func NewWebSocketStreamer(opts StreamerOptions) *WebSocketStreamer {
 	if opts.Path == "" {
-		opts.Path = "/ws"
+		opts.Path = DefaultWebSocketPath
 	}
 	if opts.Address == "" {
 		opts.Address = ":12345"
 	}
+	if opts.ClientBufferSize == 0 {
+		opts.ClientBufferSize = defaultClientBufferSize
+	}
+	if opts.SlowConsumerPolicy == "" {
+		opts.SlowConsumerPolicy = SlowConsumerDropNewest
+	}
 
 	streamer := &WebSocketStreamer{
 		clients: make(map[string]*WebSocketClient),
@@ -247,6 +510,12 @@ func NewWebSocketStreamer(opts StreamerOptions) *WebSocketStreamer {
 	return streamer
 }
 
+// Handler returns the http.Handler accepting WebSocket connections.
+// It is mounted on the shared HTTPServer.
+func (ws *WebSocketStreamer) Handler() http.Handler {
+	return http.HandlerFunc(ws.handleWebSocket)
+}
+
 // Start initializes and starts the WebSocket streamer
 func (ws *WebSocketStreamer) Start(ctx context.Context) error {
 	ws.mutex.Lock()
@@ -255,23 +524,10 @@ func (ws *WebSocketStreamer) Start(ctx context.Context) error {
 		return nil
 	}
 	ws.started = true
+	ws.stopped = false
 	ws.mutex.Unlock()
 
-	mux := http.NewServeMux()
-	mux.HandleFunc(ws.opts.Path, ws.handleWebSocket)
-
-	ws.server = &http.Server{
-		Addr:    ws.opts.Address,
-		Handler: mux,
-	}
-
-	go func() {
-		if err := ws.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logger.Error(fmt.Errorf("WebSocket server error: %w", err))
-		}
-	}()
-
-	logger.Infof("WebSocket server started on %s%s", ws.opts.Address, ws.opts.Path)
+	logger.Infof("WebSocket streaming enabled on %s", ws.opts.Path)
 
 	// Listen for context cancellation
 	go func() {
@@ -284,49 +540,41 @@ func (ws *WebSocketStreamer) Start(ctx context.Context) error {
 	return nil
 }
 
-// Stop gracefully shuts down the WebSocket streamer
+// Stop gracefully shuts down the WebSocket streamer.
+// Queued messages are flushed to every client before its close frame is sent.
 func (ws *WebSocketStreamer) Stop() error {
 	ws.mutex.Lock()
-	defer ws.mutex.Unlock()
-
-	if !ws.started || ws.server == nil {
+	ws.stopped = true
+	if !ws.started {
+		ws.mutex.Unlock()
 		return nil
 	}
 
-	// Close all client connections
+	// Closing the send channels makes writeLoop send a close frame
 	for _, client := range ws.clients {
 		close(client.SendChan)
-		client.Connection.Close()
 	}
 	ws.clients = make(map[string]*WebSocketClient)
-
-	// Create a shutdown context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	// Shutdown the server
-	err := ws.server.Shutdown(ctx)
 	ws.started = false
-	return err
+	ws.mutex.Unlock()
+
+	ws.writers.Wait()
+	return nil
 }
 
 // Send delivers an event to all connected clients
-func (ws *WebSocketStreamer) Send(event fsnotify.Event) error {
+func (ws *WebSocketStreamer) Send(event Event) error {
 	// Apply filter if one exists
 	if ws.filter != nil && !ws.filter.ShouldProcessEvent(event) {
 		return nil
 	}
 
-	// Create a message to send
-	message := map[string]interface{}{
-		"type":      "event",
-		"timestamp": time.Now().UnixNano() / 1000000,
-		"path":      event.Name,
-		"operation": eventOpToString(event.Op),
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
 	}
 
-	// Marshal the message to JSON
-	data, err := json.Marshal(message)
+	// Marshal the event to its canonical JSON
+	data, err := json.Marshal(event)
 	if err != nil {
 		return fmt.Errorf("failed to marshal event: %w", err)
 	}
@@ -335,13 +583,21 @@ func (ws *WebSocketStreamer) Send(event fsnotify.Event) error {
 	ws.mutex.RLock()
 	defer ws.mutex.RUnlock()
 
+	message := WebSocketMessage{Data: data, Observed: event.Timestamp}
 	for _, client := range ws.clients {
+		if !client.sub.Load().match(event) {
+			continue
+		}
 		// Non-blocking send to client's channel
-		select {
-		case client.SendChan <- data:
-			// Successfully sent
-		default:
-			// Channel is full, log and continue
+		delivered, keep := offer(client.SendChan, message, ws.opts.SlowConsumerPolicy)
+		if !delivered {
+			metrics.MessagesDropped.WithLabelValues(metrics.StreamWebSocket).Inc()
+		}
+		if !keep {
+			// Closing the connection makes readLoop unregister the client
+			logger.Warnf("WebSocket client %s is too slow, disconnecting", client.ID)
+			client.Connection.Close()
+		} else if !delivered {
 			logger.Error(fmt.Errorf("client %s send buffer full, dropping message", client.ID))
 		}
 	}
@@ -349,8 +605,16 @@ func (ws *WebSocketStreamer) Send(event fsnotify.Event) error {
 	return nil
 }
 
-// handleWebSocket handles WebSocket connections
+// handleWebSocket handles WebSocket connections. Like SSE clients,
+// WebSocket clients can subscribe with query parameters, and later change
+// their subscription with control messages, see controlMessage.
 func (ws *WebSocketStreamer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	sub, err := parseSubscription(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Upgrade the HTTP connection to a WebSocket connection
 	conn, err := ws.upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -365,13 +629,21 @@ func (ws *WebSocketStreamer) handleWebSocket(w http.ResponseWriter, r *http.Requ
 	client := &WebSocketClient{
 		ID:         clientID,
 		Connection: conn,
-		SendChan:   make(chan []byte, 256),
+		SendChan:   make(chan WebSocketMessage, ws.opts.ClientBufferSize),
 	}
+	client.sub.Store(sub)
 
-	// Register the client
-	ws.clientsMu.Lock()
+	// Register the client, unless the streamer is shutting down
+	ws.mutex.Lock()
+	if ws.stopped {
+		ws.mutex.Unlock()
+		conn.Close()
+		return
+	}
 	ws.clients[client.ID] = client
-	ws.clientsMu.Unlock()
+	ws.writers.Add(1)
+	ws.mutex.Unlock()
+	metrics.ConnectedClients.WithLabelValues(metrics.StreamWebSocket).Inc()
 
 	// Start goroutines for writing and reading
 	go ws.writeLoop(client)
@@ -384,6 +656,7 @@ func (ws *WebSocketStreamer) writeLoop(client *WebSocketClient) {
 	defer func() {
 		ticker.Stop()
 		client.Connection.Close()
+		ws.writers.Done()
 	}()
 
 	for {
@@ -397,10 +670,14 @@ func (ws *WebSocketStreamer) writeLoop(client *WebSocketClient) {
 			}
 
 			// Write the message
-			if err := client.Connection.WriteMessage(websocket.TextMessage, message); err != nil {
+			if err := client.Connection.WriteMessage(websocket.TextMessage, message.Data); err != nil {
 				logger.Error(fmt.Errorf("error writing to client %s: %w", client.ID, err))
 				return
 			}
+			if !message.Observed.IsZero() {
+				metrics.MessagesSent.WithLabelValues(metrics.StreamWebSocket).Inc()
+				metrics.DeliveryLatency.WithLabelValues(metrics.StreamWebSocket).Observe(time.Since(message.Observed).Seconds())
+			}
 
 		case <-ticker.C:
 			// Send ping to keep connection alive
@@ -419,6 +696,7 @@ func (ws *WebSocketStreamer) readLoop(client *WebSocketClient) {
 		delete(ws.clients, client.ID)
 		ws.mutex.Unlock()
 		client.Connection.Close()
+		metrics.ConnectedClients.WithLabelValues(metrics.StreamWebSocket).Dec()
 	}()
 
 	// Set read deadline and pong handler
@@ -428,15 +706,45 @@ func (ws *WebSocketStreamer) readLoop(client *WebSocketClient) {
 		return nil
 	})
 
-	// Read messages (mainly to detect disconnection)
+	// Read control messages until the client disconnects
 	for {
-		_, _, err := client.Connection.ReadMessage()
+		_, data, err := client.Connection.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				logger.Error(fmt.Errorf("WebSocket read error: %w", err))
 			}
 			break
 		}
+
+		reply := controlReply{Type: "ack"}
+		sub, request, err := applyControl(client.sub.Load(), data)
+		reply.Request = request
+		if err != nil {
+			reply.Type, reply.Error = "error", err.Error()
+			logger.Debugf("Rejected control message of WebSocket client %s: %v", client.ID, err)
+		} else {
+			client.sub.Store(sub)
+		}
+		ws.reply(client, reply)
+	}
+}
+
+// reply queues the answer to a control message, unless the client is gone
+func (ws *WebSocketStreamer) reply(client *WebSocketClient, reply controlReply) {
+	data, err := json.Marshal(reply)
+	if err != nil {
+		logger.Error(fmt.Errorf("failed to marshal control reply: %w", err))
+		return
+	}
+
+	// Stop closes the send channels of the registered clients
+	ws.mutex.RLock()
+	defer ws.mutex.RUnlock()
+	if ws.clients[client.ID] != client {
+		return
+	}
+	if delivered, _ := offer(client.SendChan, WebSocketMessage{Data: data}, ws.opts.SlowConsumerPolicy); !delivered {
+		metrics.MessagesDropped.WithLabelValues(metrics.StreamWebSocket).Inc()
 	}
 }
 
@@ -474,7 +782,7 @@ func (m *MultiStreamer) Stop() error {
 }
 
 // Send delivers an event to all streamers
-func (m *MultiStreamer) Send(event fsnotify.Event) error {
+func (m *MultiStreamer) Send(event Event) error {
 	var lastErr error
 	for _, streamer := range m.streamers {
 		if err := streamer.Send(event); err != nil {
@@ -1,6 +1,7 @@
 package blink
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -12,8 +13,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/TFMV/blink/pkg/metrics"
 	"github.com/fsnotify/fsnotify"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestSSEStreamer(t *testing.T) {
@@ -48,7 +51,7 @@ func TestSSEStreamer(t *testing.T) {
 	}
 
 	// Send a test event
-	event := fsnotify.Event{
+	event := Event{
 		Name: "/test/file.txt",
 		Op:   fsnotify.Create,
 	}
@@ -107,7 +110,7 @@ func TestWebSocketStreamer(t *testing.T) {
 	}
 
 	// Send a test event
-	event := fsnotify.Event{
+	event := Event{
 		Name: "/test/file.txt",
 		Op:   fsnotify.Create,
 	}
@@ -139,7 +142,7 @@ func TestMultiStreamer(t *testing.T) {
 	}
 
 	// Send a test event
-	event := fsnotify.Event{
+	event := Event{
 		Name: "/test/file.txt",
 		Op:   fsnotify.Create,
 	}
@@ -304,7 +307,373 @@ func (m *mockStreamer) Stop() error {
 	return nil
 }
 
-func (m *mockStreamer) Send(event fsnotify.Event) error {
+func (m *mockStreamer) Send(event Event) error {
 	m.received = true
 	return nil
 }
+
+// readSSEEvent reads lines from an SSE stream until a blank line ends the event
+func readSSEEvent(t *testing.T, reader *bufio.Reader) map[string]string {
+	t.Helper()
+
+	fields := make(map[string]string)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read SSE stream: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		if line == "" {
+			if len(fields) == 0 {
+				continue
+			}
+			return fields
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		if key, value, ok := strings.Cut(line, ": "); ok {
+			fields[key] = value
+		}
+	}
+}
+
+// sseClientCount returns the number of registered SSE clients
+func sseClientCount(s *SSEStreamer) int {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+	return len(s.clients)
+}
+
+// waitForSSEClients waits until the streamer has the given number of clients
+func waitForSSEClients(t *testing.T, s *SSEStreamer, count int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for sseClientCount(s) != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d SSE clients, got %d", count, sseClientCount(s))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSSEStreamerPush(t *testing.T) {
+	streamer := NewSSEStreamer(StreamerOptions{})
+	server := httptest.NewServer(http.HandlerFunc(streamer.handleSSE))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer resp.Body.Close()
+	waitForSSEClients(t, streamer, 1)
+
+	streamer.Send(Event{Name: "/test/a.txt", Op: fsnotify.Create})
+	streamer.Send(Event{Name: "/test/b.txt", Op: fsnotify.Write})
+
+	reader := bufio.NewReader(resp.Body)
+	for i, want := range []string{"/test/a.txt", "/test/b.txt"} {
+		event := readSSEEvent(t, reader)
+		var decoded Event
+		if err := json.Unmarshal([]byte(event["data"]), &decoded); err != nil {
+			t.Fatalf("Failed to decode event: %v", err)
+		}
+		if decoded.Name != want || decoded.ID != uint64(i+1) {
+			t.Errorf("Expected %s with id %d, got %s with id %d", want, i+1, decoded.Name, decoded.ID)
+		}
+		if event["id"] != fmt.Sprint(i+1) {
+			t.Errorf("Expected id %d, got %q", i+1, event["id"])
+		}
+	}
+
+	// The handler must return once the client goes away
+	cancel()
+	waitForSSEClients(t, streamer, 0)
+}
+
+func TestSSEStreamerReplay(t *testing.T) {
+	streamer := NewSSEStreamer(StreamerOptions{ReplayBufferSize: 3})
+	server := httptest.NewServer(http.HandlerFunc(streamer.handleSSE))
+	defer server.Close()
+
+	for i := 1; i <= 5; i++ {
+		streamer.Send(Event{Name: fmt.Sprintf("/test/%d.txt", i), Op: fsnotify.Write})
+	}
+
+	t.Run("Last-Event-ID within buffer", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		req.Header.Set("Last-Event-ID", "3")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer resp.Body.Close()
+
+		reader := bufio.NewReader(resp.Body)
+		for _, want := range []string{"4", "5"} {
+			if event := readSSEEvent(t, reader); event["id"] != want {
+				t.Errorf("Expected id %s, got %q", want, event["id"])
+			}
+		}
+	})
+
+	t.Run("since evicted from buffer", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "?since=1")
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer resp.Body.Close()
+
+		reader := bufio.NewReader(resp.Body)
+		gap := readSSEEvent(t, reader)
+		if gap["event"] != "gap" {
+			t.Fatalf("Expected gap event, got %v", gap)
+		}
+		var payload sseGap
+		if err := json.Unmarshal([]byte(gap["data"]), &payload); err != nil {
+			t.Fatalf("Failed to decode gap payload: %v", err)
+		}
+		if payload.LastEventID != 1 || payload.OldestID != 3 {
+			t.Errorf("Unexpected gap payload: %+v", payload)
+		}
+		if event := readSSEEvent(t, reader); event["id"] != "3" {
+			t.Errorf("Expected replay to resume at id 3, got %q", event["id"])
+		}
+	})
+}
+
+func TestSSEStreamerRoots(t *testing.T) {
+	streamer := NewSSEStreamer(StreamerOptions{})
+	server := httptest.NewServer(http.HandlerFunc(streamer.handleSSE))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?root=api,web")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer resp.Body.Close()
+	waitForSSEClients(t, streamer, 1)
+
+	streamer.Send(Event{Name: "/srv/api/a.go", Op: fsnotify.Write, RootName: "api"})
+	streamer.Send(Event{Name: "/srv/docs/b.md", Op: fsnotify.Write, RootName: "docs"})
+	streamer.Send(Event{Name: "/srv/web/c.js", Op: fsnotify.Write, RootName: "web"})
+
+	reader := bufio.NewReader(resp.Body)
+	for _, want := range []string{"/srv/api/a.go", "/srv/web/c.js"} {
+		var decoded Event
+		if err := json.Unmarshal([]byte(readSSEEvent(t, reader)["data"]), &decoded); err != nil {
+			t.Fatalf("Failed to decode event: %v", err)
+		}
+		if decoded.Name != want {
+			t.Errorf("Expected %s, got %s", want, decoded.Name)
+		}
+	}
+}
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	tests := []struct {
+		policy        SlowConsumerPolicy
+		wantDelivered bool
+		wantKeep      bool
+		wantQueue     []int
+	}{
+		{SlowConsumerDropOldest, true, true, []int{2, 3}},
+		{SlowConsumerDropNewest, false, true, []int{1, 2}},
+		{SlowConsumerDisconnect, false, false, []int{1, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			ch := make(chan int, 2)
+			ch <- 1
+			ch <- 2
+
+			delivered, keep := offer(ch, 3, tt.policy)
+			if delivered != tt.wantDelivered || keep != tt.wantKeep {
+				t.Errorf("offer() = (%v, %v), want (%v, %v)", delivered, keep, tt.wantDelivered, tt.wantKeep)
+			}
+
+			close(ch)
+			var queue []int
+			for v := range ch {
+				queue = append(queue, v)
+			}
+			if fmt.Sprint(queue) != fmt.Sprint(tt.wantQueue) {
+				t.Errorf("Queue = %v, want %v", queue, tt.wantQueue)
+			}
+		})
+	}
+}
+
+func TestSSEStreamerMetrics(t *testing.T) {
+	connected := metrics.ConnectedClients.WithLabelValues(metrics.StreamSSE)
+	sent := metrics.MessagesSent.WithLabelValues(metrics.StreamSSE)
+
+	streamer := NewSSEStreamer(StreamerOptions{})
+	server := httptest.NewServer(http.HandlerFunc(streamer.handleSSE))
+	defer server.Close()
+
+	connectedBefore := testutil.ToFloat64(connected)
+	sentBefore := testutil.ToFloat64(sent)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer resp.Body.Close()
+	waitForSSEClients(t, streamer, 1)
+
+	if got := testutil.ToFloat64(connected) - connectedBefore; got != 1 {
+		t.Errorf("Expected 1 more connected client, got %v", got)
+	}
+
+	streamer.Send(Event{Name: "/test/sent.txt", Op: fsnotify.Write})
+	readSSEEvent(t, bufio.NewReader(resp.Body))
+
+	if got := testutil.ToFloat64(sent) - sentBefore; got < 1 {
+		t.Errorf("Expected at least 1 sent message, got %v", got)
+	}
+
+	cancel()
+	waitForSSEClients(t, streamer, 0)
+	if got := testutil.ToFloat64(connected) - connectedBefore; got != 0 {
+		t.Errorf("Expected connected clients to return to baseline, got %v", got)
+	}
+}
+
+func TestSSEStreamerSubscription(t *testing.T) {
+	streamer := NewSSEStreamer(StreamerOptions{})
+	server := httptest.NewServer(http.HandlerFunc(streamer.handleSSE))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?filter=size+%3C")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a malformed filter, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + "?include=*.go&events=write&root=api")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer resp.Body.Close()
+	waitForSSEClients(t, streamer, 1)
+
+	streamer.Send(Event{Name: "/srv/api/a.md", RelPath: "a.md", Op: fsnotify.Write, RootName: "api"})
+	streamer.Send(Event{Name: "/srv/api/b.go", RelPath: "b.go", Op: fsnotify.Create, RootName: "api"})
+	streamer.Send(Event{Name: "/srv/web/c.go", RelPath: "c.go", Op: fsnotify.Write, RootName: "web"})
+	streamer.Send(Event{Name: "/srv/api/d.go", RelPath: "d.go", Op: fsnotify.Write, RootName: "api"})
+
+	var decoded Event
+	if err := json.Unmarshal([]byte(readSSEEvent(t, bufio.NewReader(resp.Body))["data"]), &decoded); err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	if decoded.Name != "/srv/api/d.go" {
+		t.Errorf("Expected /srv/api/d.go, got %s", decoded.Name)
+	}
+}
+
+func TestWebSocketStreamerSubscription(t *testing.T) {
+	streamer := NewWebSocketStreamer(StreamerOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	streamer.Start(ctx)
+	server := httptest.NewServer(streamer.Handler())
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?root=api", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	// control sends a control message and returns the reply
+	control := func(message string) controlReply {
+		t.Helper()
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+			t.Fatalf("Failed to send control message: %v", err)
+		}
+		var reply controlReply
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatalf("Failed to read reply: %v", err)
+		}
+		return reply
+	}
+	// next sends events and returns the name of the first one received
+	next := func(events ...Event) string {
+		t.Helper()
+		for _, event := range events {
+			streamer.Send(event)
+		}
+		var decoded Event
+		if err := conn.ReadJSON(&decoded); err != nil {
+			t.Fatalf("Failed to read event: %v", err)
+		}
+		return decoded.Name
+	}
+
+	apiMD := Event{Name: "/srv/api/a.md", RelPath: "a.md", Op: fsnotify.Write, RootName: "api"}
+	apiGo := Event{Name: "/srv/api/b.go", RelPath: "b.go", Op: fsnotify.Write, RootName: "api"}
+	webGo := Event{Name: "/srv/web/c.go", RelPath: "c.go", Op: fsnotify.Write, RootName: "web"}
+
+	if reply := control(`{"type":"update_filter","include":["*.go"]}`); reply.Type != "ack" || reply.Request != "update_filter" {
+		t.Fatalf("Unexpected reply: %+v", reply)
+	}
+	if name := next(apiMD, webGo, apiGo); name != apiGo.Name {
+		t.Errorf("Expected %s, got %s", apiGo.Name, name)
+	}
+
+	if reply := control(`{"type":"subscribe","roots":["web"],"filter":"ext == \".go\""}`); reply.Type != "ack" {
+		t.Fatalf("Unexpected reply: %+v", reply)
+	}
+	if name := next(apiGo, webGo); name != webGo.Name {
+		t.Errorf("Expected %s, got %s", webGo.Name, name)
+	}
+
+	for _, bad := range []string{`{"type":"subscribe","filter":"size <"}`, `{"type":"dance"}`, `not json`} {
+		if reply := control(bad); reply.Type != "error" || reply.Error == "" {
+			t.Errorf("Expected an error for %s, got %+v", bad, reply)
+		}
+	}
+
+	// A bare unsubscribe pauses the stream until the next subscribe
+	if reply := control(`{"type":"unsubscribe"}`); reply.Type != "ack" {
+		t.Fatalf("Unexpected reply: %+v", reply)
+	}
+	streamer.Send(webGo)
+	if reply := control(`{"type":"subscribe"}`); reply.Type != "ack" {
+		t.Fatalf("Expected the paused event to be dropped, got %+v", reply)
+	}
+	if name := next(apiMD); name != apiMD.Name {
+		t.Errorf("Expected %s, got %s", apiMD.Name, name)
+	}
+}
+
+func TestSubscriptionWithout(t *testing.T) {
+	api := Event{RootName: "api"}
+	web := Event{RootName: "web"}
+
+	sub := allEvents.without([]string{"api"})
+	if sub.match(api) || !sub.match(web) || !allEvents.match(api) {
+		t.Errorf("Expected only api to be unsubscribed from all roots")
+	}
+
+	sub, _ = newSubscription(subscriptionRequest{Roots: []string{"api", "web"}})
+	sub = sub.without([]string{"web"})
+	if !sub.match(api) || sub.match(web) {
+		t.Errorf("Expected web to be unsubscribed")
+	}
+	if sub.without(nil).match(api) {
+		t.Errorf("Expected a bare unsubscribe to pause the subscription")
+	}
+}
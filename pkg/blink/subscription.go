@@ -0,0 +1,188 @@
+package blink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+)
+
+// subscriptionRequest describes the events a streaming client wants. SSE
+// clients send it as query parameters (?root=api&include=*.go&events=write),
+// WebSocket clients as query parameters or as a control message.
+type subscriptionRequest struct {
+	Roots   []string `json:"roots,omitempty"`
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	Events  []string `json:"events,omitempty"`
+	Ignore  []string `json:"ignore,omitempty"`
+	Filter  string   `json:"filter,omitempty"`
+}
+
+// subscription selects the events delivered to a streaming client, on top
+// of StreamerOptions.Filter. It is never modified once created, so it can be
+// swapped while events are being sent.
+type subscription struct {
+	roots  map[string]bool // Subscribed roots, nil for all
+	except map[string]bool // Unsubscribed roots, if subscribed to all
+	filter *EventFilter    // nil for all events
+	paused bool            // Nothing is delivered after a bare unsubscribe
+}
+
+// allEvents is the subscription of clients that did not ask for anything
+var allEvents = &subscription{}
+
+// newSubscription validates a subscription request and compiles its filter
+func newSubscription(req subscriptionRequest) (*subscription, error) {
+	filter, err := req.eventFilter()
+	if err != nil {
+		return nil, err
+	}
+	sub := &subscription{filter: filter}
+	if len(req.Roots) > 0 {
+		sub.roots = make(map[string]bool, len(req.Roots))
+		for _, root := range req.Roots {
+			sub.roots[root] = true
+		}
+	}
+	return sub, nil
+}
+
+// eventFilter compiles the filter of a subscription request, or returns nil
+// if it has none
+func (req subscriptionRequest) eventFilter() (*EventFilter, error) {
+	return compileEventFilter(req.Include, req.Exclude, req.Events, req.Ignore, req.Filter)
+}
+
+// match reports whether a client with the subscription receives an event
+func (s *subscription) match(event Event) bool {
+	if s.paused {
+		return false
+	}
+	if s.roots != nil && !s.roots[event.RootName] || s.except[event.RootName] {
+		return false
+	}
+	return s.filter == nil || s.filter.ShouldProcessEvent(event)
+}
+
+// withFilter returns a copy of the subscription with another filter
+func (s *subscription) withFilter(filter *EventFilter) *subscription {
+	updated := *s
+	updated.filter = filter
+	return &updated
+}
+
+// without returns a copy of the subscription without some roots, or paused
+// if no roots are given
+func (s *subscription) without(roots []string) *subscription {
+	updated := *s
+	if len(roots) == 0 {
+		updated.paused = true
+		return &updated
+	}
+
+	if s.roots != nil {
+		updated.roots = maps.Clone(s.roots)
+		for _, root := range roots {
+			delete(updated.roots, root)
+		}
+		return &updated
+	}
+	updated.except = make(map[string]bool, len(s.except)+len(roots))
+	maps.Copy(updated.except, s.except)
+	for _, root := range roots {
+		updated.except[root] = true
+	}
+	return &updated
+}
+
+// parseSubscription returns the subscription a client asks for with the
+// query parameters "root", "include", "exclude", "events", "ignore" and
+// "filter". All but "filter" can be repeated or hold a comma-separated
+// list. Without any of them, the client receives all events.
+func parseSubscription(r *http.Request) (*subscription, error) {
+	query := r.URL.Query()
+	req := subscriptionRequest{
+		Roots:   queryList(query["root"]),
+		Include: queryList(query["include"]),
+		Exclude: queryList(query["exclude"]),
+		Events:  queryList(query["events"]),
+		Ignore:  queryList(query["ignore"]),
+		Filter:  query.Get("filter"),
+	}
+	sub, err := newSubscription(req)
+	if err != nil {
+		return nil, err
+	}
+	if sub.roots == nil && sub.filter == nil {
+		return allEvents, nil
+	}
+	return sub, nil
+}
+
+// queryList splits the values of a repeated query parameter on the commas
+// outside braces
+func queryList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		list = append(list, SplitPatterns(value)...)
+	}
+	return list
+}
+
+// Types of the control messages of WebSocket clients
+const (
+	controlSubscribe    = "subscribe"
+	controlUnsubscribe  = "unsubscribe"
+	controlUpdateFilter = "update_filter"
+)
+
+// controlMessage is a message sent by a WebSocket client to change what it
+// receives:
+//
+//	{"type": "subscribe", "roots": ["api"], "include": ["*.go"]}
+//	{"type": "update_filter", "events": ["write"], "filter": "size < 1MB"}
+//	{"type": "unsubscribe", "roots": ["api"]}
+//
+// subscribe replaces the client's subscription, and resumes delivery after
+// a bare unsubscribe. update_filter replaces only the filter and keeps the
+// roots. unsubscribe drops the given roots, or stops delivery altogether
+// without any.
+type controlMessage struct {
+	Type string `json:"type"`
+	subscriptionRequest
+}
+
+// controlReply answers a control message
+type controlReply struct {
+	Type    string `json:"type"` // "ack" or "error"
+	Request string `json:"request,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// applyControl returns the subscription after a control message
+func applyControl(current *subscription, data []byte) (*subscription, string, error) {
+	var message controlMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, "", fmt.Errorf("invalid control message: %w", err)
+	}
+
+	switch message.Type {
+	case controlSubscribe:
+		sub, err := newSubscription(message.subscriptionRequest)
+		return sub, message.Type, err
+	case controlUpdateFilter:
+		if len(message.Roots) > 0 {
+			return nil, message.Type, errors.New("update_filter cannot change roots, use subscribe")
+		}
+		filter, err := message.eventFilter()
+		if err != nil {
+			return nil, message.Type, err
+		}
+		return current.withFilter(filter), message.Type, nil
+	case controlUnsubscribe:
+		return current.without(message.Roots), message.Type, nil
+	}
+	return nil, message.Type, fmt.Errorf("unknown control message type: %q", message.Type)
+}
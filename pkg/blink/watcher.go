@@ -2,13 +2,16 @@ package blink
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/TFMV/blink/pkg/metrics"
 	"github.com/fsnotify/fsnotify"
 )
 
@@ -22,16 +25,26 @@ const (
 
 // Watcher provides improved file watching capabilities
 type Watcher struct {
-	watcher *fsnotify.Watcher
+	backend Backend
 	config  WatcherConfig
 
+	// Watched directory trees, protected by rootsLock. AddRoot and
+	// RemoveRoot replace the slice instead of modifying it, so a copy taken
+	// under the lock stays valid without it. Locks are taken in the order
+	// rootsLock, dirLock, eventLock.
+	roots     []*watchRoot
+	scanned   bool // The initial scan is done
+	rootsLock sync.RWMutex
+	// Wakes up run() after roots were added or removed
+	rootsChanged chan struct{}
+
 	// State management, protected by dirLock
-	directories map[string]bool
-	watches     map[string]bool
-	dirLock     sync.Mutex
+	watches map[string]bool
+	dirLock sync.Mutex
 
-	// Event batching, protected by eventLock
-	events    []fsnotify.Event
+	// Event batching, protected by eventLock. Pending events are kept
+	// per root, in watchRoot.events.
+	files     map[string]fileState // Known files, for pairing renames and rescans
 	eventLock sync.Mutex
 
 	// Lifecycle and control
@@ -41,45 +54,49 @@ type Watcher struct {
 
 	// Channels for output
 	errorChan chan error
-	eventChan chan []fsnotify.Event
+	eventChan chan []Event
 
 	// Polling for new files/directories
 	pollInterval time.Duration
 
-	// Pre-compiled filter masks
-	includeEvents fsnotify.Op
-	ignoreEvents  fsnotify.Op
+	// Number of watched directories last reported to metrics
+	watchCount int
 }
 
-// WatcherConfig holds configuration for the watcher
+// WatcherConfig holds configuration for the watcher. Without Roots,
+// RootPath is watched with the patterns, event types, recursion and delay
+// given here; with Roots, those are the defaults of every root.
 type WatcherConfig struct {
-	RootPath              string
-	IncludePatterns       []string
-	ExcludePatterns       []string
-	IncludeEvents         []string // e.g., ["create", "write"]
-	IgnoreEvents          []string // e.g., ["chmod"]
-	Recursive             bool
-	HandlerDelay          time.Duration
-	PollInterval          time.Duration
-	DisableDefaultExcludes bool // New flag to disable default excludes
+	RootPath               string
+	Roots                  []RootConfig // Several directory trees, each with its own configuration
+	IncludePatterns        []string
+	ExcludePatterns        []string
+	IncludeEvents          []string // e.g., ["create", "write"]
+	IgnoreEvents           []string // e.g., ["chmod"]
+	Recursive              bool
+	HandlerDelay           time.Duration
+	PollInterval           time.Duration
+	RenameWindow           time.Duration // How long a rename waits for its matching create
+	IgnoreFiles            []string      // e.g., [".gitignore"], honoured instead of the default excludes
+	Backend                string        // "inotify" (default), "poll", "fanotify" or "auto", see NewBackend
+	DisableDefaultExcludes bool          // New flag to disable default excludes
 }
 
 // NewWatcher creates a new file watcher.
 func NewWatcher(ctx context.Context, config WatcherConfig) (*Watcher, error) {
-	fsWatcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create fsnotify watcher: %w", err)
-	}
-
 	if config.HandlerDelay == 0 {
 		config.HandlerDelay = defaultHandlerDelay
 	}
 	if config.PollInterval == 0 {
 		config.PollInterval = defaultPollInterval
 	}
+	if config.RenameWindow == 0 {
+		config.RenameWindow = defaultRenameWindow
+	}
 
-	// If default excludes are not disabled, merge them with user-provided excludes.
-	if !config.DisableDefaultExcludes {
+	// If default excludes are not disabled, merge them with user-provided
+	// excludes. Ignore files take their place.
+	if !config.DisableDefaultExcludes && len(config.IgnoreFiles) == 0 {
 		excludes := make([]string, 0, len(config.ExcludePatterns)+len(defaultDevExcludePatterns)+len(defaultDevExcludePaths))
 		excludes = append(excludes, config.ExcludePatterns...)
 		excludes = append(excludes, defaultDevExcludePatterns...)
@@ -87,32 +104,51 @@ func NewWatcher(ctx context.Context, config WatcherConfig) (*Watcher, error) {
 		config.ExcludePatterns = excludes
 	}
 
+	// Events carry absolute paths
+	if config.RootPath != "" {
+		if abs, err := filepath.Abs(config.RootPath); err == nil {
+			config.RootPath = abs
+		}
+	}
+
+	rootConfigs, err := config.rootConfigs()
+	if err != nil {
+		return nil, err
+	}
+	roots := make([]*watchRoot, 0, len(rootConfigs))
+	paths := make([]string, 0, len(rootConfigs))
+	for _, rootConfig := range rootConfigs {
+		root, err := newWatchRoot(rootConfig)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, root)
+		paths = append(paths, root.Path)
+	}
+
+	backend, err := NewBackend(config.Backend, paths, config.PollInterval)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 
 	w := &Watcher{
-		watcher:      fsWatcher,
+		backend:      backend,
 		config:       config,
-		directories:  make(map[string]bool),
+		roots:        roots,
 		watches:      make(map[string]bool),
+		files:        make(map[string]fileState),
 		ctx:          ctx,
 		cancel:       cancel,
 		errorChan:    make(chan error, defaultChannelBufferSize),
-		eventChan:    make(chan []fsnotify.Event, defaultChannelBufferSize),
+		eventChan:    make(chan []Event, defaultChannelBufferSize),
 		pollInterval: config.PollInterval,
+		rootsChanged: make(chan struct{}, 1),
 	}
 
-	// Pre-compile event type filters for efficiency.
-	w.includeEvents, err = compileEventTypes(config.IncludeEvents)
-	if err != nil {
-		return nil, fmt.Errorf("invalid include event type: %w", err)
-	}
-	w.ignoreEvents, err = compileEventTypes(config.IgnoreEvents)
-	if err != nil {
-		return nil, fmt.Errorf("invalid ignore event type: %w", err)
-	}
-
-	if config.RootPath != "" {
-		w.addDirectory(config.RootPath)
+	for _, root := range roots {
+		w.addDirectory(root.Path)
 	}
 
 	return w, nil
@@ -120,6 +156,7 @@ func NewWatcher(ctx context.Context, config WatcherConfig) (*Watcher, error) {
 
 // Start begins watching for file changes.
 func (w *Watcher) Start() {
+	metrics.ActiveWatchers.Inc()
 	w.wg.Add(1)
 	go w.run()
 }
@@ -131,11 +168,165 @@ func (w *Watcher) Close() error {
 	return nil
 }
 
-// Events returns a channel that receives batched file events.
-func (w *Watcher) Events() <-chan []fsnotify.Event {
+// Events returns a channel that receives batched file events. Every batch
+// holds the events of a single root, except for the initial scan.
+func (w *Watcher) Events() <-chan []Event {
 	return w.eventChan
 }
 
+// Backend returns the name of the backend the watcher uses, e.g. "poll".
+func (w *Watcher) Backend() string {
+	return w.backend.Name()
+}
+
+// Roots returns the configurations of the watched directory trees.
+func (w *Watcher) Roots() []RootConfig {
+	roots := w.currentRoots()
+	configs := make([]RootConfig, len(roots))
+	for i, root := range roots {
+		configs[i] = root.RootConfig
+	}
+	return configs
+}
+
+// currentRoots returns the watched directory trees
+func (w *Watcher) currentRoots() []*watchRoot {
+	w.rootsLock.RLock()
+	defer w.rootsLock.RUnlock()
+	return w.roots
+}
+
+// AddRoot starts watching the directory tree at path, configured like the
+// entries of WatcherConfig.Roots; config.Path is ignored. Once the watcher
+// has started, the files already inside are reported as created, like
+// those found by the initial scan. It is safe to call while the watcher
+// runs.
+func (w *Watcher) AddRoot(path string, config RootConfig) error {
+	if w.ctx.Err() != nil {
+		return errors.New("watcher is closed")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	config.Path = path
+
+	w.rootsLock.Lock()
+	defer w.rootsLock.Unlock()
+
+	existing := make([]RootConfig, len(w.roots))
+	for i, root := range w.roots {
+		existing[i] = root.RootConfig
+	}
+	if config, err = w.config.rootConfig(config, existing); err != nil {
+		return err
+	}
+	root, err := newWatchRoot(config)
+	if err != nil {
+		return err
+	}
+
+	if backend, ok := w.backend.(rootBackend); ok {
+		if err := backend.AddRoot(root.Path); err != nil {
+			return err
+		}
+	}
+	w.dirLock.Lock()
+	if err := w.backend.Add(root.Path); err != nil {
+		w.dirLock.Unlock()
+		if backend, ok := w.backend.(rootBackend); ok {
+			backend.RemoveRoot(root.Path)
+		}
+		return err
+	}
+	w.watches[root.Path] = true
+
+	var events []Event
+	if w.scanned {
+		now := time.Now()
+		w.walkTree(root, root.Path, func(path string, info os.FileInfo) {
+			if !info.IsDir() {
+				events = append(events, root.newEvent(fsnotify.Event{Name: path, Op: fsnotify.Create}, info, now))
+			}
+		})
+	}
+	w.dirLock.Unlock()
+
+	for _, event := range events {
+		w.queueEvent(root, event)
+	}
+
+	w.roots = append(w.roots[:len(w.roots):len(w.roots)], root)
+	w.notifyRootsChanged()
+	return nil
+}
+
+// RemoveRoot stops watching the directory tree at path. Events of the root
+// that are still waiting for its debounce delay are discarded. It is safe
+// to call while the watcher runs.
+func (w *Watcher) RemoveRoot(path string) error {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	w.rootsLock.Lock()
+	defer w.rootsLock.Unlock()
+
+	var root *watchRoot
+	roots := make([]*watchRoot, 0, len(w.roots))
+	for _, candidate := range w.roots {
+		if candidate.Path == path {
+			root = candidate
+			continue
+		}
+		roots = append(roots, candidate)
+	}
+	if root == nil {
+		return fmt.Errorf("%w: %s", ErrRootNotFound, path)
+	}
+	w.roots = roots
+
+	w.dirLock.Lock()
+	for dir := range w.watches {
+		if root.contains(dir) {
+			_ = w.backend.Remove(dir)
+			delete(w.watches, dir)
+		}
+	}
+	w.dirLock.Unlock()
+	if backend, ok := w.backend.(rootBackend); ok {
+		backend.RemoveRoot(root.Path)
+	}
+
+	w.eventLock.Lock()
+	for file := range w.files {
+		if root.contains(file) {
+			delete(w.files, file)
+		}
+	}
+	root.events = nil
+	w.eventLock.Unlock()
+
+	w.notifyRootsChanged()
+	return nil
+}
+
+// notifyRootsChanged wakes up run() without waiting for it
+func (w *Watcher) notifyRootsChanged() {
+	select {
+	case w.rootsChanged <- struct{}{}:
+	default:
+	}
+}
+
+// rootCount returns the number of watched directory trees
+func (w *Watcher) rootCount() int {
+	return len(w.currentRoots())
+}
+
 // Errors returns a channel that receives errors.
 func (w *Watcher) Errors() <-chan error {
 	return w.errorChan
@@ -144,11 +335,14 @@ func (w *Watcher) Errors() <-chan error {
 // run is the main event loop for the watcher.
 func (w *Watcher) run() {
 	defer w.wg.Done()
-	defer w.watcher.Close()
+	defer metrics.ActiveWatchers.Dec()
+	defer w.updateWatchedDirectories(0)
+	defer w.backend.Close()
 	defer close(w.eventChan)
 	defer close(w.errorChan)
 
 	initialEvents := w.initialScan()
+	w.updateWatchedDirectories(len(w.backend.WatchList()))
 	if len(initialEvents) > 0 {
 		select {
 		case w.eventChan <- initialEvents:
@@ -160,6 +354,7 @@ func (w *Watcher) run() {
 	pollTicker := time.NewTicker(w.pollInterval)
 	defer pollTicker.Stop()
 
+	// Fires when the earliest pending batch of any root is due
 	debounceTimer := time.NewTimer(w.config.HandlerDelay)
 	if !debounceTimer.Stop() {
 		select {
@@ -167,94 +362,143 @@ func (w *Watcher) run() {
 		default:
 		}
 	}
+	schedule := func() {
+		debounceTimer.Stop()
+		if next := w.nextFlush(); !next.IsZero() {
+			debounceTimer.Reset(time.Until(next))
+		}
+	}
 
 	for {
 		select {
 		case <-w.ctx.Done():
-			w.flushEvents()
+			for _, root := range w.currentRoots() {
+				w.flushEvents(root, true)
+			}
 			return
 		case <-pollTicker.C:
 			if w.scanForNewDirs() {
-				debounceTimer.Reset(w.config.HandlerDelay)
+				w.updateWatchedDirectories(len(w.backend.WatchList()))
 			}
-		case event, ok := <-w.watcher.Events:
+		case event, ok := <-w.backend.Events():
 			if !ok {
 				return
 			}
-			if w.handleEvent(event) {
-				debounceTimer.Reset(w.config.HandlerDelay)
+			if root := w.handleEvent(event); root != nil {
+				root.flushAt = time.Now().Add(root.HandlerDelay)
+				schedule()
 			}
-		case err, ok := <-w.watcher.Errors:
+		case err, ok := <-w.backend.Errors():
 			if !ok {
 				return
 			}
+			// Events were lost, find out what changed by rescanning
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				w.handleOverflow()
+				w.updateWatchedDirectories(len(w.backend.WatchList()))
+				for _, root := range w.currentRoots() {
+					root.flushAt = time.Now().Add(root.HandlerDelay)
+				}
+				schedule()
+			}
 			select {
 			case w.errorChan <- err:
 			case <-w.ctx.Done():
 			}
+		case <-w.rootsChanged:
+			// An added root may already have the files found inside it queued
+			w.updateWatchedDirectories(len(w.backend.WatchList()))
+			for _, root := range w.currentRoots() {
+				if root.flushAt.IsZero() && w.hasPending(root) {
+					root.flushAt = time.Now().Add(root.HandlerDelay)
+				}
+			}
+			schedule()
 		case <-debounceTimer.C:
-			w.flushEvents()
+			now := time.Now()
+			for _, root := range w.currentRoots() {
+				if root.flushAt.IsZero() || root.flushAt.After(now) {
+					continue
+				}
+				root.flushAt = time.Time{}
+				if w.flushEvents(root, false) {
+					// Renames are waiting for their matching create
+					root.flushAt = now.Add(w.config.RenameWindow)
+				}
+			}
+			schedule()
+		}
+	}
+}
+
+// nextFlush returns when the earliest pending batch is due, or zero if
+// there is none
+func (w *Watcher) nextFlush() time.Time {
+	var next time.Time
+	for _, root := range w.currentRoots() {
+		if !root.flushAt.IsZero() && (next.IsZero() || root.flushAt.Before(next)) {
+			next = root.flushAt
 		}
 	}
+	return next
 }
 
-func (w *Watcher) initialScan() []fsnotify.Event {
+// hasPending reports whether events of a root are waiting to be flushed
+func (w *Watcher) hasPending(root *watchRoot) bool {
+	w.eventLock.Lock()
+	defer w.eventLock.Unlock()
+	return len(root.events) > 0
+}
+
+func (w *Watcher) initialScan() []Event {
+	w.rootsLock.Lock()
+	defer w.rootsLock.Unlock()
 	w.dirLock.Lock()
 	defer w.dirLock.Unlock()
+	w.scanned = true
 
-	var initialEvents []fsnotify.Event
-	for dir := range w.directories {
-		_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-			if err != nil || path == dir {
-				return nil
-			}
-			if !w.shouldIncludePath(path) {
-				if info.IsDir() {
-					return filepath.SkipDir
-				}
-				return nil
-			}
+	now := time.Now()
+	var initialEvents []Event
+	for _, root := range w.roots {
+		w.walkTree(root, root.Path, func(path string, info os.FileInfo) {
 			if info.IsDir() {
-				if !w.config.Recursive {
-					return filepath.SkipDir
-				}
-				if err := w.watcher.Add(path); err == nil {
-					w.watches[path] = true
-				}
-			} else {
-				if _, watched := w.watches[path]; !watched {
-					if w.shouldProcessEventType(fsnotify.Create) {
-						initialEvents = append(initialEvents, fsnotify.Event{Name: path, Op: fsnotify.Create})
-					}
-					w.watches[path] = true
-				}
+				return
+			}
+			event := root.newEvent(fsnotify.Event{Name: path, Op: fsnotify.Create}, info, now)
+			w.rememberFile(event)
+			if root.shouldProcessEvent(&event) {
+				initialEvents = append(initialEvents, event)
 			}
-			return nil
 		})
 	}
 	return initialEvents
 }
 
 func (w *Watcher) scanForNewDirs() bool {
+	// Backends that watch whole trees miss no directory
+	if w.watchesTrees() {
+		return false
+	}
+
+	w.rootsLock.RLock()
+	defer w.rootsLock.RUnlock()
 	w.dirLock.Lock()
 	defer w.dirLock.Unlock()
 
 	var newDirsFound bool
-	for dir := range w.directories {
-		_ = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-			if err != nil || !info.IsDir() || path == dir {
+	for _, root := range w.roots {
+		if !root.Recursive {
+			continue
+		}
+		_ = filepath.Walk(root.Path, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() || path == root.Path {
 				return nil
 			}
-			if !w.config.Recursive {
+			if root.excluded(path, true) {
 				return filepath.SkipDir
 			}
-			if w.shouldIncludePath(path) {
-				if _, watched := w.watches[path]; !watched {
-					if err := w.watcher.Add(path); err == nil {
-						w.watches[path] = true
-						newDirsFound = true
-					}
-				}
+			if w.watch(path) {
+				newDirsFound = true
 			}
 			return nil
 		})
@@ -262,128 +506,327 @@ func (w *Watcher) scanForNewDirs() bool {
 	return newDirsFound
 }
 
-func (w *Watcher) handleEvent(event fsnotify.Event) bool {
+// rootOf returns the root a path belongs to, or nil. The caller must hold
+// rootsLock.
+func (w *Watcher) rootOf(path string) *watchRoot {
+	for _, root := range w.roots {
+		if root.contains(path) {
+			return root
+		}
+	}
+	return nil
+}
+
+// handleEvent queues the events for a backend event, and returns the root
+// they were queued for, or nil if there are none.
+func (w *Watcher) handleEvent(event fsnotify.Event) *watchRoot {
+	// The root must not be removed while its watches are updated
+	w.rootsLock.RLock()
+	defer w.rootsLock.RUnlock()
+
+	root := w.rootOf(event.Name)
+	if root == nil || w.watchesTrees() && !w.reachable(root, event.Name) {
+		return nil
+	}
+
+	// Changed ignore files take effect right away
+	if root.ignores != nil && root.ignores.isIgnoreFile(event.Name) {
+		w.reloadIgnores(root, filepath.Dir(event.Name))
+		w.updateWatchedDirectories(len(w.backend.WatchList()))
+	}
+
+	observed := time.Now()
 	info, err := os.Stat(event.Name)
-	isDir := err == nil && info.IsDir()
+	if err != nil {
+		info = nil
+	}
 
-	if isDir {
-		w.handleDirectoryEvent(event)
-		return false
+	var queued bool
+	// A removed directory can no longer be stat'ed, but it was watched
+	if info != nil && info.IsDir() || info == nil && w.isWatched(event.Name) {
+		queued = w.handleDirectoryEvent(root, root.newEvent(event, info, observed))
 	} else {
-		return w.handleFileEvent(event)
+		queued = w.handleFileEvent(root, root.newEvent(event, info, observed))
+	}
+	if !queued {
+		return nil
 	}
+	return root
 }
 
-func (w *Watcher) handleFileEvent(event fsnotify.Event) bool {
-	if !w.shouldIncludePath(event.Name) || !w.shouldProcessEventType(event.Op) {
+func (w *Watcher) handleFileEvent(root *watchRoot, event Event) bool {
+	if !root.shouldIncludePath(event.Name, false) {
+		metrics.EventsFiltered.Inc()
 		return false
 	}
 
-	w.queueEvent(event)
-
-	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
-		w.dirLock.Lock()
-		delete(w.watches, event.Name)
-		w.dirLock.Unlock()
-	}
+	// Event types are filtered when the batch is flushed, after renames
+	// and creates have been paired into moves
+	w.queueEvent(root, event)
 	return true
 }
 
-func (w *Watcher) handleDirectoryEvent(event fsnotify.Event) {
-	if !w.config.Recursive || !w.shouldIncludePath(event.Name) {
-		return
+// handleDirectoryEvent watches created directories and prunes the watches
+// of removed ones. Whatever is already inside a created directory, e.g.
+// one moved in or unpacked from an archive, is queued as created, and
+// whatever was known inside a removed or renamed directory as removed,
+// followed by the directory itself. It returns true if events were queued.
+func (w *Watcher) handleDirectoryEvent(root *watchRoot, event Event) bool {
+	if !root.Recursive || root.excluded(event.Name, true) {
+		return false
 	}
+
+	var events []Event
 	if event.Op&fsnotify.Create != 0 {
-		w.addDirectory(event.Name)
+		events = w.addTree(root, event.Name, event.Timestamp)
 	} else if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
-		w.removeDirectory(event.Name)
+		// The directory itself is reported after its content
+		event.IsDir = true
+		events = w.removeTree(root, event.Name, event.Timestamp)
+		if root.included(event.Name, true) {
+			events = append(events, event)
+		}
+	}
+	w.updateWatchedDirectories(len(w.backend.WatchList()))
+
+	for _, event := range events {
+		w.queueEvent(root, event)
 	}
+	return len(events) > 0
 }
 
-func (w *Watcher) queueEvent(event fsnotify.Event) {
+// updateWatchedDirectories reports this watcher's number of watched
+// directories to the shared gauge. Only run() calls it, so watchCount
+// needs no locking.
+func (w *Watcher) updateWatchedDirectories(count int) {
+	metrics.WatchedDirectories.Add(float64(count - w.watchCount))
+	w.watchCount = count
+}
+
+// rememberFile records the state of a file found by a scan
+func (w *Watcher) rememberFile(event Event) {
+	if state, ok := stateOf(event); ok {
+		w.eventLock.Lock()
+		w.files[event.Name] = state
+		w.eventLock.Unlock()
+	}
+}
+
+func (w *Watcher) queueEvent(root *watchRoot, event Event) {
 	w.eventLock.Lock()
 	defer w.eventLock.Unlock()
-	w.events = append(w.events, event)
+
+	// Track file states, so a rename can be matched with the create of
+	// its new path and a rescan can tell what changed. The renamed file no
+	// longer exists under its old path, so its identity comes from what was
+	// seen before.
+	switch {
+	case event.Op&OpOverflow != 0:
+	case event.Op&fsnotify.Rename != 0:
+		state, known := w.files[event.Name]
+		if !known && root.pendingRemove(event.Name) {
+			return
+		}
+		event.Inode, event.Device = state.key.inode, state.key.device
+		delete(w.files, event.Name)
+	case event.Op&fsnotify.Remove != 0:
+		if _, known := w.files[event.Name]; !known && root.pendingRemove(event.Name) {
+			return
+		}
+		delete(w.files, event.Name)
+	case event.IsDir:
+	default:
+		if state, ok := stateOf(event); ok {
+			// A file created inside a new directory can be seen both by
+			// the scan of the directory and by its own create event
+			if event.Op&fsnotify.Create != 0 && w.files[event.Name] == state {
+				return
+			}
+			w.files[event.Name] = state
+		}
+	}
+
+	root.events = append(root.events, event)
 }
 
-func (w *Watcher) flushEvents() {
+// pendingRemove reports whether the latest queued event for path removed or
+// renamed it. A watched directory that goes away is reported both by its
+// parent and by its own watch. The caller must hold the Watcher's eventLock.
+func (r *watchRoot) pendingRemove(path string) bool {
+	for i := len(r.events) - 1; i >= 0; i-- {
+		if r.events[i].Name == path {
+			return r.events[i].Op&(fsnotify.Remove|fsnotify.Rename) != 0
+		}
+	}
+	return false
+}
+
+// flushEvents pairs the renames of a root into moves, filters its batch by
+// event type and sends it. Unless final is set, renames still waiting for
+// their create are kept for the next flush, in which case flushEvents
+// returns true.
+func (w *Watcher) flushEvents(root *watchRoot, final bool) bool {
 	w.eventLock.Lock()
-	if len(w.events) == 0 {
+	if len(root.events) == 0 {
 		w.eventLock.Unlock()
-		return
+		return false
+	}
+	window := w.config.RenameWindow
+	if final {
+		window = 0
 	}
-	eventsToSend := w.events
-	w.events = nil
+	ready, held := pairRenames(root.events, time.Now(), window)
+	root.events = held
 	w.eventLock.Unlock()
 
+	eventsToSend := ready[:0]
+	for _, event := range ready {
+		if !root.shouldProcessEvent(&event) {
+			metrics.EventsFiltered.Inc()
+			continue
+		}
+		eventsToSend = append(eventsToSend, event)
+		metrics.EventsProcessed.Inc()
+		metrics.EventsByOp.WithLabelValues(eventTypeToString(event.Op)).Inc()
+	}
+	if len(eventsToSend) == 0 {
+		return len(held) > 0
+	}
+
 	select {
 	case w.eventChan <- eventsToSend:
 	case <-w.ctx.Done():
+		// Shutting down: hand the final batch over if there is room,
+		// so consumers draining Events() still see it.
+		select {
+		case w.eventChan <- eventsToSend:
+		default:
+		}
 	}
+	return len(held) > 0
 }
 
 func (w *Watcher) addDirectory(path string) {
 	w.dirLock.Lock()
 	defer w.dirLock.Unlock()
 
-	if _, ok := w.directories[path]; !ok {
-		w.directories[path] = true
-		if err := w.watcher.Add(path); err == nil {
+	if !w.watches[path] {
+		if err := w.backend.Add(path); err == nil {
 			w.watches[path] = true
 		}
 	}
 }
 
-func (w *Watcher) removeDirectory(path string) {
+// watch adds a watch for a directory below a root, unless it has one, and
+// reports whether it did. Backends that watch whole trees already see the
+// entries of the directory, it is only recorded. The caller must hold
+// dirLock.
+func (w *Watcher) watch(path string) bool {
+	if w.watches[path] {
+		return false
+	}
+	if !w.watchesTrees() {
+		if err := w.backend.Add(path); err != nil {
+			return false
+		}
+	}
+	w.watches[path] = true
+	return true
+}
+
+// watchesTrees reports whether the backend watches whole directory trees,
+// rather than the directories added to it one by one
+func (w *Watcher) watchesTrees() bool {
+	_, ok := w.backend.(rootBackend)
+	return ok
+}
+
+// reachable reports whether watching directories one by one would report
+// an event for path of a backend that watches whole trees: it must be
+// directly in the root, or the root must be recursive and no directory
+// above path excluded. Directories not walked yet need not be watched, so
+// nothing created in a new directory is missed.
+func (w *Watcher) reachable(root *watchRoot, path string) bool {
+	dir := filepath.Dir(path)
+	if dir == root.Path {
+		return true
+	}
+	if !root.Recursive {
+		return false
+	}
+	if w.isWatched(dir) {
+		return true
+	}
+	for ; dir != root.Path && root.contains(dir); dir = filepath.Dir(dir) {
+		if root.excluded(dir, true) {
+			return false
+		}
+	}
+	return true
+}
+
+// addTree watches a created directory and everything below it, and returns
+// create events for the files and directories already inside
+func (w *Watcher) addTree(root *watchRoot, path string, now time.Time) []Event {
 	w.dirLock.Lock()
 	defer w.dirLock.Unlock()
 
-	delete(w.directories, path)
-	delete(w.watches, path)
+	w.watch(path)
+
+	var events []Event
+	w.walkTree(root, path, func(path string, info os.FileInfo) {
+		events = append(events, root.newEvent(fsnotify.Event{Name: path, Op: fsnotify.Create}, info, now))
+	})
+	return events
 }
 
-// shouldIncludePath checks if a path should be included based on patterns.
-func (w *Watcher) shouldIncludePath(path string) bool {
-	// Use the full path for matching, to make ** patterns work correctly.
-	normalizedPath := filepath.ToSlash(path)
+// removeTree prunes the watches of a removed or renamed directory and of
+// every directory below it, and returns remove events for the files and
+// directories that were known inside, deepest first
+func (w *Watcher) removeTree(root *watchRoot, path string, now time.Time) []Event {
+	prefix := path + string(filepath.Separator)
+	var events []Event
 
-	for _, pattern := range w.config.ExcludePatterns {
-		// Handle base name matching and full path matching
-		base := filepath.Base(normalizedPath)
-		if (strings.Contains(pattern, "/") || strings.Contains(pattern, "**")) {
-			if matched, _ := filepath.Match(pattern, normalizedPath); matched {
-				return false
-			}
-		} else {
-			if matched, _ := filepath.Match(pattern, base); matched {
-				return false
-			}
+	w.dirLock.Lock()
+	for dir := range w.watches {
+		if dir != path && !strings.HasPrefix(dir, prefix) {
+			continue
+		}
+		// Watches of a renamed tree are still alive, under the new path
+		_ = w.backend.Remove(dir)
+		delete(w.watches, dir)
+		if dir != path && root.included(dir, true) {
+			event := root.newEvent(fsnotify.Event{Name: dir, Op: fsnotify.Remove}, nil, now)
+			event.IsDir = true
+			events = append(events, event)
 		}
 	}
+	w.dirLock.Unlock()
 
-	if len(w.config.IncludePatterns) > 0 {
-		base := filepath.Base(normalizedPath)
-		for _, pattern := range w.config.IncludePatterns {
-			if matched, _ := filepath.Match(pattern, base); matched {
-				return true
-			}
+	w.eventLock.Lock()
+	for file := range w.files {
+		if strings.HasPrefix(file, prefix) {
+			events = append(events, root.newEvent(fsnotify.Event{Name: file, Op: fsnotify.Remove}, nil, now))
 		}
-		return false
 	}
+	w.eventLock.Unlock()
 
-	return true
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Name > events[j].Name
+	})
+	return events
 }
 
-func (w *Watcher) shouldProcessEventType(op fsnotify.Op) bool {
-	if w.ignoreEvents&op != 0 {
-		return false
-	}
-
-	if w.includeEvents != 0 {
-		return w.includeEvents&op != 0
-	}
+// isWatched reports whether path is a watched directory
+func (w *Watcher) isWatched(path string) bool {
+	w.dirLock.Lock()
+	defer w.dirLock.Unlock()
+	return w.watches[path]
+}
 
-	return true
+// ParseOp parses the name of an event type, e.g. "write"
+func ParseOp(name string) (fsnotify.Op, error) {
+	return compileEventTypes([]string{name})
 }
 
 func compileEventTypes(eventNames []string) (fsnotify.Op, error) {
@@ -400,6 +843,12 @@ func compileEventTypes(eventNames []string) (fsnotify.Op, error) {
 			op |= fsnotify.Rename
 		case "chmod":
 			op |= fsnotify.Chmod
+		case "move":
+			op |= OpMove
+		case "overflow":
+			op |= OpOverflow
+		case "exec":
+			op |= OpExec
 		default:
 			return 0, fmt.Errorf("unknown event type: %q", name)
 		}
@@ -87,7 +87,7 @@ func TestWatcher_Batching(t *testing.T) {
 	w.Start()
 
 	// 3. The first and ONLY event batch should be from the initial scan.
-	var initialEvents []fsnotify.Event
+	var initialEvents []blink.Event
 	select {
 	case initialEvents = <-w.Events():
 		// This is what we expect.
@@ -152,7 +152,9 @@ func TestWatcher_Close(t *testing.T) {
 	err = w.Close()
 	assert.NoError(t, err)
 
-	// The Events channel should now be closed.
+	// The Events channel should now be closed, after any final batch flushed on shutdown.
+	for range w.Events() {
+	}
 	_, ok := <-w.Events()
 	assert.False(t, ok, "Events channel should be closed after Close() returns")
 }
@@ -207,3 +209,455 @@ func TestWatcher_Race(t *testing.T) {
 	err = w.Close()
 	assert.NoError(t, err)
 }
+
+// nextEvents returns the next batch of events, failing the test on timeout.
+func nextEvents(t *testing.T, w *blink.Watcher) []blink.Event {
+	t.Helper()
+	select {
+	case events := <-w.Events():
+		return events
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for events")
+		return nil
+	}
+}
+
+// TestWatcher_Move verifies a rename inside the watch is reported as a single move.
+func TestWatcher_Move(t *testing.T) {
+	t.Parallel()
+
+	tempDir := t.TempDir()
+	oldPath := filepath.Join(tempDir, "old.txt")
+	newPath := filepath.Join(tempDir, "new.txt")
+	require.NoError(t, os.WriteFile(oldPath, []byte("hello"), 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, err := blink.NewWatcher(ctx, blink.WatcherConfig{
+		RootPath:     tempDir,
+		HandlerDelay: 20 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	w.Start()
+	defer w.Close()
+
+	// Consume the initial scan, which records the file's identity.
+	nextEvents(t, w)
+
+	require.NoError(t, os.Rename(oldPath, newPath))
+
+	events := nextEvents(t, w)
+	require.Len(t, events, 1, "Expected a single move event, got %v", events)
+	assert.Equal(t, blink.OpMove|fsnotify.Create, events[0].Op)
+	assert.Equal(t, oldPath, events[0].OldName)
+	assert.Equal(t, newPath, events[0].Name)
+	assert.Equal(t, "new.txt", events[0].RelPath)
+}
+
+// TestWatcher_MoveOutOfWatch verifies a rename across the watch boundary falls back to a remove.
+func TestWatcher_MoveOutOfWatch(t *testing.T) {
+	t.Parallel()
+
+	tempDir := t.TempDir()
+	outside := t.TempDir()
+	path := filepath.Join(tempDir, "file.txt")
+	require.NoError(t, os.WriteFile(path, []byte("hello"), 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, err := blink.NewWatcher(ctx, blink.WatcherConfig{
+		RootPath:     tempDir,
+		HandlerDelay: 20 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	w.Start()
+	defer w.Close()
+
+	nextEvents(t, w)
+
+	require.NoError(t, os.Rename(path, filepath.Join(outside, "file.txt")))
+
+	events := nextEvents(t, w)
+	require.Len(t, events, 1, "Expected a single remove event, got %v", events)
+	assert.Equal(t, fsnotify.Rename|fsnotify.Remove, events[0].Op)
+	assert.Equal(t, path, events[0].Name)
+}
+
+// collectEvents gathers events until every expected path has been seen,
+// and returns the first event of each path.
+func collectEvents(t *testing.T, w *blink.Watcher, paths ...string) map[string]blink.Event {
+	t.Helper()
+	seen := make(map[string]blink.Event)
+	deadline := time.After(2 * time.Second)
+	for {
+		missing := false
+		for _, path := range paths {
+			if _, ok := seen[path]; !ok {
+				missing = true
+			}
+		}
+		if !missing {
+			return seen
+		}
+		select {
+		case events := <-w.Events():
+			for _, event := range events {
+				if _, ok := seen[event.Name]; !ok {
+					seen[event.Name] = event
+				}
+			}
+		case <-deadline:
+			t.Fatalf("Timed out waiting for events, got %v", seen)
+		}
+	}
+}
+
+// TestWatcher_RemoveTree verifies that moving a directory away reports
+// everything inside it as removed and stops watching it.
+func TestWatcher_RemoveTree(t *testing.T) {
+	t.Parallel()
+
+	tempDir := t.TempDir()
+	outside := t.TempDir()
+	dir := filepath.Join(tempDir, "dir")
+	sub := filepath.Join(dir, "sub")
+	file1 := filepath.Join(dir, "file1.txt")
+	file2 := filepath.Join(sub, "file2.txt")
+	require.NoError(t, os.MkdirAll(sub, 0755))
+	require.NoError(t, os.WriteFile(file1, []byte("1"), 0600))
+	require.NoError(t, os.WriteFile(file2, []byte("2"), 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, err := blink.NewWatcher(ctx, blink.WatcherConfig{
+		RootPath:     tempDir,
+		Recursive:    true,
+		HandlerDelay: 20 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	w.Start()
+	defer w.Close()
+
+	nextEvents(t, w)
+
+	moved := filepath.Join(outside, "dir")
+	require.NoError(t, os.Rename(dir, moved))
+
+	seen := collectEvents(t, w, file1, file2, sub, dir)
+	for _, path := range []string{file1, file2, sub, dir} {
+		assert.NotZero(t, seen[path].Op&fsnotify.Remove, "Expected %s to be removed", path)
+	}
+	assert.True(t, seen[sub].IsDir)
+	assert.True(t, seen[dir].IsDir)
+
+	// The moved tree is no longer watched
+	require.NoError(t, os.WriteFile(filepath.Join(moved, "sub", "file2.txt"), []byte("changed"), 0600))
+	select {
+	case events := <-w.Events():
+		t.Fatalf("Received events for a directory moved out of the watch: %v", events)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// TestWatcher_CreateTree verifies that moving a directory in reports
+// what is already inside it as created.
+func TestWatcher_CreateTree(t *testing.T) {
+	t.Parallel()
+
+	tempDir := t.TempDir()
+	outside := t.TempDir()
+	src := filepath.Join(outside, "dir")
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "file1.txt"), []byte("1"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "sub", "file2.txt"), []byte("2"), 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, err := blink.NewWatcher(ctx, blink.WatcherConfig{
+		RootPath:     tempDir,
+		Recursive:    true,
+		HandlerDelay: 20 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	w.Start()
+	defer w.Close()
+
+	dir := filepath.Join(tempDir, "dir")
+	require.NoError(t, os.Rename(src, dir))
+
+	sub := filepath.Join(dir, "sub")
+	file1 := filepath.Join(dir, "file1.txt")
+	file2 := filepath.Join(sub, "file2.txt")
+	seen := collectEvents(t, w, file1, file2, sub)
+	for _, path := range []string{file1, file2, sub} {
+		assert.Equal(t, fsnotify.Create, seen[path].Op, "Expected %s to be created", path)
+	}
+	assert.True(t, seen[sub].IsDir)
+
+	// The new tree is watched
+	file3 := filepath.Join(sub, "file3.txt")
+	require.NoError(t, os.WriteFile(file3, []byte("3"), 0600))
+	seen = collectEvents(t, w, file3)
+	assert.Equal(t, fsnotify.Create, seen[file3].Op)
+}
+
+// TestWatcher_PollBackend verifies the watcher works on top of the poll backend.
+func TestWatcher_PollBackend(t *testing.T) {
+	t.Parallel()
+
+	tempDir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, err := blink.NewWatcher(ctx, blink.WatcherConfig{
+		RootPath:     tempDir,
+		Recursive:    true,
+		HandlerDelay: 20 * time.Millisecond,
+		PollInterval: 20 * time.Millisecond,
+		Backend:      blink.BackendPoll,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, blink.BackendPoll, w.Backend())
+	w.Start()
+	defer w.Close()
+
+	sub := filepath.Join(tempDir, "sub")
+	file := filepath.Join(sub, "file.txt")
+	require.NoError(t, os.Mkdir(sub, 0755))
+	require.NoError(t, os.WriteFile(file, []byte("1"), 0600))
+	seen := collectEvents(t, w, file)
+	assert.Equal(t, fsnotify.Create, seen[file].Op)
+
+	// Renames are paired into moves like with inotify
+	moved := filepath.Join(sub, "moved.txt")
+	require.NoError(t, os.Rename(file, moved))
+	seen = collectEvents(t, w, moved)
+	assert.Equal(t, blink.OpMove|fsnotify.Create, seen[moved].Op)
+	assert.Equal(t, file, seen[moved].OldName)
+}
+
+// TestWatcher_FanotifyBackend verifies that the fanotify backend reports
+// files in directories created a moment ago, and nothing in excluded ones.
+// It is skipped without CAP_SYS_ADMIN.
+func TestWatcher_FanotifyBackend(t *testing.T) {
+	t.Parallel()
+
+	tempDir := t.TempDir()
+	skipped := filepath.Join(tempDir, "skipped")
+	require.NoError(t, os.Mkdir(skipped, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "initial.txt"), []byte("0"), 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, err := blink.NewWatcher(ctx, blink.WatcherConfig{
+		RootPath:        tempDir,
+		Recursive:       true,
+		HandlerDelay:    20 * time.Millisecond,
+		ExcludePatterns: []string{"skipped/"},
+		Backend:         blink.BackendFanotify,
+	})
+	require.NoError(t, err)
+	if w.Backend() != blink.BackendFanotify {
+		t.Skip("fanotify is not available")
+	}
+	w.Start()
+	defer w.Close()
+
+	nextEvents(t, w)
+
+	nested := filepath.Join(tempDir, "a", "b")
+	file := filepath.Join(nested, "file.txt")
+	ignored := filepath.Join(skipped, "ignored.txt")
+	last := filepath.Join(tempDir, "last.txt")
+	require.NoError(t, os.MkdirAll(nested, 0755))
+	require.NoError(t, os.WriteFile(file, []byte("1"), 0600))
+	require.NoError(t, os.WriteFile(ignored, []byte("2"), 0600))
+	require.NoError(t, os.WriteFile(last, []byte("3"), 0600))
+
+	seen := collectEvents(t, w, file, last)
+	assert.Equal(t, fsnotify.Create, seen[file].Op)
+	assert.NotContains(t, seen, ignored)
+}
+
+// TestWatcher_Roots verifies that each root applies its own patterns and
+// that events carry the name of their root.
+func TestWatcher_Roots(t *testing.T) {
+	t.Parallel()
+
+	apiDir, webDir := t.TempDir(), t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, err := blink.NewWatcher(ctx, blink.WatcherConfig{
+		HandlerDelay: 20 * time.Millisecond,
+		Roots: []blink.RootConfig{
+			{Name: "api", Path: apiDir, IncludePatterns: []string{"*.go"}, Recursive: true},
+			{Name: "web", Path: webDir, IncludePatterns: []string{"*.js"}, Recursive: true},
+		},
+	})
+	require.NoError(t, err)
+	w.Start()
+	defer w.Close()
+
+	require.Len(t, w.Roots(), 2)
+
+	apiFile := filepath.Join(apiDir, "main.go")
+	webFile := filepath.Join(webDir, "app.js")
+	require.NoError(t, os.WriteFile(filepath.Join(apiDir, "app.js"), []byte("x"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(webDir, "main.go"), []byte("x"), 0600))
+	require.NoError(t, os.WriteFile(apiFile, []byte("x"), 0600))
+	require.NoError(t, os.WriteFile(webFile, []byte("x"), 0600))
+
+	seen := collectEvents(t, w, apiFile, webFile)
+	assert.Equal(t, "api", seen[apiFile].RootName)
+	assert.Equal(t, apiDir, seen[apiFile].Root)
+	assert.Equal(t, "web", seen[webFile].RootName)
+	assert.Len(t, seen, 2, "files excluded by their root's patterns must not be reported")
+}
+
+// TestWatcher_OverlappingRoots verifies that nested roots are rejected.
+func TestWatcher_OverlappingRoots(t *testing.T) {
+	t.Parallel()
+
+	tempDir := t.TempDir()
+	nested := filepath.Join(tempDir, "nested")
+	require.NoError(t, os.Mkdir(nested, 0755))
+
+	_, err := blink.NewWatcher(context.Background(), blink.WatcherConfig{
+		Roots: []blink.RootConfig{{Path: tempDir}, {Path: nested}},
+	})
+	assert.Error(t, err)
+}
+
+// TestWatcher_AddRemoveRoot verifies that roots can be added and removed
+// while the watcher runs.
+func TestWatcher_AddRemoveRoot(t *testing.T) {
+	t.Parallel()
+
+	firstDir, secondDir := t.TempDir(), t.TempDir()
+	existing := filepath.Join(secondDir, "existing.txt")
+	require.NoError(t, os.WriteFile(existing, []byte("x"), 0600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, err := blink.NewWatcher(ctx, blink.WatcherConfig{
+		RootPath:     firstDir,
+		Recursive:    true,
+		HandlerDelay: 20 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	w.Start()
+	defer w.Close()
+
+	// Overlapping roots are rejected, like in the configuration
+	assert.Error(t, w.AddRoot(firstDir, blink.RootConfig{Name: "other"}))
+
+	require.NoError(t, w.AddRoot(secondDir, blink.RootConfig{Name: "second", Recursive: true}))
+	require.Len(t, w.Roots(), 2)
+
+	// Files already inside the new root are reported as created
+	event := collectEvents(t, w, existing)[existing]
+	assert.Equal(t, fsnotify.Create, event.Op)
+	assert.Equal(t, "second", event.RootName)
+
+	added := filepath.Join(secondDir, "added.txt")
+	require.NoError(t, os.WriteFile(added, []byte("x"), 0600))
+	assert.Equal(t, "second", collectEvents(t, w, added)[added].RootName)
+
+	require.NoError(t, w.RemoveRoot(secondDir))
+	assert.ErrorIs(t, w.RemoveRoot(secondDir), blink.ErrRootNotFound)
+	require.Len(t, w.Roots(), 1)
+
+	// The removed root is no longer reported, the remaining one still is
+	require.NoError(t, os.WriteFile(filepath.Join(secondDir, "late.txt"), []byte("x"), 0600))
+	kept := filepath.Join(firstDir, "kept.txt")
+	require.NoError(t, os.WriteFile(kept, []byte("x"), 0600))
+	for path := range collectEvents(t, w, kept) {
+		assert.NotContains(t, path, secondDir)
+	}
+}
+
+// TestWatcher_IgnoreFiles verifies that ignored directories are not watched
+// and that changes to ignore files take effect right away.
+func TestWatcher_IgnoreFiles(t *testing.T) {
+	t.Parallel()
+
+	tempDir := t.TempDir()
+	ignoreFile := filepath.Join(tempDir, ".gitignore")
+	ignoredDir := filepath.Join(tempDir, "generated")
+	require.NoError(t, os.WriteFile(ignoreFile, []byte("generated/\n*.log\n"), 0600))
+	require.NoError(t, os.Mkdir(ignoredDir, 0755))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, err := blink.NewWatcher(ctx, blink.WatcherConfig{
+		RootPath:     tempDir,
+		Recursive:    true,
+		HandlerDelay: 20 * time.Millisecond,
+		IgnoreFiles:  blink.DefaultIgnoreFiles,
+	})
+	require.NoError(t, err)
+	w.Start()
+	defer w.Close()
+
+	// The initial scan reports the ignore file itself
+	collectEvents(t, w, ignoreFile)
+
+	kept := filepath.Join(tempDir, "main.go")
+	require.NoError(t, os.WriteFile(filepath.Join(ignoredDir, "out.go"), []byte("x"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "debug.log"), []byte("x"), 0600))
+	require.NoError(t, os.WriteFile(kept, []byte("x"), 0600))
+	for path := range collectEvents(t, w, kept) {
+		assert.Equal(t, kept, path)
+	}
+
+	// Once the directory is no longer ignored, it is watched
+	require.NoError(t, os.WriteFile(ignoreFile, []byte("*.log\n"), 0600))
+	collectEvents(t, w, ignoreFile)
+	generated := filepath.Join(ignoredDir, "new.go")
+	require.NoError(t, os.WriteFile(generated, []byte("x"), 0600))
+	collectEvents(t, w, generated)
+}
+
+// TestWatcher_GlobPatterns tests that include patterns reach into
+// subdirectories and that excluded directories are not watched
+func TestWatcher_GlobPatterns(t *testing.T) {
+	t.Parallel()
+
+	tempDir := t.TempDir()
+	nested := filepath.Join(tempDir, "src", "pkg", "util")
+	testdata := filepath.Join(tempDir, "src", "testdata")
+	require.NoError(t, os.MkdirAll(nested, 0755))
+	require.NoError(t, os.MkdirAll(testdata, 0755))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, err := blink.NewWatcher(ctx, blink.WatcherConfig{
+		RootPath:               tempDir,
+		Recursive:              true,
+		HandlerDelay:           20 * time.Millisecond,
+		IncludePatterns:        []string{"src/**/*.{go,mod}"},
+		ExcludePatterns:        []string{"testdata/"},
+		DisableDefaultExcludes: true,
+	})
+	require.NoError(t, err)
+	w.Start()
+	defer w.Close()
+
+	kept := filepath.Join(nested, "util.go")
+	require.NoError(t, os.WriteFile(filepath.Join(testdata, "input.go"), []byte("x"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "main.go"), []byte("x"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(nested, "README.md"), []byte("x"), 0600))
+	require.NoError(t, os.WriteFile(kept, []byte("x"), 0600))
+	for path := range collectEvents(t, w, kept) {
+		assert.Equal(t, kept, path)
+	}
+}
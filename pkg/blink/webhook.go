@@ -2,59 +2,225 @@ package blink
 
 import (
 	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand/v2"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/TFMV/blink/pkg/logger"
+	"github.com/TFMV/blink/pkg/metrics"
+	"github.com/TFMV/blink/pkg/queue"
 	"github.com/fsnotify/fsnotify"
 )
 
+// WebhookFormat is the format of webhook request bodies
+type WebhookFormat string
+
+// Webhook formats
+const (
+	// WebhookJSON sends an event as its canonical JSON, and a batch as an
+	// object with a batch_id and an events array
+	WebhookJSON WebhookFormat = "json"
+	// WebhookNDJSON sends the events as newline-delimited JSON, one per line
+	WebhookNDJSON WebhookFormat = "ndjson"
+)
+
+// ParseWebhookFormat parses a webhook format, the empty string being WebhookJSON
+func ParseWebhookFormat(format string) (WebhookFormat, error) {
+	switch WebhookFormat(strings.ToLower(strings.TrimSpace(format))) {
+	case "", WebhookJSON:
+		return WebhookJSON, nil
+	case WebhookNDJSON:
+		return WebhookNDJSON, nil
+	default:
+		return "", fmt.Errorf("unknown webhook format: %q", format)
+	}
+}
+
+// Name of a webhook without one
+const defaultWebhookName = "default"
+
 // WebhookConfig defines the configuration for a webhook
 type WebhookConfig struct {
-	// URL to send the webhook to
+	// Name identifies the webhook in logs, metrics and the queue directory
+	// of the server, it defaults to "default"
+	Name string
+	// URL to send the webhook to, a template like Template
 	URL string
 	// HTTP method to use (GET, POST, PUT, etc.)
 	Method string
-	// Headers to include in the request
+	// Headers to include in the request, the values are templates like Template
 	Headers map[string]string
 	// Timeout for the HTTP request
 	Timeout time.Duration
 	// Debounce duration to avoid sending too many webhooks
 	DebounceDuration time.Duration
+	// DebounceMode is whether the first or the last events of a path within
+	// DebounceDuration are sent, DebounceLeading by default
+	DebounceMode DebounceMode
+	// DebounceMaxWait caps how long trailing events can be held back by a
+	// path that keeps changing, 0 for no limit
+	DebounceMaxWait time.Duration
 	// Maximum number of retries for failed requests
 	MaxRetries int
+	// QueueDir holds the delivery queue and the dead-letter store, by
+	// default a subdirectory of DefaultWebhookQueueDir named after the
+	// webhook. It is kept on Close, so deliveries survive a restart.
+	QueueDir string
+	// RetryBackoff is the delay before the first retry, doubled for every
+	// further retry up to MaxRetryBackoff, with random jitter
+	RetryBackoff time.Duration
+	// MaxRetryBackoff caps the delay between retries
+	MaxRetryBackoff time.Duration
+	// MaxQueueSize is the size of the queue on disk at which new deliveries
+	// are dropped
+	MaxQueueSize int64
+	// QueueSyncInterval is how often the deliveries queued and answered
+	// meanwhile are synced to disk together, 100ms by default, or negative
+	// to sync every one of them. A power loss can drop the deliveries queued since
+	// the last sync, and send again those answered since then.
+	QueueSyncInterval time.Duration
+	// Secrets sign the requests, see package verify. Every secret adds a
+	// signature, so that receivers can switch secrets one at a time.
+	Secrets []string
+	// Batch sends several events per request, and replaces debouncing
+	Batch WebhookBatchConfig
+	// Breaker pauses deliveries while the receiver is down
+	Breaker WebhookBreakerConfig
+	// Format of the request bodies
+	Format WebhookFormat
+	// Template is a text/template for the request bodies instead of Format,
+	// executed with a WebhookTemplateData
+	Template string
+	// ContentType of the requests, by default that of Format, or
+	// application/json for templates
+	ContentType string
+
+	// Patterns and event types the files must match, on top of the
+	// server's filter
+	IncludePatterns []string
+	ExcludePatterns []string
+	IncludeEvents   []string
+	IgnoreEvents    []string
+	// Filter expression the events must satisfy
+	Filter string
 }
 
-// WebhookManager manages webhooks for file system events
+// Number of concurrent webhook requests
+const webhookWorkers = 4
+
+// Longest Retry-After honoured, a receiver asking for more is retried sooner
+const maxRetryAfter = time.Hour
+
+// How often replayed dead letters are picked up
+const replayPollInterval = time.Second
+
+// webhookDelivery is a queued webhook request, for a single event or a batch
+type webhookDelivery struct {
+	ID      string         `json:"id"`
+	Event   Event          `json:"event,omitzero"`
+	Batch   []BatchedEvent `json:"batch,omitempty"`
+	Created time.Time      `json:"created"`
+}
+
+// describe returns what the delivery is about, for logging
+func (d *webhookDelivery) describe() string {
+	if d.Batch != nil {
+		return fmt.Sprintf("batch %s of %d events", d.ID, len(d.Batch))
+	}
+	return fmt.Sprintf("%s (%s)", d.Event.Name, eventTypeToString(d.Event.Op))
+}
+
+// payload returns the request body of the delivery and its content type
+func (d *webhookDelivery) payload(format WebhookFormat) ([]byte, string, error) {
+	if format == WebhookNDJSON {
+		events := d.Batch
+		if events == nil {
+			events = []BatchedEvent{{Event: d.Event}}
+		}
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		for _, event := range events {
+			if err := encoder.Encode(event.wire()); err != nil {
+				return nil, "", err
+			}
+		}
+		return buf.Bytes(), "application/x-ndjson", nil
+	}
+
+	if d.Batch != nil {
+		body, err := batchPayload(d.ID, d.Batch)
+		return body, "application/json", err
+	}
+	// The event's canonical JSON
+	body, err := json.Marshal(d.Event)
+	return body, "application/json", err
+}
+
+// pendingDelivery is a delivery read from the queue and not acknowledged yet
+type pendingDelivery struct {
+	webhookDelivery
+	seq      uint64
+	attempts int
+}
+
+// WebhookManager manages webhooks for file system events. Events are
+// written to a queue on disk and delivered at least once: a delivery is only
+// removed from the queue once the receiver accepted it or it was moved to
+// the dead-letter store.
 type WebhookManager struct {
 	// Configuration for the webhook
 	Config WebhookConfig
 	// HTTP client for sending webhooks
 	client *http.Client
-	// Map to track recent events for debouncing
-	recentEvents map[string]time.Time
-	// Mutex to protect the recentEvents map
+	// Builds the requests
+	renderer *webhookRenderer
+	// Circuit breaker of the receiver
+	breaker *webhookBreaker
+	// Events the webhook is sent for, nil for all
+	filter *EventFilter
+	// Paths within their debounce window
+	debouncer webhookDebouncer
+	// Mutex to protect the debouncer and the batch
 	mu sync.Mutex
-	// Channel to receive events
-	eventChan chan fsnotify.Event
-}
-
-// WebhookPayload is the JSON payload sent to the webhook URL
-type WebhookPayload struct {
-	// Path of the file that changed
-	Path string `json:"path"`
-	// Type of event (create, write, remove, rename, chmod)
-	EventType string `json:"event_type"`
-	// Time the event occurred (RFC3339 format)
-	Timestamp string `json:"timestamp"`
+	// Batch being collected
+	batch webhookBatch
+
+	// Delivery queue and dead-letter store
+	queue       *queue.Queue
+	deadLetters *DeadLetterStore
+	// Deliveries read from the queue, waiting for a worker
+	ready chan *pendingDelivery
+	// Number of deliveries waiting for a retry
+	waiting atomic.Int64
+
+	// Lifecycle, closed is protected by mu
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closed    bool
+	closeOnce sync.Once
+	loops     sync.WaitGroup
 }
 
-// NewWebhookManager creates a new webhook manager
-func NewWebhookManager(config WebhookConfig) *WebhookManager {
+// NewWebhookManager creates a new webhook manager and starts delivering the
+// deliveries left in its queue by a previous run
+func NewWebhookManager(config WebhookConfig) (*WebhookManager, error) {
 	// Set default values if not provided
+	if config.Name == "" {
+		config.Name = defaultWebhookName
+	}
 	if config.Method == "" {
 		config.Method = "POST"
 	}
@@ -67,157 +233,510 @@ func NewWebhookManager(config WebhookConfig) *WebhookManager {
 	if config.MaxRetries == 0 {
 		config.MaxRetries = 3
 	}
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = time.Second
+	}
+	if config.MaxRetryBackoff == 0 {
+		config.MaxRetryBackoff = 5 * time.Minute
+	}
+	if config.QueueSyncInterval == 0 {
+		config.QueueSyncInterval = 100 * time.Millisecond
+	}
+	if config.Breaker.FailureThreshold == 0 {
+		config.Breaker.FailureThreshold = defaultBreakerFailureThreshold
+	}
+	if config.Breaker.OpenDuration <= 0 {
+		config.Breaker.OpenDuration = defaultBreakerOpenDuration
+	}
+	if config.Breaker.SuccessThreshold <= 0 {
+		config.Breaker.SuccessThreshold = defaultBreakerSuccessThreshold
+	}
+	if config.Batch.enabled() {
+		if config.Batch.MaxEvents <= 0 {
+			config.Batch.MaxEvents = defaultBatchMaxEvents
+		}
+		if config.Batch.MaxBytes <= 0 {
+			config.Batch.MaxBytes = defaultBatchMaxBytes
+		}
+		if config.Batch.MaxWait <= 0 {
+			config.Batch.MaxWait = defaultBatchMaxWait
+		}
+	}
+
+	var err error
+	if config.Format, err = ParseWebhookFormat(string(config.Format)); err != nil {
+		return nil, fmt.Errorf("invalid format for webhook %q: %w", config.Name, err)
+	}
+	if config.DebounceMode, err = ParseDebounceMode(string(config.DebounceMode)); err != nil {
+		return nil, fmt.Errorf("invalid debounce for webhook %q: %w", config.Name, err)
+	}
+	if config.Batch.Coalesce, err = ParseCoalesceMode(string(config.Batch.Coalesce)); err != nil {
+		return nil, fmt.Errorf("invalid batch for webhook %q: %w", config.Name, err)
+	}
+	filter, err := compileEventFilter(config.IncludePatterns, config.ExcludePatterns,
+		config.IncludeEvents, config.IgnoreEvents, config.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter for webhook %q: %w", config.Name, err)
+	}
+	renderer, err := newWebhookRenderer(config)
+	if err != nil {
+		return nil, fmt.Errorf("webhook %q: %w", config.Name, err)
+	}
 
-	// Create HTTP client with timeout
-	client := &http.Client{
-		Timeout: config.Timeout,
+	if config.QueueDir == "" {
+		dir := DefaultWebhookQueueDir()
+		if dir == "" {
+			return nil, fmt.Errorf("webhook %q has no queue directory", config.Name)
+		}
+		config.QueueDir = filepath.Join(dir, config.Name)
 	}
 
-	// Create webhook manager
 	manager := &WebhookManager{
-		Config:       config,
-		client:       client,
-		recentEvents: make(map[string]time.Time),
-		eventChan:    make(chan fsnotify.Event, 100),
+		Config:   config,
+		client:   &http.Client{Timeout: config.Timeout},
+		filter:   filter,
+		renderer: renderer,
+		breaker:  newWebhookBreaker(config.Name, config.Breaker),
+		ready:    make(chan *pendingDelivery),
+	}
+
+	if err := manager.open(config.QueueDir); err != nil {
+		return nil, err
+	}
+
+	if pending := manager.queue.Len(); pending > 0 {
+		logger.Infof("Resuming %d queued webhook deliveries", pending)
+	}
+	metrics.WebhookQueueDepth.WithLabelValues(config.Name).Set(float64(manager.queue.Len()))
+
+	manager.ctx, manager.cancel = context.WithCancel(context.Background())
+	manager.loops.Add(2 + webhookWorkers)
+	go manager.readQueue()
+	go manager.pollReplays()
+	for i := 0; i < webhookWorkers; i++ {
+		go manager.work()
+	}
+
+	return manager, nil
+}
+
+// DefaultWebhookQueueDir returns the directory of the webhook queues when
+// none is configured, ~/.blink/webhooks, or "" if the home directory is
+// unknown
+func DefaultWebhookQueueDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".blink", "webhooks")
+}
+
+// newWebhooks creates the managers of the given webhooks. The queue of a
+// webhook without a QueueDir goes in a subdirectory of queueDir named after
+// it, if queueDir is set.
+func newWebhooks(configs []WebhookConfig, queueDir string) ([]*WebhookManager, error) {
+	var managers []*WebhookManager
+	names := make(map[string]bool)
+	for _, config := range configs {
+		if config.Name == "" {
+			config.Name = defaultWebhookName
+		}
+		var err error
+		switch {
+		case !validWebhookName(config.Name):
+			err = fmt.Errorf("invalid webhook name %q: use letters, digits, '.', '-' and '_'", config.Name)
+		case names[config.Name]:
+			err = fmt.Errorf("duplicate webhook name %q", config.Name)
+		case config.URL == "":
+			err = fmt.Errorf("webhook %q has no url", config.Name)
+		}
+		names[config.Name] = true
+
+		if err == nil {
+			if config.QueueDir == "" && queueDir != "" {
+				config.QueueDir = filepath.Join(queueDir, config.Name)
+			}
+			var manager *WebhookManager
+			if manager, err = NewWebhookManager(config); err == nil {
+				managers = append(managers, manager)
+			}
+		}
+		if err != nil {
+			closeWebhooks(context.Background(), managers)
+			return nil, err
+		}
 	}
+	return managers, nil
+}
 
-	// Start processing events
-	go manager.processEvents()
+// closeWebhooks closes webhook managers concurrently, so that they share the
+// time ctx allows
+func closeWebhooks(ctx context.Context, managers []*WebhookManager) error {
+	errs := make([]error, len(managers))
+	var wg sync.WaitGroup
+	for i, manager := range managers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := manager.Close(ctx); err != nil {
+				errs[i] = fmt.Errorf("webhook %s: %w", manager.Config.Name, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
 
-	return manager
+// validWebhookName reports whether name can be used as a directory name
+func validWebhookName(name string) bool {
+	if name == "." || name == ".." {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
 }
 
-// HandleEvent processes a file system event and sends it to the webhook
-func (m *WebhookManager) HandleEvent(event fsnotify.Event) {
+// open opens the queue and the dead-letter store in dir
+func (m *WebhookManager) open(dir string) error {
+	q, err := queue.Open(filepath.Join(dir, "queue"), queue.Options{
+		MaxSize:      m.Config.MaxQueueSize,
+		SyncInterval: max(m.Config.QueueSyncInterval, 0),
+	})
+	if err != nil {
+		return fmt.Errorf("error opening webhook queue: %w", err)
+	}
+	deadLetters, err := OpenDeadLetterStore(dir)
+	if err != nil {
+		q.Close()
+		return fmt.Errorf("error opening webhook dead-letter store: %w", err)
+	}
+	m.queue, m.deadLetters = q, deadLetters
+	return nil
+}
+
+// DeadLetters returns the dead-letter store of the webhook
+func (m *WebhookManager) DeadLetters() *DeadLetterStore {
+	return m.deadLetters
+}
+
+// HandleEvent processes a file system event and queues it for the webhook.
+// The request body is the event's canonical JSON encoding, or a batch of
+// events if batching is enabled.
+func (m *WebhookManager) HandleEvent(event Event) {
 	// Skip if no URL is configured
 	if m.Config.URL == "" {
 		return
 	}
 
-	// If debounce is enabled, use the event channel
-	if m.Config.DebounceDuration > 0 {
+	// Skip events the webhook is not interested in
+	if m.filter != nil && !m.filter.ShouldProcessEvent(event) {
+		return
+	}
+
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		metrics.MessagesDropped.WithLabelValues(metrics.StreamWebhook).Inc()
+		return
+	}
+
+	if m.Config.Batch.enabled() {
+		m.addToBatch(event)
+		return
+	}
+
+	m.debounce(event)
+}
+
+// deliver queues the delivery of an event. The caller must hold mu.
+func (m *WebhookManager) deliver(event Event) {
+	if err := m.enqueue(webhookDelivery{ID: newDeliveryID(), Event: event, Created: time.Now()}); err != nil {
+		metrics.MessagesDropped.WithLabelValues(metrics.StreamWebhook).Inc()
+		logger.Error(fmt.Errorf("error queueing webhook, dropping event for %s: %w", event.Name, err))
+	}
+}
+
+// enqueue appends a delivery to the queue
+func (m *WebhookManager) enqueue(delivery webhookDelivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	if err := m.queue.Append(data); err != nil {
+		return err
+	}
+	metrics.WebhookQueueDepth.WithLabelValues(m.Config.Name).Set(float64(m.queue.Len()))
+	return nil
+}
+
+// Close stops accepting new events and waits for the queued deliveries to
+// be attempted. Deliveries waiting for a retry or for an open circuit stay
+// in the queue, and are resumed by the next WebhookManager using the same
+// QueueDir. If ctx expires first, in-flight requests are abandoned and
+// ctx.Err() is returned.
+func (m *WebhookManager) Close(ctx context.Context) error {
+	m.mu.Lock()
+	m.closed = true
+	m.flushDebounced()
+	m.flushBatch()
+	m.mu.Unlock()
+
+	var err error
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for !m.idle() && err == nil {
 		select {
-		case m.eventChan <- event:
-			// Event added to channel
-		default:
-			// Channel is full, log and drop the event
-			logger.Error(fmt.Errorf("webhook event channel is full, dropping event for %s", event.Name))
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = ctx.Err()
 		}
-		return
 	}
 
-	// Otherwise, send the webhook immediately
-	m.sendWebhook(event)
+	m.closeOnce.Do(func() {
+		m.cancel()
+		m.loops.Wait()
+		if closeErr := m.queue.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	})
+	return err
 }
 
-// processEvents processes events from the event channel
-func (m *WebhookManager) processEvents() {
-	for event := range m.eventChan {
-		// Check if we should debounce this event
-		if m.shouldDebounce(event) {
+// idle reports whether every delivery in the queue is waiting for a retry
+// or for the circuit to close
+func (m *WebhookManager) idle() bool {
+	return int64(m.queue.Len()) == m.waiting.Load() || m.breaker.isOpen()
+}
+
+// readQueue hands the queued deliveries to the workers
+func (m *WebhookManager) readQueue() {
+	defer m.loops.Done()
+
+	for {
+		record, err := m.queue.Next(m.ctx)
+		if err != nil {
+			if m.ctx.Err() == nil && !errors.Is(err, queue.ErrClosed) {
+				logger.Error(fmt.Errorf("error reading webhook queue, delivery stopped: %w", err))
+			}
+			return
+		}
+
+		var delivery webhookDelivery
+		if err := json.Unmarshal(record.Data, &delivery); err != nil {
+			logger.Error(fmt.Errorf("discarding unreadable webhook delivery: %w", err))
+			m.ack(record.Seq)
 			continue
 		}
 
-		// Send webhook
-		go m.sendWebhook(event)
+		select {
+		case m.ready <- &pendingDelivery{webhookDelivery: delivery, seq: record.Seq}:
+		case <-m.ctx.Done():
+			return
+		}
 	}
 }
 
-// shouldDebounce checks if an event should be debounced
-func (m *WebhookManager) shouldDebounce(event fsnotify.Event) bool {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	now := time.Now()
-	lastSeen, exists := m.recentEvents[event.Name]
+// pollReplays queues the dead letters replayed with `blink webhook dlq replay`
+func (m *WebhookManager) pollReplays() {
+	defer m.loops.Done()
 
-	// If we've seen this event recently, debounce it
-	if exists && now.Sub(lastSeen) < m.Config.DebounceDuration {
-		return true
+	ticker := time.NewTicker(replayPollInterval)
+	defer ticker.Stop()
+	for {
+		m.deadLetters.drainReplays(func(letter DeadLetter) error {
+			return m.enqueue(webhookDelivery{ID: letter.ID, Event: letter.Event, Batch: letter.Batch, Created: letter.Created})
+		})
+		select {
+		case <-ticker.C:
+		case <-m.ctx.Done():
+			return
+		}
 	}
+}
 
-	// Update the last seen time
-	m.recentEvents[event.Name] = now
+// work attempts the deliveries handed out by readQueue and retries
+func (m *WebhookManager) work() {
+	defer m.loops.Done()
 
-	// Clean up old events
-	for path, t := range m.recentEvents {
-		if now.Sub(t) > m.Config.DebounceDuration*10 {
-			delete(m.recentEvents, path)
+	for {
+		select {
+		case delivery := <-m.ready:
+			// Hold the delivery while the receiver is down
+			if !m.breaker.wait(m.ctx) {
+				return
+			}
+			m.attempt(delivery)
+		case <-m.ctx.Done():
+			return
 		}
 	}
+}
+
+// attempt sends a delivery, then acknowledges it, schedules a retry or
+// moves it to the dead-letter store
+func (m *WebhookManager) attempt(delivery *pendingDelivery) {
+	delivery.attempts++
+	retryAfter, retryable, err := m.send(delivery)
+
+	// Leave the delivery in the queue if we are shutting down
+	if m.ctx.Err() != nil {
+		return
+	}
+	m.breaker.record(err, retryable)
 
-	return false
+	switch {
+	case err == nil:
+		m.ack(delivery.seq)
+		metrics.WebhookDeliveries.WithLabelValues(m.Config.Name, "success").Inc()
+		if delivery.Batch != nil {
+			metrics.MessagesSent.WithLabelValues(metrics.StreamWebhook).Add(float64(len(delivery.Batch)))
+			for _, batched := range delivery.Batch {
+				metrics.DeliveryLatency.WithLabelValues(metrics.StreamWebhook).Observe(time.Since(batched.Event.Timestamp).Seconds())
+			}
+		} else {
+			metrics.MessagesSent.WithLabelValues(metrics.StreamWebhook).Inc()
+			metrics.DeliveryLatency.WithLabelValues(metrics.StreamWebhook).Observe(time.Since(delivery.Event.Timestamp).Seconds())
+		}
+		logger.Infof("Webhook %s sent successfully for %s", m.Config.Name, delivery.describe())
+
+	case retryable && delivery.attempts <= m.Config.MaxRetries:
+		delay := m.backoff(delivery.attempts, retryAfter)
+		metrics.WebhookRetries.WithLabelValues(m.Config.Name).Inc()
+		logger.Warnf("Webhook %s for %s failed (%s), retrying in %v", m.Config.Name, delivery.describe(), redactError(err), delay.Round(time.Millisecond))
+		m.waiting.Add(1)
+		time.AfterFunc(delay, func() {
+			m.waiting.Add(-1)
+			select {
+			case m.ready <- delivery:
+			case <-m.ctx.Done():
+			}
+		})
+
+	default:
+		metrics.WebhookErrors.WithLabelValues(m.Config.Name).Inc()
+		metrics.WebhookDeliveries.WithLabelValues(m.Config.Name, "failure").Inc()
+		logger.Error(fmt.Errorf("webhook %s for %s failed after %d attempts, moving it to the dead-letter store: %s", m.Config.Name, delivery.describe(), delivery.attempts, redactError(err)))
+
+		letter := DeadLetter{
+			ID:        delivery.ID,
+			URL:       redactURL(m.Config.URL),
+			Event:     delivery.Event,
+			Batch:     delivery.Batch,
+			Attempts:  delivery.attempts,
+			LastError: redactError(err),
+			Created:   delivery.Created,
+			FailedAt:  time.Now(),
+		}
+		if err := m.deadLetters.Add(letter); err != nil {
+			// Keep it in the queue rather than lose it, it is retried after a restart
+			logger.Error(fmt.Errorf("error storing dead letter %s: %w", delivery.ID, err))
+			return
+		}
+		metrics.WebhookDeadLetters.WithLabelValues(m.Config.Name).Inc()
+		m.ack(delivery.seq)
+	}
 }
 
-// sendWebhook sends a webhook for the given event
-func (m *WebhookManager) sendWebhook(event fsnotify.Event) {
-	// Create the payload
-	payload := WebhookPayload{
-		Path:      event.Name,
-		EventType: eventTypeToString(event.Op),
-		Timestamp: time.Now().Format(time.RFC3339),
+// ack removes a delivery from the queue
+func (m *WebhookManager) ack(seq uint64) {
+	if err := m.queue.Ack(seq); err != nil {
+		logger.Error(fmt.Errorf("error acknowledging webhook delivery: %w", err))
 	}
+	metrics.WebhookQueueDepth.WithLabelValues(m.Config.Name).Set(float64(m.queue.Len()))
+}
 
-	// Marshal the payload to JSON
-	jsonPayload, err := json.Marshal(payload)
+// send makes one attempt at a delivery. It returns whether a failed attempt
+// is worth retrying, and the delay asked for by a Retry-After header.
+func (m *WebhookManager) send(delivery *pendingDelivery) (time.Duration, bool, error) {
+	// A request that cannot be built will not be built by a retry either
+	req, err := m.renderer.request(m.ctx, &delivery.webhookDelivery)
 	if err != nil {
-		logger.Error(fmt.Errorf("error marshaling webhook payload: %w", err))
-		return
+		return 0, false, err
 	}
 
-	// Create the request
-	req, err := http.NewRequest(m.Config.Method, m.Config.URL, bytes.NewBuffer(jsonPayload))
+	start := time.Now()
+	resp, err := m.client.Do(req)
+	metrics.WebhookLatency.WithLabelValues(m.Config.Name).Observe(time.Since(start).Seconds())
 	if err != nil {
-		logger.Error(fmt.Errorf("error creating webhook request: %w", err))
-		return
+		return 0, true, err
 	}
+	defer resp.Body.Close()
+	// Drain the body so that the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
 
-	// Set headers
-	req.Header.Set("Content-Type", "application/json")
-	for key, value := range m.Config.Headers {
-		req.Header.Set(key, value)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return 0, false, nil
 	}
 
-	// Send the request with retries
-	var resp *http.Response
-	var sendErr error
+	// Client errors other than timeouts and rate limiting will not go away
+	retryable := resp.StatusCode >= 500 ||
+		resp.StatusCode == http.StatusRequestTimeout ||
+		resp.StatusCode == http.StatusTooManyRequests
+	return parseRetryAfter(resp.Header.Get("Retry-After")), retryable,
+		fmt.Errorf("webhook returned non-success status code: %d", resp.StatusCode)
+}
 
-	client := &http.Client{
-		Timeout: m.Config.Timeout,
+// backoff returns the delay before retrying a delivery after the given
+// number of attempts: the Retry-After delay if the receiver sent one,
+// otherwise between half and all of RetryBackoff doubled for every earlier
+// retry, capped at MaxRetryBackoff
+func (m *WebhookManager) backoff(attempts int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return min(retryAfter, maxRetryAfter)
 	}
 
-	for i := 0; i <= m.Config.MaxRetries; i++ {
-		resp, sendErr = client.Do(req)
-		if sendErr == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
-			break
-		}
-
-		if i < m.Config.MaxRetries {
-			// Wait before retrying
-			time.Sleep(time.Duration(i+1) * time.Second)
+	ceiling := m.Config.MaxRetryBackoff
+	if shift := attempts - 1; shift < 32 {
+		if delay := m.Config.RetryBackoff << shift; delay > 0 && delay < ceiling {
+			ceiling = delay
 		}
 	}
+	half := ceiling / 2
+	return half + rand.N(ceiling-half+1)
+}
 
-	// Check for errors
-	if sendErr != nil {
-		logger.Error(fmt.Errorf("error sending webhook after %d retries: %w", m.Config.MaxRetries, sendErr))
-		return
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date. It returns 0 if there is none.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
 	}
-	defer resp.Body.Close()
-
-	// Check response status
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		logger.Error(fmt.Errorf("webhook returned non-success status code: %d", resp.StatusCode))
-		return
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
 	}
+	return 0
+}
 
-	// Log success
-	logger.Infof("Webhook sent successfully for %s (%s)", event.Name, eventTypeToString(event.Op))
+// newDeliveryID returns a random id for a webhook delivery
+func newDeliveryID() string {
+	var id [16]byte
+	if _, err := crand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id[:])
 }
 
 // eventTypeToString converts an fsnotify.Op to a string
 func eventTypeToString(op fsnotify.Op) string {
 	switch {
+	case op&OpOverflow != 0:
+		return "overflow"
+	case op&OpExec != 0:
+		return "exec"
+	case op&OpMove != 0:
+		return "move"
 	case op&fsnotify.Create != 0:
 		return "create"
 	case op&fsnotify.Write != 0:
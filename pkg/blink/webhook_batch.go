@@ -0,0 +1,203 @@
+package blink
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/TFMV/blink/pkg/logger"
+	"github.com/TFMV/blink/pkg/metrics"
+)
+
+// CoalesceMode is how a webhook batch combines the events of a path
+type CoalesceMode string
+
+// Coalesce modes
+const (
+	// CoalesceNone keeps every event
+	CoalesceNone CoalesceMode = "none"
+	// CoalesceLast keeps the last event of each path
+	CoalesceLast CoalesceMode = "last"
+	// CoalesceMerge keeps the last event of each path, along with the
+	// operations of all of them
+	CoalesceMerge CoalesceMode = "merge"
+)
+
+// ParseCoalesceMode parses a coalesce mode, the empty string being CoalesceNone
+func ParseCoalesceMode(mode string) (CoalesceMode, error) {
+	switch CoalesceMode(strings.ToLower(strings.TrimSpace(mode))) {
+	case "", CoalesceNone:
+		return CoalesceNone, nil
+	case CoalesceLast:
+		return CoalesceLast, nil
+	case CoalesceMerge:
+		return CoalesceMerge, nil
+	default:
+		return "", fmt.Errorf("unknown coalesce mode: %q", mode)
+	}
+}
+
+// Defaults of WebhookBatchConfig
+const (
+	defaultBatchMaxEvents = 100
+	defaultBatchMaxBytes  = 1 << 20
+	defaultBatchMaxWait   = time.Second
+)
+
+// WebhookBatchConfig configures batched webhook deliveries, which send
+// several events per request, see WebhookFormat. Batching is enabled when
+// any of the limits is set, the others then get defaults.
+type WebhookBatchConfig struct {
+	// MaxEvents is the number of events at which a batch is sent
+	MaxEvents int
+	// MaxBytes is the size of the encoded events at which a batch is sent
+	MaxBytes int
+	// MaxWait is the time after its first event at which a batch is sent
+	MaxWait time.Duration
+	// Coalesce is how the events of a path within a batch are combined
+	Coalesce CoalesceMode
+}
+
+// enabled reports whether webhooks are batched
+func (c WebhookBatchConfig) enabled() bool {
+	return c.MaxEvents > 0 || c.MaxBytes > 0 || c.MaxWait > 0
+}
+
+// BatchedEvent is an event of a webhook batch. With CoalesceMerge, Ops holds
+// the operations of all the events of the path, in the order they happened.
+type BatchedEvent struct {
+	Event Event    `json:"event"`
+	Ops   []string `json:"ops,omitempty"`
+}
+
+// batchedEventJSON is the wire format of a BatchedEvent
+type batchedEventJSON struct {
+	eventJSON
+	Ops []string `json:"ops,omitempty"`
+}
+
+// webhookBatchJSON is the request body of a batch
+type webhookBatchJSON struct {
+	BatchID string             `json:"batch_id"`
+	Events  []batchedEventJSON `json:"events"`
+}
+
+// webhookBatch is the batch being collected by a WebhookManager
+type webhookBatch struct {
+	events []BatchedEvent
+	sizes  []int
+	bytes  int
+	// Position of each path in events, when coalescing
+	index map[string]int
+	// Incremented by every flush, so that a stale timer flushes nothing
+	generation uint64
+	timer      *time.Timer
+}
+
+// addToBatch adds an event to the batch, and sends the batch when it is
+// full. The caller must hold mu.
+func (m *WebhookManager) addToBatch(event Event) {
+	config := m.Config.Batch
+	batch := &m.batch
+
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		logger.Error(fmt.Errorf("error marshaling webhook event: %w", err))
+		return
+	}
+	size := len(encoded)
+
+	if i, ok := batch.index[event.Name]; ok && config.Coalesce != CoalesceNone {
+		entry := &batch.events[i]
+		entry.Event = event
+		if config.Coalesce == CoalesceMerge {
+			entry.Ops = appendOp(entry.Ops, event.OpString())
+		}
+		batch.bytes += size - batch.sizes[i]
+		batch.sizes[i] = size
+	} else {
+		// Send what we have if this event would make the batch too large
+		if len(batch.events) > 0 && batch.bytes+size > config.MaxBytes {
+			m.flushBatch()
+		}
+
+		entry := BatchedEvent{Event: event}
+		if config.Coalesce == CoalesceMerge {
+			entry.Ops = []string{event.OpString()}
+		}
+		if config.Coalesce != CoalesceNone {
+			if batch.index == nil {
+				batch.index = make(map[string]int)
+			}
+			batch.index[event.Name] = len(batch.events)
+		}
+		batch.events = append(batch.events, entry)
+		batch.sizes = append(batch.sizes, size)
+		batch.bytes += size
+
+		if len(batch.events) == 1 {
+			generation := batch.generation
+			batch.timer = time.AfterFunc(config.MaxWait, func() {
+				m.mu.Lock()
+				defer m.mu.Unlock()
+				if m.batch.generation == generation {
+					m.flushBatch()
+				}
+			})
+		}
+	}
+
+	if len(batch.events) >= config.MaxEvents || batch.bytes >= config.MaxBytes {
+		m.flushBatch()
+	}
+}
+
+// flushBatch queues the batch being collected. The caller must hold mu.
+func (m *WebhookManager) flushBatch() {
+	batch := &m.batch
+	if batch.timer != nil {
+		batch.timer.Stop()
+		batch.timer = nil
+	}
+	batch.generation++
+	if len(batch.events) == 0 {
+		return
+	}
+
+	events := batch.events
+	batch.events, batch.sizes, batch.bytes = nil, nil, 0
+	clear(batch.index)
+
+	if err := m.enqueue(webhookDelivery{ID: newDeliveryID(), Batch: events, Created: time.Now()}); err != nil {
+		metrics.MessagesDropped.WithLabelValues(metrics.StreamWebhook).Add(float64(len(events)))
+		logger.Error(fmt.Errorf("error queueing webhook, dropping a batch of %d events: %w", len(events), err))
+	}
+}
+
+// appendOp adds an operation to a set of operations, keeping their order
+func appendOp(ops []string, op string) []string {
+	for _, existing := range ops {
+		if existing == op {
+			return ops
+		}
+	}
+	return append(ops, op)
+}
+
+// batchPayload encodes a batch as a request body
+func batchPayload(id string, events []BatchedEvent) ([]byte, error) {
+	body := webhookBatchJSON{
+		BatchID: id,
+		Events:  make([]batchedEventJSON, len(events)),
+	}
+	for i, event := range events {
+		body.Events[i] = event.wire()
+	}
+	return json.Marshal(body)
+}
+
+// wire returns the event in its wire format
+func (e BatchedEvent) wire() batchedEventJSON {
+	return batchedEventJSON{eventJSON: e.Event.wire(), Ops: e.Ops}
+}
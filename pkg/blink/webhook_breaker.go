@@ -0,0 +1,286 @@
+package blink
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TFMV/blink/pkg/logger"
+	"github.com/TFMV/blink/pkg/metrics"
+)
+
+// CircuitState is the state of the circuit breaker of a webhook
+type CircuitState string
+
+// Circuit states
+const (
+	// CircuitClosed sends deliveries as usual
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen holds deliveries back after repeated failures
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen sends trial deliveries, one at a time, to find out
+	// whether the receiver is back
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// Defaults of WebhookBreakerConfig
+const (
+	defaultBreakerFailureThreshold = 5
+	defaultBreakerOpenDuration     = 30 * time.Second
+	defaultBreakerSuccessThreshold = 1
+)
+
+// WebhookBreakerConfig configures the circuit breaker of a webhook. After
+// FailureThreshold failed attempts in a row the circuit opens, and no
+// requests are sent for OpenDuration. Trial deliveries are then sent one at
+// a time: SuccessThreshold successful ones close the circuit, a failed one
+// opens it again. Deliveries wait in the queue while the circuit is open,
+// without using up their retries.
+type WebhookBreakerConfig struct {
+	// FailureThreshold is the number of failed attempts in a row that
+	// opens the circuit, negative to never open it
+	FailureThreshold int
+	// OpenDuration is how long the circuit stays open before a trial
+	OpenDuration time.Duration
+	// SuccessThreshold is the number of successful trials that close the
+	// circuit
+	SuccessThreshold int
+}
+
+// WebhookStatus is the delivery health of a webhook
+type WebhookStatus struct {
+	Name  string       `json:"name"`
+	State CircuitState `json:"state"`
+	// ConsecutiveFailures is the number of failed attempts since the last
+	// successful one
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	// QueueDepth is the number of deliveries in the queue, including those
+	// waiting for a retry
+	QueueDepth  int       `json:"queue_depth"`
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	// LastError leaves out the path and query of the URL, which may hold
+	// secrets
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitzero"`
+	// OpenUntil is when an open circuit lets a trial delivery through
+	OpenUntil time.Time `json:"open_until,omitzero"`
+}
+
+// webhookBreaker is the circuit breaker of a WebhookManager, it also keeps
+// the outcome of the last attempts for WebhookStatus
+type webhookBreaker struct {
+	name   string
+	config WebhookBreakerConfig
+
+	mu        sync.Mutex
+	state     CircuitState
+	failures  int
+	successes int
+	openedAt  time.Time
+	// Whether a trial delivery is in flight
+	trial bool
+	// Closed and replaced when the state changes or a trial ends
+	changed chan struct{}
+
+	lastSuccess time.Time
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// newWebhookBreaker creates a closed circuit breaker
+func newWebhookBreaker(name string, config WebhookBreakerConfig) *webhookBreaker {
+	metrics.WebhookCircuitState.WithLabelValues(name).Set(0)
+	return &webhookBreaker{
+		name:    name,
+		config:  config,
+		state:   CircuitClosed,
+		changed: make(chan struct{}),
+	}
+}
+
+// wait blocks until the circuit lets a request through. It returns false
+// if ctx ends first.
+func (b *webhookBreaker) wait(ctx context.Context) bool {
+	for {
+		b.mu.Lock()
+		ok, delay, changed := b.acquire(time.Now())
+		b.mu.Unlock()
+		if ok {
+			return true
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if delay > 0 {
+			timer = time.NewTimer(delay)
+			timeout = timer.C
+		}
+		select {
+		case <-timeout:
+		case <-changed:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+	}
+}
+
+// acquire reports whether a request can be sent now, or else how long the
+// circuit stays open and a channel closed when it changes. The caller must
+// hold mu.
+func (b *webhookBreaker) acquire(now time.Time) (bool, time.Duration, <-chan struct{}) {
+	b.expire(now)
+	switch b.state {
+	case CircuitOpen:
+		return false, b.openedAt.Add(b.config.OpenDuration).Sub(now), b.changed
+	case CircuitHalfOpen:
+		if b.trial {
+			return false, 0, b.changed
+		}
+		b.trial = true
+	}
+	return true, 0, nil
+}
+
+// expire moves an open circuit to half-open once OpenDuration has passed.
+// The caller must hold mu.
+func (b *webhookBreaker) expire(now time.Time) {
+	if b.state == CircuitOpen && !now.Before(b.openedAt.Add(b.config.OpenDuration)) {
+		b.setState(CircuitHalfOpen)
+		logger.Infof("Webhook %s: circuit half-open, sending a trial delivery", b.name)
+	}
+}
+
+// record records the outcome of an attempt. failed is whether the receiver
+// failed, rather than rejected the delivery.
+func (b *webhookBreaker) record(err error, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if err == nil {
+		b.lastSuccess = now
+	} else {
+		b.lastError, b.lastErrorAt = redactError(err), now
+	}
+	if failed {
+		b.failures++
+	} else {
+		b.failures = 0
+	}
+
+	switch b.state {
+	case CircuitClosed:
+		if b.config.FailureThreshold > 0 && b.failures >= b.config.FailureThreshold {
+			b.open(now)
+		}
+	case CircuitHalfOpen:
+		b.trial = false
+		switch {
+		case failed:
+			b.open(now)
+		case b.successes+1 >= b.config.SuccessThreshold:
+			b.setState(CircuitClosed)
+			logger.Infof("Webhook %s: circuit closed, resuming deliveries", b.name)
+		default:
+			b.successes++
+			b.notify()
+		}
+	}
+	// Attempts sent before the circuit opened do not change an open circuit
+}
+
+// redactError returns the text of an error with only the scheme and host
+// of the URLs it carries, since webhook URLs often hold tokens, e.g. those
+// of Slack
+func redactError(err error) string {
+	text := err.Error()
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return text
+	}
+	target := redactURL(urlErr.URL)
+	if target == "" {
+		target = "webhook"
+	}
+	redacted := urlErr.Op + " " + target + ": " + urlErr.Err.Error()
+	return strings.Replace(text, urlErr.Error(), redacted, 1)
+}
+
+// redactURL returns the scheme and host of a URL, or an empty string if it
+// has no host
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// open opens the circuit. The caller must hold mu.
+func (b *webhookBreaker) open(now time.Time) {
+	b.openedAt = now
+	b.setState(CircuitOpen)
+	metrics.WebhookCircuitOpens.WithLabelValues(b.name).Inc()
+	logger.Warnf("Webhook %s: circuit open after %d failed attempts, pausing deliveries for %v", b.name, b.failures, b.config.OpenDuration)
+}
+
+// setState changes the state of the circuit. The caller must hold mu.
+func (b *webhookBreaker) setState(state CircuitState) {
+	b.state = state
+	b.successes = 0
+	b.trial = false
+	switch state {
+	case CircuitClosed:
+		metrics.WebhookCircuitState.WithLabelValues(b.name).Set(0)
+	case CircuitOpen:
+		metrics.WebhookCircuitState.WithLabelValues(b.name).Set(1)
+	case CircuitHalfOpen:
+		metrics.WebhookCircuitState.WithLabelValues(b.name).Set(2)
+	}
+	b.notify()
+}
+
+// notify wakes up the workers waiting for the circuit. The caller must
+// hold mu.
+func (b *webhookBreaker) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// isOpen reports whether the circuit holds deliveries back
+func (b *webhookBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire(time.Now())
+	return b.state == CircuitOpen
+}
+
+// Status returns the delivery health of the webhook
+func (m *WebhookManager) Status() WebhookStatus {
+	b := m.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire(time.Now())
+
+	status := WebhookStatus{
+		Name:                m.Config.Name,
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		QueueDepth:          m.queue.Len(),
+		LastSuccess:         b.lastSuccess,
+		LastError:           b.lastError,
+		LastErrorAt:         b.lastErrorAt,
+	}
+	if b.state == CircuitOpen {
+		status.OpenUntil = b.openedAt.Add(b.config.OpenDuration)
+	}
+	return status
+}
@@ -0,0 +1,260 @@
+package blink
+
+import (
+	"container/heap"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DebounceMode is when a webhook is sent for a burst of events on a path
+type DebounceMode string
+
+// Debounce modes
+const (
+	// DebounceLeading sends the first event of a path right away, and drops
+	// the others until the debounce duration has passed
+	DebounceLeading DebounceMode = "leading"
+	// DebounceTrailing sends the coalesced events of a path once it has been
+	// quiet for the debounce duration
+	DebounceTrailing DebounceMode = "trailing"
+	// DebounceBoth sends the first event of a path right away, and the
+	// coalesced later ones once the path has been quiet
+	DebounceBoth DebounceMode = "both"
+)
+
+// ParseDebounceMode parses a debounce mode, the empty string being DebounceLeading
+func ParseDebounceMode(mode string) (DebounceMode, error) {
+	switch DebounceMode(strings.ToLower(strings.TrimSpace(mode))) {
+	case "", DebounceLeading:
+		return DebounceLeading, nil
+	case DebounceTrailing:
+		return DebounceTrailing, nil
+	case DebounceBoth:
+		return DebounceBoth, nil
+	default:
+		return "", fmt.Errorf("unknown debounce mode: %q", mode)
+	}
+}
+
+// debounceEntry is a path within its debounce window
+type debounceEntry struct {
+	path string
+	// Coalesced events not sent yet, nil if there are none. An Op of 0
+	// means that they cancel out, e.g. a create followed by a remove.
+	pending *Event
+	// When the window ends, and the latest it can be extended to (zero
+	// without a max wait)
+	deadline time.Time
+	limit    time.Time
+	// Position in the expiry heap
+	index int
+}
+
+// debounceHeap orders the debounce entries by deadline
+type debounceHeap []*debounceEntry
+
+func (h debounceHeap) Len() int           { return len(h) }
+func (h debounceHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h debounceHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *debounceHeap) Push(x any) {
+	entry := x.(*debounceEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *debounceHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// webhookDebouncer holds the paths within their debounce window, it is
+// protected by the mu of its WebhookManager
+type webhookDebouncer struct {
+	entries map[string]*debounceEntry
+	expiry  debounceHeap
+	// Fires when the earliest window ends
+	timer *time.Timer
+}
+
+// debounce sends or holds back an event according to the debounce mode.
+// The caller must hold mu.
+func (m *WebhookManager) debounce(event Event) {
+	config := m.Config
+	d := &m.debouncer
+	now := time.Now()
+
+	entry, ok := d.entries[event.Name]
+	if !ok {
+		entry = &debounceEntry{path: event.Name, deadline: now.Add(config.DebounceDuration)}
+		if config.DebounceMaxWait > 0 {
+			entry.limit = now.Add(config.DebounceMaxWait)
+		}
+		if d.entries == nil {
+			d.entries = make(map[string]*debounceEntry)
+		}
+		d.entries[event.Name] = entry
+		heap.Push(&d.expiry, entry)
+
+		if config.DebounceMode == DebounceTrailing {
+			entry.pending = &event
+		} else {
+			m.deliver(event)
+		}
+		m.scheduleDebounce()
+		return
+	}
+
+	// A leading window is not extended, so that a path changing all the
+	// time is still sent once per debounce duration
+	if config.DebounceMode == DebounceLeading {
+		return
+	}
+	pending, ok := coalesceEvents(entry.pending, event)
+	if !ok {
+		// Send what is pending rather than lose the source of a move
+		if entry.pending.Op != 0 {
+			m.deliver(*entry.pending)
+		}
+		pending = &event
+	}
+	entry.pending = pending
+	entry.deadline = now.Add(config.DebounceDuration)
+	if !entry.limit.IsZero() && entry.deadline.After(entry.limit) {
+		entry.deadline = entry.limit
+	}
+	heap.Fix(&d.expiry, entry.index)
+	m.scheduleDebounce()
+}
+
+// expireDebounced ends the debounce windows that are due. The caller must
+// hold mu.
+func (m *WebhookManager) expireDebounced(now time.Time) {
+	d := &m.debouncer
+	for len(d.expiry) > 0 && !d.expiry[0].deadline.After(now) {
+		m.endDebounce()
+	}
+	m.scheduleDebounce()
+}
+
+// flushDebounced ends all the debounce windows. The caller must hold mu.
+func (m *WebhookManager) flushDebounced() {
+	for len(m.debouncer.expiry) > 0 {
+		m.endDebounce()
+	}
+	m.scheduleDebounce()
+}
+
+// endDebounce ends the earliest debounce window, and sends its pending
+// event. The caller must hold mu.
+func (m *WebhookManager) endDebounce() {
+	d := &m.debouncer
+	entry := heap.Pop(&d.expiry).(*debounceEntry)
+	delete(d.entries, entry.path)
+	if entry.pending != nil && entry.pending.Op != 0 {
+		m.deliver(*entry.pending)
+	}
+}
+
+// scheduleDebounce sets the timer to the earliest end of a debounce
+// window. The caller must hold mu.
+func (m *WebhookManager) scheduleDebounce() {
+	d := &m.debouncer
+	if len(d.expiry) == 0 {
+		if d.timer != nil {
+			d.timer.Stop()
+		}
+		return
+	}
+
+	wait := time.Until(d.expiry[0].deadline)
+	if d.timer == nil {
+		d.timer = time.AfterFunc(wait, func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			m.expireDebounced(time.Now())
+		})
+		return
+	}
+	d.timer.Reset(wait)
+}
+
+// Kinds of operation for coalescing
+const (
+	opKindOther = iota
+	opKindNone
+	opKindCreated
+	opKindModified
+	opKindRemoved
+)
+
+// opKind returns what an operation means for the existence of a path
+func opKind(op fsnotify.Op) int {
+	switch {
+	case op == 0:
+		return opKindNone
+	case op&(OpOverflow|OpExec) != 0:
+		return opKindOther
+	case op&(OpMove|fsnotify.Create) != 0:
+		return opKindCreated
+	case op&(fsnotify.Write|fsnotify.Chmod) != 0:
+		return opKindModified
+	case op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		return opKindRemoved
+	default:
+		return opKindOther
+	}
+}
+
+// coalesceEvents combines the pending events of a path with a later one
+// into the event describing the change from before the first to after the
+// last: create+write is a create, create+remove is nothing (Op 0),
+// remove+create is a write and write+chmod is a write. The result has the
+// metadata of the later event. It returns false if the events cannot be
+// combined without losing the source path of a move, e.g. move+remove.
+func coalesceEvents(prev *Event, next Event) (*Event, bool) {
+	if prev == nil {
+		return &next, true
+	}
+
+	result := next
+	switch prevKind, nextKind := opKind(prev.Op), opKind(next.Op); {
+	case prevKind == opKindOther || nextKind == opKindOther:
+	case nextKind == opKindRemoved:
+		// The path did not exist before the first event
+		if prevKind == opKindCreated || prevKind == opKindNone {
+			result.Op = 0
+		}
+	case nextKind == opKindCreated:
+		// The path was replaced
+		if prevKind == opKindRemoved || prevKind == opKindModified {
+			result.Op = fsnotify.Write
+			result.OldName = ""
+		}
+	case nextKind == opKindModified:
+		switch prevKind {
+		case opKindCreated:
+			result.Op, result.OldName = prev.Op, prev.OldName
+		case opKindNone:
+			result.Op = fsnotify.Create
+		case opKindModified:
+			if prev.Op&fsnotify.Write != 0 {
+				result.Op = fsnotify.Write
+			}
+		}
+	}
+	if prev.OldName != "" && result.OldName != prev.OldName || next.OldName != "" && result.OldName != next.OldName {
+		return nil, false
+	}
+	return &result, true
+}
@@ -0,0 +1,197 @@
+package blink
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TFMV/blink/pkg/logger"
+)
+
+// Directories of the dead-letter store and of the deliveries replayed from
+// it, inside the webhook queue directory
+const (
+	deadLetterDir = "dlq"
+	replayDir     = "replay"
+)
+
+// DeadLetter is a webhook delivery that failed for good, because the
+// receiver rejected it or because it exhausted its retries. Batched
+// deliveries have Batch set instead of Event. URL and LastError keep only
+// the scheme and host of the webhook URL, which may hold a token.
+type DeadLetter struct {
+	ID        string         `json:"id"`
+	URL       string         `json:"url"`
+	Event     Event          `json:"event,omitzero"`
+	Batch     []BatchedEvent `json:"batch,omitempty"`
+	Attempts  int            `json:"attempts"`
+	LastError string         `json:"last_error"`
+	Created   time.Time      `json:"created"`
+	FailedAt  time.Time      `json:"failed_at"`
+}
+
+// DeadLetterStore keeps dead letters as one JSON file each, so that they can
+// be listed, replayed and purged by another process while blink is running.
+// Replaying moves a dead letter to a directory the WebhookManager using the
+// same queue directory polls, which queues it again.
+type DeadLetterStore struct {
+	dir       string
+	replayDir string
+}
+
+// OpenDeadLetterStore opens the dead-letter store of the webhook queue in
+// queueDir, see WebhookConfig.QueueDir
+func OpenDeadLetterStore(queueDir string) (*DeadLetterStore, error) {
+	s := &DeadLetterStore{
+		dir:       filepath.Join(queueDir, deadLetterDir),
+		replayDir: filepath.Join(queueDir, replayDir),
+	}
+	for _, dir := range []string{s.dir, s.replayDir} {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Add stores a dead letter
+func (s *DeadLetterStore) Add(letter DeadLetter) error {
+	data, err := json.MarshalIndent(letter, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so that readers never see half a letter
+	tmp := filepath.Join(s.dir, "."+letter.ID+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, letter.ID+".json"))
+}
+
+// List returns the dead letters, oldest failure first
+func (s *DeadLetterStore) List() ([]DeadLetter, error) {
+	letters, err := readLetters(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].FailedAt.Before(letters[j].FailedAt) })
+	return letters, nil
+}
+
+// Replay queues the dead letters with the given ids again, or all of them
+// if no ids are given, and returns how many were replayed
+func (s *DeadLetterStore) Replay(ids ...string) (int, error) {
+	return s.move(ids, func(path string) error {
+		return os.Rename(path, filepath.Join(s.replayDir, filepath.Base(path)))
+	})
+}
+
+// Purge deletes the dead letters with the given ids, or all of them if no
+// ids are given, and returns how many were deleted
+func (s *DeadLetterStore) Purge(ids ...string) (int, error) {
+	return s.move(ids, os.Remove)
+}
+
+// move applies fn to the files of the given dead letters, or of all of them
+func (s *DeadLetterStore) move(ids []string, fn func(path string) error) (int, error) {
+	var paths []string
+	if len(ids) == 0 {
+		var err error
+		if paths, err = filepath.Glob(filepath.Join(s.dir, "*.json")); err != nil {
+			return 0, err
+		}
+	}
+	for _, id := range ids {
+		if !isDeliveryID(id) {
+			return 0, fmt.Errorf("invalid delivery id: %q", id)
+		}
+		path := filepath.Join(s.dir, id+".json")
+		if _, err := os.Stat(path); err != nil {
+			return 0, fmt.Errorf("no dead letter with id %s", id)
+		}
+		paths = append(paths, path)
+	}
+
+	for i, path := range paths {
+		if err := fn(path); err != nil {
+			return i, err
+		}
+	}
+	return len(paths), nil
+}
+
+// drainReplays passes the replayed dead letters to fn, and deletes those it
+// accepts. A letter is replayed again if blink stops in between.
+func (s *DeadLetterStore) drainReplays(fn func(DeadLetter) error) {
+	entries, err := os.ReadDir(s.replayDir)
+	if err != nil {
+		logger.Error(fmt.Errorf("error reading replayed webhooks: %w", err))
+		return
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(s.replayDir, entry.Name())
+		letter, err := readLetter(path)
+		if err != nil {
+			logger.Error(fmt.Errorf("ignoring replayed webhook %s: %w", entry.Name(), err))
+			continue
+		}
+		if err := fn(letter); err != nil {
+			logger.Error(fmt.Errorf("error replaying webhook %s: %w", letter.ID, err))
+			return
+		}
+		if err := os.Remove(path); err != nil {
+			logger.Error(err)
+		}
+	}
+}
+
+// readLetters reads the dead letters in dir
+func readLetters(dir string) ([]DeadLetter, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]DeadLetter, 0, len(paths))
+	for _, path := range paths {
+		letter, err := readLetter(path)
+		if errors.Is(err, os.ErrNotExist) {
+			// Replayed or purged in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
+
+// readLetter reads a dead letter file
+func readLetter(path string) (DeadLetter, error) {
+	var letter DeadLetter
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return letter, err
+	}
+	err = json.Unmarshal(data, &letter)
+	return letter, err
+}
+
+// isDeliveryID reports whether id has the format of the ids of
+// newDeliveryID, so that it can be used in a file name
+func isDeliveryID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
@@ -0,0 +1,179 @@
+package blink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"text/template"
+	"time"
+
+	"github.com/TFMV/blink/pkg/webhook/verify"
+)
+
+// WebhookTemplateData is the data webhook templates are executed with
+type WebhookTemplateData struct {
+	// ID of the delivery, which is also the batch_id of a batch
+	ID string
+	// Event is the event of the delivery, or the last event of a batch
+	Event Event
+	// Batch holds the events of a batched delivery, it is nil otherwise
+	Batch []BatchedEvent
+	// Host is the host name of the machine running blink
+	Host string
+	// Root and RootName are the watch root of Event
+	Root     string
+	RootName string
+}
+
+// webhookFuncs are the functions available to webhook templates, besides
+// the builtin ones such as urlquery
+var webhookFuncs = template.FuncMap{
+	"relpath": func(base, path string) string {
+		return relativePath(base, path)
+	},
+	"base": filepath.Base,
+	"ext":  filepath.Ext,
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"env": os.Getenv,
+}
+
+// webhookRenderer builds the requests of a webhook, from the canonical JSON
+// encoding of the events or from templates
+type webhookRenderer struct {
+	config  WebhookConfig
+	host    string
+	url     *template.Template
+	headers map[string]*template.Template
+	// Body template, nil to send JSON
+	body *template.Template
+}
+
+// newWebhookRenderer compiles the templates of a webhook
+func newWebhookRenderer(config WebhookConfig) (*webhookRenderer, error) {
+	host, _ := os.Hostname()
+	r := &webhookRenderer{
+		config:  config,
+		host:    host,
+		headers: make(map[string]*template.Template, len(config.Headers)),
+	}
+
+	var err error
+	if r.url, err = parseWebhookTemplate("url", config.URL); err != nil {
+		return nil, err
+	}
+	for key, value := range config.Headers {
+		if r.headers[key], err = parseWebhookTemplate("header "+key, value); err != nil {
+			return nil, err
+		}
+	}
+	if config.Template != "" {
+		if r.body, err = parseWebhookTemplate("body", config.Template); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// parseWebhookTemplate parses a template with the webhook functions
+func parseWebhookTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(webhookFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %w", name, err)
+	}
+	return tmpl, nil
+}
+
+// request builds the request of a delivery
+func (r *webhookRenderer) request(ctx context.Context, delivery *webhookDelivery) (*http.Request, error) {
+	data := WebhookTemplateData{
+		ID:    delivery.ID,
+		Event: delivery.Event,
+		Batch: delivery.Batch,
+		Host:  r.host,
+	}
+	if len(delivery.Batch) > 0 {
+		data.Event = delivery.Batch[len(delivery.Batch)-1].Event
+	}
+	data.Root, data.RootName = data.Event.Root, data.Event.RootName
+
+	var payload []byte
+	var contentType string
+	if r.body != nil {
+		body, err := execute(r.body, data)
+		if err != nil {
+			return nil, err
+		}
+		payload, contentType = []byte(body), "application/json"
+	} else {
+		var err error
+		if payload, contentType, err = delivery.payload(r.config.Format); err != nil {
+			return nil, fmt.Errorf("error marshaling webhook payload: %w", err)
+		}
+	}
+	if r.config.ContentType != "" {
+		contentType = r.config.ContentType
+	}
+
+	url, err := execute(r.url, data)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, r.config.Method, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("error creating webhook request: %w", err)
+	}
+
+	// Set headers
+	req.Header.Set("Content-Type", contentType)
+	for key, tmpl := range r.headers {
+		value, err := execute(tmpl, data)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(key, value)
+	}
+
+	// The delivery id stays the same across retries and replays, the
+	// signature is renewed with every attempt
+	req.Header.Set(verify.DeliveryHeader, delivery.ID)
+	if len(r.config.Secrets) > 0 {
+		req.Header.Set(verify.SignatureHeader, verify.Sign(payload, time.Now(), r.config.Secrets...))
+	}
+	return req, nil
+}
+
+// execute executes a template to a string
+func execute(tmpl *template.Template, data WebhookTemplateData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// PreviewWebhook returns the request a webhook would send for an event,
+// without sending it
+func PreviewWebhook(config WebhookConfig, event Event) (*http.Request, error) {
+	if config.Method == "" {
+		config.Method = "POST"
+	}
+	var err error
+	if config.Format, err = ParseWebhookFormat(string(config.Format)); err != nil {
+		return nil, err
+	}
+	renderer, err := newWebhookRenderer(config)
+	if err != nil {
+		return nil, err
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	return renderer.request(context.Background(), &webhookDelivery{ID: newDeliveryID(), Event: event, Created: time.Now()})
+}
@@ -0,0 +1,799 @@
+package blink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TFMV/blink/pkg/webhook/verify"
+	"github.com/fsnotify/fsnotify"
+)
+
+// webhookReceiver is a test webhook endpoint that answers with the status
+// returned by respond for each request
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests int
+	received []Event
+}
+
+func newWebhookReceiver(t *testing.T, respond func(n int, w http.ResponseWriter) int) *webhookReceiver {
+	r := &webhookReceiver{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var event Event
+		json.NewDecoder(req.Body).Decode(&event)
+
+		r.mu.Lock()
+		r.requests++
+		n := r.requests
+		r.mu.Unlock()
+
+		status := respond(n, w)
+		if status < 300 {
+			r.mu.Lock()
+			r.received = append(r.received, event)
+			r.mu.Unlock()
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// counts returns the number of requests and of accepted events
+func (r *webhookReceiver) counts() (int, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requests, len(r.received)
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func newTestWebhook(t *testing.T, url, dir string) *WebhookManager {
+	t.Helper()
+	manager, err := NewWebhookManager(WebhookConfig{
+		URL:             url,
+		QueueDir:        dir,
+		MaxRetries:      2,
+		RetryBackoff:    10 * time.Millisecond,
+		MaxRetryBackoff: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewWebhookManager failed: %v", err)
+	}
+	return manager
+}
+
+// TestWebhookRetry tests that failed deliveries are retried with backoff,
+// and moved to the dead-letter store once retries are exhausted
+func TestWebhookRetry(t *testing.T) {
+	receiver := newWebhookReceiver(t, func(n int, w http.ResponseWriter) int {
+		// The first event fails once, the second one always fails
+		if n == 1 || n >= 3 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	dir := t.TempDir()
+	manager := newTestWebhook(t, receiver.URL+"/hooks/secret-token", dir)
+	defer manager.Close(context.Background())
+
+	manager.HandleEvent(Event{Name: "/tmp/a.txt"})
+	waitFor(t, "the first event", func() bool { _, n := receiver.counts(); return n == 1 })
+
+	manager.HandleEvent(Event{Name: "/tmp/b.txt"})
+	waitFor(t, "the dead letter", func() bool {
+		letters, _ := manager.DeadLetters().List()
+		return len(letters) == 1
+	})
+	if requests, _ := receiver.counts(); requests != 5 {
+		t.Errorf("Expected 5 requests (2 for a.txt, 3 for b.txt), got %d", requests)
+	}
+
+	letters, _ := manager.DeadLetters().List()
+	letter := letters[0]
+	if letter.Event.Name != "/tmp/b.txt" || letter.Attempts != 3 || letter.URL != receiver.URL || letter.LastError == "" {
+		t.Errorf("Unexpected dead letter: %+v", letter)
+	}
+	// Dead letters may hold file names and contents, keep them private
+	info, err := os.Stat(filepath.Join(dir, deadLetterDir, letter.ID+".json"))
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected a dead letter with mode 0600, got %v", info.Mode().Perm())
+	}
+	if manager.queue.Len() != 0 {
+		t.Errorf("Expected an empty queue, got %d deliveries", manager.queue.Len())
+	}
+}
+
+// TestWebhookDeadLetterReplay tests that rejected deliveries are not
+// retried, and are delivered again when replayed
+func TestWebhookDeadLetterReplay(t *testing.T) {
+	var accept atomic.Bool
+	receiver := newWebhookReceiver(t, func(n int, w http.ResponseWriter) int {
+		if accept.Load() {
+			return http.StatusNoContent
+		}
+		return http.StatusBadRequest
+	})
+	manager := newTestWebhook(t, receiver.URL, t.TempDir())
+	defer manager.Close(context.Background())
+
+	manager.HandleEvent(Event{Name: "/tmp/a.txt"})
+	var letters []DeadLetter
+	waitFor(t, "the dead letter", func() bool {
+		letters, _ = manager.DeadLetters().List()
+		return len(letters) == 1
+	})
+	if letters[0].Attempts != 1 {
+		t.Errorf("Expected a rejected delivery not to be retried, got %d attempts", letters[0].Attempts)
+	}
+
+	if _, err := manager.DeadLetters().Replay("not-an-id"); err == nil {
+		t.Errorf("Expected an invalid id to be rejected")
+	}
+
+	accept.Store(true)
+	if n, err := manager.DeadLetters().Replay(letters[0].ID); n != 1 || err != nil {
+		t.Fatalf("Replay = %d, %v", n, err)
+	}
+	waitFor(t, "the replayed delivery", func() bool { _, n := receiver.counts(); return n == 1 })
+	if letters, _ := manager.DeadLetters().List(); len(letters) != 0 {
+		t.Errorf("Expected the dead-letter store to be empty, got %d", len(letters))
+	}
+}
+
+// TestWebhookQueueRestart tests that deliveries waiting for a retry are
+// kept on disk and delivered after a restart, also in the default queue
+// directory
+func TestWebhookQueueRestart(t *testing.T) {
+	for _, name := range []string{"QueueDir", "Default"} {
+		t.Run(name, func(t *testing.T) {
+			var accept atomic.Bool
+			receiver := newWebhookReceiver(t, func(n int, w http.ResponseWriter) int {
+				if accept.Load() {
+					return http.StatusOK
+				}
+				w.Header().Set("Retry-After", "3600")
+				return http.StatusTooManyRequests
+			})
+			dir := t.TempDir()
+			if name == "Default" {
+				t.Setenv("HOME", dir)
+				dir = ""
+			}
+			manager := newTestWebhook(t, receiver.URL, dir)
+			if name == "Default" {
+				want := filepath.Join(DefaultWebhookQueueDir(), defaultWebhookName)
+				if manager.Config.QueueDir != want {
+					t.Errorf("QueueDir = %q, want %q", manager.Config.QueueDir, want)
+				}
+			}
+
+			manager.HandleEvent(Event{Name: "/tmp/a.txt"})
+			waitFor(t, "the first attempt", func() bool { n, _ := receiver.counts(); return n == 1 })
+
+			// Close does not wait for the retry an hour away
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := manager.Close(ctx); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			accept.Store(true)
+			manager = newTestWebhook(t, receiver.URL, dir)
+			defer manager.Close(context.Background())
+			waitFor(t, "the resumed delivery", func() bool { _, n := receiver.counts(); return n == 1 })
+			if received := receiver.received[0]; received.Name != "/tmp/a.txt" {
+				t.Errorf("Expected the queued event, got %+v", received)
+			}
+		})
+	}
+}
+
+// TestWebhookBackoff tests the retry delays
+func TestWebhookBackoff(t *testing.T) {
+	manager := &WebhookManager{Config: WebhookConfig{RetryBackoff: time.Second, MaxRetryBackoff: 10 * time.Second}}
+	tests := []struct {
+		attempts   int
+		retryAfter time.Duration
+		min, max   time.Duration
+	}{
+		{1, 0, 500 * time.Millisecond, time.Second},
+		{3, 0, 2 * time.Second, 4 * time.Second},
+		{10, 0, 5 * time.Second, 10 * time.Second},
+		{100, 0, 5 * time.Second, 10 * time.Second},
+		{1, 30 * time.Second, 30 * time.Second, 30 * time.Second},
+		{1, 48 * time.Hour, time.Hour, time.Hour},
+	}
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			if delay := manager.backoff(test.attempts, test.retryAfter); delay < test.min || delay > test.max {
+				t.Errorf("backoff(%d, %v) = %v, want between %v and %v", test.attempts, test.retryAfter, delay, test.min, test.max)
+				break
+			}
+		}
+	}
+
+	if got := parseRetryAfter("120"); got != 2*time.Minute {
+		t.Errorf("parseRetryAfter(120) = %v", got)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(date); got < 58*time.Second || got > time.Minute {
+		t.Errorf("parseRetryAfter(%q) = %v", date, got)
+	}
+	for _, value := range []string{"", "soon", "-5"} {
+		if got := parseRetryAfter(value); got != 0 {
+			t.Errorf("parseRetryAfter(%q) = %v, want 0", value, got)
+		}
+	}
+}
+
+// TestWebhookSigned tests that requests are signed with every secret and
+// keep their delivery id across retries
+func TestWebhookSigned(t *testing.T) {
+	var mu sync.Mutex
+	var deliveries []string
+	var verifyErrs []error
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := verify.Request(r, []string{"old"}, time.Minute)
+
+		mu.Lock()
+		defer mu.Unlock()
+		deliveries = append(deliveries, r.Header.Get(verify.DeliveryHeader))
+		verifyErrs = append(verifyErrs, err)
+		if len(deliveries) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	manager, err := NewWebhookManager(WebhookConfig{
+		URL:          server.URL,
+		QueueDir:     t.TempDir(),
+		RetryBackoff: 10 * time.Millisecond,
+		Secrets:      []string{"new", "old"},
+	})
+	if err != nil {
+		t.Fatalf("NewWebhookManager failed: %v", err)
+	}
+	defer manager.Close(context.Background())
+	manager.HandleEvent(Event{Name: "/tmp/a.txt"})
+	waitFor(t, "the retry", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(deliveries) == 2
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !isDeliveryID(deliveries[0]) || deliveries[0] != deliveries[1] {
+		t.Errorf("Expected the same delivery id for both attempts, got %v", deliveries)
+	}
+	for i, err := range verifyErrs {
+		if err != nil {
+			t.Errorf("Attempt %d failed verification: %v", i+1, err)
+		}
+	}
+}
+
+// TestWebhookBatch tests batched deliveries and the coalescing of the
+// events of a path
+func TestWebhookBatch(t *testing.T) {
+	type batchBody struct {
+		BatchID string `json:"batch_id"`
+		Events  []struct {
+			Op   string   `json:"op"`
+			Path string   `json:"path"`
+			Ops  []string `json:"ops"`
+		} `json:"events"`
+	}
+	var mu sync.Mutex
+	var batches []batchBody
+	var ids []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body batchBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Invalid batch: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		batches = append(batches, body)
+		ids = append(ids, r.Header.Get(verify.DeliveryHeader))
+	}))
+	defer server.Close()
+
+	manager, err := NewWebhookManager(WebhookConfig{
+		URL:      server.URL,
+		QueueDir: t.TempDir(),
+		Batch: WebhookBatchConfig{
+			MaxEvents: 3,
+			MaxWait:   50 * time.Millisecond,
+			Coalesce:  CoalesceMerge,
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewWebhookManager failed: %v", err)
+	}
+	defer manager.Close(context.Background())
+
+	// The first batch is sent when it has 3 paths, the second after MaxWait
+	manager.HandleEvent(Event{Name: "/tmp/a.txt", Op: fsnotify.Create})
+	manager.HandleEvent(Event{Name: "/tmp/a.txt", Op: fsnotify.Write})
+	manager.HandleEvent(Event{Name: "/tmp/b.txt", Op: fsnotify.Write})
+	manager.HandleEvent(Event{Name: "/tmp/a.txt", Op: fsnotify.Write})
+	manager.HandleEvent(Event{Name: "/tmp/c.txt", Op: fsnotify.Remove})
+	manager.HandleEvent(Event{Name: "/tmp/d.txt", Op: fsnotify.Create})
+	waitFor(t, "two batches", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(batches) == 2
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	first := batches[0]
+	if len(first.Events) != 3 {
+		t.Fatalf("Expected 3 events in the first batch, got %+v", first)
+	}
+	a := first.Events[0]
+	if a.Path != "/tmp/a.txt" || a.Op != "write" || len(a.Ops) != 2 || a.Ops[0] != "create" || a.Ops[1] != "write" {
+		t.Errorf("Expected a.txt merged into create and write, got %+v", a)
+	}
+	if first.Events[1].Path != "/tmp/b.txt" || first.Events[2].Path != "/tmp/c.txt" {
+		t.Errorf("Unexpected events in the first batch: %+v", first.Events)
+	}
+	if first.BatchID == "" || first.BatchID != ids[0] {
+		t.Errorf("Expected the batch id %q to be the delivery id %q", first.BatchID, ids[0])
+	}
+	if second := batches[1]; len(second.Events) != 1 || second.Events[0].Path != "/tmp/d.txt" {
+		t.Errorf("Expected d.txt alone in the second batch, got %+v", second)
+	}
+}
+
+// TestWebhookBatchLimits tests the size limit and the coalescing modes
+func TestWebhookBatchLimits(t *testing.T) {
+	encoded, _ := json.Marshal(Event{Name: "/tmp/a", Op: fsnotify.Write})
+	tests := []struct {
+		coalesce CoalesceMode
+		maxBytes int
+		want     []int
+	}{
+		{CoalesceNone, 0, []int{4}},
+		{CoalesceLast, 0, []int{2}},
+		{CoalesceNone, 2 * len(encoded), []int{2, 2}},
+	}
+	for _, test := range tests {
+		var mu sync.Mutex
+		var sizes []int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				Events []json.RawMessage `json:"events"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			mu.Lock()
+			sizes = append(sizes, len(body.Events))
+			mu.Unlock()
+		}))
+
+		manager, err := NewWebhookManager(WebhookConfig{
+			URL:      server.URL,
+			QueueDir: t.TempDir(),
+			Batch:    WebhookBatchConfig{MaxBytes: test.maxBytes, MaxWait: time.Hour, Coalesce: test.coalesce},
+		})
+		if err != nil {
+			t.Fatalf("NewWebhookManager failed: %v", err)
+		}
+		for _, name := range []string{"/tmp/a", "/tmp/b", "/tmp/a", "/tmp/b"} {
+			manager.HandleEvent(Event{Name: name, Op: fsnotify.Write, Timestamp: time.Unix(0, 0)})
+		}
+		// Close sends the batch being collected
+		if err := manager.Close(context.Background()); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		server.Close()
+
+		if fmt.Sprint(sizes) != fmt.Sprint(test.want) {
+			t.Errorf("%s with max bytes %d: batch sizes = %v, want %v", test.coalesce, test.maxBytes, sizes, test.want)
+		}
+	}
+}
+
+// TestWebhookTargets tests that webhook targets have their own filters,
+// formats and queues, and that a stuck target does not delay the others
+func TestWebhookTargets(t *testing.T) {
+	stuck := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stuck
+	}))
+	defer slow.Close()
+	defer close(stuck)
+
+	var mu sync.Mutex
+	var bodies []string
+	var contentType string
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, string(body))
+		contentType = r.Header.Get("Content-Type")
+	}))
+	defer fast.Close()
+
+	dir := t.TempDir()
+	webhooks, err := newWebhooks([]WebhookConfig{
+		{Name: "slow", URL: slow.URL},
+		{Name: "go", URL: fast.URL, IncludePatterns: []string{"*.go"}, Format: WebhookNDJSON},
+	}, dir)
+	if err != nil {
+		t.Fatalf("newWebhooks failed: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		closeWebhooks(ctx, webhooks)
+	}()
+
+	for i := 0; i < 10; i++ {
+		for _, webhook := range webhooks {
+			webhook.HandleEvent(Event{Name: fmt.Sprintf("/src/file%d.go", i), Op: fsnotify.Write})
+			webhook.HandleEvent(Event{Name: fmt.Sprintf("/src/file%d.txt", i), Op: fsnotify.Write})
+		}
+	}
+	waitFor(t, "the go webhook", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(bodies) == 10
+	})
+
+	mu.Lock()
+	if contentType != "application/x-ndjson" || !strings.HasSuffix(bodies[0], "}\n") {
+		t.Errorf("Expected an NDJSON body, got %q (%s)", bodies[0], contentType)
+	}
+	for _, body := range bodies {
+		if !strings.Contains(body, ".go\"") {
+			t.Errorf("Expected only .go files, got %s", body)
+		}
+	}
+	mu.Unlock()
+
+	for _, name := range []string{"slow", "go"} {
+		if _, err := os.Stat(filepath.Join(dir, name, "queue")); err != nil {
+			t.Errorf("Expected a queue for webhook %s: %v", name, err)
+		}
+	}
+
+	if _, err := newWebhooks([]WebhookConfig{{Name: "a", URL: fast.URL}, {Name: "a", URL: fast.URL}}, t.TempDir()); err == nil {
+		t.Errorf("Expected duplicate names to be rejected")
+	}
+	if _, err := newWebhooks([]WebhookConfig{{Name: "../a", URL: fast.URL}}, t.TempDir()); err == nil {
+		t.Errorf("Expected an invalid name to be rejected")
+	}
+}
+
+// TestWebhookTemplate tests that the body, URL and headers of a webhook are
+// rendered from templates, and that a request that cannot be rendered goes
+// to the dead-letter store without retries
+func TestWebhookTemplate(t *testing.T) {
+	t.Setenv("BLINK_TEST_CHANNEL", "#builds")
+
+	var mu sync.Mutex
+	var requests []*http.Request
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r)
+		bodies = append(bodies, string(body))
+	}))
+	defer server.Close()
+
+	manager, err := NewWebhookManager(WebhookConfig{
+		URL:         server.URL + "/{{ .RootName }}?file={{ urlquery .Event.RelPath }}",
+		Headers:     map[string]string{"X-Op": "{{ .Event.OpString }}"},
+		Template:    `{"channel": {{ env "BLINK_TEST_CHANNEL" | json }}, "text": {{ printf "%s %s (%s)" .Event.OpString (base .Event.Name) (ext .Event.Name) | json }}, "path": {{ relpath .Root .Event.Name | json }}}`,
+		ContentType: "application/vnd.test+json",
+		QueueDir:    t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("NewWebhookManager failed: %v", err)
+	}
+	defer manager.Close(context.Background())
+
+	manager.HandleEvent(Event{Name: "/src/pkg/a b.go", Op: fsnotify.Create, Root: "/src", RootName: "code", RelPath: "pkg/a b.go"})
+	waitFor(t, "the request", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(requests) == 1
+	})
+
+	mu.Lock()
+	req, body := requests[0], bodies[0]
+	mu.Unlock()
+	if req.URL.Path != "/code" || req.URL.Query().Get("file") != "pkg/a b.go" {
+		t.Errorf("Unexpected URL: %s", req.URL)
+	}
+	if req.Header.Get("X-Op") != "create" || req.Header.Get("Content-Type") != "application/vnd.test+json" {
+		t.Errorf("Unexpected headers: %v", req.Header)
+	}
+	if want := `{"channel": "#builds", "text": "create a b.go (.go)", "path": "pkg/a b.go"}`; body != want {
+		t.Errorf("Expected body %s, got %s", want, body)
+	}
+
+	// Rendering fails for every attempt, it is not retried
+	broken, err := NewWebhookManager(WebhookConfig{
+		URL:        server.URL,
+		Template:   `{{ index .Batch 1 }}`,
+		MaxRetries: 3,
+		QueueDir:   t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("NewWebhookManager failed: %v", err)
+	}
+	defer broken.Close(context.Background())
+
+	broken.HandleEvent(Event{Name: "/src/b.go", Op: fsnotify.Write})
+	waitFor(t, "the dead letter", func() bool {
+		letters, _ := broken.DeadLetters().List()
+		return len(letters) == 1
+	})
+	if letters, _ := broken.DeadLetters().List(); letters[0].Attempts != 1 {
+		t.Errorf("Expected 1 attempt, got %d", letters[0].Attempts)
+	}
+
+	if _, err := NewWebhookManager(WebhookConfig{URL: server.URL, QueueDir: t.TempDir(), Template: "{{ .Event"}); err == nil {
+		t.Errorf("Expected an invalid template to be rejected")
+	}
+}
+
+// TestCoalesceEvents tests that the events of a path are combined into the
+// overall change
+func TestCoalesceEvents(t *testing.T) {
+	move := OpMove | fsnotify.Create
+	tests := []struct {
+		ops  []fsnotify.Op
+		want fsnotify.Op
+		// Whether the last event could not be combined with the others
+		split bool
+	}{
+		{[]fsnotify.Op{fsnotify.Create, fsnotify.Write, fsnotify.Write}, fsnotify.Create, false},
+		{[]fsnotify.Op{fsnotify.Create, fsnotify.Write, fsnotify.Remove}, 0, false},
+		{[]fsnotify.Op{fsnotify.Create, fsnotify.Remove, fsnotify.Create, fsnotify.Write}, fsnotify.Create, false},
+		{[]fsnotify.Op{fsnotify.Write, fsnotify.Chmod}, fsnotify.Write, false},
+		{[]fsnotify.Op{fsnotify.Chmod, fsnotify.Write}, fsnotify.Write, false},
+		{[]fsnotify.Op{fsnotify.Write, fsnotify.Remove}, fsnotify.Remove, false},
+		{[]fsnotify.Op{fsnotify.Remove, fsnotify.Create}, fsnotify.Write, false},
+		{[]fsnotify.Op{move, fsnotify.Write}, move, false},
+		// The source of the move must still be reported
+		{[]fsnotify.Op{move, fsnotify.Remove}, fsnotify.Remove, true},
+		{[]fsnotify.Op{fsnotify.Remove, move}, move, true},
+		{[]fsnotify.Op{move, move}, move, true},
+	}
+	for _, tt := range tests {
+		var event *Event
+		split := false
+		for i, op := range tt.ops {
+			next := Event{Name: "/tmp/a.txt", Op: op, Size: int64(i)}
+			if op&OpMove != 0 {
+				next.OldName = fmt.Sprintf("/tmp/old%d.txt", i)
+			}
+			coalesced, ok := coalesceEvents(event, next)
+			if !ok {
+				split, coalesced = true, &next
+			}
+			event = coalesced
+		}
+		if event.Op != tt.want || split != tt.split {
+			t.Errorf("%v: expected %v (split %v), got %v (split %v)", tt.ops, tt.want, tt.split, event.Op, split)
+		}
+		if event.Size != int64(len(tt.ops)-1) {
+			t.Errorf("%v: expected the metadata of the last event, got size %d", tt.ops, event.Size)
+		}
+	}
+}
+
+// TestWebhookDebounce tests the leading, trailing and both debounce modes,
+// and that max wait bounds how long trailing events are held back
+func TestWebhookDebounce(t *testing.T) {
+	send := func(t *testing.T, config WebhookConfig, events ...Event) *webhookReceiver {
+		receiver := newWebhookReceiver(t, func(int, http.ResponseWriter) int { return http.StatusOK })
+		config.URL = receiver.URL
+		config.QueueDir = t.TempDir()
+		manager, err := NewWebhookManager(config)
+		if err != nil {
+			t.Fatalf("NewWebhookManager failed: %v", err)
+		}
+		for _, event := range events {
+			manager.HandleEvent(event)
+		}
+		// Close sends the events still waiting for their debounce
+		manager.Close(context.Background())
+		return receiver
+	}
+	burst := []Event{
+		{Name: "/tmp/a.txt", Op: fsnotify.Create},
+		{Name: "/tmp/a.txt", Op: fsnotify.Write, Size: 10},
+		{Name: "/tmp/b.txt", Op: fsnotify.Create},
+		{Name: "/tmp/a.txt", Op: fsnotify.Write, Size: 20},
+		{Name: "/tmp/b.txt", Op: fsnotify.Remove},
+	}
+
+	t.Run("leading", func(t *testing.T) {
+		receiver := send(t, WebhookConfig{DebounceDuration: time.Minute}, burst...)
+		if len(receiver.received) != 2 {
+			t.Fatalf("Expected the first events of a.txt and b.txt, got %v", receiver.received)
+		}
+		for _, event := range receiver.received {
+			if event.Op != fsnotify.Create || event.Size != 0 {
+				t.Errorf("Expected a first event, got %v (size %d)", event, event.Size)
+			}
+		}
+	})
+
+	t.Run("trailing", func(t *testing.T) {
+		receiver := send(t, WebhookConfig{DebounceDuration: time.Minute, DebounceMode: DebounceTrailing}, burst...)
+		if len(receiver.received) != 1 {
+			t.Fatalf("Expected 1 event, got %v", receiver.received)
+		}
+		if event := receiver.received[0]; event.Name != "/tmp/a.txt" || event.Op != fsnotify.Create || event.Size != 20 {
+			t.Errorf("Expected a create of a.txt with the last size, got %v (size %d)", event, event.Size)
+		}
+	})
+
+	t.Run("both", func(t *testing.T) {
+		receiver := send(t, WebhookConfig{DebounceDuration: time.Minute, DebounceMode: DebounceBoth}, burst...)
+		var ops []string
+		for _, event := range receiver.received {
+			ops = append(ops, filepath.Base(event.Name)+" "+event.OpString())
+		}
+		// Deliveries are sent concurrently, in any order
+		sort.Strings(ops)
+		if got := strings.Join(ops, ", "); got != "a.txt create, a.txt write, b.txt create, b.txt remove" {
+			t.Errorf("Unexpected events: %s", got)
+		}
+	})
+
+	t.Run("max wait", func(t *testing.T) {
+		receiver := newWebhookReceiver(t, func(int, http.ResponseWriter) int { return http.StatusOK })
+		manager, err := NewWebhookManager(WebhookConfig{
+			URL:              receiver.URL,
+			QueueDir:         t.TempDir(),
+			DebounceDuration: 50 * time.Millisecond,
+			DebounceMode:     DebounceTrailing,
+			DebounceMaxWait:  100 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("NewWebhookManager failed: %v", err)
+		}
+		defer manager.Close(context.Background())
+
+		// The path keeps changing for longer than the max wait
+		for i := 0; i < 20; i++ {
+			manager.HandleEvent(Event{Name: "/tmp/log.txt", Op: fsnotify.Write})
+			time.Sleep(10 * time.Millisecond)
+		}
+		if _, n := receiver.counts(); n == 0 {
+			t.Errorf("Expected events to be sent within the max wait")
+		}
+		waitFor(t, "the trailing event", func() bool {
+			manager.mu.Lock()
+			defer manager.mu.Unlock()
+			return len(manager.debouncer.entries) == 0
+		})
+	})
+}
+
+// TestWebhookBreaker tests that repeated failures open the circuit, that
+// deliveries wait without using up their retries while it is open, and
+// that the status endpoint and readiness check report it
+func TestWebhookBreaker(t *testing.T) {
+	var up atomic.Bool
+	receiver := newWebhookReceiver(t, func(int, http.ResponseWriter) int {
+		if up.Load() {
+			return http.StatusOK
+		}
+		return http.StatusServiceUnavailable
+	})
+	manager, err := NewWebhookManager(WebhookConfig{
+		URL:             receiver.URL,
+		QueueDir:        t.TempDir(),
+		MaxRetries:      3,
+		RetryBackoff:    10 * time.Millisecond,
+		MaxRetryBackoff: 10 * time.Millisecond,
+		Breaker:         WebhookBreakerConfig{FailureThreshold: 2, OpenDuration: 300 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("NewWebhookManager failed: %v", err)
+	}
+	defer manager.Close(context.Background())
+	server := &Server{webhooks: []*WebhookManager{manager}}
+
+	for i := 0; i < 5; i++ {
+		manager.HandleEvent(Event{Name: fmt.Sprintf("/tmp/file%d.txt", i), Op: fsnotify.Write})
+	}
+	waitFor(t, "the circuit to open", func() bool { return manager.Status().State == CircuitOpen })
+
+	// No requests are sent while the circuit is open, once those sent
+	// before it opened are answered
+	time.Sleep(20 * time.Millisecond)
+	requests, _ := receiver.counts()
+	time.Sleep(100 * time.Millisecond)
+	if now, _ := receiver.counts(); now != requests {
+		t.Errorf("Expected no requests while the circuit is open, got %d", now-requests)
+	}
+	if err := server.checkWebhooks(); err == nil {
+		t.Errorf("Expected the readiness check to fail while the circuit is open")
+	}
+
+	rec := httptest.NewRecorder()
+	webhooksHandler(server.webhooks).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, WebhooksPath, nil))
+	var statuses []WebhookStatus
+	if err := json.NewDecoder(rec.Body).Decode(&statuses); err != nil || len(statuses) != 1 {
+		t.Fatalf("Unexpected status response %q: %v", rec.Body, err)
+	}
+	if status := statuses[0]; status.State != CircuitOpen || status.QueueDepth != 5 || status.LastError == "" ||
+		status.OpenUntil.IsZero() || !status.LastSuccess.IsZero() {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+
+	// The trial delivery closes the circuit, and the others follow
+	up.Store(true)
+	waitFor(t, "the deliveries", func() bool { _, n := receiver.counts(); return n == 5 })
+	status := manager.Status()
+	if status.State != CircuitClosed || status.ConsecutiveFailures != 0 || status.LastSuccess.IsZero() {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+	if letters, _ := manager.DeadLetters().List(); len(letters) != 0 {
+		t.Errorf("Expected no dead letters, got %d", len(letters))
+	}
+	if err := server.checkWebhooks(); err != nil {
+		t.Errorf("Expected the readiness check to pass, got %v", err)
+	}
+}
+
+// TestRedactError tests that delivery errors keep only the host of the URL
+func TestRedactError(t *testing.T) {
+	secret := &url.Error{Op: "Post", URL: "https://hooks.slack.com/services/T0/B0/s3cret?token=s3cret", Err: errors.New("connection refused")}
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{secret, "Post https://hooks.slack.com: connection refused"},
+		{fmt.Errorf("sending: %w", secret), "sending: Post https://hooks.slack.com: connection refused"},
+		{&url.Error{Op: "parse", URL: "::s3cret", Err: errors.New("missing protocol scheme")}, "parse webhook: missing protocol scheme"},
+		{errors.New("webhook returned non-success status code: 503"), "webhook returned non-success status code: 503"},
+	}
+	for _, tt := range tests {
+		if got := redactError(tt.err); got != tt.want {
+			t.Errorf("redactError(%q) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
@@ -1,12 +1,20 @@
 package health
 
 import (
+	"fmt"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 )
 
 var (
 	ready int32
+
+	// Readiness checks by name, see SetCheck
+	checksMu sync.Mutex
+	checks   = make(map[string]func() error)
 )
 
 // SetReady marks the service as ready
@@ -18,6 +26,41 @@ func SetReady(isReady bool) {
 	}
 }
 
+// SetCheck registers a readiness check: the service is not ready while
+// check returns an error. A nil check removes the check with that name.
+func SetCheck(name string, check func() error) {
+	checksMu.Lock()
+	defer checksMu.Unlock()
+	if check == nil {
+		delete(checks, name)
+		return
+	}
+	checks[name] = check
+}
+
+// failedChecks returns the errors of the failing readiness checks
+func failedChecks() []string {
+	checksMu.Lock()
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	funcs := make([]func() error, len(names))
+	for i, name := range names {
+		funcs[i] = checks[name]
+	}
+	checksMu.Unlock()
+
+	var failed []string
+	for i, check := range funcs {
+		if err := check(); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", names[i], err))
+		}
+	}
+	return failed
+}
+
 // HealthHandler handles health check requests
 func HealthHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
@@ -26,11 +69,16 @@ func HealthHandler(w http.ResponseWriter, r *http.Request) {
 
 // ReadyHandler handles readiness check requests
 func ReadyHandler(w http.ResponseWriter, r *http.Request) {
-	if atomic.LoadInt32(&ready) == 1 {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("Ready"))
+	if atomic.LoadInt32(&ready) != 1 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Not Ready"))
 		return
 	}
-	w.WriteHeader(http.StatusServiceUnavailable)
-	w.Write([]byte("Not Ready"))
+	if failed := failedChecks(); len(failed) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Degraded\n" + strings.Join(failed, "\n")))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Ready"))
 }
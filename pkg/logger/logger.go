@@ -167,6 +167,8 @@ func Event(eventType, path string) {
 		event = Logger.Info().Str("type", eventType).Str("path", path)
 	case "CHMOD":
 		event = Logger.Debug().Str("type", eventType).Str("path", path)
+	case "OVERFLOW":
+		event = Logger.Warn().Str("type", eventType).Str("path", path)
 	default:
 		event = Logger.Info().Str("type", eventType).Str("path", path)
 	}
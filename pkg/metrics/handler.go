@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"net/http"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Handler returns an http.Handler that exposes all registered metrics
+// in the format negotiated with the scraper
+func Handler() http.Handler {
+	return HandlerFor(prometheus.DefaultGatherer)
+}
+
+// HandlerFor returns an http.Handler that exposes the metrics of the given gatherer
+func HandlerFor(gatherer prometheus.Gatherer) http.Handler {
+	handler := promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		updateMemoryUsage()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// updateMemoryUsage refreshes the memory gauge right before a scrape
+func updateMemoryUsage() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	MemoryUsage.Set(float64(stats.Alloc))
+}
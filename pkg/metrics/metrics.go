@@ -23,22 +23,114 @@ var (
 		Name: "blink_active_watchers",
 		Help: "The number of active file watchers",
 	})
-	// WebhookLatency tracks webhook request latency
-	WebhookLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+	// WebhookLatency tracks webhook request latency per target
+	WebhookLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "blink_webhook_latency_seconds",
-		Help:    "The latency of webhook requests",
+		Help:    "The latency of webhook requests, by target",
 		Buckets: prometheus.DefBuckets,
-	})
+	}, []string{"target"})
 
-	// WebhookErrors counts the total number of webhook errors
-	WebhookErrors = promauto.NewCounter(prometheus.CounterOpts{
+	// WebhookErrors counts the total number of webhook errors per target
+	WebhookErrors = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "blink_webhook_errors_total",
-		Help: "The total number of webhook errors",
-	})
+		Help: "The total number of webhook errors, by target",
+	}, []string{"target"})
 
 	// MemoryUsage tracks the current memory usage
 	MemoryUsage = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "blink_memory_bytes",
 		Help: "Current memory usage in bytes",
 	})
+
+	// EventsByOp counts the file events emitted by the watcher per operation
+	EventsByOp = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blink_events_by_op_total",
+		Help: "The total number of file events emitted by the watcher, by operation",
+	}, []string{"op"})
+
+	// WatcherOverflows counts the kernel event queue overflows that triggered a rescan
+	WatcherOverflows = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "blink_watcher_overflows_total",
+		Help: "The total number of event queue overflows that triggered a rescan",
+	})
+
+	// WatchedDirectories tracks the number of directories with an active watch
+	WatchedDirectories = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "blink_watched_directories",
+		Help: "The number of directories with an active watch",
+	})
+
+	// ConnectedClients tracks the number of connected streaming clients per stream
+	ConnectedClients = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "blink_connected_clients",
+		Help: "The number of connected streaming clients, by stream",
+	}, []string{"stream"})
+
+	// MessagesSent counts the messages delivered to streaming clients per stream
+	MessagesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blink_messages_sent_total",
+		Help: "The total number of messages delivered to clients, by stream",
+	}, []string{"stream"})
+
+	// MessagesDropped counts the messages dropped for slow clients per stream
+	MessagesDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blink_messages_dropped_total",
+		Help: "The total number of messages dropped because a client was too slow, by stream",
+	}, []string{"stream"})
+
+	// DeliveryLatency tracks the time from observing a file event to delivering it
+	DeliveryLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "blink_delivery_latency_seconds",
+		Help:    "The time from observing a file event to delivering it, by stream",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"stream"})
+
+	// WebhookDeliveries counts webhook deliveries per target and result (success or failure)
+	WebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blink_webhook_deliveries_total",
+		Help: "The total number of webhook deliveries, by target and result",
+	}, []string{"target", "result"})
+
+	// WebhookQueueDepth tracks the number of webhook deliveries in the queue per target
+	WebhookQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "blink_webhook_queue_depth",
+		Help: "The number of webhook deliveries in the queue, by target",
+	}, []string{"target"})
+
+	// WebhookRetries counts the retries of failed webhook deliveries per target
+	WebhookRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blink_webhook_retries_total",
+		Help: "The total number of webhook delivery retries, by target",
+	}, []string{"target"})
+
+	// WebhookDeadLetters counts the webhook deliveries moved to the dead-letter store per target
+	WebhookDeadLetters = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blink_webhook_dead_letters_total",
+		Help: "The total number of webhook deliveries moved to the dead-letter store, by target",
+	}, []string{"target"})
+
+	// WebhookCircuitState tracks the circuit breaker of each target: 0 closed, 1 open, 2 half-open
+	WebhookCircuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "blink_webhook_circuit_state",
+		Help: "The circuit breaker state of webhook targets (0 closed, 1 open, 2 half-open), by target",
+	}, []string{"target"})
+
+	// WebhookCircuitOpens counts how often the circuit breaker of each target opened
+	WebhookCircuitOpens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blink_webhook_circuit_opens_total",
+		Help: "The total number of times the circuit breaker of a webhook target opened, by target",
+	}, []string{"target"})
+
+	// ExecRuns counts the finished runs of action commands per action and result (success or failure)
+	ExecRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blink_exec_runs_total",
+		Help: "The total number of finished action runs, by action and result",
+	}, []string{"action", "result"})
+)
+
+// Stream label values
+const (
+	StreamSSE       = "sse"
+	StreamWebSocket = "websocket"
+	StreamWebhook   = "webhook"
 )
@@ -0,0 +1,23 @@
+//go:build !unix
+
+package queue
+
+import "os"
+
+// lockDir opens the given file, creating it if needed. Directories are not
+// locked on this platform, it is up to the caller not to open a queue twice.
+func lockDir(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+}
+
+// syncDir does nothing, directories cannot be synced on this platform
+func syncDir(path string) error {
+	return nil
+}
+
+// unlockDir closes a file opened with lockDir
+func unlockDir(file *os.File) {
+	if file != nil {
+		file.Close()
+	}
+}
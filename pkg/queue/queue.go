@@ -0,0 +1,630 @@
+// Package queue implements a durable FIFO queue on local disk, stored as an
+// append-only log of segment files.
+//
+// Records are delivered at least once: a record read with Next stays in the
+// log until it is acknowledged with Ack, and records that were not
+// acknowledged before a restart are read again. A crash can leave a
+// partially written record at the end of the log, which is detected by its
+// checksum and discarded when the queue is opened again. Appended records and
+// acknowledgements are synced to disk before Append and Ack return, or every
+// Options.SyncInterval in the background, unless Options.NoSync is set.
+package queue
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrClosed is returned by the methods of a closed queue
+	ErrClosed = errors.New("queue is closed")
+	// ErrFull is returned by Append when the queue has reached its maximum size
+	ErrFull = errors.New("queue is full")
+)
+
+// Defaults of Options
+const (
+	DefaultSegmentSize = 8 << 20
+	DefaultMaxSize     = 256 << 20
+)
+
+// Largest record accepted by Append
+const maxRecordSize = 16 << 20
+
+// Size of the record header: the length and CRC-32C of the data
+const headerSize = 8
+
+// Names of the files in the queue directory
+const (
+	segmentSuffix = ".log"
+	cursorFile    = "cursor"
+	lockFile      = "lock"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Options configures a Queue
+type Options struct {
+	// SegmentSize is the size after which a new segment file is started
+	SegmentSize int64
+	// MaxSize is the size of the segment files at which Append fails with ErrFull
+	MaxSize int64
+	// NoSync skips syncing every Append and Ack to disk, which is faster
+	// but lets a power loss drop appended records or replay acknowledged
+	// ones. The log is still synced when a segment is full and on Close.
+	NoSync bool
+	// SyncInterval syncs the records appended and acknowledged meanwhile
+	// together in the background instead of in Append and Ack, so that a
+	// power loss drops at most that much. Ignored with NoSync.
+	SyncInterval time.Duration
+}
+
+// Record is a record read from the queue
+type Record struct {
+	// Seq is the sequence number of the record, used to acknowledge it
+	Seq uint64
+	// Data is what was appended
+	Data []byte
+}
+
+// segment is a segment file holding the records from base to base+count-1
+type segment struct {
+	path  string
+	base  uint64
+	count uint64
+	size  int64
+}
+
+// last returns the sequence number of the last record of the segment
+func (s *segment) last() uint64 {
+	return s.base + s.count - 1
+}
+
+// Queue is a durable FIFO queue of byte records. It is safe for concurrent
+// use, and only one Queue can have a directory open at a time.
+type Queue struct {
+	dir  string
+	opts Options
+	lock *os.File
+
+	mu       sync.Mutex
+	segments []*segment
+	writer   *os.File // Appends to the last segment
+	size     int64    // Total size of the segments
+	nextSeq  uint64   // Sequence number of the next appended record
+	closed   bool
+
+	// Acknowledged records: everything up to committed, and those in acked
+	committed uint64
+	acked     map[uint64]bool
+
+	// Read position: the next record returned by Next
+	readSeq    uint64
+	readOffset int64
+	reader     *os.File
+	readerSeg  *segment
+
+	// Closed and replaced when a record is appended or the queue closed
+	notify chan struct{}
+
+	// Appended records and acknowledgements left to the background sync
+	unsynced    bool
+	cursorDirty bool
+	stopSync    chan struct{}
+}
+
+// Open opens the queue in dir, creating the directory if needed. Records
+// that were appended but not acknowledged before the queue was last closed
+// are read again.
+func Open(dir string, opts Options) (*Queue, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultMaxSize
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	lock, err := lockDir(filepath.Join(dir, lockFile))
+	if err != nil {
+		return nil, fmt.Errorf("queue %s is in use: %w", dir, err)
+	}
+
+	q := &Queue{
+		dir:    dir,
+		opts:   opts,
+		lock:   lock,
+		acked:  make(map[uint64]bool),
+		notify: make(chan struct{}),
+	}
+	if err := q.load(); err != nil {
+		q.closeFiles()
+		return nil, err
+	}
+	if q.delaySync() {
+		q.stopSync = make(chan struct{})
+		go q.syncLoop()
+	}
+	return q, nil
+}
+
+// load reads the cursor and the segments, and discards a torn record at
+// the end of the log
+func (q *Queue) load() error {
+	data, err := os.ReadFile(filepath.Join(q.dir, cursorFile))
+	switch {
+	case err == nil:
+		if q.committed, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return fmt.Errorf("invalid queue cursor: %w", err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, &segment{path: filepath.Join(q.dir, name), base: base})
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i].base < q.segments[j].base })
+
+	for i, seg := range q.segments {
+		if err := scanSegment(seg); err != nil {
+			return err
+		}
+		// Records after a damaged one cannot be trusted, neither can the
+		// segments that follow it
+		if i < len(q.segments)-1 && seg.base+seg.count != q.segments[i+1].base {
+			for _, dropped := range q.segments[i+1:] {
+				if err := os.Remove(dropped.path); err != nil {
+					return err
+				}
+			}
+			q.segments = q.segments[:i+1]
+			break
+		}
+	}
+
+	// Records before the first segment are gone, as if acknowledged
+	if len(q.segments) > 0 && q.segments[0].base > q.committed+1 {
+		q.committed = q.segments[0].base - 1
+	}
+	q.nextSeq = q.committed + 1
+	if n := len(q.segments); n > 0 {
+		last := q.segments[n-1]
+		q.nextSeq = max(q.nextSeq, last.base+last.count)
+	}
+	for _, seg := range q.segments {
+		q.size += seg.size
+	}
+	q.readSeq = q.committed + 1
+	q.dropConsumed()
+	return nil
+}
+
+// scanSegment counts the records of a segment, and truncates it after the
+// last intact one
+func scanSegment(seg *segment) error {
+	file, err := os.OpenFile(seg.path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		n, err := readRecord(reader, nil)
+		if err != nil {
+			break
+		}
+		offset += int64(n)
+		seg.count++
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != offset {
+		if err := file.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	seg.size = offset
+	return nil
+}
+
+// readRecord reads a record and returns its size on disk. The data is
+// stored in buf if it is not nil.
+func readRecord(r io.Reader, buf *[]byte) (int, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	if length > maxRecordSize {
+		return 0, errors.New("invalid record length")
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, err
+	}
+	if crc32.Checksum(data, crcTable) != sum {
+		return 0, errors.New("record checksum mismatch")
+	}
+	if buf != nil {
+		*buf = data
+	}
+	return headerSize + int(length), nil
+}
+
+// Append adds a record at the end of the queue, and syncs it to disk unless
+// that is left to the background sync
+func (q *Queue) Append(data []byte) error {
+	if len(data) > maxRecordSize {
+		return fmt.Errorf("record of %d bytes is too large", len(data))
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	if q.size+int64(headerSize+len(data)) > q.opts.MaxSize {
+		return ErrFull
+	}
+
+	if err := q.ensureWriter(); err != nil {
+		return err
+	}
+	record := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(data, crcTable))
+	copy(record[headerSize:], data)
+
+	seg := q.segments[len(q.segments)-1]
+	_, err := q.writer.Write(record)
+	if err == nil && !q.opts.NoSync && !q.delaySync() {
+		err = q.writer.Sync()
+	}
+	if err != nil {
+		// Take back what may have been written, so that the next record
+		// does not follow a broken one
+		_ = q.writer.Truncate(seg.size)
+		return err
+	}
+	seg.count++
+	seg.size += int64(len(record))
+	q.size += int64(len(record))
+	q.nextSeq++
+	q.unsynced = q.delaySync()
+
+	close(q.notify)
+	q.notify = make(chan struct{})
+	return nil
+}
+
+// ensureWriter opens the last segment for appending, or starts a new one if
+// there is none or it is full. The caller must hold mu.
+func (q *Queue) ensureWriter() error {
+	n := len(q.segments)
+	if n > 0 && q.segments[n-1].size < q.opts.SegmentSize && q.segments[n-1].base+q.segments[n-1].count == q.nextSeq {
+		if q.writer != nil {
+			return nil
+		}
+		writer, err := os.OpenFile(q.segments[n-1].path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			return err
+		}
+		q.writer = writer
+		return nil
+	}
+
+	// Make the full segment durable before starting the next one
+	if q.writer != nil {
+		if err := q.writer.Sync(); err != nil {
+			return err
+		}
+		q.writer.Close()
+		q.writer = nil
+	}
+	seg := &segment{
+		path: filepath.Join(q.dir, fmt.Sprintf("%020d%s", q.nextSeq, segmentSuffix)),
+		base: q.nextSeq,
+	}
+	writer, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	// The new segment must not disappear with the records synced into it
+	if err := syncDir(q.dir); err != nil {
+		writer.Close()
+		os.Remove(seg.path)
+		return err
+	}
+	q.writer = writer
+	q.segments = append(q.segments, seg)
+	return nil
+}
+
+// Next returns the next record that has not been read yet, waiting for one
+// to be appended if needed. It returns ctx.Err() if ctx is done first, and
+// ErrClosed once the queue is closed.
+func (q *Queue) Next(ctx context.Context) (Record, error) {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return Record{}, ErrClosed
+		}
+		if q.readSeq < q.nextSeq {
+			record, err := q.read()
+			q.mu.Unlock()
+			return record, err
+		}
+		notify := q.notify
+		q.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return Record{}, ctx.Err()
+		}
+	}
+}
+
+// read reads the record at the read position and advances it. The caller
+// must hold mu.
+func (q *Queue) read() (Record, error) {
+	// Find the segment of the record, skipping acknowledged records when
+	// moving to a segment
+	if q.readerSeg == nil || q.readSeq > q.readerSeg.last() {
+		if q.reader != nil {
+			q.reader.Close()
+			q.reader = nil
+		}
+		var seg *segment
+		for _, candidate := range q.segments {
+			if q.readSeq >= candidate.base && q.readSeq <= candidate.last() {
+				seg = candidate
+				break
+			}
+		}
+		if seg == nil {
+			return Record{}, fmt.Errorf("record %d is missing from the queue", q.readSeq)
+		}
+		reader, err := os.Open(seg.path)
+		if err != nil {
+			return Record{}, err
+		}
+		q.reader, q.readerSeg, q.readOffset = reader, seg, 0
+
+		buffered := bufio.NewReader(io.NewSectionReader(reader, 0, seg.size))
+		for seq := seg.base; seq < q.readSeq; seq++ {
+			n, err := readRecord(buffered, nil)
+			if err != nil {
+				return Record{}, err
+			}
+			q.readOffset += int64(n)
+		}
+	}
+
+	var data []byte
+	n, err := readRecord(io.NewSectionReader(q.reader, q.readOffset, q.readerSeg.size-q.readOffset), &data)
+	if err != nil {
+		return Record{}, fmt.Errorf("reading record %d: %w", q.readSeq, err)
+	}
+	record := Record{Seq: q.readSeq, Data: data}
+	q.readOffset += int64(n)
+	q.readSeq++
+	return record, nil
+}
+
+// Ack acknowledges a record read with Next, which will not be read again.
+// Segments whose records have all been acknowledged are deleted.
+func (q *Queue) Ack(seq uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	if seq <= q.committed || seq >= q.readSeq {
+		return nil
+	}
+	q.acked[seq] = true
+
+	advanced := false
+	for q.acked[q.committed+1] {
+		delete(q.acked, q.committed+1)
+		q.committed++
+		advanced = true
+	}
+	if !advanced {
+		return nil
+	}
+	if q.delaySync() {
+		q.cursorDirty = true
+	} else if err := q.writeCursor(); err != nil {
+		return err
+	}
+	q.dropConsumed()
+	return nil
+}
+
+// delaySync returns whether syncs are left to the background sync
+func (q *Queue) delaySync() bool {
+	return q.opts.SyncInterval > 0 && !q.opts.NoSync
+}
+
+// syncLoop syncs the queue every SyncInterval until it is closed
+func (q *Queue) syncLoop() {
+	ticker := time.NewTicker(q.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.mu.Lock()
+			if !q.closed {
+				// A failed sync is tried again on the next tick, and on Close
+				_ = q.flush()
+			}
+			q.mu.Unlock()
+		case <-q.stopSync:
+			return
+		}
+	}
+}
+
+// flush syncs the records appended and writes the cursor acknowledged since
+// the last background sync. The caller must hold mu.
+func (q *Queue) flush() error {
+	if q.unsynced && q.writer != nil {
+		if err := q.writer.Sync(); err != nil {
+			return err
+		}
+	}
+	q.unsynced = false
+	if q.cursorDirty {
+		if err := q.writeCursor(); err != nil {
+			return err
+		}
+		q.cursorDirty = false
+	}
+	return nil
+}
+
+// writeCursor records the acknowledged position, atomically, and syncs it
+// to disk. The caller must hold mu.
+func (q *Queue) writeCursor() error {
+	tmp := filepath.Join(q.dir, cursorFile+".tmp")
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(strconv.FormatUint(q.committed, 10) + "\n")
+	if err == nil && !q.opts.NoSync {
+		// The rename must not reach the disk before the content
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir, cursorFile)); err != nil {
+		return err
+	}
+	if q.opts.NoSync {
+		return nil
+	}
+	return syncDir(q.dir)
+}
+
+// dropConsumed deletes the segments before the last one whose records have
+// all been acknowledged. The caller must hold mu.
+func (q *Queue) dropConsumed() {
+	for len(q.segments) > 1 && q.segments[0].last() <= q.committed {
+		seg := q.segments[0]
+		if q.readerSeg == seg {
+			q.reader.Close()
+			q.reader, q.readerSeg = nil, nil
+		}
+		if err := os.Remove(seg.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		q.size -= seg.size
+		q.segments = q.segments[1:]
+	}
+}
+
+// Len returns the number of records that have not been acknowledged
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return int(q.nextSeq-q.committed-1) - len(q.acked)
+}
+
+// Unread returns the number of records not returned by Next yet
+func (q *Queue) Unread() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return int(q.nextSeq - q.readSeq)
+}
+
+// Size returns the total size of the segment files
+func (q *Queue) Size() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// Close syncs the log to disk and closes the queue. Records that were not
+// acknowledged are read again when the queue is next opened.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	close(q.notify)
+	if q.stopSync != nil {
+		close(q.stopSync)
+	}
+
+	var err error
+	if q.writer != nil {
+		err = q.writer.Sync()
+	}
+	if q.cursorDirty {
+		if cursorErr := q.writeCursor(); err == nil {
+			err = cursorErr
+		}
+	}
+	q.closeFiles()
+	return err
+}
+
+// closeFiles closes the open files and releases the lock
+func (q *Queue) closeFiles() {
+	if q.writer != nil {
+		q.writer.Close()
+		q.writer = nil
+	}
+	if q.reader != nil {
+		q.reader.Close()
+		q.reader = nil
+	}
+	unlockDir(q.lock)
+}
@@ -0,0 +1,190 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// next reads a record, failing the test if there is none
+func next(t *testing.T, q *Queue) Record {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	record, err := q.Next(ctx)
+	if err != nil {
+		t.Fatalf("Next failed: %v", err)
+	}
+	return record
+}
+
+// TestQueueAtLeastOnce tests that records are read in order, and read
+// again after a restart unless they were acknowledged, however they are
+// synced
+func TestQueueAtLeastOnce(t *testing.T) {
+	for name, opts := range map[string]Options{
+		"Sync":         {SegmentSize: 64},
+		"NoSync":       {SegmentSize: 64, NoSync: true},
+		"SyncInterval": {SegmentSize: 64, SyncInterval: time.Hour},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			q, err := Open(dir, opts)
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			for i := 1; i <= 10; i++ {
+				if err := q.Append([]byte(fmt.Sprintf("record %d", i))); err != nil {
+					t.Fatalf("Append failed: %v", err)
+				}
+			}
+
+			// Acknowledge 1, 2 and 4, but not 3
+			for i := 1; i <= 4; i++ {
+				record := next(t, q)
+				if want := fmt.Sprintf("record %d", i); string(record.Data) != want {
+					t.Fatalf("Next = %q, want %q", record.Data, want)
+				}
+				if i != 3 {
+					q.Ack(record.Seq)
+				}
+			}
+			if q.Len() != 7 || q.Unread() != 6 {
+				t.Errorf("Len = %d and Unread = %d, want 7 and 6", q.Len(), q.Unread())
+			}
+			if err := q.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			// Everything from the first record not acknowledged is read again
+			q, err = Open(dir, opts)
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			defer q.Close()
+			for i := 3; i <= 10; i++ {
+				record := next(t, q)
+				if want := fmt.Sprintf("record %d", i); string(record.Data) != want {
+					t.Fatalf("Next after reopening = %q, want %q", record.Data, want)
+				}
+				q.Ack(record.Seq)
+			}
+			if q.Len() != 0 {
+				t.Errorf("Len = %d, want 0", q.Len())
+			}
+
+			// Consumed segments are deleted
+			segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+			if len(segments) != 1 {
+				t.Errorf("Expected a single segment left, got %v", segments)
+			}
+		})
+	}
+}
+
+// TestQueueSyncInterval tests that acknowledgements are written by the
+// background sync
+func TestQueueSyncInterval(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir, Options{SyncInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer q.Close()
+	for i := 1; i <= 3; i++ {
+		if err := q.Append([]byte(fmt.Sprintf("record %d", i))); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	q.Ack(next(t, q).Seq)
+	q.Ack(next(t, q).Seq)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		data, _ := os.ReadFile(filepath.Join(dir, cursorFile))
+		if string(data) == "2\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Cursor = %q after a second, want \"2\\n\"", data)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestQueueTornWrite tests that a partially written record is discarded
+func TestQueueTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	q.Append([]byte("complete"))
+	q.Append([]byte("torn"))
+	q.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	info, _ := os.Stat(segments[0])
+	if err := os.Truncate(segments[0], info.Size()-2); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+
+	q, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer q.Close()
+	if record := next(t, q); string(record.Data) != "complete" {
+		t.Errorf("Next = %q, want the complete record", record.Data)
+	}
+	if q.Unread() != 0 {
+		t.Errorf("Expected the torn record to be discarded")
+	}
+
+	// Appending continues after the last intact record
+	q.Append([]byte("after"))
+	if record := next(t, q); string(record.Data) != "after" || record.Seq != 2 {
+		t.Errorf("Next = %q (%d), want the appended record", record.Data, record.Seq)
+	}
+}
+
+// TestQueueLimits tests the maximum size, the directory lock and closing
+func TestQueueLimits(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir, Options{MaxSize: 40})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := q.Append(make([]byte, 20)); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := q.Append(make([]byte, 20)); !errors.Is(err, ErrFull) {
+		t.Errorf("Append = %v, want ErrFull", err)
+	}
+
+	if _, err := Open(dir, Options{}); err == nil {
+		t.Errorf("Expected a second Open of the same directory to fail")
+	}
+
+	// Next waits for a record, and returns once the queue is closed
+	next(t, q)
+	result := make(chan error, 1)
+	go func() {
+		_, err := q.Next(context.Background())
+		result <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	q.Close()
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("Next = %v, want ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Next did not return after Close")
+	}
+}
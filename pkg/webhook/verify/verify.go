@@ -0,0 +1,149 @@
+// Package verify checks that webhook requests were sent by blink.
+//
+// When blink is configured with signing secrets, every webhook request
+// carries a signature header of the form
+//
+//	X-Blink-Signature: t=1700000000,v1=5257a869...,v1=9d1f6c0e...
+//
+// where t is the Unix time the request was signed at and each v1 is the
+// hex-encoded HMAC-SHA256, under one of the secrets, of the timestamp, a
+// dot and the request body. There is one v1 per active secret, so that
+// secrets can be rotated: configure the new secret on the receivers, add it
+// to blink next to the old one, then remove the old one from both.
+//
+// Requests also carry an X-Blink-Delivery header, which is the same for
+// every attempt at a delivery. Receivers that must not process a delivery
+// twice should remember the ids they have seen for at least the tolerance
+// window; older requests are rejected by their timestamp.
+package verify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers of signed webhook requests
+const (
+	SignatureHeader = "X-Blink-Signature"
+	DeliveryHeader  = "X-Blink-Delivery"
+)
+
+// DefaultTolerance is how far the signing time of a request may be from
+// the current time by default
+const DefaultTolerance = 5 * time.Minute
+
+// Largest request body read by Request
+const maxBodySize = 32 << 20
+
+var (
+	// ErrNoSignature is returned for requests without a signature
+	ErrNoSignature = errors.New("webhook request is not signed")
+	// ErrInvalidHeader is returned for malformed signature headers
+	ErrInvalidHeader = errors.New("invalid webhook signature header")
+	// ErrExpired is returned for requests signed outside the tolerance window
+	ErrExpired = errors.New("webhook signature timestamp is outside the tolerance window")
+	// ErrMismatch is returned when no signature matches any of the secrets
+	ErrMismatch = errors.New("webhook signature does not match")
+)
+
+// Sign returns the signature header value for body signed at timestamp,
+// with one signature per secret
+func Sign(body []byte, timestamp time.Time, secrets ...string) string {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	var b strings.Builder
+	b.WriteString("t=" + ts)
+	for _, secret := range secrets {
+		b.WriteString(",v1=")
+		b.WriteString(hex.EncodeToString(mac(secret, ts, body)))
+	}
+	return b.String()
+}
+
+// Verify checks the signature header value of a request with the given
+// body against the secrets. The request must have been signed within
+// tolerance of the current time, or DefaultTolerance if tolerance is 0.
+func Verify(body []byte, header string, secrets []string, tolerance time.Duration) error {
+	return verifyAt(time.Now(), body, header, secrets, tolerance)
+}
+
+// Request verifies a webhook request and returns its body. The body of the
+// request is replaced, so that it can still be read by the caller.
+func Request(r *http.Request, secrets []string, tolerance time.Duration) ([]byte, error) {
+	header := r.Header.Get(SignatureHeader)
+	if header == "" {
+		return nil, ErrNoSignature
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	r.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error reading webhook body: %w", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, Verify(body, header, secrets, tolerance)
+}
+
+// verifyAt is Verify with the current time given
+func verifyAt(now time.Time, body []byte, header string, secrets []string, tolerance time.Duration) error {
+	if header == "" {
+		return ErrNoSignature
+	}
+	if tolerance <= 0 {
+		tolerance = DefaultTolerance
+	}
+
+	var ts string
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return ErrInvalidHeader
+		}
+		switch key {
+		case "t":
+			ts = value
+		case "v1":
+			signature, err := hex.DecodeString(value)
+			if err != nil {
+				return ErrInvalidHeader
+			}
+			signatures = append(signatures, signature)
+		}
+		// Other schemes are ignored, so that new ones can be added
+	}
+	seconds, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrInvalidHeader
+	}
+
+	if age := now.Sub(time.Unix(seconds, 0)); age > tolerance || age < -tolerance {
+		return ErrExpired
+	}
+
+	for _, secret := range secrets {
+		expected := mac(secret, ts, body)
+		for _, signature := range signatures {
+			if hmac.Equal(signature, expected) {
+				return nil
+			}
+		}
+	}
+	return ErrMismatch
+}
+
+// mac computes the HMAC-SHA256 of the timestamp and body
+func mac(secret, ts string, body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts))
+	h.Write([]byte{'.'})
+	h.Write(body)
+	return h.Sum(nil)
+}
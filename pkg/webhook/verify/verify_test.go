@@ -0,0 +1,72 @@
+package verify
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestVerify tests signing and verifying, including rotated secrets
+func TestVerify(t *testing.T) {
+	body := []byte(`{"op":"write","path":"/tmp/a.txt"}`)
+	signedAt := time.Unix(1700000000, 0)
+	header := Sign(body, signedAt, "new", "old")
+
+	tests := []struct {
+		name    string
+		now     time.Time
+		body    []byte
+		header  string
+		secrets []string
+		want    error
+	}{
+		{"current secret", signedAt, body, header, []string{"new"}, nil},
+		{"previous secret", signedAt, body, header, []string{"old"}, nil},
+		{"one of several secrets", signedAt.Add(time.Minute), body, header, []string{"other", "old"}, nil},
+		{"wrong secret", signedAt, body, header, []string{"other"}, ErrMismatch},
+		{"modified body", signedAt, []byte(`{"op":"remove"}`), header, []string{"new"}, ErrMismatch},
+		{"modified timestamp", signedAt, body, strings.Replace(header, "t=1700000000", "t=1700000001", 1), []string{"new"}, ErrMismatch},
+		{"too old", signedAt.Add(6 * time.Minute), body, header, []string{"new"}, ErrExpired},
+		{"from the future", signedAt.Add(-6 * time.Minute), body, header, []string{"new"}, ErrExpired},
+		{"unknown scheme", signedAt, body, header + ",v2=abc", []string{"new"}, nil},
+		{"no signature", signedAt, body, "", []string{"new"}, ErrNoSignature},
+		{"no timestamp", signedAt, body, "v1=abcd", []string{"new"}, ErrInvalidHeader},
+		{"no v1", signedAt, body, "t=1700000000", []string{"new"}, ErrInvalidHeader},
+		{"bad hex", signedAt, body, "t=1700000000,v1=xyz", []string{"new"}, ErrInvalidHeader},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := verifyAt(test.now, test.body, test.header, test.secrets, 0); !errors.Is(err, test.want) {
+				t.Errorf("verify = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+// TestRequest tests verifying an HTTP request
+func TestRequest(t *testing.T) {
+	body := `{"op":"create"}`
+	req := httptest.NewRequest("POST", "/hook", strings.NewReader(body))
+	req.Header.Set(SignatureHeader, Sign([]byte(body), time.Now(), "secret"))
+
+	got, err := Request(req, []string{"secret"}, time.Minute)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if string(got) != body {
+		t.Errorf("Request returned %q, want %q", got, body)
+	}
+
+	// The body can still be read
+	if rest, _ := io.ReadAll(req.Body); string(rest) != body {
+		t.Errorf("Body after Request = %q", rest)
+	}
+
+	unsigned := httptest.NewRequest("POST", "/hook", strings.NewReader(body))
+	if _, err := Request(unsigned, []string{"secret"}, 0); !errors.Is(err, ErrNoSignature) {
+		t.Errorf("Request without signature = %v, want ErrNoSignature", err)
+	}
+}